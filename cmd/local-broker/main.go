@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/williamzujkowski/cf-local-service-broker/internal/backends"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/config"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/server"
+)
+
+func main() {
+	server.Main("local-broker", func(_ context.Context, logger *slog.Logger) ([]broker.Backend, error) {
+		names, err := config.Backends()
+		if err != nil {
+			return nil, err
+		}
+
+		var enabled []broker.Backend
+		for _, name := range names {
+			backend, err := backends.New(name)
+			if err != nil {
+				return nil, err
+			}
+			enabled = append(enabled, backend)
+			logger.Info("backend enabled", "backend", name)
+		}
+		return enabled, nil
+	})
+}
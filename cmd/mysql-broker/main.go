@@ -0,0 +1,20 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/williamzujkowski/cf-local-service-broker/internal/backends"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/server"
+)
+
+func main() {
+	server.Main("mysql-broker", func(_ context.Context, _ *slog.Logger) ([]broker.Backend, error) {
+		backend, err := backends.New("mysql")
+		if err != nil {
+			return nil, err
+		}
+		return []broker.Backend{backend}, nil
+	})
+}
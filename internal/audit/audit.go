@@ -0,0 +1,81 @@
+// Package audit records an append-only trail of service lifecycle actions
+// together with the originating identity of the platform user that
+// triggered them.
+package audit
+
+import (
+	"context"
+	"time"
+
+	"github.com/williamzujkowski/cf-local-service-broker/internal/osbapi"
+)
+
+// Actions recorded in the audit trail.
+const (
+	ActionProvision   = "provision"
+	ActionUpdate      = "update"
+	ActionDeprovision = "deprovision"
+	ActionBind        = "bind"
+	ActionUnbind      = "unbind"
+)
+
+// Outcomes recorded in the audit trail.
+const (
+	OutcomeSucceeded = "succeeded"
+	OutcomeFailed    = "failed"
+	// OutcomeAccepted marks an asynchronous operation that the broker has
+	// accepted but not yet finished.
+	OutcomeAccepted = "accepted"
+)
+
+// Event is a single entry in the audit trail.
+type Event struct {
+	Time             time.Time       `json:"time"`
+	Action           string          `json:"action"`
+	InstanceID       string          `json:"instance_id"`
+	BindingID        string          `json:"binding_id,omitempty"`
+	ServiceID        string          `json:"service_id,omitempty"`
+	PlanID           string          `json:"plan_id,omitempty"`
+	OrganizationGUID string          `json:"organization_guid,omitempty"`
+	SpaceGUID        string          `json:"space_guid,omitempty"`
+	Identity         osbapi.Identity `json:"identity"`
+	CorrelationID    string          `json:"correlation_id,omitempty"`
+	Parameters       map[string]any  `json:"parameters,omitempty"`
+	Outcome          string          `json:"outcome"`
+	Error            string          `json:"error,omitempty"`
+}
+
+// Filter selects events from a Store. Zero-valued fields match everything.
+type Filter struct {
+	InstanceID string
+	// User matches Identity.User.
+	User  string
+	Since time.Time
+	Until time.Time
+	// Limit caps the number of returned events, keeping the most recent.
+	Limit int
+}
+
+// Match reports whether e is selected by f.
+func (f Filter) Match(e Event) bool {
+	if f.InstanceID != "" && e.InstanceID != f.InstanceID {
+		return false
+	}
+	if f.User != "" && e.Identity.User != f.User {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Store persists audit events. Implementations must be safe for concurrent
+// use and must never modify or remove appended events.
+type Store interface {
+	Append(ctx context.Context, event Event) error
+	Query(ctx context.Context, filter Filter) ([]Event, error)
+}
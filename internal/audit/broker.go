@@ -0,0 +1,184 @@
+package audit
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi/v11/domain"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/osbapi"
+)
+
+var _ domain.ServiceBroker = (*Broker)(nil)
+
+// Broker wraps a domain.ServiceBroker and records every lifecycle action
+// in a Store. Read-only calls are passed through unrecorded.
+type Broker struct {
+	domain.ServiceBroker
+	store  Store
+	logger *slog.Logger
+}
+
+// Wrap returns next wrapped with audit recording. A failure to record an
+// event is logged but does not fail the request.
+func Wrap(next domain.ServiceBroker, store Store, logger *slog.Logger) *Broker {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Broker{ServiceBroker: next, store: store, logger: logger}
+}
+
+// Provision records the provision request and its outcome.
+func (b *Broker) Provision(
+	ctx context.Context,
+	instanceID string,
+	details domain.ProvisionDetails,
+	asyncAllowed bool,
+) (domain.ProvisionedServiceSpec, error) {
+	spec, err := b.ServiceBroker.Provision(ctx, instanceID, details, asyncAllowed)
+	b.record(ctx, Event{
+		Action:           ActionProvision,
+		InstanceID:       instanceID,
+		ServiceID:        details.ServiceID,
+		PlanID:           details.PlanID,
+		OrganizationGUID: details.OrganizationGUID,
+		SpaceGUID:        details.SpaceGUID,
+		Parameters:       logging.RedactParameters(details.RawParameters),
+	}, spec.IsAsync, err)
+	return spec, err
+}
+
+// Update records the update request and its outcome.
+func (b *Broker) Update(
+	ctx context.Context,
+	instanceID string,
+	details domain.UpdateDetails,
+	asyncAllowed bool,
+) (domain.UpdateServiceSpec, error) {
+	spec, err := b.ServiceBroker.Update(ctx, instanceID, details, asyncAllowed)
+	pc := osbapi.ParseContext(details.RawContext)
+	b.record(ctx, Event{
+		Action:           ActionUpdate,
+		InstanceID:       instanceID,
+		ServiceID:        details.ServiceID,
+		PlanID:           details.PlanID,
+		OrganizationGUID: pc.OrganizationGUID,
+		SpaceGUID:        pc.SpaceGUID,
+		Parameters:       logging.RedactParameters(details.RawParameters),
+	}, spec.IsAsync, err)
+	return spec, err
+}
+
+// Deprovision records the deprovision request and its outcome.
+func (b *Broker) Deprovision(
+	ctx context.Context,
+	instanceID string,
+	details domain.DeprovisionDetails,
+	asyncAllowed bool,
+) (domain.DeprovisionServiceSpec, error) {
+	spec, err := b.ServiceBroker.Deprovision(ctx, instanceID, details, asyncAllowed)
+	b.record(ctx, Event{
+		Action:     ActionDeprovision,
+		InstanceID: instanceID,
+		ServiceID:  details.ServiceID,
+		PlanID:     details.PlanID,
+	}, spec.IsAsync, err)
+	return spec, err
+}
+
+// Bind records the bind request and its outcome. Credentials are never
+// recorded.
+func (b *Broker) Bind(
+	ctx context.Context,
+	instanceID, bindingID string,
+	details domain.BindDetails,
+	asyncAllowed bool,
+) (domain.Binding, error) {
+	binding, err := b.ServiceBroker.Bind(ctx, instanceID, bindingID, details, asyncAllowed)
+	pc := osbapi.ParseContext(details.RawContext)
+	b.record(ctx, Event{
+		Action:           ActionBind,
+		InstanceID:       instanceID,
+		BindingID:        bindingID,
+		ServiceID:        details.ServiceID,
+		PlanID:           details.PlanID,
+		OrganizationGUID: pc.OrganizationGUID,
+		SpaceGUID:        pc.SpaceGUID,
+		Parameters:       logging.RedactParameters(details.RawParameters),
+	}, binding.IsAsync, err)
+	return binding, err
+}
+
+// Unbind records the unbind request and its outcome.
+func (b *Broker) Unbind(
+	ctx context.Context,
+	instanceID, bindingID string,
+	details domain.UnbindDetails,
+	asyncAllowed bool,
+) (domain.UnbindSpec, error) {
+	spec, err := b.ServiceBroker.Unbind(ctx, instanceID, bindingID, details, asyncAllowed)
+	b.record(ctx, Event{
+		Action:     ActionUnbind,
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+		ServiceID:  details.ServiceID,
+		PlanID:     details.PlanID,
+	}, spec.IsAsync, err)
+	return spec, err
+}
+
+// OperationDone returns a hook for broker.Config.OperationDone that records
+// the outcome of asynchronous provision, update and deprovision operations,
+// which Broker only records as accepted. The event carries the identity of
+// the request that started the operation.
+func OperationDone(store Store, logger *slog.Logger) func(ctx context.Context, instance *broker.Instance, operation string, err error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return func(ctx context.Context, instance *broker.Instance, operation string, err error) {
+		switch operation {
+		case ActionProvision, ActionUpdate, ActionDeprovision:
+		default:
+			return
+		}
+		record(ctx, store, logger, Event{
+			Action:           operation,
+			InstanceID:       instance.ID,
+			ServiceID:        instance.ServiceID,
+			PlanID:           instance.PlanID,
+			OrganizationGUID: instance.OrganizationGUID,
+			SpaceGUID:        instance.SpaceGUID,
+		}, false, err)
+	}
+}
+
+func (b *Broker) record(ctx context.Context, event Event, async bool, err error) {
+	record(ctx, b.store, b.logger, event, async, err)
+}
+
+func record(ctx context.Context, store Store, logger *slog.Logger, event Event, async bool, err error) {
+	event.Time = time.Now().UTC()
+	event.Identity = osbapi.OriginatingIdentity(ctx)
+	event.CorrelationID = osbapi.CorrelationID(ctx)
+
+	switch {
+	case err != nil:
+		event.Outcome = OutcomeFailed
+		event.Error = err.Error()
+	case async:
+		event.Outcome = OutcomeAccepted
+	default:
+		event.Outcome = OutcomeSucceeded
+	}
+
+	// Record even if the client has gone away.
+	if appendErr := store.Append(context.WithoutCancel(ctx), event); appendErr != nil {
+		logger.Error("failed to record audit event",
+			slog.String(logging.KeyOperation, event.Action),
+			logging.InstanceID(event.InstanceID),
+			slog.String(logging.KeyError, appendErr.Error()),
+		)
+	}
+}
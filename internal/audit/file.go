@@ -0,0 +1,147 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// FileStore appends events as JSON lines to a file.
+type FileStore struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileStore opens (or creates) the audit log at path for appending.
+func NewFileStore(path string) (*FileStore, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log %s: %w", path, err)
+	}
+	return &FileStore{path: path, file: f}, nil
+}
+
+// Append writes event as a single line and syncs it to disk.
+func (s *FileStore) Append(_ context.Context, event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit event: %w", err)
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return errors.New("audit log is closed")
+	}
+	if _, err := s.file.Write(line); err != nil {
+		return fmt.Errorf("failed to write audit event: %w", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync audit log: %w", err)
+	}
+	return nil
+}
+
+// maxLineSize bounds the lines Query decodes. Longer lines are skipped.
+const maxLineSize = 1 << 20
+
+// Query scans the audit log and returns the events matching filter in the
+// order they were recorded. Only events appended before the query started
+// are read, so appends are not blocked while the log is scanned.
+func (s *FileStore) Query(ctx context.Context, filter Filter) ([]Event, error) {
+	size, err := s.size()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log %s: %w", s.path, err)
+	}
+	defer f.Close()
+
+	var events []Event
+	r := bufio.NewReaderSize(io.LimitReader(f, size), 64*1024)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		line, tooLong, err := readLine(r)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to read audit log: %w", err)
+		}
+		if len(line) > 0 && !tooLong {
+			var e Event
+			if err := json.Unmarshal(line, &e); err != nil {
+				return nil, fmt.Errorf("corrupt audit log entry: %w", err)
+			}
+			if filter.Match(e) {
+				events = append(events, e)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[len(events)-filter.Limit:]
+	}
+	return events, nil
+}
+
+// size returns the length of the log, which only ever holds complete
+// lines between appends.
+func (s *FileStore) size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return 0, errors.New("audit log is closed")
+	}
+	info, err := s.file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return info.Size(), nil
+}
+
+// readLine reads the next line without its newline. A line longer than
+// maxLineSize is consumed and reported as too long instead.
+func readLine(r *bufio.Reader) (line []byte, tooLong bool, err error) {
+	for {
+		chunk, err := r.ReadSlice('\n')
+		switch {
+		case tooLong:
+		case len(line)+len(chunk) > maxLineSize+1:
+			tooLong, line = true, nil
+		default:
+			line = append(line, chunk...)
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return bytes.TrimSuffix(line, []byte("\n")), tooLong, err
+		}
+	}
+}
+
+// Close closes the underlying file.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return errors.New("audit log already closed")
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,127 @@
+package audit
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newTestStore(t *testing.T) *FileStore {
+	t.Helper()
+	s, err := NewFileStore(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func instanceIDs(events []Event) []string {
+	var ids []string
+	for _, e := range events {
+		ids = append(ids, e.InstanceID)
+	}
+	return ids
+}
+
+func TestFileStoreQuery(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	for _, id := range []string{"inst-1", "inst-2", "inst-1", "inst-3"} {
+		if err := s.Append(ctx, Event{Action: ActionProvision, InstanceID: id, Outcome: OutcomeSucceeded}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []string
+	}{
+		{name: "all", want: []string{"inst-1", "inst-2", "inst-1", "inst-3"}},
+		{name: "instance", filter: Filter{InstanceID: "inst-1"}, want: []string{"inst-1", "inst-1"}},
+		{name: "limit keeps the most recent", filter: Filter{Limit: 2}, want: []string{"inst-1", "inst-3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := s.Query(ctx, tt.filter)
+			if err != nil {
+				t.Fatalf("Query: %v", err)
+			}
+			if got := instanceIDs(events); !slices.Equal(got, tt.want) {
+				t.Errorf("events for %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileStoreQuerySkipsLongLines(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	events := []Event{
+		{Action: ActionProvision, InstanceID: "inst-1"},
+		{Action: ActionUpdate, InstanceID: "inst-1", Parameters: map[string]any{"blob": strings.Repeat("x", 2*maxLineSize)}},
+		{Action: ActionDeprovision, InstanceID: "inst-1"},
+	}
+	for _, e := range events {
+		if err := s.Append(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := s.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	var actions []string
+	for _, e := range got {
+		actions = append(actions, e.Action)
+	}
+	if want := []string{ActionProvision, ActionDeprovision}; !slices.Equal(actions, want) {
+		t.Errorf("actions = %q, want %q", actions, want)
+	}
+}
+
+func TestFileStoreQueryDuringAppends(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	const appends = 200
+	done := make(chan error)
+	go func() {
+		for range appends {
+			if err := s.Append(ctx, Event{Action: ActionBind, InstanceID: "inst-1"}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	// Every query sees a whole number of events, never a partial line.
+	last := 0
+	for running := true; running; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Append: %v", err)
+			}
+			running = false
+		default:
+		}
+		events, err := s.Query(ctx, Filter{})
+		if err != nil {
+			t.Fatalf("Query: %v", err)
+		}
+		if len(events) < last {
+			t.Fatalf("Query returned %d events after %d", len(events), last)
+		}
+		last = len(events)
+	}
+	if last != appends {
+		t.Errorf("Query returned %d events, want %d", last, appends)
+	}
+}
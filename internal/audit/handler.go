@@ -0,0 +1,70 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Handler serves the audit trail as JSON. It accepts the query parameters
+// instance_id, user, since and until (RFC 3339) and limit. Callers are
+// responsible for authenticating requests.
+func Handler(store Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"description": "method not allowed"})
+			return
+		}
+
+		filter, err := parseFilter(r.URL.Query())
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"description": err.Error()})
+			return
+		}
+
+		events, err := store.Query(r.Context(), filter)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"description": err.Error()})
+			return
+		}
+		if events == nil {
+			events = []Event{}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"events": events})
+	})
+}
+
+func parseFilter(q url.Values) (Filter, error) {
+	f := Filter{
+		InstanceID: q.Get("instance_id"),
+		User:       q.Get("user"),
+	}
+
+	var err error
+	if v := q.Get("since"); v != "" {
+		if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return Filter{}, fmt.Errorf("invalid since: %w", err)
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return Filter{}, fmt.Errorf("invalid until: %w", err)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit < 0 {
+			return Filter{}, fmt.Errorf("invalid limit: %q", v)
+		}
+	}
+	return f, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
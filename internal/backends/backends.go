@@ -0,0 +1,162 @@
+// Package backends builds the service backends named in BACKENDS from their
+// environment configuration.
+package backends
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	minioBroker "github.com/williamzujkowski/cf-local-service-broker/internal/broker/minio"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker/mysql"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker/postgres"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker/rabbitmq"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker/redis"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/config"
+)
+
+// New builds the named backend: postgres, mysql, minio, redis or rabbitmq.
+func New(name string) (broker.Backend, error) {
+	switch name {
+	case "postgres":
+		pool, err := Postgres()
+		if err != nil {
+			return nil, err
+		}
+		return pool, nil
+	case "mysql":
+		cfg, err := config.MySQLFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return mysql.New(cfg.Host, cfg.Port, cfg.AdminUser, cfg.AdminPassword), nil
+	case "minio":
+		pool, err := MinIO()
+		if err != nil {
+			return nil, err
+		}
+		return pool, nil
+	case "redis":
+		cfg, err := config.RedisFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return redis.New(cfg.Host, cfg.Port, cfg.AdminUser, cfg.AdminPassword, cfg.Isolation), nil
+	case "rabbitmq":
+		cfg, err := config.RabbitMQFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return rabbitmq.New(cfg.Host, cfg.AMQPPort, cfg.ManagementURL, cfg.AdminUser, cfg.AdminPassword), nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q", name)
+	}
+}
+
+// Postgres builds a pool over the PostgreSQL servers in PG_SERVERS, or over
+// the single server configured by PG_HOST.
+func Postgres() (*broker.Pool, error) {
+	servers, err := config.PostgresServersFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	placement, err := config.PlacementFromEnv("PG")
+	if err != nil {
+		return nil, err
+	}
+	planLimits, err := config.PostgresPlanLimitsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	limits := make(map[string]postgres.Limits, len(planLimits))
+	for name, l := range planLimits {
+		limits[name] = postgres.Limits(l)
+	}
+	if err := postgres.ValidateLimits(limits); err != nil {
+		return nil, fmt.Errorf("invalid PG_PLAN_LIMITS: %w", err)
+	}
+
+	var pool []*broker.Server
+	for _, s := range servers {
+		backend, err := postgres.New(s.Host, s.Port, s.AdminUser, s.AdminPassword, s.SharedDatabase, limits)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create PostgreSQL backend for server %s: %w", s.Name, err)
+		}
+		pool = append(pool, poolServer(s.PoolServer, backend))
+	}
+	return broker.NewPool(placement.Strategy, planPlacement(placement), pool...)
+}
+
+// MinIO builds a pool over the MinIO servers in MINIO_SERVERS, or over the
+// single server configured by MINIO_ENDPOINT.
+func MinIO() (*broker.Pool, error) {
+	servers, err := config.MinIOServersFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	placement, err := config.PlacementFromEnv("MINIO")
+	if err != nil {
+		return nil, err
+	}
+	encryption, err := config.MinIOEncryptionFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	planFeatures, err := config.MinIOPlanFeaturesFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	features := make(map[string]minioBroker.PlanFeatures, len(planFeatures))
+	for name, f := range planFeatures {
+		features[name] = minioBroker.PlanFeatures(f)
+	}
+
+	var pool []*broker.Server
+	for _, s := range servers {
+		if s.InsecureSkipVerify {
+			slog.Warn("TLS certificate verification is disabled for MinIO server; use this for development only",
+				slog.String("server", s.Name))
+		}
+		backend, err := minioBroker.New(minioBroker.Config{
+			Endpoint:           s.Endpoint,
+			AccessKey:          s.AccessKey,
+			SecretKey:          s.SecretKey,
+			UseSSL:             s.UseSSL,
+			PublicEndpoint:     s.PublicEndpoint,
+			Snapshots:          s.SnapshotBucket,
+			Encryption:         encryption,
+			Features:           features,
+			NotificationTarget: s.NotificationTarget,
+			Client: minioBroker.ClientConfig{
+				CAFile:             s.CAFile,
+				InsecureSkipVerify: s.InsecureSkipVerify,
+				ConnectTimeout:     s.ConnectTimeout,
+				ResponseTimeout:    s.ResponseTimeout,
+				Region:             s.Region,
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("MinIO server %q: %w", s.Name, err)
+		}
+		pool = append(pool, poolServer(s.PoolServer, backend))
+	}
+	return broker.NewPool(placement.Strategy, planPlacement(placement), pool...)
+}
+
+func poolServer(cfg config.PoolServer, backend broker.Backend) *broker.Server {
+	return &broker.Server{
+		Name:     cfg.Name,
+		Labels:   cfg.Labels,
+		Capacity: cfg.Capacity,
+		Draining: cfg.Draining,
+		Backend:  backend,
+	}
+}
+
+func planPlacement(cfg config.Placement) map[string]broker.PlanPlacement {
+	plans := make(map[string]broker.PlanPlacement, len(cfg.Plans))
+	for name, p := range cfg.Plans {
+		plans[name] = broker.PlanPlacement(p)
+	}
+	return plans
+}
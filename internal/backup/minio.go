@@ -0,0 +1,224 @@
+// Package backup stores instance backups in a MinIO or other S3-compatible
+// bucket.
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tlsutil"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// partSize is the multipart upload part size. Backups are streamed with an
+// unknown length, for which the client would otherwise buffer parts large
+// enough for the maximum object size.
+const partSize = 16 << 20
+
+// User metadata keys recorded on every backup object.
+const (
+	metaServiceID = "Service-Id"
+	metaPlanID    = "Plan-Id"
+)
+
+var _ broker.BackupStore = (*MinIOStore)(nil)
+
+// MinIOStore is a broker.BackupStore keeping every backup as one object
+// named <instance_id>/<backup_id> in a bucket.
+type MinIOStore struct {
+	client   *minio.Client
+	endpoint string
+	bucket   string
+
+	// mu guards ready, which is set once the bucket is known to exist.
+	mu    sync.Mutex
+	ready bool
+}
+
+// NewMinIOStore creates a store in bucket on the MinIO server at endpoint,
+// connecting with the TLS settings and timeouts of tlsCfg. An empty region
+// is looked up from the bucket. The bucket is created on first use.
+func NewMinIOStore(endpoint, accessKey, secretKey string, useSSL bool, region, bucket string, tlsCfg tlsutil.Config) (*MinIOStore, error) {
+	ca, err := tlsutil.ReadCA(tlsCfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:     credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure:    useSSL,
+		Region:    region,
+		Transport: otelhttp.NewTransport(tlsutil.NewTransport(tlsCfg, ca)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create MinIO client: %w", err)
+	}
+	return &MinIOStore{client: client, endpoint: endpoint, bucket: bucket}, nil
+}
+
+// startCall starts a client span for a single MinIO API call.
+func (s *MinIOStore) startCall(ctx context.Context, method string) (context.Context, trace.Span) {
+	return tracing.StartClient(ctx, "minio "+method,
+		attribute.String("rpc.system", "s3"),
+		attribute.String("rpc.method", method),
+		attribute.String("server.address", s.endpoint),
+		attribute.String("aws.s3.bucket", s.bucket),
+	)
+}
+
+func objectName(instanceID, id string) string {
+	return instanceID + "/" + id
+}
+
+// ensureBucket creates the bucket if it does not exist yet.
+func (s *MinIOStore) ensureBucket(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ready {
+		return nil
+	}
+
+	ctx, span := s.startCall(ctx, "BucketExists")
+	exists, err := s.client.BucketExists(ctx, s.bucket)
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to check backup bucket: %w", err)
+	}
+	if !exists {
+		ctx, span := s.startCall(ctx, "MakeBucket")
+		err := s.client.MakeBucket(ctx, s.bucket, minio.MakeBucketOptions{})
+		tracing.End(span, err)
+		if err != nil {
+			return fmt.Errorf("failed to create backup bucket %s: %w", s.bucket, err)
+		}
+	}
+	s.ready = true
+	return nil
+}
+
+// Put uploads a backup of unknown length from r.
+func (s *MinIOStore) Put(ctx context.Context, info broker.BackupInfo, r io.Reader) error {
+	if err := s.ensureBucket(ctx); err != nil {
+		return err
+	}
+	ctx, span := s.startCall(ctx, "PutObject")
+	_, err := s.client.PutObject(ctx, s.bucket, objectName(info.InstanceID, info.ID), r, -1, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+		UserMetadata: map[string]string{
+			metaServiceID: info.ServiceID,
+			metaPlanID:    info.PlanID,
+		},
+		PartSize: partSize,
+	})
+	tracing.End(span, err)
+	return err
+}
+
+// Stat returns the info recorded with a backup.
+func (s *MinIOStore) Stat(ctx context.Context, instanceID, id string) (broker.BackupInfo, error) {
+	ctx, span := s.startCall(ctx, "StatObject")
+	obj, err := s.client.StatObject(ctx, s.bucket, objectName(instanceID, id), minio.StatObjectOptions{})
+	tracing.End(span, err)
+	if err != nil {
+		return broker.BackupInfo{}, notFound(err)
+	}
+
+	info := broker.BackupInfo{
+		ID:         id,
+		InstanceID: instanceID,
+		ServiceID:  metadata(obj.UserMetadata, metaServiceID),
+		PlanID:     metadata(obj.UserMetadata, metaPlanID),
+		CreatedAt:  obj.LastModified.UTC(),
+		Size:       obj.Size,
+	}
+	if t, err := time.Parse(broker.BackupIDFormat, id); err == nil {
+		info.CreatedAt = t
+	}
+	return info, nil
+}
+
+// Get opens a backup for reading.
+func (s *MinIOStore) Get(ctx context.Context, instanceID, id string) (io.ReadCloser, error) {
+	// GetObject is lazy, so check that the backup exists first.
+	if _, err := s.Stat(ctx, instanceID, id); err != nil {
+		return nil, err
+	}
+	ctx, span := s.startCall(ctx, "GetObject")
+	obj, err := s.client.GetObject(ctx, s.bucket, objectName(instanceID, id), minio.GetObjectOptions{})
+	tracing.End(span, err)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return obj, nil
+}
+
+// List returns the backups of an instance, oldest first.
+func (s *MinIOStore) List(ctx context.Context, instanceID string) ([]broker.BackupInfo, error) {
+	ctx, span := s.startCall(ctx, "ListObjects")
+	var ids []string
+	var err error
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: instanceID + "/"}) {
+		if obj.Err != nil {
+			err = obj.Err
+			break
+		}
+		ids = append(ids, strings.TrimPrefix(obj.Key, instanceID+"/"))
+	}
+	tracing.End(span, err)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchBucket" {
+			return []broker.BackupInfo{}, nil
+		}
+		return nil, err
+	}
+
+	// IDs are timestamps, so they sort by age.
+	sort.Strings(ids)
+	backups := make([]broker.BackupInfo, 0, len(ids))
+	for _, id := range ids {
+		info, err := s.Stat(ctx, instanceID, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read backup %s: %w", id, err)
+		}
+		backups = append(backups, info)
+	}
+	return backups, nil
+}
+
+// Delete removes a backup.
+func (s *MinIOStore) Delete(ctx context.Context, instanceID, id string) error {
+	ctx, span := s.startCall(ctx, "RemoveObject")
+	err := s.client.RemoveObject(ctx, s.bucket, objectName(instanceID, id), minio.RemoveObjectOptions{})
+	tracing.End(span, err)
+	return err
+}
+
+// notFound maps missing objects and buckets to broker.ErrNotFound.
+func notFound(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchBucket":
+		return broker.ErrNotFound
+	}
+	return err
+}
+
+// metadata looks up a user metadata key regardless of how the server
+// cased it.
+func metadata(m map[string]string, key string) string {
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,76 @@
+package backup
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tlsutil"
+)
+
+// newTLSServer starts a stand-in MinIO server with a self-signed
+// certificate, on which the backup bucket exists, and writes its
+// certificate to a PEM file.
+func newTLSServer(t *testing.T) (endpoint, caFile string) {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || r.URL.Path != "/backups/" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	caFile = filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimPrefix(srv.URL, "https://"), caFile
+}
+
+func TestMinIOStoreTLS(t *testing.T) {
+	endpoint, caFile := newTLSServer(t)
+
+	tests := []struct {
+		name    string
+		tls     tlsutil.Config
+		wantErr string
+	}{
+		{name: "system CAs only", wantErr: "certificate"},
+		{name: "CA file", tls: tlsutil.Config{CAFile: caFile}},
+		{name: "insecure", tls: tlsutil.Config{InsecureSkipVerify: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewMinIOStore(endpoint, "admin", "admin-secret", true, "us-east-1", "backups", tt.tls)
+			if err != nil {
+				t.Fatalf("NewMinIOStore: %v", err)
+			}
+			err = s.ensureBucket(context.Background())
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("ensureBucket: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("ensureBucket error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewMinIOStoreRejectsInvalidCA(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := NewMinIOStore("localhost:9000", "admin", "admin-secret", true, "", "backups",
+		tlsutil.Config{CAFile: caFile})
+	if err == nil {
+		t.Fatal("NewMinIOStore accepted a CA bundle without certificates")
+	}
+}
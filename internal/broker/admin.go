@@ -0,0 +1,236 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi/v11/domain/apiresponses"
+)
+
+// ServersHandler serves the status of every pool server behind the broker
+// as JSON. Callers are responsible for authenticating requests.
+func (b *Broker) ServersHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"description": "method not allowed"})
+			return
+		}
+
+		servers := []ServerStatus{}
+		for _, backend := range b.backends {
+			pool, ok := backend.(*Pool)
+			if !ok {
+				continue
+			}
+			status, err := pool.Status(r.Context())
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"description": err.Error()})
+				return
+			}
+			servers = append(servers, status...)
+		}
+		sort.SliceStable(servers, func(i, j int) bool { return servers[i].Service < servers[j].Service })
+
+		writeJSON(w, http.StatusOK, map[string]any{"servers": servers})
+	})
+}
+
+// InstancesHandler serves the admin operations on instances, mounted at
+// /admin/instances/:
+//
+//	GET    /admin/instances/<id>                  placement and last operation
+//	POST   /admin/instances/<id>/migrate          {"server": "<name>"}, answered with 202
+//	GET    /admin/instances/<id>/backups          stored backups, oldest first
+//	POST   /admin/instances/<id>/backups          start a backup, answered with 202
+//	DELETE /admin/instances/<id>/backups/<backup> delete a backup
+//	GET    /admin/instances/<id>/snapshots        snapshots, oldest first
+//	POST   /admin/instances/<id>/snapshots        start a snapshot, answered with 202
+//	DELETE /admin/instances/<id>/snapshots/<snap> delete a snapshot
+//	POST   /admin/instances/<id>/restore          {"backup" or "snapshot": "<id>", "source_instance": "<id>"}, answered with 202
+//
+// Callers are responsible for authenticating requests.
+func (b *Broker) InstancesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/instances/"), "/")
+		action, itemID, _ := strings.Cut(action, "/")
+		route := action
+		if itemID != "" {
+			route += "/"
+		}
+
+		allowed := map[string]string{
+			"":         http.MethodGet,
+			"migrate":  http.MethodPost,
+			"backups":  http.MethodGet + ", " + http.MethodPost,
+			"backups/": http.MethodDelete,
+			// Snapshots are kept on the instance's own server.
+			"snapshots":  http.MethodGet + ", " + http.MethodPost,
+			"snapshots/": http.MethodDelete,
+			"restore":    http.MethodPost,
+		}
+		switch {
+		case id == "":
+			writeJSON(w, http.StatusNotFound, map[string]string{"description": "instance ID missing"})
+		case strings.Contains(itemID, "/"):
+			writeJSON(w, http.StatusNotFound, map[string]string{"description": "unknown " + action + " " + itemID})
+		case route == "" && r.Method == http.MethodGet:
+			b.serveInstance(w, r, id)
+		case route == "migrate" && r.Method == http.MethodPost:
+			b.serveMigrate(w, r, id)
+		case route == "backups" && r.Method == http.MethodGet:
+			b.serveBackups(w, r, id)
+		case route == "backups" && r.Method == http.MethodPost:
+			b.serveBackup(w, r, id)
+		case route == "backups/" && r.Method == http.MethodDelete:
+			b.serveDeleteBackup(w, r, id, itemID)
+		case route == "snapshots" && r.Method == http.MethodGet:
+			b.serveSnapshots(w, r, id)
+		case route == "snapshots" && r.Method == http.MethodPost:
+			b.serveSnapshot(w, r, id)
+		case route == "snapshots/" && r.Method == http.MethodDelete:
+			b.serveDeleteSnapshot(w, r, id, itemID)
+		case route == "restore" && r.Method == http.MethodPost:
+			b.serveRestore(w, r, id)
+		case allowed[route] != "":
+			w.Header().Set("Allow", allowed[route])
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"description": "method not allowed"})
+		default:
+			writeJSON(w, http.StatusNotFound, map[string]string{"description": "unknown action " + action})
+		}
+	})
+}
+
+func (b *Broker) serveInstance(w http.ResponseWriter, r *http.Request, id string) {
+	instance, err := b.store.GetInstance(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"id":             instance.ID,
+		"service_id":     instance.ServiceID,
+		"plan_id":        instance.PlanID,
+		"server":         instance.Attribute(AttrServer),
+		"last_operation": instance.LastOperation,
+	})
+}
+
+func (b *Broker) serveMigrate(w http.ResponseWriter, r *http.Request, id string) {
+	var req struct {
+		Server string `json:"server"`
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil || req.Server == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"description": `body must be {"server": "<name>"}`})
+		return
+	}
+	if err := b.Migrate(r.Context(), id, req.Server); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"operation": OperationMigrate})
+}
+
+func (b *Broker) serveBackups(w http.ResponseWriter, r *http.Request, id string) {
+	backups, err := b.Backups(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"backups": backups})
+}
+
+func (b *Broker) serveBackup(w http.ResponseWriter, r *http.Request, id string) {
+	info, err := b.Backup(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]any{"backup": info})
+}
+
+func (b *Broker) serveDeleteBackup(w http.ResponseWriter, r *http.Request, id, backupID string) {
+	if err := b.DeleteBackup(r.Context(), id, backupID); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (b *Broker) serveSnapshots(w http.ResponseWriter, r *http.Request, id string) {
+	snapshots, err := b.Snapshots(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"snapshots": snapshots})
+}
+
+func (b *Broker) serveSnapshot(w http.ResponseWriter, r *http.Request, id string) {
+	info, err := b.Snapshot(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]any{"snapshot": info})
+}
+
+func (b *Broker) serveDeleteSnapshot(w http.ResponseWriter, r *http.Request, id, snapshotID string) {
+	if err := b.DeleteSnapshot(r.Context(), id, snapshotID); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (b *Broker) serveRestore(w http.ResponseWriter, r *http.Request, id string) {
+	var req struct {
+		Backup         string `json:"backup"`
+		Snapshot       string `json:"snapshot"`
+		SourceInstance string `json:"source_instance"`
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&req)
+	if err != nil || (req.Backup == "") == (req.Snapshot == "") ||
+		strings.Contains(req.Backup+req.Snapshot+req.SourceInstance, "/") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"description": `body must be {"backup": "<id>"} or {"snapshot": "<id>"}, optionally with "source_instance": "<id>"`,
+		})
+		return
+	}
+	if req.Snapshot != "" {
+		err = b.RestoreSnapshot(r.Context(), id, req.SourceInstance, req.Snapshot)
+	} else {
+		err = b.Restore(r.Context(), id, req.SourceInstance, req.Backup)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"operation": OperationRestore})
+}
+
+// writeError reports err with the status of a failure response, or 500.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var failure *apiresponses.FailureResponse
+	switch {
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.As(err, &failure):
+		status = failure.ValidatedStatusCode(nil)
+	}
+	writeJSON(w, status, map[string]string{"description": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,177 @@
+// Package broker is the shared service broker framework. It implements
+// domain.ServiceBroker on top of one or more Backends, handling the catalog,
+// instance and binding state, asynchronous operations, idempotency,
+// validation, logging, tracing and metrics so that a Backend only has to
+// talk to its backing service.
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi/v11/domain"
+)
+
+// Backend provisions and binds one service type on its backing service.
+//
+// The framework serializes operations on an instance, so a Backend never
+// sees two concurrent calls for the same instance. Errors that are
+// apiresponses.FailureResponse values are passed to the platform unchanged;
+// any other error is reported as an internal error.
+type Backend interface {
+	// Service returns the catalog entry for the backend's service.
+	Service() domain.Service
+
+	// Provision creates the resources for a new instance. It may record
+	// backend-specific state in instance.Attributes.
+	Provision(ctx context.Context, instance *Instance) error
+
+	// Deprovision removes the resources of instance. It must succeed if
+	// the resources are already gone.
+	Deprovision(ctx context.Context, instance *Instance) error
+
+	// Bind creates credentials for binding and returns them. It may record
+	// backend-specific state in binding.Attributes.
+	Bind(ctx context.Context, instance *Instance, binding *Binding) (map[string]any, error)
+
+	// Unbind revokes the credentials of binding. It must succeed if they
+	// are already gone.
+	Unbind(ctx context.Context, instance *Instance, binding *Binding) error
+
+	// Update applies a plan or parameter change. instance holds the new
+	// plan and the merged parameters; previous is the instance as it was
+	// before the update.
+	Update(ctx context.Context, instance *Instance, previous *Instance) error
+
+	// Describe returns the parameters reported by GetInstance.
+	Describe(ctx context.Context, instance *Instance) (map[string]any, error)
+}
+
+// Validator is implemented by backends that check provision and update
+// parameters before any work starts, so invalid requests are rejected
+// synchronously even when the operation itself runs in the background.
+type Validator interface {
+	Validate(instance *Instance) error
+}
+
+// BindValidator is implemented by backends that check bind parameters
+// before any work starts.
+type BindValidator interface {
+	ValidateBinding(instance *Instance, binding *Binding) error
+}
+
+// BindingUpdater is implemented by backends whose bindings grant access to
+// resources that an update can add or remove. UpdateBindings runs after a
+// successful Update, with the instance's bindings.
+type BindingUpdater interface {
+	UpdateBindings(ctx context.Context, instance, previous *Instance, bindings []*Binding) error
+}
+
+// Adopter is implemented by backends whose resources are named after the
+// instance and binding IDs, so that instances created before the broker
+// recorded state, or lost with an in-memory store, can still be updated,
+// bound and deprovisioned. The broker asks the backend when a request
+// names an instance or binding it has no record of, and records adopted
+// instances.
+type Adopter interface {
+	// AdoptInstance reports whether the resources of instance exist. The
+	// instance carries the service and plan IDs of the request. It may
+	// record attributes.
+	AdoptInstance(ctx context.Context, instance *Instance) (bool, error)
+	// AdoptBinding reports whether binding has credentials to revoke.
+	AdoptBinding(ctx context.Context, instance *Instance, binding *Binding) (bool, error)
+}
+
+// Runner is implemented by backends with background work, such as
+// monitoring their instances. Run blocks until ctx is done.
+type Runner interface {
+	Run(ctx context.Context)
+}
+
+// Instance is the recorded state of a service instance.
+type Instance struct {
+	ID               string          `json:"id"`
+	ServiceID        string          `json:"service_id"`
+	PlanID           string          `json:"plan_id"`
+	OrganizationGUID string          `json:"organization_guid,omitempty"`
+	SpaceGUID        string          `json:"space_guid,omitempty"`
+	Parameters       json.RawMessage `json:"parameters,omitempty"`
+	// Attributes holds backend-specific state, e.g. generated names.
+	Attributes    map[string]string `json:"attributes,omitempty"`
+	LastOperation *Operation        `json:"last_operation,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+}
+
+// DecodeParameters decodes the instance parameters into v. Unknown fields
+// are rejected with a 400 response.
+func (i *Instance) DecodeParameters(v any) error {
+	return DecodeParameters(i.Parameters, v)
+}
+
+// Attribute returns the named attribute, or "" if it is not set.
+func (i *Instance) Attribute(key string) string {
+	return i.Attributes[key]
+}
+
+// SetAttribute records backend-specific state on the instance.
+func (i *Instance) SetAttribute(key, value string) {
+	if i.Attributes == nil {
+		i.Attributes = make(map[string]string)
+	}
+	i.Attributes[key] = value
+}
+
+// Binding is the recorded state of a service binding.
+type Binding struct {
+	ID         string          `json:"id"`
+	InstanceID string          `json:"instance_id"`
+	AppGUID    string          `json:"app_guid,omitempty"`
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+	// Credentials are the credentials returned to the platform, kept so
+	// that bindings can be fetched and binds are idempotent.
+	Credentials map[string]any    `json:"credentials,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+// DecodeParameters decodes the binding parameters into v. Unknown fields
+// are rejected with a 400 response.
+func (b *Binding) DecodeParameters(v any) error {
+	return DecodeParameters(b.Parameters, v)
+}
+
+// Attribute returns the named attribute, or "" if it is not set.
+func (b *Binding) Attribute(key string) string {
+	return b.Attributes[key]
+}
+
+// SetAttribute records backend-specific state on the binding.
+func (b *Binding) SetAttribute(key, value string) {
+	if b.Attributes == nil {
+		b.Attributes = make(map[string]string)
+	}
+	b.Attributes[key] = value
+}
+
+// Operation types recorded in Operation.Type.
+const (
+	OperationProvision   = "provision"
+	OperationUpdate      = "update"
+	OperationDeprovision = "deprovision"
+)
+
+// Operation is the most recent operation on an instance.
+type Operation struct {
+	Type        string                    `json:"type"`
+	State       domain.LastOperationState `json:"state"`
+	Description string                    `json:"description,omitempty"`
+	StartedAt   time.Time                 `json:"started_at"`
+	UpdatedAt   time.Time                 `json:"updated_at"`
+}
+
+// InProgress reports whether the operation has not finished yet.
+func (o *Operation) InProgress() bool {
+	return o != nil && o.State == domain.InProgress
+}
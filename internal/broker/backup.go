@@ -0,0 +1,414 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi/v11/domain"
+	"github.com/pivotal-cf/brokerapi/v11/domain/apiresponses"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+)
+
+// OperationRestore is the operation type recorded while an instance is
+// restored from a backup.
+const OperationRestore = "restore"
+
+// operationBackup names backups in logs and metrics. Backups run alongside
+// other operations and are not recorded as the instance's LastOperation.
+const operationBackup = "backup"
+
+// BackupIDFormat is the time layout of backup IDs, which are the UTC time
+// the backup was started.
+const BackupIDFormat = "20060102T150405.000Z"
+
+// backupCheckInterval is how often the scheduler looks for instances whose
+// newest backup is older than the backup interval.
+const backupCheckInterval = 5 * time.Minute
+
+// BackupInfo describes a stored backup.
+type BackupInfo struct {
+	ID         string    `json:"id"`
+	InstanceID string    `json:"instance_id"`
+	ServiceID  string    `json:"service_id"`
+	PlanID     string    `json:"plan_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	Size       int64     `json:"size"`
+}
+
+// Backuper is implemented by server backends that can take logical backups
+// of their instances.
+type Backuper interface {
+	// Backup writes a backup of instance to w.
+	Backup(ctx context.Context, instance *Instance, w io.Writer) error
+
+	// ValidateRestore reports whether backup can be restored into
+	// instance, which has the backup's service and plan.
+	ValidateRestore(instance *Instance, backup BackupInfo) error
+
+	// Restore replaces the data of instance with backup, read from r. The
+	// instance must be left unchanged if the restore fails.
+	Restore(ctx context.Context, instance *Instance, backup BackupInfo, r io.Reader) error
+}
+
+// BackupStore keeps backups away from the servers they were taken on.
+type BackupStore interface {
+	// Put stores a backup, read from r until EOF. Nothing is stored if
+	// reading r fails.
+	Put(ctx context.Context, info BackupInfo, r io.Reader) error
+	// Stat returns a backup's info, or ErrNotFound.
+	Stat(ctx context.Context, instanceID, id string) (BackupInfo, error)
+	// Get opens a backup for reading, or returns ErrNotFound.
+	Get(ctx context.Context, instanceID, id string) (io.ReadCloser, error)
+	// List returns the backups of an instance, oldest first.
+	List(ctx context.Context, instanceID string) ([]BackupInfo, error)
+	// Delete removes a backup. It must succeed if it is already gone.
+	Delete(ctx context.Context, instanceID, id string) error
+}
+
+// BackupPolicy schedules backups and decides how long they are kept.
+type BackupPolicy struct {
+	// Interval is the time between scheduled backups of an instance; zero
+	// disables scheduled backups.
+	Interval time.Duration
+	// Keep is the number of backups kept per instance; zero keeps all.
+	Keep int
+	// MaxAge is how long backups are kept; zero keeps them regardless of
+	// age. The newest backup of an instance is always kept.
+	MaxAge time.Duration
+}
+
+func backupError(format string, args ...any) error {
+	return apiresponses.NewFailureResponse(
+		fmt.Errorf(format, args...), http.StatusBadRequest, "invalid-backup",
+	)
+}
+
+var errBackupsDisabled = backupError("backups are not configured")
+
+// serverBackend returns the backend of the server holding instance, looking
+// through pools.
+func (b *Broker) serverBackend(instance *Instance) (Backend, error) {
+	backend, err := b.backend(instance.ServiceID)
+	if err != nil {
+		return nil, err
+	}
+	if pool, ok := backend.(*Pool); ok {
+		s, err := pool.server(instance)
+		if err != nil {
+			return nil, err
+		}
+		backend = s.Backend
+	}
+	return backend, nil
+}
+
+// backuper returns the Backuper serving instance.
+func (b *Broker) backuper(instance *Instance) (Backuper, error) {
+	backend, err := b.serverBackend(instance)
+	if err != nil {
+		return nil, err
+	}
+	backuper, ok := backend.(Backuper)
+	if !ok {
+		return nil, backupError("service %s does not support backups", instance.ServiceID)
+	}
+	return backuper, nil
+}
+
+// readyInstance loads an instance that has been provisioned and has no
+// operation in progress. The caller must hold the instance lock.
+func (b *Broker) readyInstance(ctx context.Context, instanceID string) (*Instance, error) {
+	instance, err := b.store.GetInstance(ctx, instanceID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, errInstanceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if instance.LastOperation.InProgress() {
+		return nil, apiresponses.ErrConcurrentInstanceAccess
+	}
+	if op := instance.LastOperation; op != nil && op.Type == OperationProvision && op.State != domain.Succeeded {
+		return nil, errInstanceNotReady
+	}
+	return instance, nil
+}
+
+// prepareBackup checks that instanceID can be backed up now and marks it as
+// being backed up until release is called.
+func (b *Broker) prepareBackup(ctx context.Context, instanceID string) (*Instance, Backuper, func(), error) {
+	if b.backups == nil {
+		return nil, nil, nil, errBackupsDisabled
+	}
+
+	unlock := b.locks.lock(instanceID)
+	defer unlock()
+
+	instance, err := b.readyInstance(ctx, instanceID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	backuper, err := b.backuper(instance)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	release, err := b.markCopying(operationBackup, instanceID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return instance, backuper, release, nil
+}
+
+// markCopying records that a backup or snapshot of an instance is running,
+// refusing a second one of the same kind, until release is called.
+func (b *Broker) markCopying(kind, instanceID string) (func(), error) {
+	key := kind + "/" + instanceID
+	b.copyingMu.Lock()
+	defer b.copyingMu.Unlock()
+	if b.copying[key] {
+		return nil, apiresponses.ErrConcurrentInstanceAccess
+	}
+	b.copying[key] = true
+	return func() {
+		b.copyingMu.Lock()
+		defer b.copyingMu.Unlock()
+		delete(b.copying, key)
+	}, nil
+}
+
+// Backup starts a backup of an instance in the background and returns the
+// info it will be stored under. The outcome is logged; the backup is listed
+// by Backups once it has been stored.
+func (b *Broker) Backup(ctx context.Context, instanceID string) (BackupInfo, error) {
+	instance, backuper, release, err := b.prepareBackup(ctx, instanceID)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	info := newBackupInfo(instance)
+
+	// The backup outlives the request but keeps its trace and correlation
+	// values.
+	ctx = context.WithoutCancel(ctx)
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer release()
+		_ = b.runBackup(ctx, instance, backuper, info)
+	}()
+	return info, nil
+}
+
+func newBackupInfo(instance *Instance) BackupInfo {
+	now := time.Now().UTC()
+	return BackupInfo{
+		ID:         now.Format(BackupIDFormat),
+		InstanceID: instance.ID,
+		ServiceID:  instance.ServiceID,
+		PlanID:     instance.PlanID,
+		CreatedAt:  now,
+	}
+}
+
+// runBackup streams a backup from the backend into the backup store and
+// then prunes old backups of the instance.
+func (b *Broker) runBackup(ctx context.Context, instance *Instance, backuper Backuper, info BackupInfo) error {
+	return b.run(ctx, operationBackup, instance, nil, func(ctx context.Context) error {
+		pr, pw := io.Pipe()
+		backupErr := make(chan error, 1)
+		go func() {
+			err := backuper.Backup(ctx, instance, pw)
+			pw.CloseWithError(err)
+			backupErr <- err
+		}()
+
+		putErr := b.backups.Put(ctx, info, pr)
+		// Stop the backend if the store gave up early.
+		pr.CloseWithError(putErr)
+		if err := <-backupErr; err != nil {
+			return fmt.Errorf("failed to back up instance: %w", err)
+		}
+		if putErr != nil {
+			return fmt.Errorf("failed to store backup %s: %w", info.ID, putErr)
+		}
+
+		logging.FromContext(ctx).Info("stored backup", slog.String("backup_id", info.ID))
+		b.pruneBackups(ctx, instance.ID)
+		return nil
+	})
+}
+
+// pruneBackups deletes the backups of an instance that the policy no
+// longer keeps. Failures are logged and retried after the next backup.
+func (b *Broker) pruneBackups(ctx context.Context, instanceID string) {
+	logger := logging.FromContext(ctx)
+	if b.backupPolicy.Keep <= 0 && b.backupPolicy.MaxAge <= 0 {
+		return
+	}
+	backups, err := b.backups.List(ctx, instanceID)
+	if err != nil {
+		logger.Warn("failed to list backups for pruning", slog.String(logging.KeyError, err.Error()))
+		return
+	}
+	// The newest backup is never pruned.
+	for i, backup := range backups[:max(len(backups)-1, 0)] {
+		tooMany := b.backupPolicy.Keep > 0 && len(backups)-i > b.backupPolicy.Keep
+		tooOld := b.backupPolicy.MaxAge > 0 && time.Since(backup.CreatedAt) > b.backupPolicy.MaxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := b.backups.Delete(ctx, instanceID, backup.ID); err != nil {
+			logger.Warn("failed to delete old backup",
+				slog.String("backup_id", backup.ID), slog.String(logging.KeyError, err.Error()))
+			continue
+		}
+		logger.Info("deleted old backup", slog.String("backup_id", backup.ID))
+	}
+}
+
+// Backups lists the stored backups of an instance, oldest first. Backups
+// of deprovisioned instances are listed too.
+func (b *Broker) Backups(ctx context.Context, instanceID string) ([]BackupInfo, error) {
+	if b.backups == nil {
+		return nil, errBackupsDisabled
+	}
+	return b.backups.List(ctx, instanceID)
+}
+
+// DeleteBackup removes a stored backup.
+func (b *Broker) DeleteBackup(ctx context.Context, instanceID, backupID string) error {
+	if b.backups == nil {
+		return errBackupsDisabled
+	}
+	if _, err := b.backups.Stat(ctx, instanceID, backupID); err != nil {
+		return err
+	}
+	return b.backups.Delete(ctx, instanceID, backupID)
+}
+
+// Restore replaces the data of an instance with a backup in the background.
+// The backup may have been taken of sourceInstanceID, another instance of the
+// same plan, which need not exist anymore; an empty sourceInstanceID means
+// the instance itself. Progress and the outcome are reported through
+// LastOperation.
+func (b *Broker) Restore(ctx context.Context, instanceID, sourceInstanceID, backupID string) error {
+	if b.backups == nil {
+		return errBackupsDisabled
+	}
+	if sourceInstanceID == "" {
+		sourceInstanceID = instanceID
+	}
+
+	unlock := b.locks.lock(instanceID)
+	defer unlock()
+
+	instance, err := b.readyInstance(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+	backuper, err := b.backuper(instance)
+	if err != nil {
+		return err
+	}
+	info, err := b.backups.Stat(ctx, sourceInstanceID, backupID)
+	if err != nil {
+		return err
+	}
+	if info.ServiceID != instance.ServiceID || info.PlanID != instance.PlanID {
+		return backupError("backup %s is of plan %s and cannot be restored into plan %s",
+			backupID, info.PlanID, instance.PlanID)
+	}
+	if err := backuper.ValidateRestore(instance, info); err != nil {
+		return err
+	}
+
+	restore := func(ctx context.Context) error {
+		r, err := b.backups.Get(ctx, info.InstanceID, info.ID)
+		if err != nil {
+			return fmt.Errorf("failed to open backup %s: %w", info.ID, err)
+		}
+		defer r.Close()
+		return backuper.Restore(ctx, instance, info, r)
+	}
+	return b.startAsync(ctx, OperationRestore, instance, restore, func(ctx context.Context, err error) error {
+		instance.LastOperation.finish(err)
+		if err == nil {
+			instance.LastOperation.Description = "restored backup " + info.ID
+		}
+		return b.store.PutInstance(ctx, instance)
+	})
+}
+
+// scheduleBackups backs up every instance whose newest backup is older
+// than the policy interval, one instance at a time, until ctx is done.
+func (b *Broker) scheduleBackups(ctx context.Context) {
+	logger := b.logger.With(slog.String(logging.KeyOperation, operationBackup))
+	// newest caches the time of each instance's newest backup.
+	newest := make(map[string]time.Time)
+
+	ticker := time.NewTicker(min(backupCheckInterval, b.backupPolicy.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		instances, err := b.store.ListInstances(ctx)
+		if err != nil {
+			logger.Warn("failed to list instances for backup", slog.String(logging.KeyError, err.Error()))
+			continue
+		}
+		listed := make(map[string]bool, len(instances))
+		for _, instance := range instances {
+			listed[instance.ID] = true
+		}
+		for id := range newest {
+			if !listed[id] {
+				delete(newest, id)
+			}
+		}
+		for _, instance := range instances {
+			if ctx.Err() != nil {
+				return
+			}
+			if _, err := b.backuper(instance); err != nil {
+				continue
+			}
+			last, ok := newest[instance.ID]
+			if !ok {
+				backups, err := b.backups.List(ctx, instance.ID)
+				if err != nil {
+					logger.Warn("failed to list backups",
+						logging.InstanceID(instance.ID), slog.String(logging.KeyError, err.Error()))
+					continue
+				}
+				if len(backups) > 0 {
+					last = backups[len(backups)-1].CreatedAt
+				}
+				newest[instance.ID] = last
+			}
+			if time.Since(last) < b.backupPolicy.Interval {
+				continue
+			}
+
+			instance, backuper, release, err := b.prepareBackup(ctx, instance.ID)
+			if err != nil {
+				// Busy or not ready; try again on the next check.
+				continue
+			}
+			info := newBackupInfo(instance)
+			err = b.runBackup(ctx, instance, backuper, info)
+			release()
+			if err == nil {
+				newest[instance.ID] = info.CreatedAt
+			}
+		}
+	}
+}
@@ -0,0 +1,893 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi/v11/domain"
+	"github.com/pivotal-cf/brokerapi/v11/domain/apiresponses"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var _ domain.ServiceBroker = (*Broker)(nil)
+
+// Errors returned for requests that do not match the recorded state.
+var (
+	errInstanceNotFound = apiresponses.NewFailureResponse(
+		errors.New("instance not found"), http.StatusNotFound, "instance-not-found",
+	)
+	errInstanceNotReady = apiresponses.NewFailureResponseBuilder(
+		errors.New("instance has no successful provision"), http.StatusUnprocessableEntity, "instance-not-ready",
+	).WithErrorKey("ConcurrencyError").Build()
+)
+
+// Config configures a Broker.
+type Config struct {
+	// Store records instance and binding state. Defaults to a MemoryStore.
+	Store Store
+	// Logger defaults to slog.Default().
+	Logger *slog.Logger
+	// Async runs provision, update and deprovision in the background when
+	// the platform accepts incomplete operations. Progress is then reported
+	// through LastOperation.
+	Async bool
+	// Backups stores instance backups; nil disables them.
+	Backups BackupStore
+	// BackupPolicy schedules and prunes backups when Backups is set.
+	BackupPolicy BackupPolicy
+	// OperationDone, if set, is called with the outcome of every operation
+	// run in the background once it has been recorded.
+	OperationDone func(ctx context.Context, instance *Instance, operation string, err error)
+}
+
+// Broker implements domain.ServiceBroker on top of one or more Backends,
+// routing each request to a backend by service ID.
+type Broker struct {
+	backends map[string]Backend
+	services []domain.Service
+	store    Store
+	logger   *slog.Logger
+	async    bool
+	// operationDone is Config.OperationDone.
+	operationDone func(ctx context.Context, instance *Instance, operation string, err error)
+
+	backups      BackupStore
+	backupPolicy BackupPolicy
+	copyingMu    sync.Mutex
+	// copying holds the backups and snapshots running, keyed by kind and
+	// instance ID.
+	copying map[string]bool
+
+	locks keyedMutex
+	wg    sync.WaitGroup
+}
+
+// New creates a Broker serving backends. Operations left in progress by a
+// previous run are marked as failed.
+func New(ctx context.Context, cfg Config, backends ...Backend) (*Broker, error) {
+	b := &Broker{
+		backends: make(map[string]Backend),
+		store:    cfg.Store,
+		logger:   cfg.Logger,
+		async:    cfg.Async,
+
+		operationDone: cfg.OperationDone,
+
+		backups:      cfg.Backups,
+		backupPolicy: cfg.BackupPolicy,
+		copying:      make(map[string]bool),
+	}
+	if b.store == nil {
+		b.store = NewMemoryStore()
+	}
+	if b.logger == nil {
+		b.logger = slog.Default()
+	}
+
+	for _, backend := range backends {
+		service := backend.Service()
+		if _, ok := b.backends[service.ID]; ok {
+			return nil, fmt.Errorf("service ID %s is offered by more than one backend", service.ID)
+		}
+		service.InstancesRetrievable = true
+		service.BindingsRetrievable = true
+		b.backends[service.ID] = backend
+		b.services = append(b.services, service)
+	}
+	if len(b.services) == 0 {
+		return nil, fmt.Errorf("no backends configured")
+	}
+	for _, backend := range backends {
+		if u, ok := backend.(interface{ useStore(Store) }); ok {
+			u.useStore(b.store)
+		}
+	}
+
+	if err := b.recover(ctx); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// recover fails operations that were interrupted by a broker restart.
+func (b *Broker) recover(ctx context.Context) error {
+	instances, err := b.store.ListInstances(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load instances: %w", err)
+	}
+	for _, instance := range instances {
+		if !instance.LastOperation.InProgress() {
+			continue
+		}
+		instance.LastOperation.State = domain.Failed
+		instance.LastOperation.Description = "interrupted by broker restart"
+		instance.LastOperation.UpdatedAt = time.Now().UTC()
+		if err := b.store.PutInstance(ctx, instance); err != nil {
+			return fmt.Errorf("failed to record interrupted operation: %w", err)
+		}
+		b.logger.Warn("marked interrupted operation as failed",
+			logging.InstanceID(instance.ID),
+			slog.String(logging.KeyOperation, instance.LastOperation.Type),
+		)
+	}
+	return nil
+}
+
+// Start runs the background work of every backend that implements Runner,
+// and scheduled backups if configured, until ctx is done.
+func (b *Broker) Start(ctx context.Context) {
+	if b.backups != nil && b.backupPolicy.Interval > 0 {
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			b.scheduleBackups(ctx)
+		}()
+	}
+	for id, backend := range b.backends {
+		r, ok := backend.(Runner)
+		if !ok {
+			continue
+		}
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			r.Run(logging.NewContext(ctx, b.logger.With(logging.ServiceID(id))))
+		}()
+	}
+}
+
+// Wait blocks until all background operations have finished.
+func (b *Broker) Wait() {
+	b.wg.Wait()
+}
+
+// Store returns the broker's state store.
+func (b *Broker) Store() Store {
+	return b.store
+}
+
+// Services returns the combined catalog of all backends.
+func (b *Broker) Services(_ context.Context) ([]domain.Service, error) {
+	return append([]domain.Service(nil), b.services...), nil
+}
+
+// Provision records a new instance and provisions it on its backend.
+// Repeating an identical request is reported as AlreadyExists.
+func (b *Broker) Provision(
+	ctx context.Context,
+	instanceID string,
+	details domain.ProvisionDetails,
+	asyncAllowed bool,
+) (domain.ProvisionedServiceSpec, error) {
+	backend, err := b.backend(details.ServiceID)
+	if err != nil {
+		return domain.ProvisionedServiceSpec{}, err
+	}
+	if _, err := parseObject(details.RawParameters); err != nil {
+		return domain.ProvisionedServiceSpec{}, err
+	}
+
+	unlock := b.locks.lock(instanceID)
+	defer unlock()
+
+	existing, err := b.store.GetInstance(ctx, instanceID)
+	switch {
+	case errors.Is(err, ErrNotFound):
+	case err != nil:
+		return domain.ProvisionedServiceSpec{}, err
+	case existing.ServiceID != details.ServiceID ||
+		existing.PlanID != details.PlanID ||
+		!sameParameters(existing.Parameters, details.RawParameters):
+		return domain.ProvisionedServiceSpec{}, apiresponses.ErrInstanceAlreadyExists
+	case existing.LastOperation.InProgress() && existing.LastOperation.Type == OperationProvision:
+		return domain.ProvisionedServiceSpec{IsAsync: true, OperationData: OperationProvision}, nil
+	case existing.LastOperation != nil && existing.LastOperation.State == domain.Failed &&
+		existing.LastOperation.Type == OperationProvision:
+		return domain.ProvisionedServiceSpec{}, apiresponses.ErrInstanceAlreadyExists
+	default:
+		return domain.ProvisionedServiceSpec{AlreadyExists: true}, nil
+	}
+
+	now := time.Now().UTC()
+	instance := &Instance{
+		ID:               instanceID,
+		ServiceID:        details.ServiceID,
+		PlanID:           details.PlanID,
+		OrganizationGUID: details.OrganizationGUID,
+		SpaceGUID:        details.SpaceGUID,
+		Parameters:       details.RawParameters,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+	if v, ok := backend.(Validator); ok {
+		if err := v.Validate(instance); err != nil {
+			return domain.ProvisionedServiceSpec{}, err
+		}
+	}
+
+	provision := func(ctx context.Context) error { return backend.Provision(ctx, instance) }
+
+	if b.async && asyncAllowed {
+		err := b.startAsync(ctx, OperationProvision, instance, provision, func(ctx context.Context, err error) error {
+			instance.LastOperation.finish(err)
+			return b.store.PutInstance(ctx, instance)
+		})
+		if err != nil {
+			return domain.ProvisionedServiceSpec{}, err
+		}
+		return domain.ProvisionedServiceSpec{IsAsync: true, OperationData: OperationProvision}, nil
+	}
+
+	if err := b.run(ctx, OperationProvision, instance, nil, provision); err != nil {
+		return domain.ProvisionedServiceSpec{}, err
+	}
+	instance.LastOperation = newOperation(OperationProvision)
+	instance.LastOperation.finish(nil)
+	if err := b.store.PutInstance(ctx, instance); err != nil {
+		return domain.ProvisionedServiceSpec{}, fmt.Errorf("failed to record instance: %w", err)
+	}
+	return domain.ProvisionedServiceSpec{}, nil
+}
+
+// Deprovision removes an instance from its backend and forgets it.
+func (b *Broker) Deprovision(
+	ctx context.Context,
+	instanceID string,
+	details domain.DeprovisionDetails,
+	asyncAllowed bool,
+) (domain.DeprovisionServiceSpec, error) {
+	unlock := b.locks.lock(instanceID)
+	defer unlock()
+
+	instance, err := b.getInstance(ctx, instanceID, details.ServiceID, details.PlanID)
+	if errors.Is(err, ErrNotFound) {
+		return domain.DeprovisionServiceSpec{}, apiresponses.ErrInstanceDoesNotExist
+	}
+	if err != nil {
+		return domain.DeprovisionServiceSpec{}, err
+	}
+	if instance.LastOperation.InProgress() {
+		if instance.LastOperation.Type == OperationDeprovision {
+			return domain.DeprovisionServiceSpec{IsAsync: true, OperationData: OperationDeprovision}, nil
+		}
+		return domain.DeprovisionServiceSpec{}, apiresponses.ErrConcurrentInstanceAccess
+	}
+
+	backend, err := b.backend(instance.ServiceID)
+	if err != nil {
+		return domain.DeprovisionServiceSpec{}, err
+	}
+
+	deprovision := func(ctx context.Context) error { return backend.Deprovision(ctx, instance) }
+
+	if b.async && asyncAllowed {
+		err := b.startAsync(ctx, OperationDeprovision, instance, deprovision, func(ctx context.Context, err error) error {
+			if err != nil {
+				instance.LastOperation.finish(err)
+				return b.store.PutInstance(ctx, instance)
+			}
+			return b.store.DeleteInstance(ctx, instance.ID)
+		})
+		if err != nil {
+			return domain.DeprovisionServiceSpec{}, err
+		}
+		return domain.DeprovisionServiceSpec{IsAsync: true, OperationData: OperationDeprovision}, nil
+	}
+
+	if err := b.run(ctx, OperationDeprovision, instance, nil, deprovision); err != nil {
+		return domain.DeprovisionServiceSpec{}, err
+	}
+	if err := b.store.DeleteInstance(ctx, instance.ID); err != nil {
+		return domain.DeprovisionServiceSpec{}, fmt.Errorf("failed to forget instance: %w", err)
+	}
+	return domain.DeprovisionServiceSpec{}, nil
+}
+
+// Update changes the plan and/or parameters of an instance. Parameters are
+// merged into those already recorded.
+func (b *Broker) Update(
+	ctx context.Context,
+	instanceID string,
+	details domain.UpdateDetails,
+	asyncAllowed bool,
+) (domain.UpdateServiceSpec, error) {
+	unlock := b.locks.lock(instanceID)
+	defer unlock()
+
+	planID := details.PreviousValues.PlanID
+	if planID == "" {
+		planID = details.PlanID
+	}
+	instance, err := b.getInstance(ctx, instanceID, details.ServiceID, planID)
+	if errors.Is(err, ErrNotFound) {
+		return domain.UpdateServiceSpec{}, apiresponses.ErrInstanceDoesNotExist
+	}
+	if err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+	if instance.LastOperation.InProgress() {
+		return domain.UpdateServiceSpec{}, apiresponses.ErrConcurrentInstanceAccess
+	}
+
+	backend, err := b.backend(instance.ServiceID)
+	if err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+
+	previous, err := clone(instance)
+	if err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+
+	if details.PlanID != "" && details.PlanID != instance.PlanID {
+		if err := b.checkPlanChange(instance.ServiceID, details.PlanID); err != nil {
+			return domain.UpdateServiceSpec{}, err
+		}
+		instance.PlanID = details.PlanID
+	}
+	if instance.Parameters, err = mergeParameters(instance.Parameters, details.RawParameters); err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+	instance.UpdatedAt = time.Now().UTC()
+
+	if v, ok := backend.(Validator); ok {
+		if err := v.Validate(instance); err != nil {
+			return domain.UpdateServiceSpec{}, err
+		}
+	}
+
+	update := func(ctx context.Context) error { return backend.Update(ctx, instance, previous) }
+	if u, ok := backend.(BindingUpdater); ok {
+		// Bind and unbind are refused until the update finishes, so the
+		// bindings cannot change meanwhile.
+		bindings, err := b.store.ListBindings(ctx, instanceID)
+		if err != nil {
+			return domain.UpdateServiceSpec{}, fmt.Errorf("failed to load bindings: %w", err)
+		}
+		update = func(ctx context.Context) error {
+			if err := backend.Update(ctx, instance, previous); err != nil {
+				return err
+			}
+			return u.UpdateBindings(ctx, instance, previous, bindings)
+		}
+	}
+
+	if b.async && asyncAllowed {
+		err := b.startAsync(ctx, OperationUpdate, instance, update, func(ctx context.Context, err error) error {
+			if err != nil {
+				previous.LastOperation = instance.LastOperation
+				previous.LastOperation.finish(err)
+				return b.store.PutInstance(ctx, previous)
+			}
+			instance.LastOperation.finish(nil)
+			return b.store.PutInstance(ctx, instance)
+		})
+		if err != nil {
+			return domain.UpdateServiceSpec{}, err
+		}
+		return domain.UpdateServiceSpec{IsAsync: true, OperationData: OperationUpdate}, nil
+	}
+
+	if err := b.run(ctx, OperationUpdate, instance, nil, update); err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+	instance.LastOperation = newOperation(OperationUpdate)
+	instance.LastOperation.finish(nil)
+	if err := b.store.PutInstance(ctx, instance); err != nil {
+		return domain.UpdateServiceSpec{}, fmt.Errorf("failed to record instance: %w", err)
+	}
+	return domain.UpdateServiceSpec{}, nil
+}
+
+// GetInstance returns the recorded plan and the backend's description of
+// the instance.
+func (b *Broker) GetInstance(
+	ctx context.Context,
+	instanceID string,
+	_ domain.FetchInstanceDetails,
+) (domain.GetInstanceDetailsSpec, error) {
+	instance, err := b.store.GetInstance(ctx, instanceID)
+	if errors.Is(err, ErrNotFound) {
+		return domain.GetInstanceDetailsSpec{}, errInstanceNotFound
+	}
+	if err != nil {
+		return domain.GetInstanceDetailsSpec{}, err
+	}
+	if op := instance.LastOperation; op.InProgress() {
+		if op.Type == OperationProvision {
+			return domain.GetInstanceDetailsSpec{}, errInstanceNotFound
+		}
+		return domain.GetInstanceDetailsSpec{}, apiresponses.ErrConcurrentInstanceAccess
+	}
+
+	backend, err := b.backend(instance.ServiceID)
+	if err != nil {
+		return domain.GetInstanceDetailsSpec{}, err
+	}
+	params, err := backend.Describe(ctx, instance)
+	if err != nil {
+		return domain.GetInstanceDetailsSpec{}, err
+	}
+
+	return domain.GetInstanceDetailsSpec{
+		ServiceID:  instance.ServiceID,
+		PlanID:     instance.PlanID,
+		Parameters: params,
+	}, nil
+}
+
+// LastOperation reports the state of the most recent operation on an
+// instance. A finished deprovision is reported as 410 Gone.
+func (b *Broker) LastOperation(
+	ctx context.Context,
+	instanceID string,
+	_ domain.PollDetails,
+) (domain.LastOperation, error) {
+	instance, err := b.store.GetInstance(ctx, instanceID)
+	if errors.Is(err, ErrNotFound) {
+		return domain.LastOperation{}, apiresponses.ErrInstanceDoesNotExist
+	}
+	if err != nil {
+		return domain.LastOperation{}, err
+	}
+	if instance.LastOperation == nil {
+		return domain.LastOperation{State: domain.Succeeded}, nil
+	}
+	return domain.LastOperation{
+		State:       instance.LastOperation.State,
+		Description: instance.LastOperation.Description,
+	}, nil
+}
+
+// Bind creates credentials for an instance. Repeating an identical request
+// returns the recorded credentials.
+func (b *Broker) Bind(
+	ctx context.Context,
+	instanceID, bindingID string,
+	details domain.BindDetails,
+	_ bool,
+) (domain.Binding, error) {
+	if _, err := parseObject(details.RawParameters); err != nil {
+		return domain.Binding{}, err
+	}
+
+	unlock := b.locks.lock(instanceID)
+	defer unlock()
+
+	instance, err := b.getInstance(ctx, instanceID, details.ServiceID, details.PlanID)
+	if errors.Is(err, ErrNotFound) {
+		return domain.Binding{}, apiresponses.ErrInstanceDoesNotExist
+	}
+	if err != nil {
+		return domain.Binding{}, err
+	}
+	if instance.LastOperation.InProgress() {
+		return domain.Binding{}, apiresponses.ErrConcurrentInstanceAccess
+	}
+	if op := instance.LastOperation; op != nil && op.Type == OperationProvision && op.State == domain.Failed {
+		return domain.Binding{}, errInstanceNotReady
+	}
+
+	appGUID := details.AppGUID
+	if appGUID == "" && details.BindResource != nil {
+		appGUID = details.BindResource.AppGuid
+	}
+
+	existing, err := b.store.GetBinding(ctx, instanceID, bindingID)
+	switch {
+	case errors.Is(err, ErrNotFound):
+	case err != nil:
+		return domain.Binding{}, err
+	case existing.AppGUID == appGUID && sameParameters(existing.Parameters, details.RawParameters):
+		return domain.Binding{AlreadyExists: true, Credentials: existing.Credentials}, nil
+	default:
+		return domain.Binding{}, apiresponses.ErrBindingAlreadyExists
+	}
+
+	backend, err := b.backend(instance.ServiceID)
+	if err != nil {
+		return domain.Binding{}, err
+	}
+
+	binding := &Binding{
+		ID:         bindingID,
+		InstanceID: instanceID,
+		AppGUID:    appGUID,
+		Parameters: details.RawParameters,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if v, ok := backend.(BindValidator); ok {
+		if err := v.ValidateBinding(instance, binding); err != nil {
+			return domain.Binding{}, err
+		}
+	}
+
+	err = b.run(ctx, "bind", instance, binding, func(ctx context.Context) error {
+		creds, err := backend.Bind(ctx, instance, binding)
+		binding.Credentials = creds
+		return err
+	})
+	if err != nil {
+		return domain.Binding{}, err
+	}
+
+	if err := b.store.PutBinding(ctx, binding); err != nil {
+		// Do not leave credentials behind that nothing knows about.
+		if unbindErr := backend.Unbind(ctx, instance, binding); unbindErr != nil {
+			b.logger.Error("failed to roll back binding",
+				logging.InstanceID(instanceID),
+				logging.BindingID(bindingID),
+				slog.String(logging.KeyError, unbindErr.Error()),
+			)
+		}
+		return domain.Binding{}, fmt.Errorf("failed to record binding: %w", err)
+	}
+	return domain.Binding{Credentials: binding.Credentials}, nil
+}
+
+// Unbind revokes a binding's credentials and forgets it.
+func (b *Broker) Unbind(
+	ctx context.Context,
+	instanceID, bindingID string,
+	details domain.UnbindDetails,
+	_ bool,
+) (domain.UnbindSpec, error) {
+	unlock := b.locks.lock(instanceID)
+	defer unlock()
+
+	instance, err := b.getInstance(ctx, instanceID, details.ServiceID, details.PlanID)
+	if errors.Is(err, ErrNotFound) {
+		return domain.UnbindSpec{}, apiresponses.ErrBindingDoesNotExist
+	}
+	if err != nil {
+		return domain.UnbindSpec{}, err
+	}
+	backend, err := b.backend(instance.ServiceID)
+	if err != nil {
+		return domain.UnbindSpec{}, err
+	}
+	binding, err := b.store.GetBinding(ctx, instanceID, bindingID)
+	if errors.Is(err, ErrNotFound) {
+		binding, err = b.adoptBinding(ctx, backend, instance, bindingID)
+	}
+	if errors.Is(err, ErrNotFound) {
+		return domain.UnbindSpec{}, apiresponses.ErrBindingDoesNotExist
+	}
+	if err != nil {
+		return domain.UnbindSpec{}, err
+	}
+	// A migration re-creates the bindings it started with and records them
+	// when it finishes, which would bring back one removed meanwhile.
+	if instance.LastOperation.InProgress() {
+		return domain.UnbindSpec{}, apiresponses.ErrConcurrentInstanceAccess
+	}
+
+	err = b.run(ctx, "unbind", instance, binding, func(ctx context.Context) error {
+		return backend.Unbind(ctx, instance, binding)
+	})
+	if err != nil {
+		return domain.UnbindSpec{}, err
+	}
+	if err := b.store.DeleteBinding(ctx, instanceID, bindingID); err != nil {
+		return domain.UnbindSpec{}, fmt.Errorf("failed to forget binding: %w", err)
+	}
+	return domain.UnbindSpec{}, nil
+}
+
+// GetBinding returns the recorded credentials of a binding.
+func (b *Broker) GetBinding(
+	ctx context.Context,
+	instanceID, bindingID string,
+	_ domain.FetchBindingDetails,
+) (domain.GetBindingSpec, error) {
+	binding, err := b.store.GetBinding(ctx, instanceID, bindingID)
+	if errors.Is(err, ErrNotFound) {
+		return domain.GetBindingSpec{}, apiresponses.ErrBindingNotFound
+	}
+	if err != nil {
+		return domain.GetBindingSpec{}, err
+	}
+	return domain.GetBindingSpec{
+		Credentials: binding.Credentials,
+		Parameters:  logging.RedactParameters(binding.Parameters),
+	}, nil
+}
+
+// LastBindingOperation reports bindings as succeeded once recorded;
+// bindings are always created synchronously.
+func (b *Broker) LastBindingOperation(
+	ctx context.Context,
+	instanceID, bindingID string,
+	_ domain.PollDetails,
+) (domain.LastOperation, error) {
+	if _, err := b.store.GetBinding(ctx, instanceID, bindingID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return domain.LastOperation{}, apiresponses.ErrBindingDoesNotExist
+		}
+		return domain.LastOperation{}, err
+	}
+	return domain.LastOperation{State: domain.Succeeded}, nil
+}
+
+// getInstance returns the recorded instance, or adopts it from its backend
+// if it is not recorded. serviceID and planID come from the request.
+func (b *Broker) getInstance(ctx context.Context, instanceID, serviceID, planID string) (*Instance, error) {
+	instance, err := b.store.GetInstance(ctx, instanceID)
+	if errors.Is(err, ErrNotFound) {
+		return b.adoptInstance(ctx, instanceID, serviceID, planID)
+	}
+	return instance, err
+}
+
+// adoptInstance records an instance that the store does not know but whose
+// resources exist on its backend, such as one created before the broker
+// kept state. It returns ErrNotFound if the backend does not know the
+// instance either.
+func (b *Broker) adoptInstance(ctx context.Context, instanceID, serviceID, planID string) (*Instance, error) {
+	adopter, ok := b.backends[serviceID].(Adopter)
+	if !ok || planID == "" {
+		return nil, ErrNotFound
+	}
+
+	now := time.Now().UTC()
+	instance := &Instance{
+		ID:        instanceID,
+		ServiceID: serviceID,
+		PlanID:    planID,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	var found bool
+	err := b.run(ctx, "adopt", instance, nil, func(ctx context.Context) error {
+		var err error
+		found, err = adopter.AdoptInstance(ctx, instance)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+
+	instance.LastOperation = newOperation(OperationProvision)
+	instance.LastOperation.finish(nil)
+	if err := b.store.PutInstance(ctx, instance); err != nil {
+		return nil, fmt.Errorf("failed to record instance: %w", err)
+	}
+	b.logger.Info("adopted unrecorded instance",
+		logging.ServiceID(serviceID),
+		logging.InstanceID(instanceID),
+		logging.PlanID(planID),
+	)
+	return instance, nil
+}
+
+// adoptBinding returns a binding that the store does not know but that
+// still has credentials on the instance's backend. Adopted bindings are not
+// recorded; they are only unbound. It returns ErrNotFound if the backend
+// has nothing to revoke.
+func (b *Broker) adoptBinding(ctx context.Context, backend Backend, instance *Instance, bindingID string) (*Binding, error) {
+	adopter, ok := backend.(Adopter)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	binding := &Binding{ID: bindingID, InstanceID: instance.ID, CreatedAt: time.Now().UTC()}
+	var found bool
+	err := b.run(ctx, "adopt", instance, binding, func(ctx context.Context) error {
+		var err error
+		found, err = adopter.AdoptBinding(ctx, instance, binding)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	return binding, nil
+}
+
+func (b *Broker) backend(serviceID string) (Backend, error) {
+	backend, ok := b.backends[serviceID]
+	if !ok {
+		return nil, apiresponses.NewFailureResponse(
+			fmt.Errorf("unknown service ID %s", serviceID), http.StatusBadRequest, "unknown-service-id",
+		)
+	}
+	return backend, nil
+}
+
+// checkPlanChange verifies that planID belongs to the service and that the
+// catalog allows changing plans.
+func (b *Broker) checkPlanChange(serviceID, planID string) error {
+	service := b.backends[serviceID].Service()
+	for _, plan := range service.Plans {
+		if plan.ID != planID {
+			continue
+		}
+		updatable := service.PlanUpdatable
+		if plan.PlanUpdatable != nil {
+			updatable = *plan.PlanUpdatable
+		}
+		if !updatable {
+			return apiresponses.ErrPlanChangeNotSupported
+		}
+		return nil
+	}
+	return apiresponses.NewFailureResponse(
+		fmt.Errorf("unknown plan ID %s", planID), http.StatusBadRequest, "unknown-plan-id",
+	)
+}
+
+// run calls fn with the logging, tracing and metrics shared by every
+// backend operation. fn receives a context carrying the operation logger,
+// available to backends through logging.FromContext.
+func (b *Broker) run(
+	ctx context.Context,
+	name string,
+	instance *Instance,
+	binding *Binding,
+	fn func(ctx context.Context) error,
+) (err error) {
+	logAttrs := []any{
+		logging.ServiceID(instance.ServiceID),
+		logging.InstanceID(instance.ID),
+		logging.PlanID(instance.PlanID),
+		logging.Platform(instance.OrganizationGUID, instance.SpaceGUID),
+	}
+	spanAttrs := []attribute.KeyValue{
+		attribute.String("service_id", instance.ServiceID),
+		attribute.String("instance_id", instance.ID),
+		attribute.String("plan_id", instance.PlanID),
+	}
+	if binding != nil {
+		logAttrs = append(logAttrs, logging.BindingID(binding.ID), logging.Parameters(binding.Parameters))
+		spanAttrs = append(spanAttrs, attribute.String("binding_id", binding.ID))
+	} else {
+		logAttrs = append(logAttrs, logging.Parameters(instance.Parameters))
+	}
+
+	op := logging.Start(ctx, b.logger, name, logAttrs...)
+	ctx, span := tracing.Start(ctx, "broker."+name, spanAttrs...)
+	ctx = logging.NewContext(ctx, op.Logger())
+	start := time.Now()
+	defer func() {
+		observeOperation(instance.ServiceID, name, start, err)
+		tracing.End(span, err)
+		op.End(err)
+	}()
+
+	return fn(ctx)
+}
+
+// startAsync records instance with an in-progress operation and runs fn in
+// the background. Once fn returns, finish records the outcome with the
+// instance lock held. The caller must hold the instance lock.
+func (b *Broker) startAsync(
+	ctx context.Context,
+	name string,
+	instance *Instance,
+	fn func(ctx context.Context) error,
+	finish func(ctx context.Context, err error) error,
+) error {
+	instance.LastOperation = newOperation(name)
+	if err := b.store.PutInstance(ctx, instance); err != nil {
+		return fmt.Errorf("failed to record operation: %w", err)
+	}
+
+	// The operation outlives the request but keeps its trace and
+	// correlation values.
+	ctx = context.WithoutCancel(ctx)
+	operationsTotal.WithLabelValues(instance.ServiceID, name, outcomeAccepted).Inc()
+	inFlight := operationsInFlight.WithLabelValues(instance.ServiceID, name)
+	inFlight.Inc()
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer inFlight.Dec()
+
+		err := b.run(ctx, name, instance, nil, fn)
+
+		unlock := b.locks.lock(instance.ID)
+		defer unlock()
+		if err := finish(ctx, err); err != nil {
+			b.logger.Error("failed to record operation outcome",
+				logging.InstanceID(instance.ID),
+				slog.String(logging.KeyOperation, name),
+				slog.String(logging.KeyError, err.Error()),
+			)
+		}
+		if b.operationDone != nil {
+			b.operationDone(ctx, instance, name, err)
+		}
+	}()
+	return nil
+}
+
+func newOperation(name string) *Operation {
+	now := time.Now().UTC()
+	return &Operation{
+		Type:      name,
+		State:     domain.InProgress,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// finish marks the operation as succeeded or, if err is set, failed.
+func (o *Operation) finish(err error) {
+	o.UpdatedAt = time.Now().UTC()
+	if err != nil {
+		o.State = domain.Failed
+		o.Description = err.Error()
+		return
+	}
+	o.State = domain.Succeeded
+	o.Description = ""
+}
+
+// keyedMutex serializes work per instance ID.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock acquires the lock for key and returns the function releasing it.
+func (m *keyedMutex) lock(key string) func() {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*keyedLock)
+	}
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		m.locks[key] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		m.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
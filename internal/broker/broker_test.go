@@ -0,0 +1,601 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi/v11/domain"
+	"github.com/pivotal-cf/brokerapi/v11/domain/apiresponses"
+)
+
+const (
+	testServiceID = "test-service-id"
+	testPlanID    = "test-plan-id"
+	otherPlanID   = "other-plan-id"
+)
+
+// fakeBackend records the calls made to it. Operations fail with the error
+// registered for them, and Provision waits for release when it is set.
+type fakeBackend struct {
+	mu    sync.Mutex
+	calls []string
+	fail  map[string]error
+	// release, if set, is waited for by Provision and Update.
+	release chan struct{}
+	// existing holds the instances and bindings that exist without being
+	// recorded, for adoption.
+	existing map[string]bool
+	// updated holds the parameters last passed to Update.
+	updated json.RawMessage
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{fail: map[string]error{}, existing: map[string]bool{}}
+}
+
+func (f *fakeBackend) Service() domain.Service {
+	return domain.Service{
+		ID:            testServiceID,
+		Name:          "test",
+		Bindable:      true,
+		PlanUpdatable: true,
+		Plans: []domain.ServicePlan{
+			{ID: testPlanID, Name: "small"},
+			{ID: otherPlanID, Name: "large"},
+		},
+	}
+}
+
+func (f *fakeBackend) record(call string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+	return f.fail[call]
+}
+
+func (f *fakeBackend) wait() {
+	if f.release != nil {
+		<-f.release
+	}
+}
+
+func (f *fakeBackend) Provision(_ context.Context, instance *Instance) error {
+	f.wait()
+	return f.record("provision " + instance.ID)
+}
+
+func (f *fakeBackend) Deprovision(_ context.Context, instance *Instance) error {
+	return f.record("deprovision " + instance.ID)
+}
+
+func (f *fakeBackend) Bind(_ context.Context, instance *Instance, binding *Binding) (map[string]any, error) {
+	if err := f.record("bind " + binding.ID); err != nil {
+		return nil, err
+	}
+	return map[string]any{"user": binding.ID, "instance": instance.ID}, nil
+}
+
+func (f *fakeBackend) Unbind(_ context.Context, _ *Instance, binding *Binding) error {
+	return f.record("unbind " + binding.ID)
+}
+
+func (f *fakeBackend) Update(_ context.Context, instance *Instance, _ *Instance) error {
+	f.wait()
+	f.mu.Lock()
+	f.updated = instance.Parameters
+	f.mu.Unlock()
+	return f.record("update " + instance.ID)
+}
+
+func (f *fakeBackend) Describe(_ context.Context, instance *Instance) (map[string]any, error) {
+	return map[string]any{"name": instance.ID}, nil
+}
+
+func (f *fakeBackend) AdoptInstance(_ context.Context, instance *Instance) (bool, error) {
+	return f.existing[instance.ID], f.record("adopt " + instance.ID)
+}
+
+func (f *fakeBackend) AdoptBinding(_ context.Context, _ *Instance, binding *Binding) (bool, error) {
+	return f.existing[binding.ID], f.record("adopt " + binding.ID)
+}
+
+// takeCalls returns the calls made so far and forgets them.
+func (f *fakeBackend) takeCalls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := f.calls
+	f.calls = nil
+	return calls
+}
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func newTestBroker(t *testing.T, backend Backend, async bool) *Broker {
+	t.Helper()
+	b, err := New(context.Background(), Config{Async: async, Logger: discardLogger}, backend)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(b.Wait)
+	return b
+}
+
+func provisionDetails(params string) domain.ProvisionDetails {
+	return domain.ProvisionDetails{
+		ServiceID:     testServiceID,
+		PlanID:        testPlanID,
+		RawParameters: json.RawMessage(params),
+	}
+}
+
+func bindDetails(appGUID, params string) domain.BindDetails {
+	return domain.BindDetails{
+		ServiceID:     testServiceID,
+		PlanID:        testPlanID,
+		AppGUID:       appGUID,
+		RawParameters: json.RawMessage(params),
+	}
+}
+
+// statusOf returns the HTTP status an error is reported with, or 0 if it
+// is not a failure response.
+func statusOf(err error) int {
+	var failure *apiresponses.FailureResponse
+	if errors.As(err, &failure) {
+		return failure.ValidatedStatusCode(nil)
+	}
+	return 0
+}
+
+func TestProvisionIdempotency(t *testing.T) {
+	tests := []struct {
+		name       string
+		details    domain.ProvisionDetails
+		wantStatus int
+	}{
+		{name: "identical", details: provisionDetails(`{"a": 1, "b": [true]}`)},
+		{name: "reordered", details: provisionDetails(` { "b": [ true ], "a": 1 } `)},
+		{name: "other parameters", details: provisionDetails(`{"a": 2, "b": [true]}`), wantStatus: http.StatusConflict},
+		{name: "other plan", details: domain.ProvisionDetails{
+			ServiceID: testServiceID, PlanID: otherPlanID, RawParameters: json.RawMessage(`{"a": 1, "b": [true]}`),
+		}, wantStatus: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newFakeBackend()
+			b := newTestBroker(t, backend, false)
+			ctx := context.Background()
+			if _, err := b.Provision(ctx, "inst-1", provisionDetails(`{"a": 1, "b": [true]}`), false); err != nil {
+				t.Fatalf("Provision: %v", err)
+			}
+			backend.takeCalls()
+
+			spec, err := b.Provision(ctx, "inst-1", tt.details, false)
+			if tt.wantStatus != 0 {
+				if status := statusOf(err); status != tt.wantStatus {
+					t.Fatalf("repeated Provision error = %v, want status %d", err, tt.wantStatus)
+				}
+			} else if err != nil || !spec.AlreadyExists {
+				t.Fatalf("repeated Provision = %+v, %v, want AlreadyExists", spec, err)
+			}
+			if calls := backend.takeCalls(); len(calls) != 0 {
+				t.Errorf("backend calls = %q, want none", calls)
+			}
+		})
+	}
+}
+
+func TestProvisionRejectsInvalidParameters(t *testing.T) {
+	b := newTestBroker(t, newFakeBackend(), false)
+	for _, params := range []string{`[1]`, `"x"`, `{`} {
+		_, err := b.Provision(context.Background(), "inst-1", provisionDetails(params), false)
+		if status := statusOf(err); status != http.StatusUnprocessableEntity {
+			t.Errorf("Provision with %s: error = %v, want 422", params, err)
+		}
+	}
+}
+
+func TestAsyncProvision(t *testing.T) {
+	backend := newFakeBackend()
+	backend.release = make(chan struct{})
+	b := newTestBroker(t, backend, true)
+	ctx := context.Background()
+
+	spec, err := b.Provision(ctx, "inst-1", provisionDetails(""), true)
+	if err != nil || !spec.IsAsync || spec.OperationData != OperationProvision {
+		t.Fatalf("Provision = %+v, %v, want an asynchronous provision", spec, err)
+	}
+	op, err := b.LastOperation(ctx, "inst-1", domain.PollDetails{})
+	if err != nil || op.State != domain.InProgress {
+		t.Fatalf("LastOperation = %+v, %v, want in progress", op, err)
+	}
+
+	// A repeated request joins the running operation.
+	if spec, err := b.Provision(ctx, "inst-1", provisionDetails(""), true); err != nil || !spec.IsAsync {
+		t.Errorf("repeated Provision = %+v, %v, want IsAsync", spec, err)
+	}
+	if _, err := b.Bind(ctx, "inst-1", "bind-1", bindDetails("app", ""), false); statusOf(err) != http.StatusUnprocessableEntity {
+		t.Errorf("Bind during provision: error = %v, want 422", err)
+	}
+	if _, err := b.Update(ctx, "inst-1", domain.UpdateDetails{ServiceID: testServiceID}, true); statusOf(err) != http.StatusUnprocessableEntity {
+		t.Errorf("Update during provision: error = %v, want 422", err)
+	}
+	if _, err := b.GetInstance(ctx, "inst-1", domain.FetchInstanceDetails{}); statusOf(err) != http.StatusNotFound {
+		t.Errorf("GetInstance during provision: error = %v, want 404", err)
+	}
+
+	close(backend.release)
+	b.Wait()
+	op, err = b.LastOperation(ctx, "inst-1", domain.PollDetails{})
+	if err != nil || op.State != domain.Succeeded {
+		t.Fatalf("LastOperation = %+v, %v, want succeeded", op, err)
+	}
+	if spec, err := b.Provision(ctx, "inst-1", provisionDetails(""), true); err != nil || !spec.AlreadyExists {
+		t.Errorf("Provision after success = %+v, %v, want AlreadyExists", spec, err)
+	}
+}
+
+func TestAsyncProvisionFailure(t *testing.T) {
+	backend := newFakeBackend()
+	backend.fail["provision inst-1"] = errors.New("server unavailable")
+	b := newTestBroker(t, backend, true)
+	ctx := context.Background()
+
+	if _, err := b.Provision(ctx, "inst-1", provisionDetails(""), true); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	b.Wait()
+
+	op, err := b.LastOperation(ctx, "inst-1", domain.PollDetails{})
+	if err != nil || op.State != domain.Failed || op.Description != "server unavailable" {
+		t.Fatalf("LastOperation = %+v, %v, want failed with the backend error", op, err)
+	}
+	if _, err := b.Provision(ctx, "inst-1", provisionDetails(""), true); statusOf(err) != http.StatusConflict {
+		t.Errorf("Provision after failure: error = %v, want 409", err)
+	}
+	if _, err := b.Bind(ctx, "inst-1", "bind-1", bindDetails("app", ""), false); statusOf(err) != http.StatusUnprocessableEntity {
+		t.Errorf("Bind after failed provision: error = %v, want 422", err)
+	}
+	// The failed instance can still be deprovisioned.
+	if _, err := b.Deprovision(ctx, "inst-1", domain.DeprovisionDetails{}, false); err != nil {
+		t.Errorf("Deprovision: %v", err)
+	}
+}
+
+func TestSyncWhenAsyncNotAllowed(t *testing.T) {
+	backend := newFakeBackend()
+	b := newTestBroker(t, backend, true)
+
+	spec, err := b.Provision(context.Background(), "inst-1", provisionDetails(""), false)
+	if err != nil || spec.IsAsync {
+		t.Fatalf("Provision = %+v, %v, want a synchronous provision", spec, err)
+	}
+	if calls := backend.takeCalls(); !slices.Equal(calls, []string{"provision inst-1"}) {
+		t.Errorf("backend calls = %q", calls)
+	}
+}
+
+func TestOperationDone(t *testing.T) {
+	backend := newFakeBackend()
+	backend.fail["update inst-1"] = errors.New("boom")
+
+	type outcome struct {
+		operation string
+		err       string
+	}
+	var mu sync.Mutex
+	var outcomes []outcome
+	b, err := New(context.Background(), Config{
+		Async:  true,
+		Logger: discardLogger,
+		OperationDone: func(_ context.Context, instance *Instance, operation string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			o := outcome{operation: operation}
+			if err != nil {
+				o.err = err.Error()
+			}
+			outcomes = append(outcomes, o)
+		},
+	}, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if _, err := b.Provision(ctx, "inst-1", provisionDetails(""), true); err != nil {
+		t.Fatal(err)
+	}
+	b.Wait()
+	if _, err := b.Update(ctx, "inst-1", domain.UpdateDetails{ServiceID: testServiceID}, true); err != nil {
+		t.Fatal(err)
+	}
+	b.Wait()
+
+	want := []outcome{{operation: OperationProvision}, {operation: OperationUpdate, err: "boom"}}
+	if !slices.Equal(outcomes, want) {
+		t.Errorf("outcomes = %+v, want %+v", outcomes, want)
+	}
+}
+
+func TestUpdateMergesParameters(t *testing.T) {
+	backend := newFakeBackend()
+	b := newTestBroker(t, backend, false)
+	ctx := context.Background()
+
+	if _, err := b.Provision(ctx, "inst-1", provisionDetails(`{"a": 1, "b": 2}`), false); err != nil {
+		t.Fatal(err)
+	}
+	_, err := b.Update(ctx, "inst-1", domain.UpdateDetails{
+		ServiceID:     testServiceID,
+		PlanID:        otherPlanID,
+		RawParameters: json.RawMessage(`{"b": null, "c": 3}`),
+	}, false)
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if !sameParameters(backend.updated, json.RawMessage(`{"a": 1, "c": 3}`)) {
+		t.Errorf("backend saw parameters %s", backend.updated)
+	}
+	instance, err := b.Store().GetInstance(ctx, "inst-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.PlanID != otherPlanID || !sameParameters(instance.Parameters, backend.updated) {
+		t.Errorf("recorded instance = %+v", instance)
+	}
+}
+
+func TestFailedAsyncUpdateKeepsPrevious(t *testing.T) {
+	backend := newFakeBackend()
+	backend.fail["update inst-1"] = errors.New("boom")
+	b := newTestBroker(t, backend, true)
+	ctx := context.Background()
+
+	if _, err := b.Provision(ctx, "inst-1", provisionDetails(`{"a": 1}`), false); err != nil {
+		t.Fatal(err)
+	}
+	details := domain.UpdateDetails{ServiceID: testServiceID, PlanID: otherPlanID, RawParameters: json.RawMessage(`{"a": 2}`)}
+	if _, err := b.Update(ctx, "inst-1", details, true); err != nil {
+		t.Fatal(err)
+	}
+	b.Wait()
+
+	instance, err := b.Store().GetInstance(ctx, "inst-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.PlanID != testPlanID || !sameParameters(instance.Parameters, json.RawMessage(`{"a": 1}`)) {
+		t.Errorf("recorded instance = plan %s, parameters %s, want the previous ones", instance.PlanID, instance.Parameters)
+	}
+	if op := instance.LastOperation; op.Type != OperationUpdate || op.State != domain.Failed {
+		t.Errorf("last operation = %+v, want a failed update", op)
+	}
+}
+
+func TestMergeParameters(t *testing.T) {
+	tests := []struct {
+		name            string
+		current, update string
+		want            string
+		wantErr         bool
+	}{
+		{name: "no update", current: `{"a": 1}`, update: ``, want: `{"a": 1}`},
+		{name: "empty object", current: `{"a": 1}`, update: `{}`, want: `{"a": 1}`},
+		{name: "add", current: `{"a": 1}`, update: `{"b": 2}`, want: `{"a": 1, "b": 2}`},
+		{name: "replace", current: `{"a": {"x": 1}}`, update: `{"a": {"y": 2}}`, want: `{"a": {"y": 2}}`},
+		{name: "remove", current: `{"a": 1, "b": 2}`, update: `{"a": null}`, want: `{"b": 2}`},
+		{name: "remove last", current: `{"a": 1}`, update: `{"a": null}`, want: ``},
+		{name: "from nothing", current: ``, update: `{"a": 1}`, want: `{"a": 1}`},
+		{name: "not an object", current: `{"a": 1}`, update: `[1]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mergeParameters(json.RawMessage(tt.current), json.RawMessage(tt.update))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("mergeParameters = %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mergeParameters: %v", err)
+			}
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("mergeParameters = %s, want nothing", got)
+				}
+				return
+			}
+			if !sameParameters(got, json.RawMessage(tt.want)) {
+				t.Errorf("mergeParameters = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBindIdempotency(t *testing.T) {
+	tests := []struct {
+		name       string
+		details    domain.BindDetails
+		wantStatus int
+	}{
+		{name: "identical", details: bindDetails("app-1", `{"role": "read"}`)},
+		{name: "other parameters", details: bindDetails("app-1", `{"role": "write"}`), wantStatus: http.StatusConflict},
+		{name: "other app", details: bindDetails("app-2", `{"role": "read"}`), wantStatus: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newFakeBackend()
+			b := newTestBroker(t, backend, false)
+			ctx := context.Background()
+			if _, err := b.Provision(ctx, "inst-1", provisionDetails(""), false); err != nil {
+				t.Fatal(err)
+			}
+			first, err := b.Bind(ctx, "inst-1", "bind-1", bindDetails("app-1", `{"role": "read"}`), false)
+			if err != nil {
+				t.Fatalf("Bind: %v", err)
+			}
+			backend.takeCalls()
+
+			again, err := b.Bind(ctx, "inst-1", "bind-1", tt.details, false)
+			if tt.wantStatus != 0 {
+				if status := statusOf(err); status != tt.wantStatus {
+					t.Fatalf("repeated Bind error = %v, want status %d", err, tt.wantStatus)
+				}
+			} else {
+				if err != nil || !again.AlreadyExists {
+					t.Fatalf("repeated Bind = %+v, %v, want AlreadyExists", again, err)
+				}
+				if fmt.Sprint(again.Credentials) != fmt.Sprint(first.Credentials) {
+					t.Errorf("credentials = %v, want %v", again.Credentials, first.Credentials)
+				}
+			}
+			if calls := backend.takeCalls(); len(calls) != 0 {
+				t.Errorf("backend calls = %q, want none", calls)
+			}
+		})
+	}
+}
+
+func TestBindRollsBackOnBackendError(t *testing.T) {
+	backend := newFakeBackend()
+	backend.fail["bind bind-1"] = errors.New("boom")
+	b := newTestBroker(t, backend, false)
+	ctx := context.Background()
+	if _, err := b.Provision(ctx, "inst-1", provisionDetails(""), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Bind(ctx, "inst-1", "bind-1", bindDetails("app", ""), false); err == nil {
+		t.Fatal("Bind succeeded")
+	}
+	if _, err := b.Store().GetBinding(ctx, "inst-1", "bind-1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("binding recorded after a failed bind: %v", err)
+	}
+}
+
+func TestUnknownInstancesAndBindings(t *testing.T) {
+	backend := newFakeBackend()
+	b := newTestBroker(t, backend, false)
+	ctx := context.Background()
+	if _, err := b.Provision(ctx, "inst-1", provisionDetails(""), false); err != nil {
+		t.Fatal(err)
+	}
+	backend.takeCalls()
+
+	tests := []struct {
+		name string
+		call func() error
+		want int
+	}{
+		{name: "deprovision", want: http.StatusGone, call: func() error {
+			_, err := b.Deprovision(ctx, "missing", domain.DeprovisionDetails{ServiceID: testServiceID, PlanID: testPlanID}, false)
+			return err
+		}},
+		{name: "update", want: http.StatusGone, call: func() error {
+			_, err := b.Update(ctx, "missing", domain.UpdateDetails{ServiceID: testServiceID, PlanID: testPlanID}, false)
+			return err
+		}},
+		{name: "bind", want: http.StatusGone, call: func() error {
+			_, err := b.Bind(ctx, "missing", "bind-1", bindDetails("app", ""), false)
+			return err
+		}},
+		{name: "last operation", want: http.StatusGone, call: func() error {
+			_, err := b.LastOperation(ctx, "missing", domain.PollDetails{})
+			return err
+		}},
+		{name: "get instance", want: http.StatusNotFound, call: func() error {
+			_, err := b.GetInstance(ctx, "missing", domain.FetchInstanceDetails{})
+			return err
+		}},
+		{name: "unbind", want: http.StatusGone, call: func() error {
+			_, err := b.Unbind(ctx, "inst-1", "missing", domain.UnbindDetails{ServiceID: testServiceID, PlanID: testPlanID}, false)
+			return err
+		}},
+		{name: "get binding", want: http.StatusNotFound, call: func() error {
+			_, err := b.GetBinding(ctx, "inst-1", "missing", domain.FetchBindingDetails{})
+			return err
+		}},
+		{name: "last binding operation", want: http.StatusGone, call: func() error {
+			_, err := b.LastBindingOperation(ctx, "inst-1", "missing", domain.PollDetails{})
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := statusOf(tt.call()); status != tt.want {
+				t.Errorf("status = %d, want %d", status, tt.want)
+			}
+			for _, call := range backend.takeCalls() {
+				if !slices.Contains([]string{"adopt missing"}, call) {
+					t.Errorf("unexpected backend call %s", call)
+				}
+			}
+		})
+	}
+}
+
+func TestAdoptUnrecordedInstance(t *testing.T) {
+	backend := newFakeBackend()
+	backend.existing["legacy"] = true
+	backend.existing["legacy-bind"] = true
+	b := newTestBroker(t, backend, false)
+	ctx := context.Background()
+
+	if _, err := b.Bind(ctx, "legacy", "bind-1", bindDetails("app", ""), false); err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+	instance, err := b.Store().GetInstance(ctx, "legacy")
+	if err != nil {
+		t.Fatalf("adopted instance not recorded: %v", err)
+	}
+	if instance.ServiceID != testServiceID || instance.PlanID != testPlanID {
+		t.Errorf("adopted instance = %+v, want the request's service and plan", instance)
+	}
+
+	unbind := domain.UnbindDetails{ServiceID: testServiceID, PlanID: testPlanID}
+	if _, err := b.Unbind(ctx, "legacy", "legacy-bind", unbind, false); err != nil {
+		t.Fatalf("Unbind of an unrecorded binding: %v", err)
+	}
+	if _, err := b.Unbind(ctx, "legacy", "gone", unbind, false); statusOf(err) != http.StatusGone {
+		t.Errorf("Unbind of an unknown binding: error = %v, want 410", err)
+	}
+	if _, err := b.Deprovision(ctx, "legacy", domain.DeprovisionDetails{ServiceID: testServiceID, PlanID: testPlanID}, false); err != nil {
+		t.Fatalf("Deprovision: %v", err)
+	}
+
+	want := []string{
+		"adopt legacy", "bind bind-1",
+		"adopt legacy-bind", "unbind legacy-bind",
+		"adopt gone",
+		"deprovision legacy",
+	}
+	if calls := backend.takeCalls(); !slices.Equal(calls, want) {
+		t.Errorf("backend calls = %q, want %q", calls, want)
+	}
+	if _, err := b.Store().GetInstance(ctx, "legacy"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("instance still recorded after Deprovision: %v", err)
+	}
+}
+
+func TestAdoptNeedsServiceAndPlan(t *testing.T) {
+	backend := newFakeBackend()
+	backend.existing["legacy"] = true
+	b := newTestBroker(t, backend, false)
+
+	_, err := b.Deprovision(context.Background(), "legacy", domain.DeprovisionDetails{ServiceID: "other-service", PlanID: testPlanID}, false)
+	if statusOf(err) != http.StatusGone {
+		t.Errorf("Deprovision for another service: error = %v, want 410", err)
+	}
+	if calls := backend.takeCalls(); len(calls) != 0 {
+		t.Errorf("backend calls = %q, want none", calls)
+	}
+}
@@ -0,0 +1,42 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	operationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "broker_operations_total",
+		Help: "Broker operations by service, operation and outcome.",
+	}, []string{"service", "operation", "outcome"})
+
+	operationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "broker_operation_duration_seconds",
+		Help:    "Time spent in backend operations.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"service", "operation"})
+
+	operationsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "broker_async_operations_in_flight",
+		Help: "Asynchronous operations currently running in the background.",
+	}, []string{"service", "operation"})
+)
+
+// Outcomes recorded by broker_operations_total.
+const (
+	outcomeSucceeded = "succeeded"
+	outcomeFailed    = "failed"
+	outcomeAccepted  = "accepted"
+)
+
+func observeOperation(service, operation string, start time.Time, err error) {
+	outcome := outcomeSucceeded
+	if err != nil {
+		outcome = outcomeFailed
+	}
+	operationsTotal.WithLabelValues(service, operation, outcome).Inc()
+	operationDuration.WithLabelValues(service, operation).Observe(time.Since(start).Seconds())
+}
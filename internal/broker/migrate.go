@@ -0,0 +1,309 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi/v11/domain"
+	"github.com/pivotal-cf/brokerapi/v11/domain/apiresponses"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+)
+
+// OperationMigrate is the operation type recorded while an instance moves
+// to another server.
+const OperationMigrate = "migrate"
+
+// Migrator is implemented by server backends that can move an instance to
+// another server of the same kind.
+type Migrator interface {
+	// MigrateTo copies the data of instance to target, where targetInstance
+	// has already been provisioned and bound. progress reports what is
+	// happening in a few words; it is shown through LastOperation.
+	MigrateTo(ctx context.Context, instance *Instance, target Backend, targetInstance *Instance, progress func(string)) error
+
+	// RemoveMigrated deletes what is left of instance on this server once
+	// it has been migrated away, including data Deprovision would refuse
+	// to delete.
+	RemoveMigrated(ctx context.Context, instance *Instance) error
+}
+
+// Migrate moves an instance to the named server of its pool in the
+// background. Bindings are re-created on the target and their recorded
+// credentials replaced; apps must be restaged or rebound to pick them up.
+// Progress and the outcome are reported through LastOperation.
+//
+// Apps keep their access to the source while the data is copied, and
+// writes made after the copy has started are not carried over, so they
+// should be stopped first. The source is only removed once the instance
+// has been recorded on the target.
+func (b *Broker) Migrate(ctx context.Context, instanceID, server string) error {
+	unlock := b.locks.lock(instanceID)
+	defer unlock()
+
+	instance, err := b.store.GetInstance(ctx, instanceID)
+	if errors.Is(err, ErrNotFound) {
+		return errInstanceNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if instance.LastOperation.InProgress() {
+		return apiresponses.ErrConcurrentInstanceAccess
+	}
+	if op := instance.LastOperation; op != nil && op.Type == OperationProvision && op.State != domain.Succeeded {
+		return errInstanceNotReady
+	}
+
+	backend, err := b.backend(instance.ServiceID)
+	if err != nil {
+		return err
+	}
+	pool, ok := backend.(*Pool)
+	if !ok {
+		return migrationError("service %s is not served by a server pool", instance.ServiceID)
+	}
+	if err := pool.checkTarget(ctx, instance, server); err != nil {
+		return err
+	}
+
+	bindings, err := b.store.ListBindings(ctx, instanceID)
+	if err != nil {
+		return fmt.Errorf("failed to load bindings: %w", err)
+	}
+
+	migrate := func(ctx context.Context) error {
+		progress := func(msg string) { b.reportProgress(ctx, instanceID, msg) }
+		moved, movedBindings, err := pool.migrate(ctx, instance, bindings, server, progress)
+		if err != nil {
+			return err
+		}
+		// The new placement is recorded before anything is removed from
+		// the source, so that a failure or crash from here on leaves the
+		// store pointing at a complete copy.
+		if err := b.recordMigrated(ctx, moved, bindings, movedBindings); err != nil {
+			pool.discardMigrated(ctx, moved, movedBindings)
+			return err
+		}
+		source := *instance
+		sourceBindings := make([]*Binding, len(bindings))
+		for i, binding := range bindings {
+			previous := *binding
+			sourceBindings[i] = &previous
+			*binding = *movedBindings[i]
+		}
+		*instance = *moved
+		progress("removing instance from " + source.Attribute(AttrServer))
+		pool.removeMigrated(ctx, &source, sourceBindings)
+		return nil
+	}
+	return b.startAsync(ctx, OperationMigrate, instance, migrate, func(ctx context.Context, err error) error {
+		instance.LastOperation.finish(err)
+		if err == nil {
+			instance.LastOperation.Description = "migrated to " + server
+		}
+		return b.store.PutInstance(ctx, instance)
+	})
+}
+
+// recordMigrated records the bindings and instance moved by a migration.
+// If that fails, the bindings already written are put back, so the store
+// still describes the instance on its source server.
+func (b *Broker) recordMigrated(ctx context.Context, moved *Instance, bindings, movedBindings []*Binding) error {
+	unlock := b.locks.lock(moved.ID)
+	defer unlock()
+
+	restore := func(n int) {
+		for _, binding := range bindings[:n] {
+			if err := b.store.PutBinding(ctx, binding); err != nil {
+				b.logger.Error("failed to restore binding after a failed migration",
+					logging.BindingID(binding.ID), slog.String(logging.KeyError, err.Error()))
+			}
+		}
+	}
+	for i, binding := range movedBindings {
+		if err := b.store.PutBinding(ctx, binding); err != nil {
+			restore(i)
+			return fmt.Errorf("failed to record binding %s: %w", binding.ID, err)
+		}
+	}
+	if err := b.store.PutInstance(ctx, moved); err != nil {
+		restore(len(bindings))
+		return fmt.Errorf("failed to record instance: %w", err)
+	}
+	return nil
+}
+
+// reportProgress updates the description of an in-progress operation.
+func (b *Broker) reportProgress(ctx context.Context, instanceID, msg string) {
+	unlock := b.locks.lock(instanceID)
+	defer unlock()
+
+	instance, err := b.store.GetInstance(ctx, instanceID)
+	if err != nil || !instance.LastOperation.InProgress() {
+		return
+	}
+	instance.LastOperation.Description = msg
+	instance.LastOperation.UpdatedAt = time.Now().UTC()
+	if err := b.store.PutInstance(ctx, instance); err != nil {
+		b.logger.Warn("failed to record progress",
+			logging.InstanceID(instanceID), slog.String(logging.KeyError, err.Error()))
+	}
+}
+
+func migrationError(format string, args ...any) error {
+	return apiresponses.NewFailureResponse(
+		fmt.Errorf(format, args...), http.StatusBadRequest, "invalid-migration",
+	)
+}
+
+// checkTarget verifies that instance can move to the named server.
+func (p *Pool) checkTarget(ctx context.Context, instance *Instance, name string) error {
+	source, err := p.server(instance)
+	if err != nil {
+		return err
+	}
+	target, ok := p.byName[name]
+	switch {
+	case !ok:
+		return migrationError("unknown server %q", name)
+	case target == source:
+		return migrationError("instance is already on server %s", name)
+	case target.Draining:
+		return migrationError("server %s is draining", name)
+	}
+	for _, server := range []*Server{source, target} {
+		if _, ok := server.Backend.(Migrator); !ok {
+			return migrationError("server %s does not support migration", server.Name)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	loads, err := p.loadsLocked(ctx, instance.ID)
+	if err != nil {
+		return err
+	}
+	if target.Capacity > 0 && loads[target.Name] >= target.Capacity {
+		return migrationError("server %s is at capacity", name)
+	}
+	return nil
+}
+
+// migrate provisions and binds a copy of instance on the target server
+// and copies its data there. It returns the copy and its bindings, in the
+// order of bindings, without changing instance or removing anything from
+// the source; the caller records the copy, then calls removeMigrated or,
+// if that fails, discardMigrated.
+func (p *Pool) migrate(ctx context.Context, instance *Instance, bindings []*Binding, targetName string, progress func(string)) (*Instance, []*Binding, error) {
+	source, err := p.server(instance)
+	if err != nil {
+		return nil, nil, err
+	}
+	target := p.byName[targetName]
+	migrator, ok := source.Backend.(Migrator)
+	if !ok {
+		return nil, nil, fmt.Errorf("server %s does not support migration", source.Name)
+	}
+
+	moved, err := clone(instance)
+	if err != nil {
+		return nil, nil, err
+	}
+	moved.SetAttribute(AttrServer, target.Name)
+	moved.LastOperation = instance.LastOperation
+
+	progress("provisioning on " + target.Name)
+	if err := target.Backend.Provision(ctx, moved); err != nil {
+		return nil, nil, fmt.Errorf("failed to provision on %s: %w", target.Name, err)
+	}
+
+	var movedBindings []*Binding
+	progress(fmt.Sprintf("creating %d bindings on %s", len(bindings), target.Name))
+	for _, binding := range bindings {
+		next, err := clone(binding)
+		if err != nil {
+			p.discardMigrated(ctx, moved, movedBindings)
+			return nil, nil, err
+		}
+		next.Attributes = nil
+		if next.Credentials, err = target.Backend.Bind(ctx, moved, next); err != nil {
+			p.discardMigrated(ctx, moved, movedBindings)
+			return nil, nil, fmt.Errorf("failed to re-create binding %s: %w", binding.ID, err)
+		}
+		movedBindings = append(movedBindings, next)
+	}
+
+	progress("copying data from " + source.Name + " to " + target.Name)
+	if err := migrator.MigrateTo(ctx, instance, target.Backend, moved, progress); err != nil {
+		p.discardMigrated(ctx, moved, movedBindings)
+		return nil, nil, fmt.Errorf("failed to copy data: %w", err)
+	}
+	return moved, movedBindings, nil
+}
+
+// discardMigrated removes an unrecorded copy made by migrate from its
+// target server. Failures are logged.
+func (p *Pool) discardMigrated(ctx context.Context, moved *Instance, bindings []*Binding) {
+	logger := logging.FromContext(ctx)
+
+	target, err := p.server(moved)
+	if err != nil {
+		logger.Warn("failed to remove instance from migration target", slog.String(logging.KeyError, err.Error()))
+		return
+	}
+	for _, binding := range bindings {
+		if err := target.Backend.Unbind(ctx, moved, binding); err != nil {
+			logger.Warn("failed to remove binding from migration target",
+				logging.BindingID(binding.ID), slog.String(logging.KeyError, err.Error()))
+		}
+	}
+	remove := target.Backend.Deprovision
+	if m, ok := target.Backend.(Migrator); ok {
+		remove = m.RemoveMigrated
+	}
+	if err := remove(ctx, moved); err != nil {
+		logger.Warn("failed to remove instance from migration target",
+			slog.String(AttrServer, target.Name), slog.String(logging.KeyError, err.Error()))
+	}
+}
+
+// removeMigrated removes instance and its bindings from the server it was
+// migrated away from, once the copy has been recorded. Failures leave
+// garbage on the source but do not fail the migration; they are logged.
+func (p *Pool) removeMigrated(ctx context.Context, instance *Instance, bindings []*Binding) {
+	logger := logging.FromContext(ctx)
+
+	source, err := p.server(instance)
+	if err != nil {
+		logger.Warn("failed to remove instance from migration source", slog.String(logging.KeyError, err.Error()))
+		return
+	}
+	var leftovers []string
+	// Data goes first, so that roles or users owning objects in it can be
+	// dropped afterwards.
+	if m, ok := source.Backend.(Migrator); !ok {
+		leftovers = append(leftovers, "instance data")
+	} else if err := m.RemoveMigrated(ctx, instance); err != nil {
+		leftovers = append(leftovers, "instance data")
+		logger.Warn("failed to remove instance from migration source",
+			slog.String(AttrServer, source.Name), slog.String(logging.KeyError, err.Error()))
+	}
+	for _, binding := range bindings {
+		if err := source.Backend.Unbind(ctx, instance, binding); err != nil {
+			leftovers = append(leftovers, "binding "+binding.ID)
+			logger.Warn("failed to remove binding from migration source",
+				logging.BindingID(binding.ID), slog.String(logging.KeyError, err.Error()))
+		}
+	}
+	if len(leftovers) > 0 {
+		logger.Warn("migration left data on the source server",
+			slog.String(AttrServer, source.Name), slog.String("leftovers", strings.Join(leftovers, ", ")))
+		return
+	}
+	logger.Info("migrated instance", slog.String("from", source.Name), logging.InstanceID(instance.ID))
+}
@@ -0,0 +1,198 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi/v11/domain"
+)
+
+// fakeMigrator is a pool server backend that supports migration.
+type fakeMigrator struct {
+	*fakeBackend
+	name  string
+	store Store
+
+	mu sync.Mutex
+	// removedWhileOn records, for each RemoveMigrated call, the server the
+	// store placed the instance on at that time.
+	removedWhileOn []string
+}
+
+func newFakeMigrator(name string) *fakeMigrator {
+	return &fakeMigrator{fakeBackend: newFakeBackend(), name: name}
+}
+
+func (f *fakeMigrator) Bind(ctx context.Context, instance *Instance, binding *Binding) (map[string]any, error) {
+	credentials, err := f.fakeBackend.Bind(ctx, instance, binding)
+	if err != nil {
+		return nil, err
+	}
+	credentials["server"] = f.name
+	return credentials, nil
+}
+
+func (f *fakeMigrator) MigrateTo(_ context.Context, instance *Instance, _ Backend, _ *Instance, _ func(string)) error {
+	return f.record("migrate " + instance.ID)
+}
+
+func (f *fakeMigrator) RemoveMigrated(ctx context.Context, instance *Instance) error {
+	if recorded, err := f.store.GetInstance(ctx, instance.ID); err == nil {
+		f.mu.Lock()
+		f.removedWhileOn = append(f.removedWhileOn, recorded.Attribute(AttrServer))
+		f.mu.Unlock()
+	}
+	return f.record("remove " + instance.ID)
+}
+
+// failingStore fails PutInstance for instances placed on one server.
+type failingStore struct {
+	*MemoryStore
+	failOn string
+}
+
+func (s *failingStore) PutInstance(ctx context.Context, instance *Instance) error {
+	if s.failOn != "" && instance.Attribute(AttrServer) == s.failOn {
+		return errors.New("disk full")
+	}
+	return s.MemoryStore.PutInstance(ctx, instance)
+}
+
+// newMigrationBroker returns a broker over a pool of servers a and b, with
+// instance inst-1 and binding bind-1 on a.
+func newMigrationBroker(t *testing.T) (*Broker, *failingStore, *fakeMigrator, *fakeMigrator) {
+	t.Helper()
+	store := &failingStore{MemoryStore: NewMemoryStore()}
+	a, b := newFakeMigrator("a"), newFakeMigrator("b")
+	a.store, b.store = store, store
+	pool, err := NewPool(StrategyLeastLoaded, nil,
+		&Server{Name: "a", Backend: a},
+		&Server{Name: "b", Backend: b, Capacity: 1},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	brk, err := New(context.Background(), Config{Store: store, Logger: discardLogger}, pool)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(brk.Wait)
+
+	ctx := context.Background()
+	if _, err := brk.Provision(ctx, "inst-1", provisionDetails(""), false); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	if _, err := brk.Bind(ctx, "inst-1", "bind-1", bindDetails("app", ""), false); err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+	a.takeCalls()
+	b.takeCalls()
+	return brk, store, a, b
+}
+
+func TestMigrate(t *testing.T) {
+	brk, store, a, b := newMigrationBroker(t)
+	ctx := context.Background()
+
+	if err := brk.Migrate(ctx, "inst-1", "b"); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	brk.Wait()
+
+	instance, err := store.GetInstance(ctx, "inst-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := instance.Attribute(AttrServer); got != "b" {
+		t.Errorf("instance is on server %q, want b", got)
+	}
+	if op := instance.LastOperation; op.State != domain.Succeeded || op.Description != "migrated to b" {
+		t.Errorf("last operation = %+v, want a succeeded migration", op)
+	}
+	binding, err := store.GetBinding(ctx, "inst-1", "bind-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := binding.Credentials["server"]; got != "b" {
+		t.Errorf("binding credentials are from server %v, want b", got)
+	}
+
+	if got, want := b.takeCalls(), []string{"provision inst-1", "bind bind-1"}; !slices.Equal(got, want) {
+		t.Errorf("target calls = %q, want %q", got, want)
+	}
+	if got, want := a.takeCalls(), []string{"migrate inst-1", "remove inst-1", "unbind bind-1"}; !slices.Equal(got, want) {
+		t.Errorf("source calls = %q, want %q", got, want)
+	}
+	if got := a.removedWhileOn; !slices.Equal(got, []string{"b"}) {
+		t.Errorf("source removed while the instance was recorded on %q, want it recorded on b first", got)
+	}
+}
+
+func TestMigrateFailureKeepsSource(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(store *failingStore, a, b *fakeMigrator)
+		target  []string
+	}{
+		{
+			name:    "copy fails",
+			prepare: func(_ *failingStore, a, _ *fakeMigrator) { a.fail["migrate inst-1"] = errors.New("connection reset") },
+			target:  []string{"provision inst-1", "bind bind-1", "unbind bind-1", "remove inst-1"},
+		},
+		{
+			name:    "bind fails",
+			prepare: func(_ *failingStore, _, b *fakeMigrator) { b.fail["bind bind-1"] = errors.New("too many users") },
+			target:  []string{"provision inst-1", "bind bind-1", "remove inst-1"},
+		},
+		{
+			name:    "recording fails",
+			prepare: func(store *failingStore, _, _ *fakeMigrator) { store.failOn = "b" },
+			target:  []string{"provision inst-1", "bind bind-1", "unbind bind-1", "remove inst-1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			brk, store, a, b := newMigrationBroker(t)
+			ctx := context.Background()
+			before, err := store.GetBinding(ctx, "inst-1", "bind-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.prepare(store, a, b)
+
+			if err := brk.Migrate(ctx, "inst-1", "b"); err != nil {
+				t.Fatalf("Migrate: %v", err)
+			}
+			brk.Wait()
+
+			instance, err := store.GetInstance(ctx, "inst-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := instance.Attribute(AttrServer); got != "a" {
+				t.Errorf("instance is on server %q, want a", got)
+			}
+			if instance.LastOperation.State != domain.Failed {
+				t.Errorf("last operation = %+v, want failed", instance.LastOperation)
+			}
+			binding, err := store.GetBinding(ctx, "inst-1", "bind-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := binding.Credentials["server"]; got != before.Credentials["server"] {
+				t.Errorf("binding credentials are from server %v, want %v", got, before.Credentials["server"])
+			}
+			if got := b.takeCalls(); !slices.Equal(got, tt.target) {
+				t.Errorf("target calls = %q, want %q", got, tt.target)
+			}
+			for _, call := range a.takeCalls() {
+				if call == "remove inst-1" || call == "unbind bind-1" {
+					t.Errorf("source was cleaned up after a failed migration: %s", call)
+				}
+			}
+		})
+	}
+}
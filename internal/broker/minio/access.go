@@ -0,0 +1,162 @@
+package minio
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/cors"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+)
+
+// PlanFeatures are the parameters operators can disable per plan. Plans
+// without an entry allow everything.
+type PlanFeatures struct {
+	// CORS allows the cors parameter.
+	CORS bool
+	// PublicRead allows the public_read_prefixes parameter.
+	PublicRead bool
+}
+
+var allFeatures = PlanFeatures{CORS: true, PublicRead: true}
+
+// Limits on the access parameters.
+const (
+	maxCORSRules          = 100
+	maxPublicReadPrefixes = 20
+)
+
+var corsMethods = []string{http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete, http.MethodHead}
+
+// corsRule is one rule of the cors parameter.
+type corsRule struct {
+	AllowedOrigins []string `json:"allowed_origins"`
+	AllowedMethods []string `json:"allowed_methods"`
+	AllowedHeaders []string `json:"allowed_headers,omitempty"`
+	ExposeHeaders  []string `json:"expose_headers,omitempty"`
+	MaxAgeSeconds  int      `json:"max_age_seconds,omitempty"`
+}
+
+// features returns the parameters the instance's plan allows.
+func (b *Backend) features(instance *broker.Instance) PlanFeatures {
+	if f, ok := b.plans[instance.PlanID]; ok {
+		return f
+	}
+	return allFeatures
+}
+
+// validateAccess checks the cors and public_read_prefixes parameters and
+// that the plan allows them.
+func validateAccess(p params, features PlanFeatures) error {
+	if len(p.CORS) > 0 && !features.CORS {
+		return broker.InvalidParameters("cors is not available on this plan")
+	}
+	if len(p.PublicReadPrefixes) > 0 && !features.PublicRead {
+		return broker.InvalidParameters("public_read_prefixes is not available on this plan")
+	}
+
+	if len(p.CORS) > maxCORSRules {
+		return broker.InvalidParameters("cors allows at most %d rules", maxCORSRules)
+	}
+	for i, r := range p.CORS {
+		if len(r.AllowedOrigins) == 0 || len(r.AllowedMethods) == 0 {
+			return broker.InvalidParameters("cors rule %d: allowed_origins and allowed_methods are required", i+1)
+		}
+		for _, origin := range r.AllowedOrigins {
+			if origin == "" || strings.Count(origin, "*") > 1 {
+				return broker.InvalidParameters("cors rule %d: invalid origin %q", i+1, origin)
+			}
+		}
+		for _, method := range r.AllowedMethods {
+			if !slices.Contains(corsMethods, method) {
+				return broker.InvalidParameters("cors rule %d: method %q must be one of %s",
+					i+1, method, strings.Join(corsMethods, ", "))
+			}
+		}
+		if r.MaxAgeSeconds < 0 {
+			return broker.InvalidParameters("cors rule %d: max_age_seconds must not be negative", i+1)
+		}
+	}
+
+	if len(p.PublicReadPrefixes) > maxPublicReadPrefixes {
+		return broker.InvalidParameters("public_read_prefixes allows at most %d prefixes", maxPublicReadPrefixes)
+	}
+	for _, prefix := range p.PublicReadPrefixes {
+		// An empty prefix would publish the whole bucket, and wildcards
+		// would widen the policy beyond the prefix.
+		if prefix == "" || strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, "*?$") || len(prefix) > 1024 {
+			return broker.InvalidParameters("public_read_prefixes: invalid prefix %q", prefix)
+		}
+	}
+	return nil
+}
+
+// applyCORS replaces the CORS configuration of a bucket.
+func (b *Backend) applyCORS(ctx context.Context, client *minio.Client, bucketName string, rules []corsRule) error {
+	var config *cors.Config
+	if len(rules) > 0 {
+		config = &cors.Config{}
+		for _, r := range rules {
+			config.CORSRules = append(config.CORSRules, cors.Rule{
+				AllowedOrigin: r.AllowedOrigins,
+				AllowedMethod: r.AllowedMethods,
+				AllowedHeader: r.AllowedHeaders,
+				ExposeHeader:  r.ExposeHeaders,
+				MaxAgeSeconds: r.MaxAgeSeconds,
+			})
+		}
+	}
+
+	ctx, span := b.startCall(ctx, "SetBucketCors", bucketName)
+	err := client.SetBucketCors(ctx, bucketName, config)
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to set CORS configuration of bucket %s: %w", bucketName, err)
+	}
+	return nil
+}
+
+// publicReadPolicy returns a bucket policy that lets anyone get the objects
+// under prefixes, and nothing else; listing stays private.
+func publicReadPolicy(bucketName string, prefixes []string) (string, error) {
+	resources := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		resources = append(resources, "arn:aws:s3:::"+bucketName+"/"+prefix+"*")
+	}
+	policy, err := json.Marshal(map[string]any{
+		"Version": "2012-10-17",
+		"Statement": []map[string]any{{
+			"Sid":       "PublicRead",
+			"Effect":    "Allow",
+			"Principal": map[string]any{"AWS": []string{"*"}},
+			"Action":    []string{"s3:GetObject"},
+			"Resource":  resources,
+		}},
+	})
+	return string(policy), err
+}
+
+// applyPublicRead replaces the bucket policy with one granting anonymous
+// read on prefixes, or removes it if there are none.
+func (b *Backend) applyPublicRead(ctx context.Context, client *minio.Client, bucketName string, prefixes []string) error {
+	var policy string
+	if len(prefixes) > 0 {
+		var err error
+		if policy, err = publicReadPolicy(bucketName, prefixes); err != nil {
+			return fmt.Errorf("failed to encode bucket policy: %w", err)
+		}
+	}
+
+	ctx, span := b.startCall(ctx, "SetBucketPolicy", bucketName)
+	err := client.SetBucketPolicy(ctx, bucketName, policy)
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to set policy of bucket %s: %w", bucketName, err)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package minio
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/minio/madmin-go/v3"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+)
+
+var _ broker.Adopter = (*Backend)(nil)
+
+// AdoptInstance reports whether the instance's default bucket exists.
+// Buckets are named after the instance ID, as the broker named them before
+// it kept state.
+func (b *Backend) AdoptInstance(ctx context.Context, instance *broker.Instance) (bool, error) {
+	exists, err := b.bucketExists(ctx, b.client(), b.bucketName(instance.ID))
+	if err != nil {
+		return false, fmt.Errorf("failed to check bucket existence: %w", err)
+	}
+	return exists, nil
+}
+
+// AdoptBinding looks up the user attached to the binding's policy and
+// records both, so that Unbind removes them. Bindings made before the broker
+// kept state were handed keys that MinIO never knew of, so they have
+// nothing to revoke.
+func (b *Backend) AdoptBinding(ctx context.Context, instance *broker.Instance, binding *broker.Binding) (bool, error) {
+	name := policyName(binding.ID)
+	callCtx, span := b.startCall(ctx, "GetPolicyEntities", b.bucketName(instance.ID))
+	entities, err := b.adminClient().GetPolicyEntities(callCtx, madmin.PolicyEntitiesQuery{Policy: []string{name}})
+	tracing.End(span, err)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up policy %s: %w", name, err)
+	}
+	for _, mapping := range entities.PolicyMappings {
+		if mapping.Policy != name {
+			continue
+		}
+		binding.SetAttribute(attrPolicy, name)
+		if len(mapping.Users) > 0 {
+			binding.SetAttribute(attrAccessKey, mapping.Users[0])
+		}
+		return true, nil
+	}
+	return false, nil
+}
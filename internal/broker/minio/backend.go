@@ -0,0 +1,547 @@
+package minio
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/minio/madmin-go/v3"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/pivotal-cf/brokerapi/v11/domain"
+	"github.com/pivotal-cf/brokerapi/v11/domain/apiresponses"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tlsutil"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Service and plan IDs offered in the catalog.
+const (
+	ServiceID    = "minio-local-service-id"
+	SharedPlanID = "minio-local-shared-plan-id"
+)
+
+var (
+	_ broker.Backend        = (*Backend)(nil)
+	_ broker.Validator      = (*Backend)(nil)
+	_ broker.BindValidator  = (*Backend)(nil)
+	_ broker.BindingUpdater = (*Backend)(nil)
+)
+
+// Backend implements broker.Backend for MinIO.
+// It provisions buckets and access keys on a shared MinIO instance.
+type Backend struct {
+	endpoint string
+	useSSL   bool
+	// publicEndpoint and publicSSL are how apps and browsers outside the
+	// cluster reach the server; they default to endpoint and useSSL.
+	publicEndpoint string
+	publicSSL      bool
+	region         string
+	// ca is the PEM bundle of extra certificate authorities, and
+	// insecure disables certificate verification; both are passed on in
+	// binding credentials.
+	ca       []byte
+	insecure bool
+
+	// transport is shared by the clients, which are created once by New
+	// and used for every call.
+	transport  http.RoundTripper
+	dataClient *minio.Client
+	admin      *madmin.AdminClient
+
+	// snapshotsBucket and snapshotsPrefix locate the instance snapshots
+	// on the server.
+	snapshotsBucket string
+	snapshotsPrefix string
+
+	// encryption holds the enabled encryption modes, each offered as a
+	// plan.
+	encryption map[string]bool
+	// plans maps plan IDs to the parameters they allow.
+	plans map[string]PlanFeatures
+	// notificationTarget is the ARN of the webhook target that bucket
+	// notifications are sent to; empty disables notifications.
+	notificationTarget string
+}
+
+// Config holds the settings of a MinIO backend.
+type Config struct {
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+	// PublicEndpoint is the host[:port], or http(s) URL, that reaches
+	// the server from outside the cluster; empty uses Endpoint.
+	PublicEndpoint string
+	// Snapshots is the bucket, optionally followed by a /prefix, that
+	// instance snapshots are kept in.
+	Snapshots string
+	// Encryption lists the default bucket encryption modes
+	// (EncryptionSSES3, EncryptionSSEKMS) to offer plans for; the server
+	// must have a KMS configured for them.
+	Encryption []string
+	// Features maps plan names to the parameters they allow.
+	Features map[string]PlanFeatures
+	// NotificationTarget is the ARN of a webhook target configured on the
+	// server, e.g. arn:minio:sqs::primary:webhook, or empty.
+	NotificationTarget string
+	// Client holds the settings of the broker's connections to the
+	// server.
+	Client ClientConfig
+}
+
+// New creates a new MinIO backend and its clients.
+func New(cfg Config) (*Backend, error) {
+	if cfg.NotificationTarget != "" {
+		if _, err := notification.NewArnFromString(cfg.NotificationTarget); err != nil {
+			return nil, fmt.Errorf("invalid notification target %q: %w", cfg.NotificationTarget, err)
+		}
+	}
+	ca, err := tlsutil.ReadCA(cfg.Client.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	publicEndpoint, publicSSL, err := parseEndpoint(cfg.PublicEndpoint, cfg.UseSSL)
+	if err != nil {
+		return nil, err
+	}
+	if publicEndpoint == "" {
+		publicEndpoint, publicSSL = cfg.Endpoint, cfg.UseSSL
+	}
+
+	bucket, prefix, _ := strings.Cut(cfg.Snapshots, "/")
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		prefix += "/"
+	}
+	modes := make(map[string]bool, len(cfg.Encryption))
+	for _, mode := range cfg.Encryption {
+		modes[mode] = true
+	}
+	b := &Backend{
+		endpoint:        cfg.Endpoint,
+		useSSL:          cfg.UseSSL,
+		publicEndpoint:  publicEndpoint,
+		publicSSL:       publicSSL,
+		region:          cfg.Client.Region,
+		ca:              ca,
+		insecure:        cfg.Client.InsecureSkipVerify,
+		transport:       newTransport(cfg.Client, ca),
+		snapshotsBucket: bucket,
+		snapshotsPrefix: prefix,
+		encryption:      modes,
+		plans:           make(map[string]PlanFeatures, len(cfg.Features)),
+
+		notificationTarget: cfg.NotificationTarget,
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("access key and secret key must be set")
+	}
+	if b.dataClient, b.admin, err = b.newClients(cfg.AccessKey, cfg.SecretKey); err != nil {
+		return nil, err
+	}
+
+	for name, f := range cfg.Features {
+		id := ""
+		for _, plan := range b.Service().Plans {
+			if plan.Name == name {
+				id = plan.ID
+			}
+		}
+		if id == "" {
+			return nil, fmt.Errorf("features for unknown plan %q", name)
+		}
+		b.plans[id] = f
+	}
+	return b, nil
+}
+
+// parseEndpoint splits an endpoint given as host[:port] or as an http(s)
+// URL into the host and whether it uses TLS, which defaults to useSSL.
+func parseEndpoint(endpoint string, useSSL bool) (string, bool, error) {
+	if !strings.Contains(endpoint, "://") {
+		return endpoint, useSSL, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+		return "", false, fmt.Errorf("invalid public endpoint %q: use host[:port] or an http(s) URL without a path", endpoint)
+	}
+	return u.Host, u.Scheme == "https", nil
+}
+
+// startCall starts a client span for a single MinIO API call.
+func (b *Backend) startCall(ctx context.Context, method, bucketName string) (context.Context, trace.Span) {
+	return tracing.StartClient(ctx, "minio "+method,
+		attribute.String("rpc.system", "s3"),
+		attribute.String("rpc.method", method),
+		attribute.String("server.address", b.endpoint),
+		attribute.String("aws.s3.bucket", bucketName),
+	)
+}
+
+func (b *Backend) bucketExists(ctx context.Context, client *minio.Client, bucketName string) (bool, error) {
+	ctx, span := b.startCall(ctx, "BucketExists", bucketName)
+	exists, err := client.BucketExists(ctx, bucketName)
+	tracing.End(span, err)
+	return exists, err
+}
+
+func (b *Backend) makeBucket(ctx context.Context, client *minio.Client, bucketName string, objectLocking bool) error {
+	ctx, span := b.startCall(ctx, "MakeBucket", bucketName)
+	err := client.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{ObjectLocking: objectLocking})
+	tracing.End(span, err)
+	return err
+}
+
+// bucketEmpty reports whether a bucket has no objects.
+func (b *Backend) bucketEmpty(ctx context.Context, client *minio.Client, bucketName string) (bool, error) {
+	ctx, span := b.startCall(ctx, "ListObjects", bucketName)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	empty := true
+	var err error
+	for obj := range client.ListObjects(ctx, bucketName, minio.ListObjectsOptions{MaxKeys: 1, WithVersions: true}) {
+		empty, err = false, obj.Err
+		break
+	}
+	tracing.End(span, err)
+	if err != nil {
+		return false, fmt.Errorf("failed to list bucket %s: %w", bucketName, err)
+	}
+	return empty, nil
+}
+
+func (b *Backend) removeBucket(ctx context.Context, client *minio.Client, bucketName string) error {
+	ctx, span := b.startCall(ctx, "RemoveBucket", bucketName)
+	err := client.RemoveBucket(ctx, bucketName)
+	tracing.End(span, err)
+	return err
+}
+
+func (b *Backend) bucketName(instanceID string) string {
+	// Bucket names must be lowercase, 3-63 characters, no underscores
+	safe := strings.ReplaceAll(instanceID, "_", "-")
+	safe = strings.ToLower(safe)
+	name := "cf-" + safe
+	// Truncate to 63 characters (S3 bucket name limit)
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return name
+}
+
+func generateAccessKey(length int) (string, error) {
+	bytes := make([]byte, length)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate random key: %w", err)
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// Service returns the catalog entry for the MinIO service.
+func (b *Backend) Service() domain.Service {
+	return domain.Service{
+		ID:          ServiceID,
+		Name:        "minio-local",
+		Description: "MinIO object storage on a shared local instance",
+		Bindable:    true,
+		Tags:        []string{"minio", "s3", "object-storage"},
+		Plans: append([]domain.ServicePlan{
+			{
+				ID:          SharedPlanID,
+				Name:        "shared",
+				Description: "Creates a bucket on the shared MinIO instance",
+				Free:        domain.FreeValue(true),
+			},
+		}, b.encryptionPlans()...),
+		Metadata: &domain.ServiceMetadata{
+			DisplayName: "MinIO (Local)",
+			LongDescription: "Provisions a dedicated bucket and credentials on a shared " +
+				"MinIO instance running in the local cluster.",
+		},
+	}
+}
+
+// Validate checks the provision and update parameters.
+func (b *Backend) Validate(instance *broker.Instance) error {
+	p, err := decodeParams(instance)
+	if err != nil {
+		return err
+	}
+	if err := validateAccess(p, b.features(instance)); err != nil {
+		return err
+	}
+	if err := b.validateBuckets(instance.ID, p.Buckets); err != nil {
+		return err
+	}
+	return validateNotifications(p.Notifications, b.notificationTarget)
+}
+
+// Provision creates the buckets for the service instance and applies its
+// parameters to them.
+func (b *Backend) Provision(ctx context.Context, instance *broker.Instance) error {
+	logger := logging.FromContext(ctx)
+	bucketName := b.bucketName(instance.ID)
+	p, err := decodeParams(instance)
+	if err != nil {
+		return err
+	}
+
+	client := b.client()
+
+	// Check if bucket already exists
+	exists, err := b.bucketExists(ctx, client, bucketName)
+	if err != nil {
+		return fmt.Errorf("failed to check bucket existence: %w", err)
+	}
+	if exists {
+		return apiresponses.ErrInstanceAlreadyExists
+	}
+
+	if encryption(instance) == EncryptionSSEKMS {
+		if err := b.ensureKMSKey(ctx, instance); err != nil {
+			return err
+		}
+	}
+
+	// Remove the new, empty buckets if any of them fails, so that
+	// provisioning can be retried.
+	var created []string
+	for _, bucket := range b.buckets(instance.ID, p) {
+		if bucket.Name != "" {
+			exists, err := b.bucketExists(ctx, client, bucket.Bucket)
+			if err != nil {
+				b.removeBuckets(ctx, client, created)
+				return fmt.Errorf("failed to check bucket existence: %w", err)
+			}
+			if exists {
+				b.removeBuckets(ctx, client, created)
+				return bucketExistsError(bucket.Bucket)
+			}
+		}
+		if err := b.createBucket(ctx, client, bucket.Bucket, instance, p); err != nil {
+			b.removeBuckets(ctx, client, created)
+			return err
+		}
+		created = append(created, bucket.Bucket)
+	}
+
+	logger.Info("provisioned bucket", slog.String("bucket", bucketName), slog.String("encryption", encryption(instance)),
+		slog.Bool("versioning", p.versioned()), slog.Bool("object_lock", p.ObjectLock != nil),
+		slog.Any("buckets", p.Buckets))
+	return nil
+}
+
+// Deprovision removes the buckets for the service instance (only if empty),
+// the default bucket last.
+func (b *Backend) Deprovision(ctx context.Context, instance *broker.Instance) error {
+	client := b.client()
+
+	// Parameters were validated when they were recorded.
+	p, _ := decodeParams(instance)
+	buckets := b.buckets(instance.ID, p)
+	for _, bucket := range slices.Backward(buckets) {
+		if err := b.deleteBucket(ctx, client, bucket.Bucket, p); err != nil {
+			return err
+		}
+	}
+
+	logging.FromContext(ctx).Info("deprovisioned bucket", slog.String("bucket", b.bucketName(instance.ID)))
+	return nil
+}
+
+// Bind creates an IAM user whose policy allows access to the provisioned
+// buckets, or only to the objects under the prefix bind parameter.
+func (b *Backend) Bind(ctx context.Context, instance *broker.Instance, binding *broker.Binding) (map[string]any, error) {
+	logger := logging.FromContext(ctx)
+	bucketName := b.bucketName(instance.ID)
+	bp, err := decodeBindParams(binding)
+	if err != nil {
+		return nil, err
+	}
+
+	client := b.client()
+
+	// Verify the bucket exists
+	exists, err := b.bucketExists(ctx, client, bucketName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check bucket existence: %w", err)
+	}
+	if !exists {
+		return nil, apiresponses.ErrInstanceDoesNotExist
+	}
+
+	bindAccessKey, err := generateAccessKey(10)
+	if err != nil {
+		return nil, err
+	}
+	bindSecretKey, err := generateAccessKey(20)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parameters were validated when they were recorded.
+	p, _ := decodeParams(instance)
+	buckets := b.buckets(instance.ID, p)
+	if err := b.createUser(ctx, binding, bucketNames(buckets), bp.Prefix, bindAccessKey, bindSecretKey); err != nil {
+		// Remove what was created so that nothing is left behind.
+		if err := b.removeUser(context.WithoutCancel(ctx), binding, bucketName); err != nil {
+			logger.Warn("failed to remove binding user", slog.String("bucket", bucketName), slog.String(logging.KeyError, err.Error()))
+		}
+		return nil, err
+	}
+
+	logger.Info("created binding", slog.String("bucket", bucketName),
+		slog.String("access_key_prefix", bindAccessKey[:8]), slog.String("prefix", bp.Prefix))
+
+	location := bucketName
+	if bp.Prefix != "" {
+		location += "/" + bp.Prefix
+	}
+	creds := map[string]any{
+		"endpoint":        b.endpoint,
+		"use_ssl":         b.useSSL,
+		"public_endpoint": b.publicEndpoint,
+		"public_use_ssl":  b.publicSSL,
+		"access_key":      bindAccessKey,
+		"secret_key":      bindSecretKey,
+		"bucket":          bucketName,
+		"encryption":      encryption(instance),
+		"uri": fmt.Sprintf("s3://%s:%s@%s/%s",
+			bindAccessKey, bindSecretKey, b.publicEndpoint, location,
+		),
+	}
+	if b.region != "" {
+		creds["region"] = b.region
+	}
+	if len(b.ca) > 0 {
+		creds["ca_certificate"] = string(b.ca)
+	}
+	if b.insecure {
+		creds["insecure_skip_verify"] = true
+	}
+	if bp.Prefix != "" {
+		creds["prefix"] = bp.Prefix
+	}
+	if len(p.Buckets) > 0 {
+		creds["buckets"] = namedBuckets(buckets)
+	}
+	if key := instance.Attribute(attrKMSKey); key != "" {
+		creds["kms_key_id"] = key
+	}
+	return creds, nil
+}
+
+// Unbind removes the IAM user and policy created during binding.
+func (b *Backend) Unbind(ctx context.Context, instance *broker.Instance, binding *broker.Binding) error {
+	bucketName := b.bucketName(instance.ID)
+	if err := b.removeUser(ctx, binding, bucketName); err != nil {
+		return err
+	}
+
+	logging.FromContext(ctx).Info("removed binding", slog.String("bucket", bucketName))
+	return nil
+}
+
+// Update applies changed parameters to the instance's buckets, and adds or
+// removes buckets.
+func (b *Backend) Update(ctx context.Context, instance *broker.Instance, previous *broker.Instance) error {
+	p, err := decodeParams(instance)
+	if err != nil {
+		return err
+	}
+	prev, err := decodeParams(previous)
+	if err != nil {
+		return err
+	}
+	if err := checkVersioningUpdate(p, prev); err != nil {
+		return err
+	}
+
+	client := b.client()
+	return b.updateBuckets(ctx, client, instance, p, prev)
+}
+
+// configureBucket applies the settings of p to a bucket: all of them for a
+// new bucket, or those that differ from prev.
+func (b *Backend) configureBucket(ctx context.Context, client *minio.Client, bucketName string, p params, prev *params) error {
+	changed := func(get func(params) any) bool {
+		if prev == nil {
+			return !reflect.ValueOf(get(p)).IsZero()
+		}
+		return !reflect.DeepEqual(get(p), get(*prev))
+	}
+
+	if changed(func(p params) any { return p.versioned() }) || changed(func(p params) any { return p.ObjectLock }) {
+		if err := b.applyVersioning(ctx, client, bucketName, p); err != nil {
+			return err
+		}
+	}
+	if changed(func(p params) any { return p.Lifecycle }) {
+		if err := b.applyLifecycle(ctx, client, bucketName, p.Lifecycle); err != nil {
+			return err
+		}
+	}
+	if changed(func(p params) any { return p.CORS }) {
+		if err := b.applyCORS(ctx, client, bucketName, p.CORS); err != nil {
+			return err
+		}
+	}
+	if changed(func(p params) any { return p.PublicReadPrefixes }) {
+		if err := b.applyPublicRead(ctx, client, bucketName, p.PublicReadPrefixes); err != nil {
+			return err
+		}
+	}
+	if changed(func(p params) any { return p.Notifications }) {
+		if err := b.applyNotifications(ctx, client, bucketName, p.Notifications); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Describe reports the instance's buckets and their settings.
+func (b *Backend) Describe(_ context.Context, instance *broker.Instance) (map[string]any, error) {
+	// Parameters were validated when they were recorded.
+	p, _ := decodeParams(instance)
+	desc := map[string]any{
+		"endpoint":        b.endpoint,
+		"public_endpoint": b.publicEndpoint,
+		"bucket":          b.bucketName(instance.ID),
+		"encryption":      encryption(instance),
+		"versioning":      p.versioned(),
+	}
+	if key := instance.Attribute(attrKMSKey); key != "" {
+		desc["kms_key_id"] = key
+	}
+	if p.ObjectLock != nil {
+		desc["object_lock"] = p.ObjectLock
+	}
+	if len(p.Lifecycle) > 0 {
+		desc["lifecycle"] = p.Lifecycle
+	}
+	if len(p.CORS) > 0 {
+		desc["cors"] = p.CORS
+	}
+	if len(p.PublicReadPrefixes) > 0 {
+		desc["public_read_prefixes"] = p.PublicReadPrefixes
+	}
+	if len(p.Notifications) > 0 {
+		desc["notifications"] = p.Notifications
+	}
+	if len(p.Buckets) > 0 {
+		desc["buckets"] = namedBuckets(b.buckets(instance.ID, p))
+	}
+	return desc, nil
+}
@@ -0,0 +1,211 @@
+package minio
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/minio/madmin-go/v3"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+)
+
+// Binding attributes recording the IAM user and policy of a binding.
+const (
+	attrAccessKey = "access_key"
+	attrPolicy    = "policy"
+)
+
+// bindParams are the bind parameters.
+type bindParams struct {
+	// Prefix restricts the binding to the objects under it.
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// decodeBindParams decodes and validates the parameters of a binding. A
+// prefix is returned with a trailing slash, so that it names a folder.
+func decodeBindParams(binding *broker.Binding) (bindParams, error) {
+	var p bindParams
+	if err := binding.DecodeParameters(&p); err != nil {
+		return bindParams{}, err
+	}
+	if p.Prefix == "" {
+		return p, nil
+	}
+	// Wildcards would widen the policy beyond the prefix.
+	if strings.HasPrefix(p.Prefix, "/") || strings.ContainsAny(p.Prefix, "*?$") || len(p.Prefix) > 1024 ||
+		strings.Trim(p.Prefix, "/") == "" || strings.Contains(p.Prefix, "//") {
+		return bindParams{}, broker.InvalidParameters("invalid prefix %q", p.Prefix)
+	}
+	for _, segment := range strings.Split(strings.TrimSuffix(p.Prefix, "/"), "/") {
+		if segment == "." || segment == ".." {
+			return bindParams{}, broker.InvalidParameters("invalid prefix %q", p.Prefix)
+		}
+	}
+	p.Prefix = strings.TrimSuffix(p.Prefix, "/") + "/"
+	return p, nil
+}
+
+// ValidateBinding checks the bind parameters.
+func (b *Backend) ValidateBinding(_ *broker.Instance, binding *broker.Binding) error {
+	_, err := decodeBindParams(binding)
+	return err
+}
+
+func policyName(bindingID string) string {
+	return "cf-binding-" + bindingID
+}
+
+// bindingPolicy returns an IAM policy that allows reading and writing the
+// objects of an instance's buckets under prefix, or all of them if prefix is
+// empty, and listing only those. The buckets are listed by name, so that the
+// policy never matches buckets of other instances; UpdateBindings rewrites
+// it when buckets are added or removed.
+func bindingPolicy(bucketNames []string, prefix string) ([]byte, error) {
+	var bucketResources, objectResources []string
+	for _, bucketName := range bucketNames {
+		bucketResources = append(bucketResources, "arn:aws:s3:::"+bucketName)
+		objectResources = append(objectResources, "arn:aws:s3:::"+bucketName+"/"+prefix+"*")
+	}
+	bucket := map[string]any{
+		"Effect":   "Allow",
+		"Action":   []string{"s3:ListBucket", "s3:ListBucketMultipartUploads"},
+		"Resource": bucketResources,
+	}
+	if prefix != "" {
+		bucket["Condition"] = map[string]any{
+			"StringLike": map[string]any{"s3:prefix": []string{prefix + "*"}},
+		}
+	}
+	return json.Marshal(map[string]any{
+		"Version": "2012-10-17",
+		"Statement": []map[string]any{
+			{
+				"Effect":   "Allow",
+				"Action":   []string{"s3:GetBucketLocation"},
+				"Resource": bucketResources,
+			},
+			bucket,
+			{
+				"Effect": "Allow",
+				"Action": []string{
+					"s3:GetObject", "s3:PutObject", "s3:DeleteObject",
+					"s3:AbortMultipartUpload", "s3:ListMultipartUploadParts",
+				},
+				"Resource": objectResources,
+			},
+		},
+	})
+}
+
+// createUser creates the IAM user of a binding with a policy limited to
+// prefix of the instance's buckets, and records both on the binding.
+// bucketNames starts with the default bucket.
+func (b *Backend) createUser(ctx context.Context, binding *broker.Binding, bucketNames []string, prefix, accessKey, secretKey string) error {
+	policy, err := bindingPolicy(bucketNames, prefix)
+	if err != nil {
+		return fmt.Errorf("failed to encode binding policy: %w", err)
+	}
+	admin := b.adminClient()
+	bucketName := bucketNames[0]
+
+	name := policyName(binding.ID)
+	callCtx, span := b.startCall(ctx, "AddCannedPolicy", bucketName)
+	err = admin.AddCannedPolicy(callCtx, name, policy)
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to create policy %s: %w", name, err)
+	}
+	binding.SetAttribute(attrPolicy, name)
+
+	callCtx, span = b.startCall(ctx, "AddUser", bucketName)
+	err = admin.AddUser(callCtx, accessKey, secretKey)
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to create user %s: %w", accessKey, err)
+	}
+	binding.SetAttribute(attrAccessKey, accessKey)
+
+	callCtx, span = b.startCall(ctx, "AttachPolicy", bucketName)
+	_, err = admin.AttachPolicy(callCtx, madmin.PolicyAssociationReq{Policies: []string{name}, User: accessKey})
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to attach policy %s to user %s: %w", name, accessKey, err)
+	}
+	return nil
+}
+
+// removeUser removes the IAM user and policy recorded on a binding. Either
+// may be missing: bindings made before they were created have neither.
+func (b *Backend) removeUser(ctx context.Context, binding *broker.Binding, bucketName string) error {
+	accessKey, name := binding.Attribute(attrAccessKey), binding.Attribute(attrPolicy)
+	if accessKey == "" && name == "" {
+		return nil
+	}
+	admin := b.adminClient()
+
+	if accessKey != "" {
+		callCtx, span := b.startCall(ctx, "RemoveUser", bucketName)
+		err := admin.RemoveUser(callCtx, accessKey)
+		tracing.End(span, err)
+		if err != nil && madmin.ToErrorResponse(err).Code != "XMinioAdminNoSuchUser" {
+			return fmt.Errorf("failed to remove user %s: %w", accessKey, err)
+		}
+	}
+	if name != "" {
+		callCtx, span := b.startCall(ctx, "RemoveCannedPolicy", bucketName)
+		err := admin.RemoveCannedPolicy(callCtx, name)
+		tracing.End(span, err)
+		if err != nil && madmin.ToErrorResponse(err).Code != "XMinioAdminNoSuchPolicy" {
+			return fmt.Errorf("failed to remove policy %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// UpdateBindings rewrites the policies of the instance's bindings when
+// buckets were added or removed, so that they cover exactly the instance's
+// current buckets.
+func (b *Backend) UpdateBindings(ctx context.Context, instance, previous *broker.Instance, bindings []*broker.Binding) error {
+	// Parameters were validated when they were recorded.
+	p, _ := decodeParams(instance)
+	prev, _ := decodeParams(previous)
+	if slices.Equal(p.Buckets, prev.Buckets) {
+		return nil
+	}
+	bucketNames := bucketNames(b.buckets(instance.ID, p))
+	admin := b.adminClient()
+
+	updated := 0
+	for _, binding := range bindings {
+		// Bindings made before users were created per binding have no
+		// policy of their own.
+		name := binding.Attribute(attrPolicy)
+		if name == "" {
+			continue
+		}
+		bp, err := decodeBindParams(binding)
+		if err != nil {
+			return err
+		}
+		policy, err := bindingPolicy(bucketNames, bp.Prefix)
+		if err != nil {
+			return fmt.Errorf("failed to encode binding policy: %w", err)
+		}
+		callCtx, span := b.startCall(ctx, "AddCannedPolicy", bucketNames[0])
+		err = admin.AddCannedPolicy(callCtx, name, policy)
+		tracing.End(span, err)
+		if err != nil {
+			return fmt.Errorf("failed to update policy %s: %w", name, err)
+		}
+		updated++
+	}
+	if updated > 0 {
+		logging.FromContext(ctx).Info("updated binding policies", slog.Int("bindings", updated))
+	}
+	return nil
+}
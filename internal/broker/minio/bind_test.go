@@ -0,0 +1,143 @@
+package minio
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+)
+
+// policyStatement is one statement of a binding policy.
+type policyStatement struct {
+	Action    []string
+	Resource  []string
+	Condition map[string]map[string][]string
+}
+
+func decodePolicy(t *testing.T, data []byte) []policyStatement {
+	t.Helper()
+	var policy struct{ Statement []policyStatement }
+	if err := json.Unmarshal(data, &policy); err != nil {
+		t.Fatalf("invalid policy %s: %v", data, err)
+	}
+	return policy.Statement
+}
+
+// policyResources returns every resource a policy grants access to.
+func policyResources(t *testing.T, data []byte) []string {
+	t.Helper()
+	var resources []string
+	for _, statement := range decodePolicy(t, data) {
+		for _, r := range statement.Resource {
+			if !slices.Contains(resources, r) {
+				resources = append(resources, r)
+			}
+		}
+	}
+	slices.Sort(resources)
+	return resources
+}
+
+func TestBindingPolicyListsBuckets(t *testing.T) {
+	data, err := bindingPolicy([]string{"cf-inst-1", "cf-inst-1-logs"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"arn:aws:s3:::cf-inst-1",
+		"arn:aws:s3:::cf-inst-1-logs",
+		"arn:aws:s3:::cf-inst-1-logs/*",
+		"arn:aws:s3:::cf-inst-1/*",
+	}
+	if got := policyResources(t, data); !slices.Equal(got, want) {
+		t.Errorf("resources = %q, want %q", got, want)
+	}
+	for _, r := range policyResources(t, data) {
+		if strings.Contains(strings.TrimSuffix(r, "/*"), "*") {
+			t.Errorf("resource %s matches buckets by wildcard", r)
+		}
+	}
+}
+
+func TestBindingPolicyPrefix(t *testing.T) {
+	data, err := bindingPolicy([]string{"cf-inst-1"}, "uploads/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"arn:aws:s3:::cf-inst-1", "arn:aws:s3:::cf-inst-1/uploads/*"}
+	if got := policyResources(t, data); !slices.Equal(got, want) {
+		t.Errorf("resources = %q, want %q", got, want)
+	}
+	for _, statement := range decodePolicy(t, data) {
+		if !slices.Contains(statement.Action, "s3:ListBucket") {
+			continue
+		}
+		if got := statement.Condition["StringLike"]["s3:prefix"]; !slices.Equal(got, []string{"uploads/*"}) {
+			t.Errorf("list condition = %q, want uploads/*", got)
+		}
+	}
+}
+
+func TestUpdateBindingsRewritesPolicies(t *testing.T) {
+	s3, srv := newFakeS3(t)
+	b := newTestBackend(t, srv, Config{})
+
+	bindings := []*broker.Binding{
+		{ID: "bind-1", Attributes: map[string]string{attrPolicy: policyName("bind-1")}},
+		{ID: "bind-2", Parameters: json.RawMessage(`{"prefix": "uploads"}`),
+			Attributes: map[string]string{attrPolicy: policyName("bind-2")}},
+		// Made before bindings had their own users.
+		{ID: "bind-3"},
+	}
+	previous := instanceWith(t, "inst-1", params{Buckets: []string{"logs", "old"}})
+	instance := instanceWith(t, "inst-1", params{Buckets: []string{"logs", "new"}})
+	if err := b.UpdateBindings(context.Background(), instance, previous, bindings); err != nil {
+		t.Fatalf("UpdateBindings: %v", err)
+	}
+
+	want := []string{
+		"PUT admin/add-canned-policy cf-binding-bind-1",
+		"PUT admin/add-canned-policy cf-binding-bind-2",
+	}
+	if got := s3.calls(); !slices.Equal(got, want) {
+		t.Errorf("requests = %q, want %q", got, want)
+	}
+
+	buckets := []string{"cf-inst-1", "cf-inst-1-logs", "cf-inst-1-new"}
+	for _, tt := range []struct {
+		binding, prefix string
+	}{
+		{binding: "bind-1", prefix: ""},
+		{binding: "bind-2", prefix: "uploads/"},
+	} {
+		data, err := bindingPolicy(buckets, tt.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := policyResources(t, s3.policy(policyName(tt.binding)))
+		if want := policyResources(t, data); !slices.Equal(got, want) {
+			t.Errorf("%s: resources = %q, want %q", tt.binding, got, want)
+		}
+		if slices.ContainsFunc(got, func(r string) bool { return strings.Contains(r, "cf-inst-1-old") }) {
+			t.Errorf("%s: policy still grants the removed bucket", tt.binding)
+		}
+	}
+}
+
+func TestUpdateBindingsSkipsUnchangedBuckets(t *testing.T) {
+	s3, srv := newFakeS3(t)
+	b := newTestBackend(t, srv, Config{})
+
+	bindings := []*broker.Binding{{ID: "bind-1", Attributes: map[string]string{attrPolicy: policyName("bind-1")}}}
+	previous := instanceWith(t, "inst-1", params{Buckets: []string{"logs"}, PublicReadPrefixes: []string{"public/"}})
+	instance := instanceWith(t, "inst-1", params{Buckets: []string{"logs"}})
+	if err := b.UpdateBindings(context.Background(), instance, previous, bindings); err != nil {
+		t.Fatalf("UpdateBindings: %v", err)
+	}
+	if got := s3.calls(); len(got) != 0 {
+		t.Errorf("requests = %q, want none", got)
+	}
+}
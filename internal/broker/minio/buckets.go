@@ -0,0 +1,263 @@
+package minio
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/tags"
+	"github.com/pivotal-cf/brokerapi/v11/domain/apiresponses"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+)
+
+// maxBuckets limits the buckets parameter.
+const maxBuckets = 10
+
+// tagInstanceID is the bucket tag recording the instance a bucket was
+// created for. Binding users cannot change bucket tags.
+const tagInstanceID = "cf-instance-id"
+
+// bucketNamePattern matches the logical names of the buckets parameter,
+// which become the end of bucket names.
+var bucketNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// bucket is one of the buckets of an instance.
+type bucket struct {
+	// Name is the logical name from the buckets parameter, or empty for
+	// the default bucket.
+	Name string
+	// Bucket is the name of the bucket on the server.
+	Bucket string
+}
+
+// namedBucket returns the server name of a bucket from the buckets
+// parameter: the default bucket's name followed by the logical name.
+func (b *Backend) namedBucket(instanceID, name string) string {
+	return b.bucketName(instanceID) + "-" + name
+}
+
+// buckets returns the default bucket of an instance followed by the buckets
+// named in p.
+func (b *Backend) buckets(instanceID string, p params) []bucket {
+	buckets := []bucket{{Bucket: b.bucketName(instanceID)}}
+	for _, name := range p.Buckets {
+		buckets = append(buckets, bucket{Name: name, Bucket: b.namedBucket(instanceID, name)})
+	}
+	return buckets
+}
+
+// bucketNames returns the server names of buckets.
+func bucketNames(buckets []bucket) []string {
+	names := make([]string, 0, len(buckets))
+	for _, bucket := range buckets {
+		names = append(names, bucket.Bucket)
+	}
+	return names
+}
+
+// namedBuckets maps the logical names of the buckets from the buckets
+// parameter to their server names, as reported in credentials.
+func namedBuckets(buckets []bucket) map[string]string {
+	named := make(map[string]string, len(buckets))
+	for _, bucket := range buckets {
+		if bucket.Name != "" {
+			named[bucket.Name] = bucket.Bucket
+		}
+	}
+	return named
+}
+
+// validateBuckets checks the buckets parameter of an instance.
+func (b *Backend) validateBuckets(instanceID string, names []string) error {
+	if len(names) > maxBuckets {
+		return broker.InvalidParameters("buckets allows at most %d buckets", maxBuckets)
+	}
+	for i, name := range names {
+		if !bucketNamePattern.MatchString(name) {
+			return broker.InvalidParameters("buckets: invalid name %q: use lowercase letters, digits and hyphens", name)
+		}
+		if slices.Contains(names[:i], name) {
+			return broker.InvalidParameters("buckets: duplicate name %q", name)
+		}
+		if bucketName := b.namedBucket(instanceID, name); len(bucketName) > 63 {
+			return broker.InvalidParameters("buckets: name %q is too long: bucket %s exceeds 63 characters", name, bucketName)
+		}
+	}
+	return nil
+}
+
+// bucketExistsError is returned for a bucket that was expected to be new but
+// is already on the server.
+func bucketExistsError(bucketName string) error {
+	return apiresponses.NewFailureResponse(
+		fmt.Errorf("bucket %s already exists and does not belong to this instance", bucketName),
+		http.StatusConflict, "bucket-exists",
+	)
+}
+
+// tagBucket records the instance a bucket was created for.
+func (b *Backend) tagBucket(ctx context.Context, client *minio.Client, bucketName, instanceID string) error {
+	t, err := tags.NewTags(map[string]string{tagInstanceID: instanceID}, false)
+	if err != nil {
+		return fmt.Errorf("failed to tag bucket %s: %w", bucketName, err)
+	}
+	ctx, span := b.startCall(ctx, "SetBucketTagging", bucketName)
+	err = client.SetBucketTagging(ctx, bucketName, t)
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to tag bucket %s: %w", bucketName, err)
+	}
+	return nil
+}
+
+// bucketInstance returns the instance a bucket was created for, or "" if it
+// has no instance tag.
+func (b *Backend) bucketInstance(ctx context.Context, client *minio.Client, bucketName string) (string, error) {
+	ctx, span := b.startCall(ctx, "GetBucketTagging", bucketName)
+	t, err := client.GetBucketTagging(ctx, bucketName)
+	if minio.ToErrorResponse(err).Code == "NoSuchTagSet" {
+		err = nil
+	}
+	tracing.End(span, err)
+	if err != nil {
+		return "", fmt.Errorf("failed to read tags of bucket %s: %w", bucketName, err)
+	}
+	if t == nil {
+		return "", nil
+	}
+	return t.ToMap()[tagInstanceID], nil
+}
+
+// createBucket creates a bucket of an instance, tags it with the instance
+// ID and applies the instance's settings to it. A bucket that cannot be
+// set up is removed again.
+func (b *Backend) createBucket(ctx context.Context, client *minio.Client, bucketName string, instance *broker.Instance, p params) error {
+	if err := b.makeBucket(ctx, client, bucketName, p.ObjectLock != nil); err != nil {
+		return fmt.Errorf("failed to create bucket %s: %w", bucketName, err)
+	}
+	err := b.tagBucket(ctx, client, bucketName, instance.ID)
+	if err == nil {
+		err = b.applyEncryption(ctx, client, bucketName, instance)
+	}
+	if err == nil {
+		err = b.configureBucket(ctx, client, bucketName, p, nil)
+	}
+	if err != nil {
+		b.removeBuckets(ctx, client, []string{bucketName})
+		return err
+	}
+	return nil
+}
+
+// removeBuckets removes new, empty buckets after a failed provision or
+// update, logging any failure.
+func (b *Backend) removeBuckets(ctx context.Context, client *minio.Client, bucketNames []string) {
+	for _, bucketName := range bucketNames {
+		if err := b.removeBucket(context.WithoutCancel(ctx), client, bucketName); err != nil {
+			logging.FromContext(ctx).Warn("failed to remove bucket",
+				slog.String("bucket", bucketName), slog.String(logging.KeyError, err.Error()))
+		}
+	}
+}
+
+// deleteBucket removes a bucket of an instance if the app has deleted its
+// objects. The noncurrent versions and delete markers of a versioned bucket
+// are removed with it, unless any of them is still retained.
+func (b *Backend) deleteBucket(ctx context.Context, client *minio.Client, bucketName string, p params) error {
+	logger := logging.FromContext(ctx)
+
+	exists, err := b.bucketExists(ctx, client, bucketName)
+	if err != nil {
+		return fmt.Errorf("failed to check bucket existence: %w", err)
+	}
+	if !exists {
+		logger.Info("bucket already removed", slog.String("bucket", bucketName))
+		return nil
+	}
+
+	if err := b.removeVersions(ctx, client, bucketName); err != nil {
+		return err
+	}
+
+	// Only drop the notifications of a bucket that can be removed, so
+	// that a refused deprovision leaves them working.
+	if len(p.Notifications) > 0 {
+		empty, err := b.bucketEmpty(ctx, client, bucketName)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return fmt.Errorf("bucket %s is not empty", bucketName)
+		}
+		if err := b.removeNotifications(ctx, client, bucketName); err != nil {
+			return err
+		}
+	}
+
+	// Remove the bucket (will fail if not empty, which is the desired behavior)
+	if err := b.removeBucket(ctx, client, bucketName); err != nil {
+		return fmt.Errorf("failed to remove bucket %s (it may not be empty): %w", bucketName, err)
+	}
+	logger.Info("removed bucket", slog.String("bucket", bucketName))
+	return nil
+}
+
+// updateBuckets removes the buckets that were dropped from the buckets
+// parameter, applies changed settings to the remaining ones and creates the
+// new ones. Dropped buckets must be empty; they are removed first so that
+// a refused update changes nothing else.
+func (b *Backend) updateBuckets(ctx context.Context, client *minio.Client, instance *broker.Instance, p, prev params) error {
+	for _, name := range prev.Buckets {
+		if !slices.Contains(p.Buckets, name) {
+			if err := b.deleteBucket(ctx, client, b.namedBucket(instance.ID, name), prev); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, bucket := range b.buckets(instance.ID, p) {
+		if bucket.Name != "" && !slices.Contains(prev.Buckets, bucket.Name) {
+			continue
+		}
+		if err := b.configureBucket(ctx, client, bucket.Bucket, p, &prev); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range p.Buckets {
+		if slices.Contains(prev.Buckets, name) {
+			continue
+		}
+		bucketName := b.namedBucket(instance.ID, name)
+		exists, err := b.bucketExists(ctx, client, bucketName)
+		if err != nil {
+			return fmt.Errorf("failed to check bucket existence: %w", err)
+		}
+		if exists {
+			// Only a bucket left over from an update of this instance
+			// that failed after creating it is taken over.
+			owner, err := b.bucketInstance(ctx, client, bucketName)
+			if err != nil {
+				return err
+			}
+			if owner != instance.ID {
+				return bucketExistsError(bucketName)
+			}
+			if err := b.configureBucket(ctx, client, bucketName, p, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := b.createBucket(ctx, client, bucketName, instance, p); err != nil {
+			return err
+		}
+		logging.FromContext(ctx).Info("created bucket", slog.String("bucket", bucketName))
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package minio
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi/v11/domain/apiresponses"
+)
+
+// failureStatus returns the HTTP status of a failure response, or 0.
+func failureStatus(err error) int {
+	var failure *apiresponses.FailureResponse
+	if errors.As(err, &failure) {
+		return failure.ValidatedStatusCode(nil)
+	}
+	return 0
+}
+
+func TestProvisionTagsBuckets(t *testing.T) {
+	s3, srv := newFakeS3(t)
+	b := newTestBackend(t, srv, Config{})
+
+	instance := instanceWith(t, "inst-1", params{Buckets: []string{"logs"}})
+	if err := b.Provision(context.Background(), instance); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	for _, name := range []string{"cf-inst-1", "cf-inst-1-logs"} {
+		if got := s3.bucketTags(name)[tagInstanceID]; got != "inst-1" {
+			t.Errorf("%s: instance tag = %q, want inst-1", name, got)
+		}
+	}
+}
+
+func TestProvisionRefusesExistingNamedBucket(t *testing.T) {
+	s3, srv := newFakeS3(t)
+	b := newTestBackend(t, srv, Config{})
+	s3.addBucket("cf-inst-1-logs")
+
+	err := b.Provision(context.Background(), instanceWith(t, "inst-1", params{Buckets: []string{"logs"}}))
+	if status := failureStatus(err); status != http.StatusConflict {
+		t.Fatalf("Provision error = %v, want 409", err)
+	}
+	if s3.bucket("cf-inst-1") != nil {
+		t.Error("default bucket was not removed after the failed provision")
+	}
+}
+
+func TestUpdateCreatesTaggedBucket(t *testing.T) {
+	s3, srv := newFakeS3(t)
+	b := newTestBackend(t, srv, Config{})
+	s3.addBucket("cf-inst-1")
+
+	previous := instanceWith(t, "inst-1", params{})
+	instance := instanceWith(t, "inst-1", params{Buckets: []string{"logs"}})
+	if err := b.Update(context.Background(), instance, previous); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if got := s3.bucketTags("cf-inst-1-logs")[tagInstanceID]; got != "inst-1" {
+		t.Errorf("instance tag = %q, want inst-1", got)
+	}
+}
+
+func TestUpdateAdoptsOwnLeftoverBucket(t *testing.T) {
+	s3, srv := newFakeS3(t)
+	b := newTestBackend(t, srv, Config{})
+	s3.addBucket("cf-inst-1")
+	s3.addBucket("cf-inst-1-logs").tags = map[string]string{tagInstanceID: "inst-1"}
+	s3.calls()
+
+	previous := instanceWith(t, "inst-1", params{})
+	instance := instanceWith(t, "inst-1", params{Buckets: []string{"logs"}})
+	if err := b.Update(context.Background(), instance, previous); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if calls := s3.calls(); slices.Contains(calls, "PUT cf-inst-1-logs") {
+		t.Errorf("requests = %q, want the existing bucket reused", calls)
+	}
+}
+
+func TestUpdateRefusesForeignBucket(t *testing.T) {
+	tests := []struct {
+		name string
+		tags map[string]string
+	}{
+		{name: "untagged"},
+		{name: "other instance", tags: map[string]string{tagInstanceID: "inst-2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3, srv := newFakeS3(t)
+			b := newTestBackend(t, srv, Config{})
+			s3.addBucket("cf-inst-1")
+			s3.addBucket("cf-inst-1-logs", "someone-elses-object").tags = tt.tags
+			s3.calls()
+
+			previous := instanceWith(t, "inst-1", params{})
+			instance := instanceWith(t, "inst-1", params{Buckets: []string{"logs"}})
+			err := b.Update(context.Background(), instance, previous)
+			if status := failureStatus(err); status != http.StatusConflict {
+				t.Fatalf("Update error = %v, want 409", err)
+			}
+			for _, call := range s3.calls() {
+				if call != "HEAD cf-inst-1-logs" && call != "GET cf-inst-1-logs?tagging" {
+					t.Errorf("unexpected request %s to a foreign bucket", call)
+				}
+			}
+		})
+	}
+}
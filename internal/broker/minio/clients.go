@@ -0,0 +1,94 @@
+package minio
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/minio/madmin-go/v3"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tlsutil"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// ClientConfig holds the HTTP settings of the broker's connections to a
+// MinIO server.
+type ClientConfig struct {
+	// Transport, if set, is used instead of one built from the TLS
+	// settings and timeouts.
+	Transport http.RoundTripper
+	// CAFile is a PEM bundle of certificate authorities trusted in
+	// addition to the system ones. It is also handed to apps in binding
+	// credentials.
+	CAFile string
+	// InsecureSkipVerify disables TLS certificate verification, for
+	// development servers only.
+	InsecureSkipVerify bool
+	// ConnectTimeout limits dialing and the TLS handshake; zero uses
+	// the Go defaults.
+	ConnectTimeout time.Duration
+	// ResponseTimeout limits the wait for response headers; zero waits
+	// as long as the request's context allows.
+	ResponseTimeout time.Duration
+	// Region is sent in request signatures; empty lets the client look
+	// up each bucket's region.
+	Region string
+}
+
+// tlsConfig returns the TLS settings and timeouts of cfg.
+func (cfg ClientConfig) tlsConfig() tlsutil.Config {
+	return tlsutil.Config{
+		CAFile:             cfg.CAFile,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		ConnectTimeout:     cfg.ConnectTimeout,
+		ResponseTimeout:    cfg.ResponseTimeout,
+	}
+}
+
+// newTransport builds the HTTP transport shared by the data and admin
+// clients of a server, so that they reuse connections. ca is the PEM bundle
+// read from cfg.CAFile.
+func newTransport(cfg ClientConfig, ca []byte) http.RoundTripper {
+	if cfg.Transport != nil {
+		return otelhttp.NewTransport(cfg.Transport)
+	}
+	transport := tlsutil.NewTransport(cfg.tlsConfig(), ca)
+	// Objects are copied with copyWorkers requests in parallel.
+	transport.MaxIdleConnsPerHost = copyWorkers * 2
+	return otelhttp.NewTransport(transport)
+}
+
+// newClients creates the data and admin clients for the given
+// credentials.
+func (b *Backend) newClients(accessKey, secretKey string) (*minio.Client, *madmin.AdminClient, error) {
+	creds := credentials.NewStaticV4(accessKey, secretKey, "")
+	client, err := minio.New(b.endpoint, &minio.Options{
+		Creds:     creds,
+		Secure:    b.useSSL,
+		Region:    b.region,
+		Transport: b.transport,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create MinIO client: %w", err)
+	}
+	admin, err := madmin.NewWithOptions(b.endpoint, &madmin.Options{
+		Creds:     creds,
+		Secure:    b.useSSL,
+		Transport: b.transport,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create MinIO admin client: %w", err)
+	}
+	return client, admin, nil
+}
+
+// client returns the data client.
+func (b *Backend) client() *minio.Client {
+	return b.dataClient
+}
+
+// adminClient returns the admin client.
+func (b *Backend) adminClient() *madmin.AdminClient {
+	return b.admin
+}
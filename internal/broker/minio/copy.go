@@ -0,0 +1,176 @@
+package minio
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+)
+
+// copyWorkers is the number of objects copied concurrently.
+const copyWorkers = 8
+
+// progressInterval is how often a running copy reports its progress.
+const progressInterval = 10 * time.Second
+
+// objectCopy copies every object under a prefix of one bucket to another
+// bucket, possibly on another server.
+type objectCopy struct {
+	src, dst             *minio.Client
+	srcBucket, dstBucket string
+	// srcPrefix is stripped from object names and dstPrefix prepended.
+	srcPrefix, dstPrefix string
+	// serverSide copies with CopyObject, which requires src and dst to be
+	// the same server.
+	serverSide bool
+	// encryption, if set, is requested for every copy instead of the
+	// destination bucket's default.
+	encryption encrypt.ServerSide
+	progress   func(string)
+	// record, if set, is called with each copied object, listed with its
+	// metadata, and the ETag of its copy.
+	record func(obj minio.ObjectInfo, etag string)
+}
+
+// run copies the objects with copyWorkers in parallel and returns how many
+// were copied.
+func (c *objectCopy) run(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		copied  atomic.Int64
+		listed  atomic.Int64
+		errOnce sync.Once
+		copyErr error
+		wg      sync.WaitGroup
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			copyErr = err
+			cancel()
+		})
+	}
+
+	objects := make(chan minio.ObjectInfo)
+	for range copyWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for obj := range objects {
+				etag, err := c.copyObject(ctx, obj)
+				if err != nil {
+					fail(fmt.Errorf("failed to copy %s: %w", obj.Key, err))
+					continue
+				}
+				if c.record != nil {
+					c.record(obj, etag)
+				}
+				copied.Add(1)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	if c.progress != nil {
+		go func() {
+			ticker := time.NewTicker(progressInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					c.progress(fmt.Sprintf("copied %d of %d objects listed so far", copied.Load(), listed.Load()))
+				}
+			}
+		}()
+	}
+
+	listOpts := minio.ListObjectsOptions{Prefix: c.srcPrefix, Recursive: true, WithMetadata: c.record != nil}
+	for obj := range c.src.ListObjects(ctx, c.srcBucket, listOpts) {
+		if obj.Err != nil {
+			fail(fmt.Errorf("failed to list objects: %w", obj.Err))
+			break
+		}
+		listed.Add(1)
+		select {
+		case objects <- obj:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(objects)
+	wg.Wait()
+	close(done)
+
+	if copyErr == nil && ctx.Err() != nil {
+		copyErr = ctx.Err()
+	}
+	return copied.Load(), copyErr
+}
+
+// copyObject copies one object and returns the ETag of the copy.
+func (c *objectCopy) copyObject(ctx context.Context, obj minio.ObjectInfo) (string, error) {
+	name := c.dstPrefix + strings.TrimPrefix(obj.Key, c.srcPrefix)
+
+	if c.serverSide {
+		ctx, span := tracing.StartClient(ctx, "minio CopyObject")
+		info, err := c.dst.CopyObject(ctx,
+			minio.CopyDestOptions{Bucket: c.dstBucket, Object: name, Encryption: c.encryption},
+			minio.CopySrcOptions{Bucket: c.srcBucket, Object: obj.Key},
+		)
+		tracing.End(span, err)
+		return info.ETag, err
+	}
+
+	ctx, span := tracing.StartClient(ctx, "minio GetObject/PutObject")
+	info, err := func() (minio.UploadInfo, error) {
+		reader, err := c.src.GetObject(ctx, c.srcBucket, obj.Key, minio.GetObjectOptions{})
+		if err != nil {
+			return minio.UploadInfo{}, err
+		}
+		defer reader.Close()
+		stat, err := reader.Stat()
+		if err != nil {
+			return minio.UploadInfo{}, err
+		}
+		return c.dst.PutObject(ctx, c.dstBucket, name, reader, stat.Size, minio.PutObjectOptions{
+			ContentType:          stat.ContentType,
+			UserMetadata:         stat.UserMetadata,
+			ServerSideEncryption: c.encryption,
+		})
+	}()
+	tracing.End(span, err)
+	return info.ETag, err
+}
+
+// removePrefix removes every object under prefix from a bucket.
+func removePrefix(ctx context.Context, client *minio.Client, bucket, prefix string) error {
+	objects := client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true})
+	for result := range client.RemoveObjects(ctx, bucket, objects, minio.RemoveObjectsOptions{}) {
+		if result.Err != nil {
+			return fmt.Errorf("failed to remove %s: %w", result.ObjectName, result.Err)
+		}
+	}
+	return nil
+}
+
+// emptyBucket removes every object, including old versions, from a bucket.
+func emptyBucket(ctx context.Context, client *minio.Client, bucket string) error {
+	objects := client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Recursive: true, WithVersions: true})
+	for result := range client.RemoveObjects(ctx, bucket, objects, minio.RemoveObjectsOptions{}) {
+		if result.Err != nil {
+			return fmt.Errorf("failed to remove %s: %w", result.ObjectName, result.Err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package minio
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/minio/minio-go/v7/pkg/sse"
+	"github.com/pivotal-cf/brokerapi/v11/domain"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+)
+
+// Plan IDs of the encrypted plans, offered when enabled by the operator.
+const (
+	EncryptedPlanID    = "minio-local-encrypted-plan-id"
+	EncryptedKMSPlanID = "minio-local-encrypted-kms-plan-id"
+)
+
+// Default bucket encryption modes, as named in credentials and accepted by
+// New.
+const (
+	EncryptionNone   = "none"
+	EncryptionSSES3  = "SSE-S3"
+	EncryptionSSEKMS = "SSE-KMS"
+)
+
+// attrKMSKey records the KMS key of an SSE-KMS instance.
+const attrKMSKey = "kms_key"
+
+// encryptionPlans returns the catalog entries of the enabled encrypted
+// plans.
+func (b *Backend) encryptionPlans() []domain.ServicePlan {
+	var plans []domain.ServicePlan
+	if b.encryption[EncryptionSSES3] {
+		plans = append(plans, domain.ServicePlan{
+			ID:          EncryptedPlanID,
+			Name:        "encrypted",
+			Description: "Creates a bucket encrypted at rest with SSE-S3",
+			Free:        domain.FreeValue(true),
+		})
+	}
+	if b.encryption[EncryptionSSEKMS] {
+		plans = append(plans, domain.ServicePlan{
+			ID:          EncryptedKMSPlanID,
+			Name:        "encrypted-kms",
+			Description: "Creates a bucket encrypted at rest with SSE-KMS under its own key",
+			Free:        domain.FreeValue(true),
+		})
+	}
+	return plans
+}
+
+// encryption returns the default encryption mode of an instance's bucket.
+func encryption(instance *broker.Instance) string {
+	switch instance.PlanID {
+	case EncryptedPlanID:
+		return EncryptionSSES3
+	case EncryptedKMSPlanID:
+		return EncryptionSSEKMS
+	}
+	return EncryptionNone
+}
+
+// serverSide returns the encryption to request when writing objects of an
+// instance outside its bucket, e.g. into snapshots, or nil.
+func serverSide(instance *broker.Instance) (encrypt.ServerSide, error) {
+	switch encryption(instance) {
+	case EncryptionSSES3:
+		return encrypt.NewSSE(), nil
+	case EncryptionSSEKMS:
+		return encrypt.NewSSEKMS(instance.Attribute(attrKMSKey), nil)
+	}
+	return nil, nil
+}
+
+// ensureKMSKey creates the KMS key of an SSE-KMS instance, named after its
+// bucket, unless it exists already. Keys are never deleted by the broker, so
+// that backups and snapshots of deprovisioned instances stay readable.
+func (b *Backend) ensureKMSKey(ctx context.Context, instance *broker.Instance) error {
+	key := b.bucketName(instance.ID)
+	admin := b.adminClient()
+
+	callCtx, span := b.startCall(ctx, "KMSKeyStatus", "")
+	_, err := admin.GetKeyStatus(callCtx, key)
+	tracing.End(span, err)
+	if err != nil {
+		callCtx, span := b.startCall(ctx, "KMSCreateKey", "")
+		err := admin.CreateKey(callCtx, key)
+		tracing.End(span, err)
+		if err != nil {
+			return fmt.Errorf("failed to create KMS key %s: %w", key, err)
+		}
+	}
+	instance.SetAttribute(attrKMSKey, key)
+	return nil
+}
+
+// applyEncryption sets the default encryption of a new bucket.
+func (b *Backend) applyEncryption(ctx context.Context, client *minio.Client, bucketName string, instance *broker.Instance) error {
+	var config *sse.Configuration
+	switch encryption(instance) {
+	case EncryptionSSES3:
+		config = sse.NewConfigurationSSES3()
+	case EncryptionSSEKMS:
+		config = sse.NewConfigurationSSEKMS(instance.Attribute(attrKMSKey))
+	default:
+		return nil
+	}
+
+	ctx, span := b.startCall(ctx, "SetBucketEncryption", bucketName)
+	err := client.SetBucketEncryption(ctx, bucketName, config)
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to set encryption of bucket %s: %w", bucketName, err)
+	}
+	return nil
+}
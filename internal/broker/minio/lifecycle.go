@@ -0,0 +1,114 @@
+package minio
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+)
+
+// Limits on lifecycle rules, below the S3 maximums, to keep configurations
+// reviewable.
+const (
+	maxLifecycleRules = 100
+	maxLifecycleDays  = 36500
+)
+
+// lifecycleRule is one rule of the lifecycle parameter. Each rule applies
+// to the objects under Prefix, or to the whole bucket, and takes at least
+// one action.
+type lifecycleRule struct {
+	// ID names the rule; it defaults to rule-<n>, counting from 1.
+	ID     string `json:"id,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	// ExpireDays deletes objects this many days after they were written.
+	ExpireDays int `json:"expire_days,omitempty"`
+	// AbortIncompleteUploadDays aborts multipart uploads that have not
+	// completed this many days after they were started.
+	AbortIncompleteUploadDays int `json:"abort_incomplete_upload_days,omitempty"`
+	// NoncurrentExpireDays deletes object versions this many days after
+	// they were replaced or deleted. It requires versioning.
+	NoncurrentExpireDays int `json:"noncurrent_expire_days,omitempty"`
+}
+
+func (r lifecycleRule) id(i int) string {
+	if r.ID != "" {
+		return r.ID
+	}
+	return "rule-" + strconv.Itoa(i+1)
+}
+
+// validateLifecycle checks rules before any of them is applied, so that the
+// server never sees a configuration it would reject.
+func validateLifecycle(rules []lifecycleRule, versioned bool) error {
+	if len(rules) > maxLifecycleRules {
+		return broker.InvalidParameters("lifecycle allows at most %d rules", maxLifecycleRules)
+	}
+	ids := make(map[string]bool, len(rules))
+	for i, r := range rules {
+		id := r.id(i)
+		switch {
+		case len(id) > 255:
+			return broker.InvalidParameters("lifecycle rule %d: id must be at most 255 characters", i+1)
+		case ids[id]:
+			return broker.InvalidParameters("lifecycle rule %d: duplicate id %q", i+1, id)
+		case strings.HasPrefix(r.Prefix, "/") || len(r.Prefix) > 1024:
+			return broker.InvalidParameters("lifecycle rule %s: prefix must not start with / and be at most 1024 characters", id)
+		case r.ExpireDays == 0 && r.AbortIncompleteUploadDays == 0 && r.NoncurrentExpireDays == 0:
+			return broker.InvalidParameters("lifecycle rule %s: set expire_days, abort_incomplete_upload_days or noncurrent_expire_days", id)
+		case r.NoncurrentExpireDays != 0 && !versioned:
+			return broker.InvalidParameters("lifecycle rule %s: noncurrent_expire_days requires versioning", id)
+		}
+		for name, days := range map[string]int{
+			"expire_days":                  r.ExpireDays,
+			"abort_incomplete_upload_days": r.AbortIncompleteUploadDays,
+			"noncurrent_expire_days":       r.NoncurrentExpireDays,
+		} {
+			if days < 0 || days > maxLifecycleDays {
+				return broker.InvalidParameters("lifecycle rule %s: %s must be between 1 and %d", id, name, maxLifecycleDays)
+			}
+		}
+		ids[id] = true
+	}
+	return nil
+}
+
+// lifecycleConfig translates rules into a bucket lifecycle configuration.
+// No rules give an empty configuration, which removes the bucket's.
+func lifecycleConfig(rules []lifecycleRule) *lifecycle.Configuration {
+	config := lifecycle.NewConfiguration()
+	for i, r := range rules {
+		rule := lifecycle.Rule{
+			ID:         r.id(i),
+			Status:     "Enabled",
+			RuleFilter: lifecycle.Filter{Prefix: r.Prefix},
+		}
+		if r.ExpireDays > 0 {
+			rule.Expiration.Days = lifecycle.ExpirationDays(r.ExpireDays)
+		}
+		if r.AbortIncompleteUploadDays > 0 {
+			rule.AbortIncompleteMultipartUpload.DaysAfterInitiation = lifecycle.ExpirationDays(r.AbortIncompleteUploadDays)
+		}
+		if r.NoncurrentExpireDays > 0 {
+			rule.NoncurrentVersionExpiration.NoncurrentDays = lifecycle.ExpirationDays(r.NoncurrentExpireDays)
+		}
+		config.Rules = append(config.Rules, rule)
+	}
+	return config
+}
+
+// applyLifecycle replaces the lifecycle configuration of a bucket.
+func (b *Backend) applyLifecycle(ctx context.Context, client *minio.Client, bucketName string, rules []lifecycleRule) error {
+	ctx, span := b.startCall(ctx, "SetBucketLifecycle", bucketName)
+	err := client.SetBucketLifecycle(ctx, bucketName, lifecycleConfig(rules))
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to set lifecycle of bucket %s: %w", bucketName, err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package minio
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+)
+
+var _ broker.Migrator = (*Backend)(nil)
+
+// MigrateTo copies every object of the instance's buckets to its buckets on
+// target. Objects are streamed through the broker, several in parallel, as
+// S3 server-side copies cannot cross servers.
+func (b *Backend) MigrateTo(
+	ctx context.Context,
+	instance *broker.Instance,
+	target broker.Backend,
+	targetInstance *broker.Instance,
+	progress func(string),
+) error {
+	t, ok := target.(*Backend)
+	if !ok {
+		return fmt.Errorf("cannot migrate MinIO instance to %T", target)
+	}
+
+	src := b.client()
+	dst := t.client()
+
+	// Parameters were validated when they were recorded.
+	p, _ := decodeParams(instance)
+	for _, bucket := range b.buckets(instance.ID, p) {
+		c := &objectCopy{
+			src:       src,
+			dst:       dst,
+			srcBucket: bucket.Bucket,
+			dstBucket: t.bucketName(targetInstance.ID),
+			progress:  progress,
+		}
+		if bucket.Name != "" {
+			c.dstBucket = t.namedBucket(targetInstance.ID, bucket.Name)
+		}
+		n, err := c.run(ctx)
+		if err != nil {
+			return err
+		}
+
+		logging.FromContext(ctx).Info("copied bucket",
+			slog.String("bucket", c.srcBucket), slog.Int64("objects", n))
+	}
+	return nil
+}
+
+// RemoveMigrated empties and removes the instance's buckets.
+func (b *Backend) RemoveMigrated(ctx context.Context, instance *broker.Instance) error {
+	client := b.client()
+
+	p, _ := decodeParams(instance)
+	for _, bucket := range b.buckets(instance.ID, p) {
+		bucketName := bucket.Bucket
+		exists, err := b.bucketExists(ctx, client, bucketName)
+		if err != nil {
+			return fmt.Errorf("failed to check bucket existence: %w", err)
+		}
+		if !exists {
+			continue
+		}
+		if err := emptyBucket(ctx, client, bucketName); err != nil {
+			return fmt.Errorf("failed to empty bucket %s: %w", bucketName, err)
+		}
+		if err := b.removeBucket(ctx, client, bucketName); err != nil {
+			return fmt.Errorf("failed to remove bucket %s: %w", bucketName, err)
+		}
+	}
+	return nil
+}
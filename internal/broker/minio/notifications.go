@@ -0,0 +1,117 @@
+package minio
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+)
+
+// maxNotificationRules limits the notifications parameter.
+const maxNotificationRules = 20
+
+// notificationEvents maps the event names accepted in the notifications
+// parameter to S3 event types.
+var notificationEvents = map[string]notification.EventType{
+	"put":    notification.ObjectCreatedAll,
+	"delete": notification.ObjectRemovedAll,
+}
+
+// notificationRule is one rule of the notifications parameter: the events
+// on objects matching Prefix and Suffix that are sent to the operator's
+// webhook target.
+type notificationRule struct {
+	Events []string `json:"events"`
+	Prefix string   `json:"prefix,omitempty"`
+	Suffix string   `json:"suffix,omitempty"`
+}
+
+// validateNotifications checks the notifications parameter. Rules may not
+// overlap: the server rejects two rules that would both match an event.
+func validateNotifications(rules []notificationRule, target string) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	if target == "" {
+		return broker.InvalidParameters("notifications are not available: no webhook target is configured")
+	}
+	if len(rules) > maxNotificationRules {
+		return broker.InvalidParameters("notifications allows at most %d rules", maxNotificationRules)
+	}
+	for i, r := range rules {
+		if len(r.Events) == 0 {
+			return broker.InvalidParameters("notification rule %d: events are required", i+1)
+		}
+		for _, event := range r.Events {
+			if _, ok := notificationEvents[event]; !ok {
+				return broker.InvalidParameters("notification rule %d: event %q must be put or delete", i+1, event)
+			}
+		}
+		if len(r.Prefix) > 1024 || len(r.Suffix) > 1024 {
+			return broker.InvalidParameters("notification rule %d: prefix and suffix must be at most 1024 characters", i+1)
+		}
+		for j, other := range rules[:i] {
+			shared := slices.ContainsFunc(r.Events, func(e string) bool { return slices.Contains(other.Events, e) })
+			if shared && overlaps(r.Prefix, other.Prefix, strings.HasPrefix) && overlaps(r.Suffix, other.Suffix, strings.HasSuffix) {
+				return broker.InvalidParameters("notification rules %d and %d overlap", j+1, i+1)
+			}
+		}
+	}
+	return nil
+}
+
+// overlaps reports whether some key can match both a and b, given how they
+// are matched.
+func overlaps(a, b string, match func(s, affix string) bool) bool {
+	return match(a, b) || match(b, a)
+}
+
+// applyNotifications replaces the event notifications of a bucket.
+func (b *Backend) applyNotifications(ctx context.Context, client *minio.Client, bucketName string, rules []notificationRule) error {
+	if len(rules) == 0 {
+		return b.removeNotifications(ctx, client, bucketName)
+	}
+
+	arn, err := notification.NewArnFromString(b.notificationTarget)
+	if err != nil {
+		return fmt.Errorf("invalid notification target %q: %w", b.notificationTarget, err)
+	}
+	var config notification.Configuration
+	for _, r := range rules {
+		queue := notification.NewConfig(arn)
+		for _, event := range r.Events {
+			queue.AddEvents(notificationEvents[event])
+		}
+		if r.Prefix != "" {
+			queue.AddFilterPrefix(r.Prefix)
+		}
+		if r.Suffix != "" {
+			queue.AddFilterSuffix(r.Suffix)
+		}
+		config.AddQueue(queue)
+	}
+
+	ctx, span := b.startCall(ctx, "SetBucketNotification", bucketName)
+	err = client.SetBucketNotification(ctx, bucketName, config)
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to set notifications of bucket %s: %w", bucketName, err)
+	}
+	return nil
+}
+
+// removeNotifications removes every event notification of a bucket.
+func (b *Backend) removeNotifications(ctx context.Context, client *minio.Client, bucketName string) error {
+	ctx, span := b.startCall(ctx, "RemoveAllBucketNotification", bucketName)
+	err := client.RemoveAllBucketNotification(ctx, bucketName)
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to remove notifications of bucket %s: %w", bucketName, err)
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package minio
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+)
+
+const testTarget = "arn:minio:sqs::primary:webhook"
+
+// notificationConfig returns the notification configuration last set on a
+// bucket.
+func (s *fakeS3) notificationConfig(t *testing.T, name string) notification.Configuration {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var config notification.Configuration
+	if body := s.buckets[name].notification; body != nil {
+		if err := xml.Unmarshal(body, &config); err != nil {
+			t.Fatalf("notification configuration of %s: %v", name, err)
+		}
+	}
+	return config
+}
+
+func instanceWith(t *testing.T, id string, p params) *broker.Instance {
+	t.Helper()
+	raw, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &broker.Instance{ID: id, PlanID: SharedPlanID, Parameters: raw}
+}
+
+func TestValidateNotifications(t *testing.T) {
+	tooMany := make([]notificationRule, maxNotificationRules+1)
+	for i := range tooMany {
+		tooMany[i] = notificationRule{Events: []string{"put"}, Prefix: strings.Repeat("a", i+1) + "/"}
+	}
+
+	tests := []struct {
+		name    string
+		rules   []notificationRule
+		target  string
+		wantErr string
+	}{
+		{name: "none without target", rules: nil},
+		{name: "valid", target: testTarget, rules: []notificationRule{
+			{Events: []string{"put", "delete"}, Prefix: "uploads/", Suffix: ".jpg"},
+		}},
+		{name: "no target", rules: []notificationRule{{Events: []string{"put"}}}, wantErr: "no webhook target"},
+		{name: "no events", target: testTarget, rules: []notificationRule{{Prefix: "a/"}}, wantErr: "events are required"},
+		{name: "unknown event", target: testTarget, rules: []notificationRule{{Events: []string{"get"}}}, wantErr: `event "get"`},
+		{name: "too many", target: testTarget, rules: tooMany, wantErr: "at most"},
+		{name: "long prefix", target: testTarget, rules: []notificationRule{
+			{Events: []string{"put"}, Prefix: strings.Repeat("a", 1025)},
+		}, wantErr: "at most 1024"},
+		{name: "nested prefixes", target: testTarget, rules: []notificationRule{
+			{Events: []string{"put"}, Prefix: "uploads/"},
+			{Events: []string{"put"}, Prefix: "uploads/images/"},
+		}, wantErr: "rules 1 and 2 overlap"},
+		{name: "shared suffix", target: testTarget, rules: []notificationRule{
+			{Events: []string{"put"}, Suffix: ".jpg"},
+			{Events: []string{"put", "delete"}, Prefix: "a/", Suffix: "large.jpg"},
+		}, wantErr: "overlap"},
+		{name: "different events", target: testTarget, rules: []notificationRule{
+			{Events: []string{"put"}, Prefix: "uploads/"},
+			{Events: []string{"delete"}, Prefix: "uploads/"},
+		}},
+		{name: "different suffixes", target: testTarget, rules: []notificationRule{
+			{Events: []string{"put"}, Prefix: "uploads/", Suffix: ".jpg"},
+			{Events: []string{"put"}, Prefix: "uploads/", Suffix: ".png"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateNotifications(tt.rules, tt.target)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewRejectsInvalidTarget(t *testing.T) {
+	_, err := New(Config{Endpoint: "localhost:9000", AccessKey: "a", SecretKey: "b", NotificationTarget: "webhook"})
+	if err == nil {
+		t.Fatal("New accepted an invalid notification target")
+	}
+}
+
+func TestUpdateRegistersNotifications(t *testing.T) {
+	s3, srv := newFakeS3(t)
+	b := newTestBackend(t, srv, Config{NotificationTarget: testTarget})
+	s3.addBucket("cf-inst-1")
+
+	previous := instanceWith(t, "inst-1", params{})
+	instance := instanceWith(t, "inst-1", params{Notifications: []notificationRule{
+		{Events: []string{"put"}, Prefix: "uploads/", Suffix: ".jpg"},
+		{Events: []string{"delete"}},
+	}})
+	if err := b.Validate(instance); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if err := b.Update(context.Background(), instance, previous); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	if got, want := s3.calls(), []string{"PUT cf-inst-1?notification"}; !slices.Equal(got, want) {
+		t.Errorf("requests = %q, want %q", got, want)
+	}
+	config := s3.notificationConfig(t, "cf-inst-1")
+	if len(config.QueueConfigs) != 2 {
+		t.Fatalf("queue configurations = %+v, want 2", config.QueueConfigs)
+	}
+
+	put := config.QueueConfigs[0]
+	if put.Queue != testTarget {
+		t.Errorf("queue = %q, want %q", put.Queue, testTarget)
+	}
+	if !slices.Equal(put.Events, []notification.EventType{notification.ObjectCreatedAll}) {
+		t.Errorf("events = %v, want %v", put.Events, notification.ObjectCreatedAll)
+	}
+	if put.Filter == nil {
+		t.Fatal("put rule has no filter")
+	}
+	wantRules := []notification.FilterRule{{Name: "prefix", Value: "uploads/"}, {Name: "suffix", Value: ".jpg"}}
+	if !slices.Equal(put.Filter.S3Key.FilterRules, wantRules) {
+		t.Errorf("filter rules = %v, want %v", put.Filter.S3Key.FilterRules, wantRules)
+	}
+
+	del := config.QueueConfigs[1]
+	if del.Queue != testTarget || !slices.Equal(del.Events, []notification.EventType{notification.ObjectRemovedAll}) {
+		t.Errorf("delete rule = %+v", del)
+	}
+	if del.Filter != nil && len(del.Filter.S3Key.FilterRules) > 0 {
+		t.Errorf("delete rule filter = %v, want none", del.Filter.S3Key.FilterRules)
+	}
+}
+
+func TestUpdateLeavesUnchangedNotifications(t *testing.T) {
+	s3, srv := newFakeS3(t)
+	b := newTestBackend(t, srv, Config{NotificationTarget: testTarget})
+	s3.addBucket("cf-inst-1")
+
+	p := params{Notifications: []notificationRule{{Events: []string{"put"}}}}
+	if err := b.Update(context.Background(), instanceWith(t, "inst-1", p), instanceWith(t, "inst-1", p)); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if got := s3.calls(); len(got) != 0 {
+		t.Errorf("requests = %q, want none", got)
+	}
+}
+
+func TestUpdateRemovesNotifications(t *testing.T) {
+	s3, srv := newFakeS3(t)
+	b := newTestBackend(t, srv, Config{NotificationTarget: testTarget})
+	s3.addBucket("cf-inst-1")
+
+	withRules := instanceWith(t, "inst-1", params{Notifications: []notificationRule{{Events: []string{"put"}}}})
+	without := instanceWith(t, "inst-1", params{})
+	if err := b.Update(context.Background(), withRules, without); err != nil {
+		t.Fatalf("Update adding notifications: %v", err)
+	}
+	if got := s3.notificationConfig(t, "cf-inst-1"); len(got.QueueConfigs) != 1 {
+		t.Fatalf("queue configurations = %+v, want 1", got.QueueConfigs)
+	}
+	if err := b.Update(context.Background(), without, withRules); err != nil {
+		t.Fatalf("Update removing notifications: %v", err)
+	}
+	if got := s3.notificationConfig(t, "cf-inst-1"); len(got.QueueConfigs) != 0 {
+		t.Errorf("queue configurations = %+v, want none", got.QueueConfigs)
+	}
+}
+
+func TestDeprovisionRemovesNotifications(t *testing.T) {
+	s3, srv := newFakeS3(t)
+	b := newTestBackend(t, srv, Config{NotificationTarget: testTarget})
+	bucket := s3.addBucket("cf-inst-1")
+	bucket.notification = []byte(`<NotificationConfiguration><QueueConfiguration><Queue>` + testTarget +
+		`</Queue><Event>s3:ObjectCreated:*</Event></QueueConfiguration></NotificationConfiguration>`)
+
+	instance := instanceWith(t, "inst-1", params{Notifications: []notificationRule{{Events: []string{"put"}}}})
+	if err := b.Deprovision(context.Background(), instance); err != nil {
+		t.Fatalf("Deprovision: %v", err)
+	}
+
+	calls := s3.calls()
+	removed := slices.Index(calls, "PUT cf-inst-1?notification")
+	deleted := slices.Index(calls, "DELETE cf-inst-1")
+	if removed < 0 || deleted < 0 || removed > deleted {
+		t.Errorf("requests = %q, want notifications removed before the bucket", calls)
+	}
+	if s3.bucket("cf-inst-1") != nil {
+		t.Error("bucket still exists after Deprovision")
+	}
+}
+
+func TestDeprovisionKeepsNotificationsOfFullBucket(t *testing.T) {
+	s3, srv := newFakeS3(t)
+	b := newTestBackend(t, srv, Config{NotificationTarget: testTarget})
+	s3.addBucket("cf-inst-1", "uploads/a.jpg")
+
+	instance := instanceWith(t, "inst-1", params{Notifications: []notificationRule{{Events: []string{"put"}}}})
+	if err := b.Deprovision(context.Background(), instance); err == nil {
+		t.Fatal("Deprovision of a bucket with objects succeeded")
+	}
+	if calls := s3.calls(); slices.Contains(calls, "PUT cf-inst-1?notification") {
+		t.Errorf("requests = %q, want notifications left in place", calls)
+	}
+}
@@ -0,0 +1,87 @@
+package minio
+
+import (
+	"github.com/minio/minio-go/v7"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+)
+
+// params are the provision and update parameters of an instance.
+type params struct {
+	// Versioning keeps every version of every object. It can be enabled
+	// by Update but not disabled again.
+	Versioning bool `json:"versioning,omitempty"`
+	// ObjectLock creates the bucket with object locking, which implies
+	// versioning, and a default retention for new objects. It can only be
+	// set at provision; its retention can be changed by Update.
+	ObjectLock *objectLock `json:"object_lock,omitempty"`
+	// Lifecycle replaces the bucket's lifecycle configuration.
+	Lifecycle []lifecycleRule `json:"lifecycle,omitempty"`
+	// CORS replaces the bucket's CORS configuration.
+	CORS []corsRule `json:"cors,omitempty"`
+	// PublicReadPrefixes are the prefixes anyone may read objects under.
+	PublicReadPrefixes []string `json:"public_read_prefixes,omitempty"`
+	// Notifications replaces the bucket's event notifications.
+	Notifications []notificationRule `json:"notifications,omitempty"`
+	// Buckets names additional buckets of the instance. Every setting
+	// above applies to each of them as well as to the default bucket.
+	Buckets []string `json:"buckets,omitempty"`
+}
+
+// objectLock is the default retention of a bucket with object locking.
+type objectLock struct {
+	// Mode is GOVERNANCE or COMPLIANCE.
+	Mode string `json:"mode"`
+	// Exactly one of Days and Years is set.
+	Days  uint `json:"days,omitempty"`
+	Years uint `json:"years,omitempty"`
+}
+
+// maxRetentionYears caps default retention periods, to catch typos that
+// would lock objects forever.
+const maxRetentionYears = 100
+
+// decodeParams decodes and validates the parameters of an instance.
+func decodeParams(instance *broker.Instance) (params, error) {
+	var p params
+	if err := instance.DecodeParameters(&p); err != nil {
+		return params{}, err
+	}
+	if p.ObjectLock != nil {
+		if err := p.ObjectLock.validate(); err != nil {
+			return params{}, err
+		}
+	}
+	if err := validateLifecycle(p.Lifecycle, p.versioned()); err != nil {
+		return params{}, err
+	}
+	return p, nil
+}
+
+func (l *objectLock) validate() error {
+	if !minio.RetentionMode(l.Mode).IsValid() {
+		return broker.InvalidParameters("object_lock.mode must be GOVERNANCE or COMPLIANCE")
+	}
+	if (l.Days == 0) == (l.Years == 0) {
+		return broker.InvalidParameters("object_lock must set exactly one of days and years")
+	}
+	if l.Days > maxRetentionYears*366 || l.Years > maxRetentionYears {
+		return broker.InvalidParameters("object_lock retention must be at most %d years", maxRetentionYears)
+	}
+	return nil
+}
+
+// versioned reports whether the bucket keeps object versions.
+func (p params) versioned() bool {
+	return p.Versioning || p.ObjectLock != nil
+}
+
+// retention returns the default retention in the form taken by
+// SetObjectLockConfig.
+func (l *objectLock) retention() (*minio.RetentionMode, *uint, *minio.ValidityUnit) {
+	mode := minio.RetentionMode(l.Mode)
+	validity, unit := l.Days, minio.Days
+	if l.Years != 0 {
+		validity, unit = l.Years, minio.Years
+	}
+	return &mode, &validity, &unit
+}
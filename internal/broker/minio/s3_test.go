@@ -0,0 +1,224 @@
+package minio
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/minio/minio-go/v7/pkg/tags"
+)
+
+// fakeS3 is a stand-in for the parts of the MinIO S3 and admin APIs that
+// the backend uses to manage buckets and policies. Requests it does not
+// know fail the test.
+type fakeS3 struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	buckets  map[string]*fakeBucket
+	policies map[string][]byte
+	requests []string
+}
+
+type fakeBucket struct {
+	objects      []string
+	notification []byte
+	tags         map[string]string
+}
+
+// subresources are the query parameters that select what a bucket request
+// acts on, in the order they are looked for.
+var subresources = []string{"location", "versioning", "versions", "notification", "tagging", "list-type"}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	t.Helper()
+	s := &fakeS3{t: t, buckets: map[string]*fakeBucket{}, policies: map[string][]byte{}}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+// newTestBackend returns a backend using srv as its MinIO server.
+func newTestBackend(t *testing.T, srv *httptest.Server, cfg Config) *Backend {
+	t.Helper()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Endpoint = u.Host
+	cfg.AccessKey, cfg.SecretKey = "admin", "admin-secret"
+	cfg.Client.Region = "us-east-1"
+	b, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return b
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if api, ok := strings.CutPrefix(r.URL.Path, "/minio/admin/v3/"); ok {
+		s.serveAdmin(w, r, api, body)
+		return
+	}
+	name, _, _ := strings.Cut(strings.Trim(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	sub := ""
+	for _, key := range subresources {
+		if query.Has(key) {
+			sub = key
+			break
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	call := r.Method + " " + name
+	if sub != "" {
+		call += "?" + sub
+	}
+	s.requests = append(s.requests, call)
+
+	bucket := s.buckets[name]
+	if bucket == nil && !(r.Method == http.MethodPut && sub == "") {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", name)
+		return
+	}
+
+	switch r.Method + " " + sub {
+	case "HEAD ":
+		w.WriteHeader(http.StatusOK)
+	case "PUT ":
+		if bucket != nil {
+			writeS3Error(w, http.StatusConflict, "BucketAlreadyOwnedByYou", name)
+			return
+		}
+		s.buckets[name] = &fakeBucket{}
+	case "DELETE ":
+		if len(bucket.objects) > 0 {
+			writeS3Error(w, http.StatusConflict, "BucketNotEmpty", name)
+			return
+		}
+		delete(s.buckets, name)
+		w.WriteHeader(http.StatusNoContent)
+	case "GET location":
+		writeXML(w, `<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`)
+	case "GET versioning":
+		writeXML(w, `<VersioningConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></VersioningConfiguration>`)
+	case "GET versions":
+		var versions strings.Builder
+		for _, key := range bucket.objects {
+			fmt.Fprintf(&versions, `<Version><Key>%s</Key><VersionId>null</VersionId><IsLatest>true</IsLatest>`+
+				`<LastModified>2026-01-01T00:00:00.000Z</LastModified><ETag>"0"</ETag><Size>1</Size></Version>`, key)
+		}
+		writeXML(w, `<ListVersionsResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>`+name+
+			`</Name><IsTruncated>false</IsTruncated>`+versions.String()+`</ListVersionsResult>`)
+	case "PUT notification":
+		bucket.notification = body
+	case "GET notification":
+		if bucket.notification == nil {
+			writeXML(w, `<NotificationConfiguration></NotificationConfiguration>`)
+			return
+		}
+		writeXML(w, string(bucket.notification))
+	case "PUT tagging":
+		t, err := tags.ParseBucketXML(strings.NewReader(string(body)))
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "MalformedXML", name)
+			return
+		}
+		bucket.tags = t.ToMap()
+		w.WriteHeader(http.StatusNoContent)
+	case "GET tagging":
+		if len(bucket.tags) == 0 {
+			writeS3Error(w, http.StatusNotFound, "NoSuchTagSet", name)
+			return
+		}
+		t, _ := tags.NewTags(bucket.tags, false)
+		data, _ := xml.Marshal(t)
+		writeXML(w, string(data))
+	default:
+		s.t.Errorf("unexpected S3 request %s %s", r.Method, r.URL)
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented", name)
+	}
+}
+
+// serveAdmin answers the admin API calls that manage canned policies.
+func (s *fakeS3) serveAdmin(w http.ResponseWriter, r *http.Request, api string, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := r.URL.Query().Get("name")
+	s.requests = append(s.requests, r.Method+" admin/"+api+" "+name)
+
+	switch r.Method + " " + api {
+	case "PUT add-canned-policy":
+		s.policies[name] = body
+	default:
+		s.t.Errorf("unexpected admin request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func writeXML(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, body)
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code, bucketName string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message><BucketName>%s</BucketName></Error>`, code, code, bucketName)
+}
+
+// addBucket creates a bucket holding objects.
+func (s *fakeS3) addBucket(name string, objects ...string) *fakeBucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket := &fakeBucket{objects: objects}
+	s.buckets[name] = bucket
+	return bucket
+}
+
+func (s *fakeS3) bucket(name string) *fakeBucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buckets[name]
+}
+
+// calls returns the requests made so far, as "METHOD bucket?subresource",
+// and forgets them.
+func (s *fakeS3) calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	calls := slices.Clone(s.requests)
+	s.requests = nil
+	return calls
+}
+
+// policy returns the canned policy stored under name.
+func (s *fakeS3) policy(name string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.policies[name]
+}
+
+// bucketTags returns the tags of a bucket.
+func (s *fakeS3) bucketTags(name string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bucket := s.buckets[name]; bucket != nil {
+		return bucket.tags
+	}
+	return nil
+}
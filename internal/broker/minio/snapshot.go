@@ -0,0 +1,450 @@
+package minio
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+)
+
+var _ broker.Snapshotter = (*Backend)(nil)
+
+// manifestName is the object, within a snapshot's prefix, that lists the
+// snapshot's objects. It is written last, so a snapshot without one is
+// incomplete.
+const manifestName = "manifest.json"
+
+// User metadata keys recorded on every manifest, so that snapshots can be
+// listed without reading their manifests.
+const (
+	metaServiceID = "Service-Id"
+	metaPlanID    = "Plan-Id"
+	metaObjects   = "Objects"
+	metaSize      = "Size"
+)
+
+// manifest records the objects of a snapshot as they were copied.
+type manifest struct {
+	ID         string           `json:"id"`
+	InstanceID string           `json:"instance_id"`
+	ServiceID  string           `json:"service_id"`
+	PlanID     string           `json:"plan_id"`
+	Bucket     string           `json:"bucket"`
+	CreatedAt  time.Time        `json:"created_at"`
+	Objects    []manifestObject `json:"objects"`
+	// Buckets holds the objects of the buckets from the buckets
+	// parameter by logical name.
+	Buckets map[string][]manifestObject `json:"buckets,omitempty"`
+}
+
+type manifestObject struct {
+	Key          string            `json:"key"`
+	ETag         string            `json:"etag"`
+	Size         int64             `json:"size"`
+	ContentType  string            `json:"content_type,omitempty"`
+	LastModified time.Time         `json:"last_modified"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// snapshotPrefix is the prefix of a snapshot, or of all snapshots of an
+// instance if id is empty, in the snapshot bucket.
+func (b *Backend) snapshotPrefix(instanceID, id string) string {
+	prefix := b.snapshotsPrefix + instanceID + "/"
+	if id != "" {
+		prefix += id + "/"
+	}
+	return prefix
+}
+
+// snapshotObjects is the prefix, within a snapshot's prefix, of the objects
+// of one of the instance's buckets.
+func snapshotObjects(name string) string {
+	if name == "" {
+		return "objects/"
+	}
+	return "buckets/" + name + "/"
+}
+
+// ensureSnapshotBucket creates the snapshot bucket if it does not exist yet.
+func (b *Backend) ensureSnapshotBucket(ctx context.Context, client *minio.Client) error {
+	exists, err := b.bucketExists(ctx, client, b.snapshotsBucket)
+	if err != nil {
+		return fmt.Errorf("failed to check snapshot bucket: %w", err)
+	}
+	if exists {
+		return nil
+	}
+	if err := b.makeBucket(ctx, client, b.snapshotsBucket, false); err != nil {
+		return fmt.Errorf("failed to create snapshot bucket %s: %w", b.snapshotsBucket, err)
+	}
+	return nil
+}
+
+// Snapshot copies the instance's buckets into the snapshot bucket with
+// server-side copies and then writes the manifest. A failed snapshot is
+// removed.
+func (b *Backend) Snapshot(ctx context.Context, instance *broker.Instance, info broker.SnapshotInfo, progress func(string)) error {
+	client := b.client()
+	if err := b.ensureSnapshotBucket(ctx, client); err != nil {
+		return err
+	}
+
+	// Keep encrypted instances encrypted in the snapshot bucket.
+	sse, err := serverSide(instance)
+	if err != nil {
+		return fmt.Errorf("failed to configure snapshot encryption: %w", err)
+	}
+
+	prefix := b.snapshotPrefix(instance.ID, info.ID)
+	m := manifest{
+		ID:         info.ID,
+		InstanceID: info.InstanceID,
+		ServiceID:  info.ServiceID,
+		PlanID:     info.PlanID,
+		Bucket:     b.bucketName(instance.ID),
+		CreatedAt:  info.CreatedAt,
+	}
+	var (
+		count int
+		size  int64
+	)
+	// Parameters were validated when they were recorded.
+	p, _ := decodeParams(instance)
+	for _, bucket := range b.buckets(instance.ID, p) {
+		objects, err := b.snapshotBucket(ctx, client, bucket.Bucket, prefix+snapshotObjects(bucket.Name), sse, progress)
+		if err != nil {
+			b.removeSnapshot(ctx, client, prefix)
+			return err
+		}
+		if bucket.Name == "" {
+			m.Objects = objects
+		} else {
+			if m.Buckets == nil {
+				m.Buckets = make(map[string][]manifestObject)
+			}
+			m.Buckets[bucket.Name] = objects
+		}
+		count += len(objects)
+		for _, obj := range objects {
+			size += obj.Size
+		}
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	ctx, span := b.startCall(ctx, "PutObject", b.snapshotsBucket)
+	_, err = client.PutObject(ctx, b.snapshotsBucket, prefix+manifestName, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{
+			ContentType: "application/json",
+			UserMetadata: map[string]string{
+				metaServiceID: info.ServiceID,
+				metaPlanID:    info.PlanID,
+				metaObjects:   strconv.Itoa(count),
+				metaSize:      strconv.FormatInt(size, 10),
+			},
+		})
+	tracing.End(span, err)
+	if err != nil {
+		b.removeSnapshot(ctx, client, prefix)
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// snapshotBucket copies a bucket under prefix of the snapshot bucket and
+// returns its objects, sorted by key.
+func (b *Backend) snapshotBucket(
+	ctx context.Context,
+	client *minio.Client,
+	bucketName, prefix string,
+	sse encrypt.ServerSide,
+	progress func(string),
+) ([]manifestObject, error) {
+	var mu sync.Mutex
+	objects := []manifestObject{}
+	c := &objectCopy{
+		src:        client,
+		dst:        client,
+		srcBucket:  bucketName,
+		dstBucket:  b.snapshotsBucket,
+		dstPrefix:  prefix,
+		serverSide: true,
+		encryption: sse,
+		progress:   progress,
+		record: func(obj minio.ObjectInfo, etag string) {
+			mu.Lock()
+			defer mu.Unlock()
+			objects = append(objects, manifestObject{
+				Key:          obj.Key,
+				ETag:         etag,
+				Size:         obj.Size,
+				ContentType:  obj.ContentType,
+				LastModified: obj.LastModified.UTC(),
+				Metadata:     obj.UserMetadata,
+			})
+		},
+	}
+	if _, err := c.run(ctx); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	var size int64
+	for _, obj := range objects {
+		size += obj.Size
+	}
+	logging.FromContext(ctx).Info("copied bucket to snapshot",
+		slog.String("bucket", bucketName), slog.Int("objects", len(objects)), slog.Int64("size_bytes", size))
+	return objects, nil
+}
+
+// removeSnapshot removes the objects of a failed snapshot, logging any
+// failure.
+func (b *Backend) removeSnapshot(ctx context.Context, client *minio.Client, prefix string) {
+	if err := removePrefix(context.WithoutCancel(ctx), client, b.snapshotsBucket, prefix); err != nil {
+		logging.FromContext(ctx).Warn("failed to remove incomplete snapshot",
+			slog.String("prefix", prefix), slog.String(logging.KeyError, err.Error()))
+	}
+}
+
+// Snapshots lists the snapshots of an instance that have a manifest.
+func (b *Backend) Snapshots(ctx context.Context, instanceID string) ([]broker.SnapshotInfo, error) {
+	client := b.client()
+
+	prefix := b.snapshotPrefix(instanceID, "")
+	var (
+		ids []string
+		err error
+	)
+	listCtx, span := b.startCall(ctx, "ListObjects", b.snapshotsBucket)
+	for obj := range client.ListObjects(listCtx, b.snapshotsBucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			err = obj.Err
+			break
+		}
+		if id, ok := strings.CutSuffix(strings.TrimPrefix(obj.Key, prefix), "/"); ok {
+			ids = append(ids, id)
+		}
+	}
+	tracing.End(span, err)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchBucket" {
+			return []broker.SnapshotInfo{}, nil
+		}
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	// IDs are timestamps, so they sort by age.
+	sort.Strings(ids)
+	snapshots := make([]broker.SnapshotInfo, 0, len(ids))
+	for _, id := range ids {
+		statCtx, span := b.startCall(ctx, "StatObject", b.snapshotsBucket)
+		obj, err := client.StatObject(statCtx, b.snapshotsBucket, b.snapshotPrefix(instanceID, id)+manifestName,
+			minio.StatObjectOptions{})
+		tracing.End(span, err)
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			// Still running, or failed without being cleaned up.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read snapshot %s: %w", id, err)
+		}
+
+		info := broker.SnapshotInfo{
+			ID:         id,
+			InstanceID: instanceID,
+			ServiceID:  metadata(obj.UserMetadata, metaServiceID),
+			PlanID:     metadata(obj.UserMetadata, metaPlanID),
+			CreatedAt:  obj.LastModified.UTC(),
+		}
+		if t, err := time.Parse(broker.BackupIDFormat, id); err == nil {
+			info.CreatedAt = t
+		}
+		info.Objects, _ = strconv.ParseInt(metadata(obj.UserMetadata, metaObjects), 10, 64)
+		info.Size, _ = strconv.ParseInt(metadata(obj.UserMetadata, metaSize), 10, 64)
+		snapshots = append(snapshots, info)
+	}
+	return snapshots, nil
+}
+
+// RestoreSnapshot copies the snapshot's objects into the instance's buckets
+// with server-side copies and then removes the objects the snapshot does not
+// have. Buckets the snapshot does not have are left alone. A failed restore
+// leaves the buckets partly restored; it can be retried.
+func (b *Backend) RestoreSnapshot(ctx context.Context, instance *broker.Instance, snapshot broker.SnapshotInfo, progress func(string)) error {
+	client := b.client()
+	prefix := b.snapshotPrefix(snapshot.InstanceID, snapshot.ID)
+	m, err := b.readManifest(ctx, client, prefix)
+	if err != nil {
+		return err
+	}
+
+	// Parameters were validated when they were recorded.
+	p, _ := decodeParams(instance)
+	for name := range m.Buckets {
+		if !slices.Contains(p.Buckets, name) {
+			return fmt.Errorf("snapshot %s has bucket %q, which the instance does not have", snapshot.ID, name)
+		}
+	}
+	for _, bucket := range b.buckets(instance.ID, p) {
+		objects, ok := m.Objects, true
+		if bucket.Name != "" {
+			objects, ok = m.Buckets[bucket.Name]
+		}
+		if !ok {
+			continue
+		}
+		if err := b.restoreBucket(ctx, client, prefix+snapshotObjects(bucket.Name), bucket.Bucket, objects, progress); err != nil {
+			return fmt.Errorf("failed to restore bucket %s from snapshot %s: %w", bucket.Bucket, snapshot.ID, err)
+		}
+	}
+	return nil
+}
+
+// restoreBucket copies the objects under prefix of the snapshot bucket into
+// a bucket and removes the objects that are not listed in objects.
+func (b *Backend) restoreBucket(
+	ctx context.Context,
+	client *minio.Client,
+	prefix, bucketName string,
+	objects []manifestObject,
+	progress func(string),
+) error {
+	c := &objectCopy{
+		src:        client,
+		dst:        client,
+		srcBucket:  b.snapshotsBucket,
+		dstBucket:  bucketName,
+		srcPrefix:  prefix,
+		serverSide: true,
+		progress:   progress,
+	}
+	n, err := c.run(ctx)
+	if err != nil {
+		return err
+	}
+	if n != int64(len(objects)) {
+		return fmt.Errorf("snapshot has %d objects but its manifest lists %d", n, len(objects))
+	}
+
+	keep := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		keep[obj.Key] = true
+	}
+	// Listing and removal stop together: a listing error must not be sent
+	// on as an object to remove, and a removal error cancels the listing
+	// but the results are drained before returning.
+	removeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	listed := client.ListObjects(removeCtx, bucketName, minio.ListObjectsOptions{Recursive: true})
+	stale := make(chan minio.ObjectInfo)
+	var listErr error
+	listDone := make(chan struct{})
+	go func() {
+		defer close(listDone)
+		defer close(stale)
+		for obj := range listed {
+			if obj.Err != nil {
+				listErr = obj.Err
+				cancel()
+				return
+			}
+			if keep[obj.Key] {
+				continue
+			}
+			select {
+			case stale <- obj:
+			case <-removeCtx.Done():
+				return
+			}
+		}
+	}()
+	var (
+		removed   int
+		removeErr error
+	)
+	for result := range client.RemoveObjects(removeCtx, bucketName, stale, minio.RemoveObjectsOptions{}) {
+		if result.Err != nil {
+			if removeErr == nil {
+				removeErr = fmt.Errorf("failed to remove %s: %w", result.ObjectName, result.Err)
+				cancel()
+			}
+			continue
+		}
+		removed++
+	}
+	<-listDone
+	// A removal error comes first, as it also cancels the listing.
+	if removeErr != nil {
+		return removeErr
+	}
+	if listErr != nil {
+		return fmt.Errorf("failed to list bucket %s: %w", bucketName, listErr)
+	}
+
+	logging.FromContext(ctx).Info("restored bucket from snapshot",
+		slog.String("bucket", bucketName), slog.Int64("objects", n), slog.Int("removed", removed))
+	return nil
+}
+
+func (b *Backend) readManifest(ctx context.Context, client *minio.Client, prefix string) (*manifest, error) {
+	ctx, span := b.startCall(ctx, "GetObject", b.snapshotsBucket)
+	m, err := func() (*manifest, error) {
+		obj, err := client.GetObject(ctx, b.snapshotsBucket, prefix+manifestName, minio.GetObjectOptions{})
+		if err != nil {
+			return nil, err
+		}
+		defer obj.Close()
+		var m manifest
+		if err := json.NewDecoder(obj).Decode(&m); err != nil {
+			return nil, err
+		}
+		return &m, nil
+	}()
+	tracing.End(span, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	return m, nil
+}
+
+// DeleteSnapshot removes the manifest of a snapshot, which hides it from
+// Snapshots, and then its objects.
+func (b *Backend) DeleteSnapshot(ctx context.Context, instanceID, id string) error {
+	client := b.client()
+	prefix := b.snapshotPrefix(instanceID, id)
+
+	removeCtx, span := b.startCall(ctx, "RemoveObject", b.snapshotsBucket)
+	err := client.RemoveObject(removeCtx, b.snapshotsBucket, prefix+manifestName, minio.RemoveObjectOptions{})
+	tracing.End(span, err)
+	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchBucket" {
+		return err
+	}
+	return removePrefix(ctx, client, b.snapshotsBucket, prefix)
+}
+
+// metadata looks up a user metadata key regardless of how the server
+// cased it.
+func metadata(m map[string]string, key string) string {
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,137 @@
+package minio
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/pivotal-cf/brokerapi/v11/domain/apiresponses"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+)
+
+// applyVersioning enables versioning and sets the default retention of a
+// bucket as p requires.
+func (b *Backend) applyVersioning(ctx context.Context, client *minio.Client, bucketName string, p params) error {
+	if p.ObjectLock != nil {
+		// Object locking enabled versioning when the bucket was created.
+		mode, validity, unit := p.ObjectLock.retention()
+		ctx, span := b.startCall(ctx, "SetObjectLockConfig", bucketName)
+		err := client.SetObjectLockConfig(ctx, bucketName, mode, validity, unit)
+		tracing.End(span, err)
+		if err != nil {
+			return fmt.Errorf("failed to set default retention of bucket %s: %w", bucketName, err)
+		}
+		return nil
+	}
+	if p.Versioning {
+		ctx, span := b.startCall(ctx, "EnableVersioning", bucketName)
+		err := client.EnableVersioning(ctx, bucketName)
+		tracing.End(span, err)
+		if err != nil {
+			return fmt.Errorf("failed to enable versioning of bucket %s: %w", bucketName, err)
+		}
+	}
+	return nil
+}
+
+// checkVersioningUpdate rejects the changes to versioning and object
+// locking that a bucket cannot make.
+func checkVersioningUpdate(p, previous params) error {
+	switch {
+	case previous.versioned() && !p.versioned():
+		return broker.InvalidParameters("versioning cannot be disabled once enabled")
+	case previous.ObjectLock == nil && p.ObjectLock != nil:
+		return broker.InvalidParameters("object_lock can only be set when the instance is created")
+	case previous.ObjectLock != nil && p.ObjectLock == nil:
+		return broker.InvalidParameters("object_lock cannot be removed")
+	}
+	return nil
+}
+
+// removeVersions removes the noncurrent object versions and delete markers
+// of a versioned bucket whose current objects have all been deleted, so that
+// the bucket itself can be removed. It refuses, leaving the bucket
+// untouched, while the bucket holds objects or versions under retention or
+// legal hold.
+func (b *Backend) removeVersions(ctx context.Context, client *minio.Client, bucketName string) error {
+	callCtx, span := b.startCall(ctx, "GetBucketVersioning", bucketName)
+	versioning, err := client.GetBucketVersioning(callCtx, bucketName)
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to read versioning of bucket %s: %w", bucketName, err)
+	}
+	if !versioning.Enabled() && !versioning.Suspended() {
+		return nil
+	}
+
+	callCtx, span = b.startCall(ctx, "GetObjectLockConfig", bucketName)
+	lockEnabled, _, _, _, err := client.GetObjectLockConfig(callCtx, bucketName)
+	tracing.End(span, err)
+	if err != nil && minio.ToErrorResponse(err).Code != "ObjectLockConfigurationNotFoundError" {
+		return fmt.Errorf("failed to read object lock configuration of bucket %s: %w", bucketName, err)
+	}
+	locked := lockEnabled == "Enabled"
+
+	var versions []minio.ObjectInfo
+	for obj := range client.ListObjects(ctx, bucketName, minio.ListObjectsOptions{Recursive: true, WithVersions: true}) {
+		if obj.Err != nil {
+			return fmt.Errorf("failed to list object versions: %w", obj.Err)
+		}
+		if obj.IsLatest && !obj.IsDeleteMarker {
+			return fmt.Errorf("bucket %s is not empty", bucketName)
+		}
+		if locked && !obj.IsDeleteMarker {
+			if err := b.checkRetention(ctx, client, bucketName, obj); err != nil {
+				return err
+			}
+		}
+		versions = append(versions, obj)
+	}
+
+	objects := make(chan minio.ObjectInfo, len(versions))
+	for _, obj := range versions {
+		objects <- obj
+	}
+	close(objects)
+	for result := range client.RemoveObjects(ctx, bucketName, objects, minio.RemoveObjectsOptions{}) {
+		if result.Err != nil {
+			return fmt.Errorf("failed to remove %s version %s: %w", result.ObjectName, result.VersionID, result.Err)
+		}
+	}
+	return nil
+}
+
+// checkRetention fails if an object version is under retention or legal
+// hold.
+func (b *Backend) checkRetention(ctx context.Context, client *minio.Client, bucketName string, obj minio.ObjectInfo) error {
+	callCtx, span := b.startCall(ctx, "GetObjectRetention", bucketName)
+	_, until, err := client.GetObjectRetention(callCtx, bucketName, obj.Key, obj.VersionID)
+	tracing.End(span, err)
+	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchObjectLockConfiguration" {
+		return fmt.Errorf("failed to read retention of %s: %w", obj.Key, err)
+	}
+	if until != nil && until.After(time.Now()) {
+		return retainedError("object %s version %s is retained until %s",
+			obj.Key, obj.VersionID, until.UTC().Format(time.RFC3339))
+	}
+
+	callCtx, span = b.startCall(ctx, "GetObjectLegalHold", bucketName)
+	hold, err := client.GetObjectLegalHold(callCtx, bucketName, obj.Key, minio.GetObjectLegalHoldOptions{VersionID: obj.VersionID})
+	tracing.End(span, err)
+	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchObjectLockConfiguration" {
+		return fmt.Errorf("failed to read legal hold of %s: %w", obj.Key, err)
+	}
+	if hold != nil && *hold == minio.LegalHoldEnabled {
+		return retainedError("object %s version %s is under legal hold", obj.Key, obj.VersionID)
+	}
+	return nil
+}
+
+func retainedError(format string, args ...any) error {
+	return apiresponses.NewFailureResponse(
+		fmt.Errorf("bucket cannot be removed: "+format, args...), http.StatusUnprocessableEntity, "object-retained",
+	)
+}
@@ -0,0 +1,416 @@
+package mysql
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+
+	driver "github.com/go-sql-driver/mysql"
+	"github.com/pivotal-cf/brokerapi/v11/domain"
+	"github.com/pivotal-cf/brokerapi/v11/domain/apiresponses"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// errDatabaseExists is ER_DB_CREATE_EXISTS, returned by CREATE DATABASE for
+// a database that already exists.
+const errDatabaseExists = 1007
+
+// Identifier length limits. MySQL allows 64 characters for database names
+// but only 32 for user names; MariaDB allows more, so the MySQL limits are
+// used for both.
+const (
+	maxDatabaseName = 64
+	maxUserName     = 32
+)
+
+// identifierPattern validates generated identifiers before they are quoted.
+var identifierPattern = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// Service and plan IDs offered in the catalog.
+const (
+	ServiceID    = "mysql-local-service-id"
+	SharedPlanID = "mysql-local-shared-plan-id"
+)
+
+var (
+	_ broker.Backend   = (*Backend)(nil)
+	_ broker.Validator = (*Backend)(nil)
+)
+
+// Backend implements broker.Backend for MySQL and MariaDB.
+// It provisions databases and users on a shared server.
+type Backend struct {
+	host      string
+	port      string
+	adminUser string
+	adminPass string
+	// connect opens an admin connection; tests replace it.
+	connect func() (*sql.DB, error)
+}
+
+// New creates a new MySQL backend.
+func New(host, port, adminUser, adminPass string) *Backend {
+	b := &Backend{
+		host:      host,
+		port:      port,
+		adminUser: adminUser,
+		adminPass: adminPass,
+	}
+	b.connect = b.connectAdmin
+	return b
+}
+
+func (b *Backend) connectAdmin() (*sql.DB, error) {
+	cfg := driver.NewConfig()
+	cfg.User = b.adminUser
+	cfg.Passwd = b.adminPass
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(b.host, b.port)
+	return sql.Open("mysql", cfg.FormatDSN())
+}
+
+// exec runs a statement on the admin connection inside a client span. The
+// statement text is not recorded because it may contain passwords.
+func (b *Backend) exec(ctx context.Context, db *sql.DB, operation, query string, args ...any) error {
+	ctx, span := tracing.StartClient(ctx, "mysql "+operation, b.spanAttrs(operation)...)
+	_, err := db.ExecContext(ctx, query, args...)
+	tracing.End(span, err)
+	return err
+}
+
+// queryStrings runs a query returning a single string column inside a
+// client span.
+func (b *Backend) queryStrings(ctx context.Context, db *sql.DB, operation, query string, args ...any) ([]string, error) {
+	ctx, span := tracing.StartClient(ctx, "mysql "+operation, b.spanAttrs("SELECT")...)
+	values, err := func() ([]string, error) {
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var values []string
+		for rows.Next() {
+			var v string
+			if err := rows.Scan(&v); err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, rows.Err()
+	}()
+	tracing.End(span, err)
+	return values, err
+}
+
+func (b *Backend) spanAttrs(operation string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("db.system.name", "mysql"),
+		attribute.String("db.operation.name", operation),
+		attribute.String("server.address", b.host),
+		attribute.String("server.port", b.port),
+	}
+}
+
+func (b *Backend) dbName(instanceID string) string {
+	return identifier("cf_", instanceID, maxDatabaseName)
+}
+
+func (b *Backend) userName(bindingID string) string {
+	return identifier("cf_", bindingID, maxUserName)
+}
+
+// identifier builds prefix+id as a safe identifier of at most max
+// characters. IDs that do not fit are replaced by a hash so that distinct
+// IDs keep distinct names.
+func identifier(prefix, id string, max int) string {
+	name := prefix + sanitizeIdentifier(id)
+	if len(name) <= max {
+		return name
+	}
+	sum := sha256.Sum256([]byte(id))
+	return prefix + hex.EncodeToString(sum[:])[:max-len(prefix)]
+}
+
+// sanitizeIdentifier replaces hyphens with underscores and removes any
+// characters that are not alphanumeric or underscores.
+func sanitizeIdentifier(id string) string {
+	s := strings.ReplaceAll(id, "-", "_")
+	return regexp.MustCompile(`[^a-zA-Z0-9_]`).ReplaceAllString(s, "")
+}
+
+func validateIdentifier(name string) error {
+	if !identifierPattern.MatchString(name) {
+		return fmt.Errorf("invalid identifier: %s", name)
+	}
+	return nil
+}
+
+func generatePassword(length int) (string, error) {
+	bytes := make([]byte, length)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate random password: %w", err)
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// Service returns the catalog entry for the MySQL service.
+func (b *Backend) Service() domain.Service {
+	return domain.Service{
+		ID:          ServiceID,
+		Name:        "mysql-local",
+		Description: "MySQL database on a shared local instance",
+		Bindable:    true,
+		Tags:        []string{"mysql", "mariadb", "sql", "database"},
+		Plans: []domain.ServicePlan{
+			{
+				ID:          SharedPlanID,
+				Name:        "shared",
+				Description: "Creates a database on the shared MySQL instance",
+				Free:        domain.FreeValue(true),
+			},
+		},
+		Metadata: &domain.ServiceMetadata{
+			DisplayName: "MySQL (Local)",
+			LongDescription: "Provisions a dedicated database and credentials on a shared " +
+				"MySQL or MariaDB instance running in the local cluster.",
+		},
+	}
+}
+
+// Validate rejects parameters, as the service has none.
+func (b *Backend) Validate(instance *broker.Instance) error {
+	var params struct{}
+	return instance.DecodeParameters(&params)
+}
+
+// Provision creates a new database for the service instance.
+func (b *Backend) Provision(ctx context.Context, instance *broker.Instance) error {
+	logger := logging.FromContext(ctx)
+
+	dbName := b.dbName(instance.ID)
+	if err := validateIdentifier(dbName); err != nil {
+		return err
+	}
+
+	db, err := b.connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to MySQL: %w", err)
+	}
+	defer db.Close()
+
+	// CREATE DATABASE cannot use parameterized queries, so we validate the identifier strictly
+	err = b.exec(ctx, db, "CREATE DATABASE", fmt.Sprintf(
+		"CREATE DATABASE %s CHARACTER SET utf8mb4", quoteIdentifier(dbName),
+	))
+	var mysqlErr *driver.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == errDatabaseExists {
+		return apiresponses.ErrInstanceAlreadyExists
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create database %s: %w", dbName, err)
+	}
+
+	logger.Info("provisioned database", slog.String("database", dbName))
+	return nil
+}
+
+// Deprovision drops the database for the service instance, along with any
+// users still granted access to it.
+func (b *Backend) Deprovision(ctx context.Context, instance *broker.Instance) error {
+	logger := logging.FromContext(ctx)
+
+	dbName := b.dbName(instance.ID)
+	if err := validateIdentifier(dbName); err != nil {
+		return err
+	}
+
+	db, err := b.connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to MySQL: %w", err)
+	}
+	defer db.Close()
+
+	users, err := b.queryStrings(ctx, db, "SELECT mysql.db",
+		"SELECT DISTINCT User FROM mysql.db WHERE Db = ? AND Host = '%'", grantPattern(dbName),
+	)
+	if err != nil {
+		logger.Warn("failed to list remaining users",
+			slog.String("database", dbName), slog.String(logging.KeyError, err.Error()))
+	}
+	for _, user := range users {
+		if err := b.exec(ctx, db, "DROP USER", "DROP USER IF EXISTS "+quoteAccount(user)); err != nil {
+			return fmt.Errorf("failed to drop user %s: %w", user, err)
+		}
+	}
+
+	// Terminate existing connections to the database
+	ids, err := b.queryStrings(ctx, db, "SELECT PROCESSLIST",
+		"SELECT ID FROM information_schema.PROCESSLIST WHERE DB = ? AND ID <> CONNECTION_ID()", dbName,
+	)
+	if err == nil {
+		for _, id := range ids {
+			if err = b.exec(ctx, db, "KILL", "KILL "+id); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		logger.Warn("failed to terminate connections",
+			slog.String("database", dbName), slog.String(logging.KeyError, err.Error()))
+	}
+
+	// DROP DATABASE cannot use parameterized queries
+	err = b.exec(ctx, db, "DROP DATABASE", fmt.Sprintf("DROP DATABASE IF EXISTS %s", quoteIdentifier(dbName)))
+	if err != nil {
+		return fmt.Errorf("failed to drop database %s: %w", dbName, err)
+	}
+
+	logger.Info("deprovisioned database", slog.String("database", dbName))
+	return nil
+}
+
+// Bind creates a new user with access to the provisioned database and returns credentials.
+func (b *Backend) Bind(ctx context.Context, instance *broker.Instance, binding *broker.Binding) (map[string]any, error) {
+	logger := logging.FromContext(ctx)
+
+	dbName := b.dbName(instance.ID)
+	userName := b.userName(binding.ID)
+
+	if err := validateIdentifier(dbName); err != nil {
+		return nil, err
+	}
+	if err := validateIdentifier(userName); err != nil {
+		return nil, err
+	}
+
+	password, err := generatePassword(16)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := b.connect()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MySQL: %w", err)
+	}
+	defer db.Close()
+
+	// A user left over from an interrupted bind is replaced so that the
+	// returned password is the one in effect.
+	err = b.exec(ctx, db, "DROP USER", "DROP USER IF EXISTS "+quoteAccount(userName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to drop stale user %s: %w", userName, err)
+	}
+
+	// Account names and passwords cannot use parameterized queries in CREATE USER
+	err = b.exec(ctx, db, "CREATE USER", fmt.Sprintf(
+		"CREATE USER %s IDENTIFIED BY %s", quoteAccount(userName), quoteLiteral(password),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user %s: %w", userName, err)
+	}
+
+	err = b.exec(ctx, db, "GRANT", fmt.Sprintf(
+		"GRANT ALL PRIVILEGES ON %s.* TO %s",
+		quoteIdentifier(grantPattern(dbName)), quoteAccount(userName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to grant privileges: %w", err)
+	}
+
+	addr := net.JoinHostPort(b.host, b.port)
+	uri := fmt.Sprintf("mysql://%s:%s@%s/%s?reconnect=true", userName, password, addr, dbName)
+	jdbcURL := fmt.Sprintf("jdbc:mysql://%s/%s?%s", addr, dbName, url.Values{
+		"user":     {userName},
+		"password": {password},
+	}.Encode())
+
+	logger.Info("created binding", slog.String("user", userName), slog.String("database", dbName))
+
+	return map[string]any{
+		"host":     b.host,
+		"port":     b.port,
+		"name":     dbName,
+		"database": dbName,
+		"username": userName,
+		"password": password,
+		"uri":      uri,
+		"jdbcUrl":  jdbcURL,
+	}, nil
+}
+
+// Unbind drops the user created during binding.
+func (b *Backend) Unbind(ctx context.Context, instance *broker.Instance, binding *broker.Binding) error {
+	logger := logging.FromContext(ctx)
+
+	userName := b.userName(binding.ID)
+	if err := validateIdentifier(userName); err != nil {
+		return err
+	}
+
+	db, err := b.connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to MySQL: %w", err)
+	}
+	defer db.Close()
+
+	err = b.exec(ctx, db, "DROP USER", "DROP USER IF EXISTS "+quoteAccount(userName))
+	if err != nil {
+		return fmt.Errorf("failed to drop user %s: %w", userName, err)
+	}
+
+	logger.Info("removed binding", slog.String("user", userName), slog.String("database", b.dbName(instance.ID)))
+	return nil
+}
+
+// Update has nothing to change: there is a single plan and no parameters.
+func (b *Backend) Update(_ context.Context, _ *broker.Instance, _ *broker.Instance) error {
+	return nil
+}
+
+// Describe reports where the instance's database lives.
+func (b *Backend) Describe(_ context.Context, instance *broker.Instance) (map[string]any, error) {
+	return map[string]any{
+		"host":     b.host,
+		"port":     b.port,
+		"database": b.dbName(instance.ID),
+	}, nil
+}
+
+// quoteIdentifier quotes a MySQL identifier to prevent SQL injection.
+// It doubles any embedded backticks per MySQL quoting rules.
+func quoteIdentifier(s string) string {
+	return "`" + strings.ReplaceAll(s, "`", "``") + "`"
+}
+
+// quoteLiteral quotes a MySQL string literal to prevent SQL injection.
+// Backslashes are escaped too, as MySQL treats them as escape characters
+// unless NO_BACKSLASH_ESCAPES is set.
+func quoteLiteral(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `'` + strings.ReplaceAll(s, `'`, `''`) + `'`
+}
+
+// quoteAccount quotes a user name as an account that may connect from any
+// host.
+func quoteAccount(user string) string {
+	return quoteLiteral(user) + "@'%'"
+}
+
+// grantPattern escapes the wildcards that GRANT interprets in database
+// names, so that cf_a_b does not also match cf_aXb.
+func grantPattern(dbName string) string {
+	s := strings.ReplaceAll(dbName, `_`, `\_`)
+	return strings.ReplaceAll(s, `%`, `\%`)
+}
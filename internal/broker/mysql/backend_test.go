@@ -0,0 +1,255 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	driver "github.com/go-sql-driver/mysql"
+	"github.com/pivotal-cf/brokerapi/v11/domain/apiresponses"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+)
+
+// newMockBackend returns a backend whose admin connections go to mock.
+func newMockBackend(t *testing.T) (*Backend, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+	b := New("mysql.local", "3306", "admin", "secret")
+	b.connect = func() (*sql.DB, error) { return db, nil }
+	return b, mock
+}
+
+func exact(query string) string {
+	return "^" + regexp.QuoteMeta(query) + "$"
+}
+
+func TestIdentifier(t *testing.T) {
+	tests := []struct {
+		name   string
+		id     string
+		max    int
+		want   string
+		hashed bool
+	}{
+		{name: "short", id: "abc-123", max: maxUserName, want: "cf_abc_123"},
+		{name: "sanitized", id: "a.b$c'd`e", max: maxUserName, want: "cf_abcde"},
+		{name: "user at limit", id: strings.Repeat("a", 29), max: maxUserName, want: "cf_" + strings.Repeat("a", 29)},
+		{name: "user over limit", id: strings.Repeat("a", 30), max: maxUserName, hashed: true},
+		{name: "uuid user", id: "8f1c2d3e-4b5a-6789-abcd-ef0123456789", max: maxUserName, hashed: true},
+		{name: "uuid database", id: "8f1c2d3e-4b5a-6789-abcd-ef0123456789", max: maxDatabaseName, want: "cf_8f1c2d3e_4b5a_6789_abcd_ef0123456789"},
+		{name: "database at limit", id: strings.Repeat("b", 61), max: maxDatabaseName, want: "cf_" + strings.Repeat("b", 61)},
+		{name: "database over limit", id: strings.Repeat("b", 62), max: maxDatabaseName, hashed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := identifier("cf_", tt.id, tt.max)
+			if err := validateIdentifier(got); err != nil {
+				t.Errorf("identifier(%q) = %q: %v", tt.id, got, err)
+			}
+			if !tt.hashed {
+				if got != tt.want {
+					t.Errorf("identifier(%q) = %q, want %q", tt.id, got, tt.want)
+				}
+				return
+			}
+			if len(got) != tt.max || !regexp.MustCompile(`^cf_[0-9a-f]+$`).MatchString(got) {
+				t.Errorf("identifier(%q) = %q, want a %d character hash", tt.id, got, tt.max)
+			}
+			if again := identifier("cf_", tt.id, tt.max); again != got {
+				t.Errorf("identifier(%q) is not stable: %q, %q", tt.id, got, again)
+			}
+			if other := identifier("cf_", tt.id+"x", tt.max); other == got {
+				t.Errorf("identifier(%q) and identifier(%q) collide: %q", tt.id, tt.id+"x", got)
+			}
+		})
+	}
+}
+
+func TestQuoting(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func(string) string
+		in   string
+		want string
+	}{
+		{name: "identifier", fn: quoteIdentifier, in: "cf_db", want: "`cf_db`"},
+		{name: "identifier backtick", fn: quoteIdentifier, in: "a`b", want: "`a``b`"},
+		{name: "literal", fn: quoteLiteral, in: "secret", want: "'secret'"},
+		{name: "literal quote", fn: quoteLiteral, in: "it's", want: "'it''s'"},
+		{name: "literal backslash", fn: quoteLiteral, in: `a\'b`, want: `'a\\''b'`},
+		{name: "account", fn: quoteAccount, in: "cf_user", want: "'cf_user'@'%'"},
+		{name: "grant underscore", fn: grantPattern, in: "cf_a_b", want: `cf\_a\_b`},
+		{name: "grant percent", fn: grantPattern, in: "cf%", want: `cf\%`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.fn(tt.in); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProvision(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantErr    bool
+	}{
+		{name: "created"},
+		{name: "exists", err: &driver.MySQLError{Number: 1007, Message: "database exists"}, wantStatus: http.StatusConflict},
+		{name: "other error", err: &driver.MySQLError{Number: 1044, Message: "access denied"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, mock := newMockBackend(t)
+			exec := mock.ExpectExec(exact("CREATE DATABASE `cf_inst_1` CHARACTER SET utf8mb4"))
+			if tt.err != nil {
+				exec.WillReturnError(tt.err)
+			} else {
+				exec.WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			mock.ExpectClose()
+
+			err := b.Provision(context.Background(), &broker.Instance{ID: "inst-1"})
+			var failure *apiresponses.FailureResponse
+			switch {
+			case tt.wantStatus != 0:
+				if !errors.As(err, &failure) || failure.ValidatedStatusCode(nil) != tt.wantStatus {
+					t.Fatalf("Provision error = %v, want %d", err, tt.wantStatus)
+				}
+			case tt.wantErr:
+				if err == nil || errors.As(err, &failure) {
+					t.Fatalf("Provision error = %v, want an internal error", err)
+				}
+			case err != nil:
+				t.Fatalf("Provision: %v", err)
+			}
+		})
+	}
+}
+
+func TestBind(t *testing.T) {
+	b, mock := newMockBackend(t)
+	instance := &broker.Instance{ID: "inst-1"}
+	binding := &broker.Binding{ID: "bind-1", InstanceID: instance.ID}
+
+	mock.ExpectExec(exact("DROP USER IF EXISTS 'cf_bind_1'@'%'")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`^CREATE USER 'cf_bind_1'@'%' IDENTIFIED BY '[0-9a-f]{32}'$`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(exact("GRANT ALL PRIVILEGES ON `cf\\_inst\\_1`.* TO 'cf_bind_1'@'%'")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectClose()
+
+	creds, err := b.Bind(context.Background(), instance, binding)
+	if err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+
+	password, _ := creds["password"].(string)
+	if len(password) != 32 {
+		t.Fatalf("password = %q, want 32 hex characters", password)
+	}
+	for key, want := range map[string]string{
+		"host":     "mysql.local",
+		"port":     "3306",
+		"name":     "cf_inst_1",
+		"database": "cf_inst_1",
+		"username": "cf_bind_1",
+		"uri":      "mysql://cf_bind_1:" + password + "@mysql.local:3306/cf_inst_1?reconnect=true",
+	} {
+		if creds[key] != want {
+			t.Errorf("credentials %s = %v, want %s", key, creds[key], want)
+		}
+	}
+
+	jdbcURL, _ := creds["jdbcUrl"].(string)
+	base, query, _ := strings.Cut(jdbcURL, "?")
+	if base != "jdbc:mysql://mysql.local:3306/cf_inst_1" {
+		t.Errorf("jdbcUrl = %q, want jdbc:mysql://mysql.local:3306/cf_inst_1?...", jdbcURL)
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		t.Fatalf("jdbcUrl query: %v", err)
+	}
+	if values.Get("user") != "cf_bind_1" || values.Get("password") != password {
+		t.Errorf("jdbcUrl query = %v, want the binding's user and password", values)
+	}
+}
+
+func TestBindGrantFailure(t *testing.T) {
+	b, mock := newMockBackend(t)
+	instance := &broker.Instance{ID: "inst-1"}
+	binding := &broker.Binding{ID: "bind-1", InstanceID: instance.ID}
+
+	mock.ExpectExec(`^DROP USER`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`^CREATE USER`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`^GRANT`).WillReturnError(sql.ErrConnDone)
+	mock.ExpectClose()
+
+	if _, err := b.Bind(context.Background(), instance, binding); err == nil {
+		t.Fatal("Bind succeeded, want error")
+	}
+}
+
+func TestUnbind(t *testing.T) {
+	b, mock := newMockBackend(t)
+	instance := &broker.Instance{ID: "inst-1"}
+	binding := &broker.Binding{ID: "bind-1", InstanceID: instance.ID}
+
+	mock.ExpectExec(exact("DROP USER IF EXISTS 'cf_bind_1'@'%'")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectClose()
+
+	if err := b.Unbind(context.Background(), instance, binding); err != nil {
+		t.Fatalf("Unbind: %v", err)
+	}
+}
+
+func TestDeprovision(t *testing.T) {
+	b, mock := newMockBackend(t)
+	instance := &broker.Instance{ID: "inst-1"}
+
+	mock.ExpectQuery(exact("SELECT DISTINCT User FROM mysql.db WHERE Db = ? AND Host = '%'")).
+		WithArgs(`cf\_inst\_1`).
+		WillReturnRows(sqlmock.NewRows([]string{"User"}).AddRow("cf_bind_1").AddRow("cf_bind_2"))
+	mock.ExpectExec(exact("DROP USER IF EXISTS 'cf_bind_1'@'%'")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(exact("DROP USER IF EXISTS 'cf_bind_2'@'%'")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(exact("SELECT ID FROM information_schema.PROCESSLIST WHERE DB = ? AND ID <> CONNECTION_ID()")).
+		WithArgs("cf_inst_1").
+		WillReturnRows(sqlmock.NewRows([]string{"ID"}).AddRow("42"))
+	mock.ExpectExec(exact("KILL 42")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(exact("DROP DATABASE IF EXISTS `cf_inst_1`")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectClose()
+
+	if err := b.Deprovision(context.Background(), instance); err != nil {
+		t.Fatalf("Deprovision: %v", err)
+	}
+}
+
+func TestDeprovisionToleratesKillFailure(t *testing.T) {
+	b, mock := newMockBackend(t)
+	instance := &broker.Instance{ID: "inst-1"}
+
+	mock.ExpectQuery(`^SELECT DISTINCT User`).WillReturnRows(sqlmock.NewRows([]string{"User"}))
+	mock.ExpectQuery(`^SELECT ID`).WillReturnRows(sqlmock.NewRows([]string{"ID"}).AddRow("42").AddRow("43"))
+	mock.ExpectExec(exact("KILL 42")).WillReturnError(sql.ErrConnDone)
+	mock.ExpectExec(exact("DROP DATABASE IF EXISTS `cf_inst_1`")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectClose()
+
+	if err := b.Deprovision(context.Background(), instance); err != nil {
+		t.Fatalf("Deprovision: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/pivotal-cf/brokerapi/v11/domain/apiresponses"
+)
+
+// InvalidParameters returns a 400 response describing why the request
+// parameters were rejected.
+func InvalidParameters(format string, args ...any) error {
+	return apiresponses.NewFailureResponse(
+		fmt.Errorf(format, args...), http.StatusBadRequest, "invalid-parameters",
+	)
+}
+
+// DecodeParameters decodes raw OSBAPI parameters into v, which should be a
+// pointer to a struct. Empty input leaves v untouched. Unknown fields and
+// malformed values are rejected with a 400 response.
+func DecodeParameters(raw json.RawMessage, v any) error {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return InvalidParameters("invalid parameters: %v", err)
+	}
+	return nil
+}
+
+// parseObject checks that raw is empty or a JSON object.
+func parseObject(raw json.RawMessage) (map[string]json.RawMessage, error) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, nil
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &obj); err != nil || obj == nil {
+		return nil, apiresponses.ErrRawParamsInvalid
+	}
+	return obj, nil
+}
+
+// mergeParameters overlays the top-level keys of update onto current, as
+// OSBAPI update requests only carry the parameters being changed. A null
+// value removes the key.
+func mergeParameters(current, update json.RawMessage) (json.RawMessage, error) {
+	base, err := parseObject(current)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := parseObject(update)
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 {
+		return current, nil
+	}
+	if base == nil {
+		base = make(map[string]json.RawMessage, len(changes))
+	}
+	for k, v := range changes {
+		if bytes.Equal(bytes.TrimSpace(v), []byte("null")) {
+			delete(base, k)
+			continue
+		}
+		base[k] = v
+	}
+	if len(base) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(base)
+}
+
+// sameParameters reports whether two raw parameter objects are
+// semantically equal.
+func sameParameters(a, b json.RawMessage) bool {
+	oa, errA := parseObject(a)
+	ob, errB := parseObject(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	if len(oa) != len(ob) {
+		return false
+	}
+	for k, va := range oa {
+		vb, ok := ob[k]
+		if !ok {
+			return false
+		}
+		var x, y any
+		if json.Unmarshal(va, &x) != nil || json.Unmarshal(vb, &y) != nil {
+			return false
+		}
+		ja, _ := json.Marshal(x)
+		jb, _ := json.Marshal(y)
+		if !bytes.Equal(ja, jb) {
+			return false
+		}
+	}
+	return true
+}
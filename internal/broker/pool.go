@@ -0,0 +1,491 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/pivotal-cf/brokerapi/v11/domain"
+	"github.com/pivotal-cf/brokerapi/v11/domain/apiresponses"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+)
+
+// AttrServer is the instance attribute recording which pool server an
+// instance was placed on.
+const AttrServer = "server"
+
+// Placement strategies.
+const (
+	// StrategyLeastLoaded places an instance on the eligible server with
+	// the fewest instances relative to its capacity.
+	StrategyLeastLoaded = "least-loaded"
+	// StrategyRoundRobin cycles through the eligible servers.
+	StrategyRoundRobin = "round-robin"
+)
+
+// Server is one backing server in a Pool.
+type Server struct {
+	Name string
+	// Labels are matched against the labels required by a plan.
+	Labels map[string]string
+	// Capacity is the maximum number of instances; zero means unlimited.
+	Capacity int
+	// Draining servers keep serving their instances but receive no new
+	// ones.
+	Draining bool
+	Backend  Backend
+}
+
+// PlanPlacement restricts and steers placement for one plan.
+type PlanPlacement struct {
+	// Labels must all be present on a server for it to be eligible.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Strategy overrides the pool strategy for the plan.
+	Strategy string `json:"strategy,omitempty"`
+}
+
+var (
+	_ Backend        = (*Pool)(nil)
+	_ Validator      = (*Pool)(nil)
+	_ BindValidator  = (*Pool)(nil)
+	_ BindingUpdater = (*Pool)(nil)
+	_ Adopter        = (*Pool)(nil)
+	_ Runner         = (*Pool)(nil)
+)
+
+// Pool is a Backend spreading the instances of one service over several
+// servers. Each server has its own Backend. The server chosen at provision
+// is recorded in the AttrServer attribute, and later operations on the
+// instance are routed to it.
+//
+// Instances recorded without a server, e.g. from before the pool was
+// configured, belong to the first server.
+type Pool struct {
+	servers  []*Server
+	byName   map[string]*Server
+	strategy string
+	// plans is keyed by plan ID.
+	plans map[string]PlanPlacement
+
+	mu    sync.Mutex
+	store Store
+	// pending holds placements made for provisions that have not been
+	// recorded yet, so concurrent provisions see each other.
+	pending map[string]string
+	next    int
+}
+
+// NewPool creates a pool over servers, which must all offer the same
+// service. plans maps plan names to their placement rules.
+func NewPool(strategy string, plans map[string]PlanPlacement, servers ...*Server) (*Pool, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("pool needs at least one server")
+	}
+	if err := checkStrategy(strategy); err != nil {
+		return nil, err
+	}
+
+	p := &Pool{
+		servers:  servers,
+		byName:   make(map[string]*Server, len(servers)),
+		strategy: strategy,
+		plans:    make(map[string]PlanPlacement, len(plans)),
+		pending:  make(map[string]string),
+	}
+
+	service := servers[0].Backend.Service()
+	for _, s := range servers {
+		if s.Name == "" {
+			return nil, errors.New("pool servers must be named")
+		}
+		if _, ok := p.byName[s.Name]; ok {
+			return nil, fmt.Errorf("server %s is configured more than once", s.Name)
+		}
+		if id := s.Backend.Service().ID; id != service.ID {
+			return nil, fmt.Errorf("server %s offers service %s, not %s", s.Name, id, service.ID)
+		}
+		p.byName[s.Name] = s
+	}
+
+	for name, placement := range plans {
+		if err := checkStrategy(placement.Strategy); placement.Strategy != "" && err != nil {
+			return nil, fmt.Errorf("plan %s: %w", name, err)
+		}
+		id := ""
+		for _, plan := range service.Plans {
+			if plan.Name == name {
+				id = plan.ID
+			}
+		}
+		if id == "" {
+			return nil, fmt.Errorf("placement configured for unknown plan %q", name)
+		}
+		p.plans[id] = placement
+	}
+	return p, nil
+}
+
+func checkStrategy(strategy string) error {
+	switch strategy {
+	case StrategyLeastLoaded, StrategyRoundRobin:
+		return nil
+	default:
+		return fmt.Errorf("unknown placement strategy %q", strategy)
+	}
+}
+
+// useStore gives the pool access to the recorded instances, from which it
+// derives server load.
+func (p *Pool) useStore(store Store) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.store = store
+}
+
+// server returns the server an instance was placed on.
+func (p *Pool) server(instance *Instance) (*Server, error) {
+	name := instance.Attribute(AttrServer)
+	if name == "" {
+		return p.servers[0], nil
+	}
+	s, ok := p.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("instance is placed on server %s, which is not configured", name)
+	}
+	return s, nil
+}
+
+// Run runs the background work of every server backend that implements
+// Runner until ctx is done.
+func (p *Pool) Run(ctx context.Context) {
+	logger := logging.FromContext(ctx)
+	var wg sync.WaitGroup
+	for _, s := range p.servers {
+		r, ok := s.Backend.(Runner)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Run(logging.NewContext(ctx, logger.With(AttrServer, s.Name)))
+		}()
+	}
+	wg.Wait()
+}
+
+// Service returns the catalog entry shared by the pool's servers.
+func (p *Pool) Service() domain.Service {
+	return p.servers[0].Backend.Service()
+}
+
+// Validate delegates to the backend serving the instance or, for an
+// instance that has not been placed yet, to the backend of every server it
+// could be placed on, so that placement cannot turn valid parameters into
+// a failed provision.
+func (p *Pool) Validate(instance *Instance) error {
+	var servers []*Server
+	if instance.Attribute(AttrServer) != "" {
+		s, err := p.server(instance)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, s)
+	} else {
+		placement := p.plans[instance.PlanID]
+		for _, s := range p.servers {
+			if placeable(s, placement) {
+				servers = append(servers, s)
+			}
+		}
+	}
+	for _, s := range servers {
+		if v, ok := s.Backend.(Validator); ok {
+			if err := v.Validate(instance); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateBinding delegates to the instance's server backend.
+func (p *Pool) ValidateBinding(instance *Instance, binding *Binding) error {
+	s, err := p.server(instance)
+	if err != nil {
+		return err
+	}
+	if v, ok := s.Backend.(BindValidator); ok {
+		return v.ValidateBinding(instance, binding)
+	}
+	return nil
+}
+
+// Provision places the instance on a server and provisions it there. A
+// retried provision stays on the server chosen the first time.
+func (p *Pool) Provision(ctx context.Context, instance *Instance) error {
+	if instance.Attribute(AttrServer) == "" {
+		s, err := p.place(ctx, instance)
+		if err != nil {
+			return err
+		}
+		defer p.release(instance.ID)
+		instance.SetAttribute(AttrServer, s.Name)
+		logging.FromContext(ctx).Info("placed instance", AttrServer, s.Name)
+	}
+	s, err := p.server(instance)
+	if err != nil {
+		return err
+	}
+	return s.Backend.Provision(ctx, instance)
+}
+
+// place chooses a server for a new instance and reserves it until release
+// is called.
+func (p *Pool) place(ctx context.Context, instance *Instance) (*Server, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	loads, err := p.loadsLocked(ctx, instance.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	placement := p.plans[instance.PlanID]
+	strategy := p.strategy
+	if placement.Strategy != "" {
+		strategy = placement.Strategy
+	}
+
+	var eligible []*Server
+	for _, s := range p.servers {
+		if !placeable(s, placement) {
+			continue
+		}
+		if s.Capacity > 0 && loads[s.Name] >= s.Capacity {
+			continue
+		}
+		eligible = append(eligible, s)
+	}
+	if len(eligible) == 0 {
+		return nil, apiresponses.NewFailureResponse(
+			errors.New("no server has capacity for this plan"),
+			http.StatusUnprocessableEntity, "no-capacity",
+		)
+	}
+
+	var chosen *Server
+	switch strategy {
+	case StrategyRoundRobin:
+		chosen = eligible[p.next%len(eligible)]
+		p.next++
+	default:
+		for _, s := range eligible {
+			if chosen == nil || utilization(loads[s.Name], s.Capacity) < utilization(loads[chosen.Name], chosen.Capacity) {
+				chosen = s
+			}
+		}
+	}
+	p.pending[instance.ID] = chosen.Name
+	return chosen, nil
+}
+
+func (p *Pool) release(instanceID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pending, instanceID)
+}
+
+// loadsLocked counts the instances on each server, including pending
+// placements and excluding the instance being placed.
+func (p *Pool) loadsLocked(ctx context.Context, excludeID string) (map[string]int, error) {
+	loads := make(map[string]int, len(p.servers))
+	if p.store != nil {
+		instances, err := p.store.ListInstances(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count instances: %w", err)
+		}
+		service := p.Service().ID
+		for _, instance := range instances {
+			if instance.ServiceID != service || instance.ID == excludeID {
+				continue
+			}
+			if _, ok := p.pending[instance.ID]; ok {
+				continue
+			}
+			name := instance.Attribute(AttrServer)
+			if name == "" {
+				if op := instance.LastOperation; op.InProgress() && op.Type == OperationProvision {
+					// Recorded by an async provision that has not
+					// been placed yet.
+					continue
+				}
+				name = p.servers[0].Name
+			}
+			loads[name]++
+		}
+	}
+	for id, name := range p.pending {
+		if id != excludeID {
+			loads[name]++
+		}
+	}
+	return loads, nil
+}
+
+// utilization compares servers of different capacity. Unlimited servers
+// are compared by instance count alone.
+func utilization(load, capacity int) float64 {
+	if capacity <= 0 {
+		return float64(load)
+	}
+	return float64(load) / float64(capacity)
+}
+
+// placeable reports whether new instances of a plan may go to s, capacity
+// aside.
+func placeable(s *Server, placement PlanPlacement) bool {
+	return !s.Draining && hasLabels(s.Labels, placement.Labels)
+}
+
+func hasLabels(have, want map[string]string) bool {
+	for k, v := range want {
+		if have[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Deprovision implements Backend on the instance's server.
+func (p *Pool) Deprovision(ctx context.Context, instance *Instance) error {
+	s, err := p.server(instance)
+	if err != nil {
+		return err
+	}
+	return s.Backend.Deprovision(ctx, instance)
+}
+
+// Bind implements Backend on the instance's server.
+func (p *Pool) Bind(ctx context.Context, instance *Instance, binding *Binding) (map[string]any, error) {
+	s, err := p.server(instance)
+	if err != nil {
+		return nil, err
+	}
+	return s.Backend.Bind(ctx, instance, binding)
+}
+
+// Unbind implements Backend on the instance's server.
+func (p *Pool) Unbind(ctx context.Context, instance *Instance, binding *Binding) error {
+	s, err := p.server(instance)
+	if err != nil {
+		return err
+	}
+	return s.Backend.Unbind(ctx, instance, binding)
+}
+
+// Update implements Backend on the instance's server.
+func (p *Pool) Update(ctx context.Context, instance *Instance, previous *Instance) error {
+	s, err := p.server(instance)
+	if err != nil {
+		return err
+	}
+	return s.Backend.Update(ctx, instance, previous)
+}
+
+// UpdateBindings delegates to the instance's server backend.
+func (p *Pool) UpdateBindings(ctx context.Context, instance, previous *Instance, bindings []*Binding) error {
+	s, err := p.server(instance)
+	if err != nil {
+		return err
+	}
+	if u, ok := s.Backend.(BindingUpdater); ok {
+		return u.UpdateBindings(ctx, instance, previous, bindings)
+	}
+	return nil
+}
+
+// AdoptInstance looks for the instance's resources on every server, and
+// records the server they are found on.
+func (p *Pool) AdoptInstance(ctx context.Context, instance *Instance) (bool, error) {
+	for _, s := range p.servers {
+		a, ok := s.Backend.(Adopter)
+		if !ok {
+			continue
+		}
+		found, err := a.AdoptInstance(ctx, instance)
+		if err != nil {
+			return false, fmt.Errorf("server %s: %w", s.Name, err)
+		}
+		if found {
+			instance.SetAttribute(AttrServer, s.Name)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AdoptBinding delegates to the instance's server backend.
+func (p *Pool) AdoptBinding(ctx context.Context, instance *Instance, binding *Binding) (bool, error) {
+	s, err := p.server(instance)
+	if err != nil {
+		return false, err
+	}
+	if a, ok := s.Backend.(Adopter); ok {
+		return a.AdoptBinding(ctx, instance, binding)
+	}
+	return false, nil
+}
+
+// Describe adds the instance's server to its backend's description.
+func (p *Pool) Describe(ctx context.Context, instance *Instance) (map[string]any, error) {
+	s, err := p.server(instance)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := s.Backend.Describe(ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+	if desc == nil {
+		desc = make(map[string]any)
+	}
+	desc[AttrServer] = s.Name
+	return desc, nil
+}
+
+// ServerStatus describes a pool server for operators.
+type ServerStatus struct {
+	Service   string            `json:"service"`
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Capacity  int               `json:"capacity,omitempty"`
+	Draining  bool              `json:"draining"`
+	Instances int               `json:"instances"`
+}
+
+// Status reports every server with its current number of instances.
+func (p *Pool) Status(ctx context.Context) ([]ServerStatus, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	loads, err := p.loadsLocked(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	service := p.Service().Name
+	status := make([]ServerStatus, 0, len(p.servers))
+	for _, s := range p.servers {
+		status = append(status, ServerStatus{
+			Service:   service,
+			Name:      s.Name,
+			Labels:    s.Labels,
+			Capacity:  s.Capacity,
+			Draining:  s.Draining,
+			Instances: loads[s.Name],
+		})
+	}
+	return status, nil
+}
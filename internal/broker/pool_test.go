@@ -0,0 +1,301 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi/v11/domain"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+)
+
+// quietContext carries a logger that discards what the pool logs.
+var quietContext = logging.NewContext(context.Background(), discardLogger)
+
+// validatingBackend is a server backend that rejects every instance with
+// err.
+type validatingBackend struct {
+	*fakeBackend
+	err error
+}
+
+func (v *validatingBackend) Validate(*Instance) error {
+	return v.err
+}
+
+// newTestPool returns a pool over servers backed by fake backends, using
+// store for its load counts.
+func newTestPool(t *testing.T, strategy string, plans map[string]PlanPlacement, store Store, servers ...*Server) *Pool {
+	t.Helper()
+	for _, s := range servers {
+		if s.Backend == nil {
+			s.Backend = newFakeBackend()
+		}
+	}
+	p, err := NewPool(strategy, plans, servers...)
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+	p.useStore(store)
+	return p
+}
+
+// recordOn records an instance placed on the named server.
+func recordOn(t *testing.T, store Store, id, server string) {
+	t.Helper()
+	instance := &Instance{ID: id, ServiceID: testServiceID, PlanID: testPlanID}
+	if server != "" {
+		instance.SetAttribute(AttrServer, server)
+	}
+	if err := store.PutInstance(quietContext, instance); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolPlacement(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		plans    map[string]PlanPlacement
+		servers  []*Server
+		// recorded maps instance IDs to the server they are on.
+		recorded map[string]string
+		// want lists the servers of consecutive provisions.
+		want []string
+	}{
+		{
+			name:     "least loaded",
+			strategy: StrategyLeastLoaded,
+			servers:  []*Server{{Name: "a"}, {Name: "b"}},
+			recorded: map[string]string{"old-1": "a", "old-2": "a"},
+			want:     []string{"b", "b", "a"},
+		},
+		{
+			name:     "least loaded relative to capacity",
+			strategy: StrategyLeastLoaded,
+			servers:  []*Server{{Name: "a", Capacity: 10}, {Name: "b", Capacity: 2}},
+			recorded: map[string]string{"old-1": "a", "old-2": "b"},
+			want:     []string{"a", "a", "a", "a", "a", "b"},
+		},
+		{
+			name:     "round robin",
+			strategy: StrategyRoundRobin,
+			servers:  []*Server{{Name: "a"}, {Name: "b"}, {Name: "c"}},
+			recorded: map[string]string{"old-1": "b"},
+			want:     []string{"a", "b", "c", "a"},
+		},
+		{
+			name:     "plan strategy overrides the pool",
+			strategy: StrategyLeastLoaded,
+			plans:    map[string]PlanPlacement{"small": {Strategy: StrategyRoundRobin}},
+			servers:  []*Server{{Name: "a"}, {Name: "b"}},
+			recorded: map[string]string{"old-1": "a", "old-2": "a"},
+			want:     []string{"a", "b", "a"},
+		},
+		{
+			name:     "plan labels",
+			strategy: StrategyLeastLoaded,
+			plans:    map[string]PlanPlacement{"small": {Labels: map[string]string{"disk": "ssd"}}},
+			servers: []*Server{
+				{Name: "a", Labels: map[string]string{"disk": "hdd"}},
+				{Name: "b", Labels: map[string]string{"disk": "ssd", "zone": "1"}},
+			},
+			want: []string{"b", "b"},
+		},
+		{
+			name:     "draining servers are skipped",
+			strategy: StrategyLeastLoaded,
+			servers:  []*Server{{Name: "a", Draining: true}, {Name: "b"}},
+			recorded: map[string]string{"old-1": "b", "old-2": "b"},
+			want:     []string{"b", "b"},
+		},
+		{
+			name:     "full servers are skipped",
+			strategy: StrategyRoundRobin,
+			servers:  []*Server{{Name: "a", Capacity: 1}, {Name: "b"}},
+			recorded: map[string]string{"old-1": "a"},
+			want:     []string{"b", "b"},
+		},
+		{
+			name:     "unplaced instances belong to the first server",
+			strategy: StrategyLeastLoaded,
+			servers:  []*Server{{Name: "a"}, {Name: "b"}},
+			recorded: map[string]string{"old-1": "", "old-2": ""},
+			want:     []string{"b", "b", "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			for id, server := range tt.recorded {
+				recordOn(t, store, id, server)
+			}
+			p := newTestPool(t, tt.strategy, tt.plans, store, tt.servers...)
+
+			var got []string
+			for i := range tt.want {
+				instance := &Instance{ID: "new-" + string(rune('0'+i)), ServiceID: testServiceID, PlanID: testPlanID}
+				if err := p.Provision(quietContext, instance); err != nil {
+					t.Fatalf("Provision %s: %v", instance.ID, err)
+				}
+				if err := store.PutInstance(quietContext, instance); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, instance.Attribute(AttrServer))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("placed on %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoolNoCapacity(t *testing.T) {
+	tests := []struct {
+		name    string
+		plans   map[string]PlanPlacement
+		servers []*Server
+	}{
+		{name: "all full", servers: []*Server{{Name: "a", Capacity: 1}, {Name: "b", Capacity: 1, Draining: true}}},
+		{
+			name:    "no server with the plan's labels",
+			plans:   map[string]PlanPlacement{"small": {Labels: map[string]string{"disk": "ssd"}}},
+			servers: []*Server{{Name: "a"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			recordOn(t, store, "old-1", "a")
+			p := newTestPool(t, StrategyLeastLoaded, tt.plans, store, tt.servers...)
+
+			instance := &Instance{ID: "new", ServiceID: testServiceID, PlanID: testPlanID}
+			err := p.Provision(quietContext, instance)
+			if statusOf(err) != http.StatusUnprocessableEntity {
+				t.Fatalf("Provision error = %v, want 422", err)
+			}
+			if len(p.pending) != 0 {
+				t.Errorf("pending placements = %v, want none", p.pending)
+			}
+		})
+	}
+}
+
+func TestPoolPendingPlacements(t *testing.T) {
+	store := NewMemoryStore()
+	p := newTestPool(t, StrategyLeastLoaded, nil, store, &Server{Name: "a", Capacity: 2}, &Server{Name: "b", Capacity: 2})
+	ctx := quietContext
+
+	// Provisions that have not been recorded yet see each other.
+	var placed []string
+	for _, id := range []string{"new-1", "new-2", "new-3"} {
+		s, err := p.place(ctx, &Instance{ID: id, ServiceID: testServiceID, PlanID: testPlanID})
+		if err != nil {
+			t.Fatalf("place %s: %v", id, err)
+		}
+		placed = append(placed, s.Name)
+	}
+	if want := []string{"a", "b", "a"}; !slices.Equal(placed, want) {
+		t.Errorf("placed on %q, want %q", placed, want)
+	}
+
+	// A pending instance that is also recorded counts once, and one being
+	// placed again does not count against itself.
+	recordOn(t, store, "new-1", "a")
+	// An asynchronous provision recorded before placement is not counted
+	// on the first server.
+	unplaced := &Instance{ID: "async", ServiceID: testServiceID, PlanID: testPlanID, LastOperation: newOperation(OperationProvision)}
+	if err := store.PutInstance(ctx, unplaced); err != nil {
+		t.Fatal(err)
+	}
+
+	p.mu.Lock()
+	loads, err := p.loadsLocked(ctx, "new-3")
+	p.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loads["a"] != 1 || loads["b"] != 1 {
+		t.Errorf("loads = %v, want a: 1, b: 1", loads)
+	}
+
+	p.release("new-1")
+	p.release("new-2")
+	p.release("new-3")
+	if len(p.pending) != 0 {
+		t.Errorf("pending placements = %v, want none", p.pending)
+	}
+}
+
+func TestPoolValidate(t *testing.T) {
+	rejected := errors.New("unsupported parameter")
+	newPool := func() *Pool {
+		return newTestPool(t, StrategyLeastLoaded,
+			map[string]PlanPlacement{"small": {Labels: map[string]string{"disk": "ssd"}}},
+			NewMemoryStore(),
+			&Server{Name: "a", Labels: map[string]string{"disk": "ssd"}},
+			&Server{Name: "b", Labels: map[string]string{"disk": "ssd"}, Backend: &validatingBackend{fakeBackend: newFakeBackend(), err: rejected}},
+			&Server{Name: "c", Backend: &validatingBackend{fakeBackend: newFakeBackend(), err: errors.New("not eligible")}},
+			&Server{Name: "d", Labels: map[string]string{"disk": "ssd"}, Draining: true,
+				Backend: &validatingBackend{fakeBackend: newFakeBackend(), err: errors.New("draining")}},
+		)
+	}
+
+	tests := []struct {
+		name     string
+		server   string
+		planID   string
+		wantErr  error
+		wantPass bool
+	}{
+		{name: "unplaced checks every eligible server", planID: testPlanID, wantErr: rejected},
+		{name: "placed checks its server", server: "a", planID: testPlanID, wantPass: true},
+		{name: "placed on a rejecting server", server: "b", planID: testPlanID, wantErr: rejected},
+		{name: "other plans are not restricted", planID: otherPlanID, wantErr: rejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := &Instance{ID: "inst-1", ServiceID: testServiceID, PlanID: tt.planID}
+			if tt.server != "" {
+				instance.SetAttribute(AttrServer, tt.server)
+			}
+			err := newPool().Validate(instance)
+			switch {
+			case tt.wantPass && err != nil:
+				t.Errorf("Validate: %v", err)
+			case !tt.wantPass && !errors.Is(err, tt.wantErr):
+				t.Errorf("Validate error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBrokerPoolProvision(t *testing.T) {
+	a, b := newFakeBackend(), newFakeBackend()
+	pool, err := NewPool(StrategyRoundRobin, nil, &Server{Name: "a", Backend: a}, &Server{Name: "b", Backend: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	brk := newTestBroker(t, pool, false)
+	ctx := quietContext
+
+	for _, id := range []string{"inst-1", "inst-2"} {
+		if _, err := brk.Provision(ctx, id, provisionDetails(""), false); err != nil {
+			t.Fatalf("Provision %s: %v", id, err)
+		}
+	}
+	for _, tt := range []struct{ id, server string }{{"inst-1", "a"}, {"inst-2", "b"}} {
+		spec, err := brk.GetInstance(ctx, tt.id, domain.FetchInstanceDetails{})
+		if err != nil {
+			t.Fatalf("GetInstance %s: %v", tt.id, err)
+		}
+		if got := spec.Parameters.(map[string]any)[AttrServer]; got != tt.server {
+			t.Errorf("%s is on server %v, want %s", tt.id, got, tt.server)
+		}
+	}
+	if got := a.takeCalls(); !slices.Equal(got, []string{"provision inst-1"}) {
+		t.Errorf("server a calls = %q", got)
+	}
+}
@@ -0,0 +1,49 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+)
+
+var _ broker.Adopter = (*Backend)(nil)
+
+// AdoptInstance reports whether the instance's database, or for the schema
+// plan its owner role, exists. Databases are named after the instance ID,
+// as the broker named them before it kept state.
+func (b *Backend) AdoptInstance(ctx context.Context, instance *broker.Instance) (bool, error) {
+	db, err := b.connectAdmin()
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer db.Close()
+
+	if instance.PlanID == SchemaPlanID {
+		exists, err := b.roleExists(ctx, db, b.ownerRoleName(instance.ID))
+		if err != nil {
+			return false, fmt.Errorf("failed to check role existence: %w", err)
+		}
+		return exists, nil
+	}
+	exists, err := b.databaseExists(ctx, db, b.dbName(instance.ID))
+	if err != nil {
+		return false, fmt.Errorf("failed to check database existence: %w", err)
+	}
+	return exists, nil
+}
+
+// AdoptBinding reports whether the binding's role exists.
+func (b *Backend) AdoptBinding(ctx context.Context, _ *broker.Instance, binding *broker.Binding) (bool, error) {
+	db, err := b.connectAdmin()
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer db.Close()
+
+	exists, err := b.roleExists(ctx, db, b.roleName(binding.ID))
+	if err != nil {
+		return false, fmt.Errorf("failed to check role existence: %w", err)
+	}
+	return exists, nil
+}
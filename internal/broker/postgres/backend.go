@@ -0,0 +1,445 @@
+package postgres
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi/v11/domain"
+	"github.com/pivotal-cf/brokerapi/v11/domain/apiresponses"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+
+	// PostgreSQL driver
+	_ "github.com/lib/pq"
+)
+
+// identifierPattern validates SQL identifiers to prevent injection.
+// Only allows alphanumeric characters and underscores.
+var identifierPattern = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// Service and plan IDs offered in the catalog.
+const (
+	ServiceID    = "postgresql-local-service-id"
+	SharedPlanID = "postgresql-local-shared-plan-id"
+	SchemaPlanID = "postgresql-local-schema-plan-id"
+)
+
+var (
+	_ broker.Backend   = (*Backend)(nil)
+	_ broker.Validator = (*Backend)(nil)
+	_ broker.Runner    = (*Backend)(nil)
+)
+
+// Backend implements broker.Backend for PostgreSQL.
+// It provisions databases and roles on a shared PostgreSQL instance.
+type Backend struct {
+	host      string
+	port      string
+	adminUser string
+	adminPass string
+	// sharedDB is the database holding the schemas of schema plan
+	// instances.
+	sharedDB string
+	// plans holds the limits of each plan, keyed by plan ID.
+	plans map[string]Limits
+	// connect opens an admin connection to the named database; tests
+	// replace it.
+	connect func(dbName string) (*sql.DB, error)
+}
+
+// New creates a new PostgreSQL backend. sharedDB is the database that
+// schema plan instances are created in; it is created on first use. limits
+// maps plan names to the resource limits of their instances.
+func New(host, port, adminUser, adminPass, sharedDB string, limits map[string]Limits) (*Backend, error) {
+	plans, err := planLimits(limits)
+	if err != nil {
+		return nil, err
+	}
+	b := &Backend{
+		host:      host,
+		port:      port,
+		adminUser: adminUser,
+		adminPass: adminPass,
+		sharedDB:  sharedDB,
+		plans:     plans,
+	}
+	b.connect = b.open
+	return b, nil
+}
+
+func (b *Backend) connectAdmin() (*sql.DB, error) {
+	return b.connect("postgres")
+}
+
+// open opens an admin connection to the named database.
+func (b *Backend) open(dbName string) (*sql.DB, error) {
+	connStr := fmt.Sprintf(
+		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		b.host, b.port, b.adminUser, b.adminPass, quoteConnValue(dbName),
+	)
+	return sql.Open("postgres", connStr)
+}
+
+// exec runs a statement on the admin connection inside a client span. The
+// statement text is not recorded because it may contain passwords.
+func (b *Backend) exec(ctx context.Context, db *sql.DB, operation, query string, args ...any) error {
+	ctx, span := tracing.StartClient(ctx, "postgresql "+operation, b.spanAttrs(operation)...)
+	_, err := db.ExecContext(ctx, query, args...)
+	tracing.End(span, err)
+	return err
+}
+
+// databaseExists looks up name in pg_database inside a client span.
+func (b *Backend) databaseExists(ctx context.Context, db *sql.DB, name string) (bool, error) {
+	ctx, span := tracing.StartClient(ctx, "postgresql SELECT pg_database", b.spanAttrs("SELECT")...)
+	var exists bool
+	err := db.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM pg_database WHERE datname = $1)", name,
+	).Scan(&exists)
+	tracing.End(span, err)
+	return exists, err
+}
+
+func (b *Backend) spanAttrs(operation string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("db.system.name", "postgresql"),
+		attribute.String("db.operation.name", operation),
+		attribute.String("server.address", b.host),
+		attribute.String("server.port", b.port),
+	}
+}
+
+func (b *Backend) dbName(instanceID string) string {
+	safe := sanitizeIdentifier(instanceID)
+	return "cf_" + safe
+}
+
+func (b *Backend) roleName(bindingID string) string {
+	safe := sanitizeIdentifier(bindingID)
+	return "cf_" + safe
+}
+
+// sanitizeIdentifier replaces hyphens with underscores and removes any
+// characters that are not alphanumeric or underscores.
+func sanitizeIdentifier(id string) string {
+	s := strings.ReplaceAll(id, "-", "_")
+	// Remove anything that is not alphanumeric or underscore
+	safe := regexp.MustCompile(`[^a-zA-Z0-9_]`).ReplaceAllString(s, "")
+	return safe
+}
+
+func validateIdentifier(name string) error {
+	if !identifierPattern.MatchString(name) {
+		return fmt.Errorf("invalid identifier: %s", name)
+	}
+	return nil
+}
+
+func generatePassword(length int) (string, error) {
+	bytes := make([]byte, length)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate random password: %w", err)
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// Service returns the catalog entry for the PostgreSQL service.
+func (b *Backend) Service() domain.Service {
+	return domain.Service{
+		ID:          ServiceID,
+		Name:        "postgresql-local",
+		Description: "PostgreSQL database on a shared local instance",
+		Bindable:    true,
+		Tags:        []string{"postgresql", "sql", "database"},
+		Plans: []domain.ServicePlan{
+			{
+				ID:          SharedPlanID,
+				Name:        "shared",
+				Description: "Creates a database on the shared PostgreSQL instance",
+				Free:        domain.FreeValue(true),
+			},
+			{
+				ID:          SchemaPlanID,
+				Name:        "schema",
+				Description: "Creates a schema in a database shared with other instances",
+				Free:        domain.FreeValue(true),
+			},
+		},
+		Metadata: &domain.ServiceMetadata{
+			DisplayName: "PostgreSQL (Local)",
+			LongDescription: "Provisions a dedicated database and credentials on a shared " +
+				"PostgreSQL instance running in the local cluster.",
+		},
+	}
+}
+
+// Validate rejects parameters, as the service has none.
+func (b *Backend) Validate(instance *broker.Instance) error {
+	var params struct{}
+	return instance.DecodeParameters(&params)
+}
+
+// Provision creates a new database for the service instance.
+func (b *Backend) Provision(ctx context.Context, instance *broker.Instance) error {
+	if instance.PlanID == SchemaPlanID {
+		return b.provisionSchema(ctx, instance)
+	}
+
+	logger := logging.FromContext(ctx)
+
+	dbName := b.dbName(instance.ID)
+	if err := validateIdentifier(dbName); err != nil {
+		return err
+	}
+
+	db, err := b.connectAdmin()
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer db.Close()
+
+	// Check if database already exists
+	exists, err := b.databaseExists(ctx, db, dbName)
+	if err != nil {
+		return fmt.Errorf("failed to check database existence: %w", err)
+	}
+	if exists {
+		return apiresponses.ErrInstanceAlreadyExists
+	}
+
+	// CREATE DATABASE cannot use parameterized queries, so we validate the identifier strictly
+	err = b.exec(ctx, db, "CREATE DATABASE", fmt.Sprintf("CREATE DATABASE %s", quoteIdentifier(dbName)))
+	if err != nil {
+		return fmt.Errorf("failed to create database %s: %w", dbName, err)
+	}
+	if err := b.applyDatabaseLimits(ctx, db, dbName, instance.PlanID); err != nil {
+		return err
+	}
+
+	logger.Info("provisioned database", slog.String("database", dbName))
+	return nil
+}
+
+// Deprovision drops the database for the service instance.
+func (b *Backend) Deprovision(ctx context.Context, instance *broker.Instance) error {
+	if instance.PlanID == SchemaPlanID {
+		return b.deprovisionSchema(ctx, instance)
+	}
+
+	logger := logging.FromContext(ctx)
+
+	dbName := b.dbName(instance.ID)
+	if err := validateIdentifier(dbName); err != nil {
+		return err
+	}
+
+	db, err := b.connectAdmin()
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer db.Close()
+
+	// Terminate existing connections to the database
+	err = b.exec(ctx, db, "SELECT pg_terminate_backend",
+		"SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1 AND pid <> pg_backend_pid()",
+		dbName,
+	)
+	if err != nil {
+		logger.Warn("failed to terminate connections",
+			slog.String("database", dbName), slog.String(logging.KeyError, err.Error()))
+	}
+
+	// DROP DATABASE cannot use parameterized queries
+	err = b.exec(ctx, db, "DROP DATABASE", fmt.Sprintf("DROP DATABASE IF EXISTS %s", quoteIdentifier(dbName)))
+	if err != nil {
+		return fmt.Errorf("failed to drop database %s: %w", dbName, err)
+	}
+
+	// The owner role of a restored database owns nothing else.
+	owner := b.ownerRoleName(instance.ID)
+	if err := b.exec(ctx, db, "DROP ROLE", fmt.Sprintf("DROP ROLE IF EXISTS %s", quoteIdentifier(owner))); err != nil {
+		return fmt.Errorf("failed to drop role %s: %w", owner, err)
+	}
+
+	logger.Info("deprovisioned database", slog.String("database", dbName))
+	return nil
+}
+
+// Bind creates a new role with access to the provisioned database and returns credentials.
+func (b *Backend) Bind(ctx context.Context, instance *broker.Instance, binding *broker.Binding) (map[string]any, error) {
+	if instance.PlanID == SchemaPlanID {
+		return b.bindSchema(ctx, instance, binding)
+	}
+
+	logger := logging.FromContext(ctx)
+
+	dbName := b.dbName(instance.ID)
+	roleName := b.roleName(binding.ID)
+
+	if err := validateIdentifier(dbName); err != nil {
+		return nil, err
+	}
+	if err := validateIdentifier(roleName); err != nil {
+		return nil, err
+	}
+
+	password, err := generatePassword(16)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := b.connectAdmin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer db.Close()
+
+	// Create role with login and password
+	// Role names and passwords cannot use parameterized queries in CREATE ROLE
+	err = b.exec(ctx, db, "CREATE ROLE", fmt.Sprintf(
+		"CREATE ROLE %s WITH LOGIN PASSWORD %s",
+		quoteIdentifier(roleName),
+		quoteLiteral(password),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create role %s: %w", roleName, err)
+	}
+	if err := b.applyRoleLimits(ctx, db, roleName, b.limits(instance)); err != nil {
+		return nil, err
+	}
+
+	// Grant all privileges on the database to the role
+	err = b.exec(ctx, db, "GRANT", fmt.Sprintf(
+		"GRANT ALL PRIVILEGES ON DATABASE %s TO %s",
+		quoteIdentifier(dbName),
+		quoteIdentifier(roleName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to grant privileges: %w", err)
+	}
+
+	// Objects of a restored database belong to the instance's owner role.
+	owner := b.ownerRoleName(instance.ID)
+	hasOwner, err := b.roleExists(ctx, db, owner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check role existence: %w", err)
+	}
+	if hasOwner {
+		err = b.exec(ctx, db, "GRANT", fmt.Sprintf("GRANT %s TO %s", quoteIdentifier(owner), quoteIdentifier(roleName)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to grant privileges: %w", err)
+		}
+	}
+
+	uri := fmt.Sprintf("postgres://%s:%s@%s:%s/%s",
+		roleName, password, b.host, b.port, dbName,
+	)
+
+	logger.Info("created binding", slog.String("role", roleName), slog.String("database", dbName))
+
+	return map[string]any{
+		"host":     b.host,
+		"port":     b.port,
+		"database": dbName,
+		"username": roleName,
+		"password": password,
+		"uri":      uri,
+	}, nil
+}
+
+// Unbind drops the role created during binding.
+func (b *Backend) Unbind(ctx context.Context, instance *broker.Instance, binding *broker.Binding) error {
+	if instance.PlanID == SchemaPlanID {
+		return b.unbindSchema(ctx, instance, binding)
+	}
+
+	logger := logging.FromContext(ctx)
+
+	dbName := b.dbName(instance.ID)
+	roleName := b.roleName(binding.ID)
+
+	if err := validateIdentifier(dbName); err != nil {
+		return err
+	}
+	if err := validateIdentifier(roleName); err != nil {
+		return err
+	}
+
+	db, err := b.connectAdmin()
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer db.Close()
+
+	// Revoke privileges first
+	err = b.exec(ctx, db, "REVOKE", fmt.Sprintf(
+		"REVOKE ALL PRIVILEGES ON DATABASE %s FROM %s",
+		quoteIdentifier(dbName),
+		quoteIdentifier(roleName),
+	))
+	if err != nil {
+		logger.Warn("failed to revoke privileges",
+			slog.String("role", roleName), slog.String(logging.KeyError, err.Error()))
+	}
+
+	// Drop the role
+	err = b.exec(ctx, db, "DROP ROLE", fmt.Sprintf("DROP ROLE IF EXISTS %s", quoteIdentifier(roleName)))
+	if err != nil {
+		return fmt.Errorf("failed to drop role %s: %w", roleName, err)
+	}
+
+	logger.Info("removed binding", slog.String("role", roleName), slog.String("database", dbName))
+	return nil
+}
+
+// Update re-applies the limits of the instance's plan to its database and
+// binding roles, so that changed plan limits reach existing instances.
+func (b *Backend) Update(ctx context.Context, instance *broker.Instance, _ *broker.Instance) error {
+	return b.applyLimits(ctx, instance)
+}
+
+// Describe reports where the instance's database or schema lives and the
+// limits of its plan.
+func (b *Backend) Describe(_ context.Context, instance *broker.Instance) (map[string]any, error) {
+	if instance.PlanID == SchemaPlanID {
+		return map[string]any{
+			"host":     b.host,
+			"port":     b.port,
+			"database": b.sharedDB,
+			"schema":   b.schemaName(instance.ID),
+			"limits":   b.limits(instance),
+		}, nil
+	}
+	return map[string]any{
+		"host":     b.host,
+		"port":     b.port,
+		"database": b.dbName(instance.ID),
+		"limits":   b.limits(instance),
+	}, nil
+}
+
+// quoteIdentifier quotes a PostgreSQL identifier to prevent SQL injection.
+// It doubles any embedded double quotes per PostgreSQL quoting rules.
+func quoteIdentifier(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// quoteLiteral quotes a PostgreSQL string literal to prevent SQL injection.
+// It doubles any embedded single quotes per PostgreSQL quoting rules.
+func quoteLiteral(s string) string {
+	return `'` + strings.ReplaceAll(s, `'`, `''`) + `'`
+}
+
+// quoteConnValue quotes a value for a libpq key/value connection string.
+func quoteConnValue(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `'` + strings.ReplaceAll(s, `'`, `\'`) + `'`
+}
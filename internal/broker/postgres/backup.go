@@ -0,0 +1,375 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi/v11/domain/apiresponses"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+)
+
+var _ broker.Backuper = (*Backend)(nil)
+
+// Backups are pg_dump archives in custom format. They are restored without
+// their original owners and privileges: restored objects belong to the
+// instance's owner role, of which every binding role is a member. Shared
+// plan instances get an owner role on their first restore.
+
+// dumpSource returns the database holding the instance and the pg_dump
+// arguments selecting it.
+func (b *Backend) dumpSource(instance *broker.Instance) (string, []string, error) {
+	if instance.PlanID != SchemaPlanID {
+		return b.dbName(instance.ID), nil, nil
+	}
+	schema := b.schemaName(instance.ID)
+	if err := validateIdentifier(schema); err != nil {
+		return "", nil, err
+	}
+	return b.sharedDB, []string{"--schema=" + quoteIdentifier(schema)}, nil
+}
+
+// Backup streams a pg_dump archive of the instance's database or schema
+// to w.
+func (b *Backend) Backup(ctx context.Context, instance *broker.Instance, w io.Writer) error {
+	dbName, args, err := b.dumpSource(instance)
+	if err != nil {
+		return err
+	}
+	if _, err := exec.LookPath("pg_dump"); err != nil {
+		return fmt.Errorf("pg_dump is required for backups: %w", err)
+	}
+
+	ctx, span := tracing.StartClient(ctx, "postgresql pg_dump", b.spanAttrs("COPY")...)
+	n, err := func() (int64, error) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		dump := exec.CommandContext(ctx, "pg_dump", append(args,
+			"--no-password", "--format=custom",
+			"--host="+b.host, "--port="+b.port, "--username="+b.adminUser, "--dbname="+dbName)...)
+		dump.Env = append(os.Environ(), "PGPASSWORD="+b.adminPass)
+		var stderr strings.Builder
+		dump.Stderr = &stderr
+		out, err := dump.StdoutPipe()
+		if err != nil {
+			return 0, err
+		}
+		if err := dump.Start(); err != nil {
+			return 0, fmt.Errorf("failed to start pg_dump: %w", err)
+		}
+
+		n, copyErr := io.Copy(w, out)
+		if copyErr != nil {
+			cancel()
+		}
+		waitErr := dump.Wait()
+		// A failed write kills pg_dump, so its error comes first.
+		switch {
+		case copyErr != nil:
+			return n, fmt.Errorf("failed to write backup: %w", copyErr)
+		case waitErr != nil:
+			return n, fmt.Errorf("pg_dump failed: %w: %s", waitErr, strings.TrimSpace(stderr.String()))
+		}
+		return n, nil
+	}()
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+
+	logging.FromContext(ctx).Info("backed up database", slog.String("database", dbName), slog.Int64("bytes", n))
+	return nil
+}
+
+// ValidateRestore rejects restoring a schema plan backup into another
+// instance, as the schema name is part of the archive.
+func (b *Backend) ValidateRestore(instance *broker.Instance, backup broker.BackupInfo) error {
+	if instance.PlanID == SchemaPlanID && backup.InstanceID != instance.ID {
+		return apiresponses.NewFailureResponse(
+			errors.New("schema plan backups can only be restored into the instance they were taken of"),
+			http.StatusBadRequest, "invalid-backup",
+		)
+	}
+	return nil
+}
+
+// Restore replaces the instance's database or schema with a backup.
+func (b *Backend) Restore(ctx context.Context, instance *broker.Instance, backup broker.BackupInfo, r io.Reader) error {
+	if instance.PlanID == SchemaPlanID {
+		return b.restoreSchema(ctx, instance, r)
+	}
+	return b.restoreDatabase(ctx, instance, r)
+}
+
+// pgRestore restores the archive read from r into dbName as role, in one
+// transaction.
+func (b *Backend) pgRestore(ctx context.Context, dbName, role string, r io.Reader) error {
+	if _, err := exec.LookPath("pg_restore"); err != nil {
+		return fmt.Errorf("pg_restore is required for restores: %w", err)
+	}
+
+	ctx, span := tracing.StartClient(ctx, "postgresql pg_restore", b.spanAttrs("COPY")...)
+	restore := exec.CommandContext(ctx, "pg_restore",
+		"--no-password", "--no-owner", "--no-privileges", "--single-transaction", "--exit-on-error",
+		"--role="+role,
+		"--host="+b.host, "--port="+b.port, "--username="+b.adminUser, "--dbname="+dbName)
+	restore.Env = append(os.Environ(), "PGPASSWORD="+b.adminPass)
+	restore.Stdin = r
+	var stderr strings.Builder
+	restore.Stderr = &stderr
+	err := restore.Run()
+	if err != nil {
+		err = fmt.Errorf("pg_restore failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	tracing.End(span, err)
+	return err
+}
+
+// ensureOwnerRole creates the instance's NOLOGIN owner role if needed.
+func (b *Backend) ensureOwnerRole(ctx context.Context, admin *sql.DB, owner string) error {
+	exists, err := b.roleExists(ctx, admin, owner)
+	if err != nil {
+		return fmt.Errorf("failed to check role existence: %w", err)
+	}
+	if exists {
+		return nil
+	}
+	if err := b.exec(ctx, admin, "CREATE ROLE", fmt.Sprintf("CREATE ROLE %s NOLOGIN", quoteIdentifier(owner))); err != nil {
+		return fmt.Errorf("failed to create role %s: %w", owner, err)
+	}
+	return nil
+}
+
+// grantOwnerRole gives the owner role of a shared plan instance access to
+// its database and makes roles members of it.
+func (b *Backend) grantOwnerRole(ctx context.Context, admin *sql.DB, dbName, owner string, roles []string) error {
+	err := b.exec(ctx, admin, "GRANT", fmt.Sprintf(
+		"GRANT ALL PRIVILEGES ON DATABASE %s TO %s", quoteIdentifier(dbName), quoteIdentifier(owner),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to grant privileges: %w", err)
+	}
+	for _, role := range roles {
+		if err := validateIdentifier(role); err != nil {
+			return err
+		}
+		grants := []string{
+			fmt.Sprintf("GRANT ALL PRIVILEGES ON DATABASE %s TO %s", quoteIdentifier(dbName), quoteIdentifier(role)),
+			fmt.Sprintf("GRANT %s TO %s", quoteIdentifier(owner), quoteIdentifier(role)),
+		}
+		for _, grant := range grants {
+			if err := b.exec(ctx, admin, "GRANT", grant); err != nil {
+				return fmt.Errorf("failed to grant privileges to %s: %w", role, err)
+			}
+		}
+	}
+	return nil
+}
+
+// restoreDatabase restores a shared plan backup into a new database and
+// swaps it in for the instance's database once the restore has succeeded.
+func (b *Backend) restoreDatabase(ctx context.Context, instance *broker.Instance, r io.Reader) error {
+	logger := logging.FromContext(ctx)
+
+	dbName := b.dbName(instance.ID)
+	staging, old := dbName+"_restore", dbName+"_old"
+	owner := b.ownerRoleName(instance.ID)
+	for _, name := range []string{staging, old, owner} {
+		if err := validateIdentifier(name); err != nil {
+			return err
+		}
+	}
+
+	admin, err := b.connectAdmin()
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer admin.Close()
+
+	roles, err := b.bindingRoles(ctx, admin, instance)
+	if err != nil {
+		return fmt.Errorf("failed to list binding roles: %w", err)
+	}
+	if err := b.ensureOwnerRole(ctx, admin, owner); err != nil {
+		return err
+	}
+
+	// Leftovers of an interrupted restore are dropped.
+	for _, name := range []string{staging, old} {
+		if err := b.exec(ctx, admin, "DROP DATABASE", fmt.Sprintf("DROP DATABASE IF EXISTS %s", quoteIdentifier(name))); err != nil {
+			return fmt.Errorf("failed to drop database %s: %w", name, err)
+		}
+	}
+	if err := b.exec(ctx, admin, "CREATE DATABASE", fmt.Sprintf("CREATE DATABASE %s", quoteIdentifier(staging))); err != nil {
+		return fmt.Errorf("failed to create database %s: %w", staging, err)
+	}
+	dropStaging := func() {
+		if err := b.exec(ctx, admin, "DROP DATABASE", fmt.Sprintf("DROP DATABASE IF EXISTS %s", quoteIdentifier(staging))); err != nil {
+			logger.Warn("failed to drop staging database",
+				slog.String("database", staging), slog.String(logging.KeyError, err.Error()))
+		}
+	}
+
+	err = func() error {
+		err := b.exec(ctx, admin, "GRANT", fmt.Sprintf(
+			"GRANT ALL PRIVILEGES ON DATABASE %s TO %s", quoteIdentifier(staging), quoteIdentifier(owner),
+		))
+		if err != nil {
+			return fmt.Errorf("failed to grant privileges: %w", err)
+		}
+		db, err := b.connect(staging)
+		if err != nil {
+			return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+		}
+		defer db.Close()
+		err = b.exec(ctx, db, "GRANT", fmt.Sprintf("GRANT ALL ON SCHEMA public TO %s", quoteIdentifier(owner)))
+		if err != nil {
+			return fmt.Errorf("failed to grant privileges on schema public: %w", err)
+		}
+		return b.pgRestore(ctx, staging, owner, r)
+	}()
+	if err != nil {
+		dropStaging()
+		return err
+	}
+
+	// Swap the databases. Renaming requires that nobody is connected, so
+	// connections are refused while the old database is moved aside.
+	allowConnections := func(name string, allow bool) error {
+		return b.exec(ctx, admin, "ALTER DATABASE", fmt.Sprintf(
+			"ALTER DATABASE %s ALLOW_CONNECTIONS %t", quoteIdentifier(name), allow,
+		))
+	}
+	rename := func(from, to string) error {
+		return b.exec(ctx, admin, "ALTER DATABASE", fmt.Sprintf(
+			"ALTER DATABASE %s RENAME TO %s", quoteIdentifier(from), quoteIdentifier(to),
+		))
+	}
+	if err := allowConnections(dbName, false); err != nil {
+		dropStaging()
+		return fmt.Errorf("failed to close database %s: %w", dbName, err)
+	}
+	err = b.exec(ctx, admin, "SELECT pg_terminate_backend",
+		"SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1 AND pid <> pg_backend_pid()",
+		dbName,
+	)
+	if err == nil {
+		err = rename(dbName, old)
+	}
+	if err != nil {
+		_ = allowConnections(dbName, true)
+		dropStaging()
+		return fmt.Errorf("failed to move database %s aside: %w", dbName, err)
+	}
+	if err := rename(staging, dbName); err != nil {
+		_ = rename(old, dbName)
+		_ = allowConnections(dbName, true)
+		dropStaging()
+		return fmt.Errorf("failed to rename restored database: %w", err)
+	}
+	if err := b.exec(ctx, admin, "DROP DATABASE", fmt.Sprintf("DROP DATABASE %s", quoteIdentifier(old))); err != nil {
+		logger.Warn("failed to drop replaced database",
+			slog.String("database", old), slog.String(logging.KeyError, err.Error()))
+	}
+
+	// Bring the restored database in line with the instance.
+	if err := b.applyDatabaseLimits(ctx, admin, dbName, instance.PlanID); err != nil {
+		return err
+	}
+	if err := b.grantOwnerRole(ctx, admin, dbName, owner, roles); err != nil {
+		return err
+	}
+
+	logger.Info("restored database", slog.String("database", dbName), slog.Int("roles", len(roles)))
+	return nil
+}
+
+// restoreSchema restores a schema plan backup. The instance's schema is
+// renamed aside while the archive, which creates the schema itself, is
+// restored, and put back if the restore fails.
+func (b *Backend) restoreSchema(ctx context.Context, instance *broker.Instance, r io.Reader) error {
+	logger := logging.FromContext(ctx)
+
+	schema := b.schemaName(instance.ID)
+	old := schema + "_old"
+	owner := b.ownerRoleName(instance.ID)
+	for _, name := range []string{schema, old, owner} {
+		if err := validateIdentifier(name); err != nil {
+			return err
+		}
+	}
+
+	admin, err := b.connectAdmin()
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer admin.Close()
+	db, err := b.connect(b.sharedDB)
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer db.Close()
+
+	if err := b.exec(ctx, db, "DROP SCHEMA", fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", quoteIdentifier(old))); err != nil {
+		return fmt.Errorf("failed to drop schema %s: %w", old, err)
+	}
+	err = b.exec(ctx, db, "ALTER SCHEMA", fmt.Sprintf("ALTER SCHEMA %s RENAME TO %s", quoteIdentifier(schema), quoteIdentifier(old)))
+	if err != nil {
+		return fmt.Errorf("failed to move schema %s aside: %w", schema, err)
+	}
+
+	// The owner role creates the schema, which needs CREATE on the shared
+	// database for the duration of the restore.
+	err = b.exec(ctx, admin, "GRANT", fmt.Sprintf(
+		"GRANT CREATE ON DATABASE %s TO %s", quoteIdentifier(b.sharedDB), quoteIdentifier(owner),
+	))
+	if err == nil {
+		err = b.pgRestore(ctx, b.sharedDB, owner, r)
+		revokeErr := b.exec(ctx, admin, "REVOKE", fmt.Sprintf(
+			"REVOKE CREATE ON DATABASE %s FROM %s", quoteIdentifier(b.sharedDB), quoteIdentifier(owner),
+		))
+		if revokeErr != nil {
+			logger.Warn("failed to revoke CREATE from owner role",
+				slog.String("role", owner), slog.String(logging.KeyError, revokeErr.Error()))
+		}
+	}
+	if err != nil {
+		_ = b.exec(ctx, db, "DROP SCHEMA", fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", quoteIdentifier(schema)))
+		if renameErr := b.exec(ctx, db, "ALTER SCHEMA", fmt.Sprintf(
+			"ALTER SCHEMA %s RENAME TO %s", quoteIdentifier(old), quoteIdentifier(schema),
+		)); renameErr != nil {
+			logger.Error("failed to put schema back after failed restore",
+				slog.String("schema", old), slog.String(logging.KeyError, renameErr.Error()))
+		}
+		return err
+	}
+
+	if err := b.exec(ctx, db, "DROP SCHEMA", fmt.Sprintf("DROP SCHEMA %s CASCADE", quoteIdentifier(old))); err != nil {
+		logger.Warn("failed to drop replaced schema",
+			slog.String("schema", old), slog.String(logging.KeyError, err.Error()))
+	}
+	// Sessions still using objects of the replaced schema reconnect.
+	err = b.exec(ctx, db, "SELECT pg_terminate_backend", `
+		SELECT pg_terminate_backend(a.pid) FROM pg_stat_activity a
+		JOIN pg_auth_members m ON m.member = a.usesysid
+		JOIN pg_roles r ON r.oid = m.roleid
+		WHERE r.rolname = $1 AND a.pid <> pg_backend_pid()`, owner,
+	)
+	if err != nil {
+		logger.Warn("failed to terminate connections",
+			slog.String("schema", schema), slog.String(logging.KeyError, err.Error()))
+	}
+
+	logger.Info("restored schema", slog.String("database", b.sharedDB), slog.String("schema", schema))
+	return nil
+}
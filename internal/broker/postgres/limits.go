@@ -0,0 +1,247 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+)
+
+// Limits caps the resources one instance can use. Zero values leave the
+// server defaults in place.
+type Limits struct {
+	// ConnectionLimit is the CONNECTION LIMIT of the instance's database.
+	// It does not apply to the schema plan, whose database is shared.
+	ConnectionLimit int `json:"connection_limit,omitempty"`
+	// RoleConnectionLimit is the CONNECTION LIMIT of each binding role.
+	RoleConnectionLimit int `json:"role_connection_limit,omitempty"`
+	// StatementTimeout, IdleInTransactionSessionTimeout and WorkMem are
+	// set on binding roles with ALTER ROLE ... SET, in PostgreSQL units
+	// such as "30s" or "64MB".
+	StatementTimeout                string `json:"statement_timeout,omitempty"`
+	IdleInTransactionSessionTimeout string `json:"idle_in_transaction_session_timeout,omitempty"`
+	WorkMem                         string `json:"work_mem,omitempty"`
+	// MaxSizeMB is the size quota of the instance's database, enforced by
+	// Run. It is not supported by the schema plan.
+	MaxSizeMB int64 `json:"max_size_mb,omitempty"`
+}
+
+var (
+	durationPattern = regexp.MustCompile(`^[0-9]+(us|ms|s|min|h|d)?$`)
+	memoryPattern   = regexp.MustCompile(`^[0-9]+(kB|MB|GB|TB)?$`)
+)
+
+// ValidateLimits checks limits, which map plan names to the limits of
+// their instances, as New does.
+func ValidateLimits(limits map[string]Limits) error {
+	_, err := planLimits(limits)
+	return err
+}
+
+// planLimits validates limits and keys them by plan ID.
+func planLimits(limits map[string]Limits) (map[string]Limits, error) {
+	plans := make(map[string]Limits, len(limits))
+	for name, l := range limits {
+		if err := l.validate(); err != nil {
+			return nil, fmt.Errorf("plan %s: %w", name, err)
+		}
+		id := ""
+		for _, plan := range (&Backend{}).Service().Plans {
+			if plan.Name == name {
+				id = plan.ID
+			}
+		}
+		if id == "" {
+			return nil, fmt.Errorf("limits configured for unknown plan %q", name)
+		}
+		if id == SchemaPlanID && l.MaxSizeMB > 0 {
+			return nil, fmt.Errorf("plan %s: max_size_mb is not supported", name)
+		}
+		plans[id] = l
+	}
+	return plans, nil
+}
+
+func (l Limits) validate() error {
+	if l.ConnectionLimit < 0 || l.RoleConnectionLimit < 0 || l.MaxSizeMB < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	for name, v := range map[string]string{
+		"statement_timeout":                   l.StatementTimeout,
+		"idle_in_transaction_session_timeout": l.IdleInTransactionSessionTimeout,
+	} {
+		if v != "" && !durationPattern.MatchString(v) {
+			return fmt.Errorf("invalid %s %q: want a number with an optional unit (us, ms, s, min, h, d)", name, v)
+		}
+	}
+	if l.WorkMem != "" && !memoryPattern.MatchString(l.WorkMem) {
+		return fmt.Errorf("invalid work_mem %q: want a number with an optional unit (kB, MB, GB, TB)", l.WorkMem)
+	}
+	return nil
+}
+
+// connectionLimit converts a limit to SQL, where -1 means unlimited.
+func connectionLimit(n int) int {
+	if n == 0 {
+		return -1
+	}
+	return n
+}
+
+// roleSettings lists the settings applied to binding roles, in a fixed
+// order.
+func (l Limits) roleSettings() []struct{ name, value string } {
+	return []struct{ name, value string }{
+		{"statement_timeout", l.StatementTimeout},
+		{"idle_in_transaction_session_timeout", l.IdleInTransactionSessionTimeout},
+		{"work_mem", l.WorkMem},
+	}
+}
+
+// limits returns the limits of the instance's plan.
+func (b *Backend) limits(instance *broker.Instance) Limits {
+	return b.plans[instance.PlanID]
+}
+
+// applyDatabaseLimits sets the CONNECTION LIMIT of a shared plan database
+// and records its plan as the database comment, from which Run looks up
+// its size quota.
+func (b *Backend) applyDatabaseLimits(ctx context.Context, db *sql.DB, dbName, planID string) error {
+	err := b.exec(ctx, db, "ALTER DATABASE", fmt.Sprintf(
+		"ALTER DATABASE %s CONNECTION LIMIT %d", quoteIdentifier(dbName), connectionLimit(b.plans[planID].ConnectionLimit),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to set connection limit of database %s: %w", dbName, err)
+	}
+	err = b.exec(ctx, db, "COMMENT ON DATABASE", fmt.Sprintf(
+		"COMMENT ON DATABASE %s IS %s", quoteIdentifier(dbName), quoteLiteral(planID),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to record the plan of database %s: %w", dbName, err)
+	}
+	return nil
+}
+
+// applyRoleLimits sets the connection limit and settings of a binding role,
+// resetting the settings the plan leaves unset.
+func (b *Backend) applyRoleLimits(ctx context.Context, db *sql.DB, role string, limits Limits) error {
+	err := b.exec(ctx, db, "ALTER ROLE", fmt.Sprintf(
+		"ALTER ROLE %s CONNECTION LIMIT %d", quoteIdentifier(role), connectionLimit(limits.RoleConnectionLimit),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to set connection limit of role %s: %w", role, err)
+	}
+	for _, s := range limits.roleSettings() {
+		query := fmt.Sprintf("ALTER ROLE %s RESET %s", quoteIdentifier(role), s.name)
+		if s.value != "" {
+			query = fmt.Sprintf("ALTER ROLE %s SET %s = %s", quoteIdentifier(role), s.name, quoteLiteral(s.value))
+		}
+		if err := b.exec(ctx, db, "ALTER ROLE", query); err != nil {
+			return fmt.Errorf("failed to set %s of role %s: %w", s.name, role, err)
+		}
+	}
+	return nil
+}
+
+// databaseGrantees lists the roles holding privileges on a database.
+func (b *Backend) databaseGrantees(ctx context.Context, db *sql.DB, dbName string) ([]string, error) {
+	ctx, span := tracing.StartClient(ctx, "postgresql SELECT pg_database", b.spanAttrs("SELECT")...)
+	roles, err := func() ([]string, error) {
+		rows, err := db.QueryContext(ctx, `
+			SELECT DISTINCT r.rolname FROM pg_database d
+			CROSS JOIN LATERAL aclexplode(d.datacl) a
+			JOIN pg_roles r ON r.oid = a.grantee
+			WHERE d.datname = $1`, dbName)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var roles []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return nil, err
+			}
+			roles = append(roles, name)
+		}
+		return roles, rows.Err()
+	}()
+	tracing.End(span, err)
+	return roles, err
+}
+
+// bindingRoles lists the binding roles of an instance.
+func (b *Backend) bindingRoles(ctx context.Context, db *sql.DB, instance *broker.Instance) ([]string, error) {
+	var (
+		candidates []string
+		err        error
+	)
+	if instance.PlanID == SchemaPlanID {
+		candidates, err = b.roleMembers(ctx, db, b.ownerRoleName(instance.ID))
+	} else {
+		candidates, err = b.databaseGrantees(ctx, db, b.dbName(instance.ID))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	owner := b.ownerRoleName(instance.ID)
+	var roles []string
+	for _, role := range candidates {
+		if role != b.adminUser && role != owner && strings.HasPrefix(role, "cf_") {
+			roles = append(roles, role)
+		}
+	}
+	return roles, nil
+}
+
+// applyLimits brings an existing instance and its binding roles in line
+// with the limits of its plan.
+func (b *Backend) applyLimits(ctx context.Context, instance *broker.Instance) error {
+	limits := b.limits(instance)
+
+	db, err := b.connectAdmin()
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer db.Close()
+
+	if instance.PlanID != SchemaPlanID {
+		dbName := b.dbName(instance.ID)
+		if err := b.applyDatabaseLimits(ctx, db, dbName, instance.PlanID); err != nil {
+			return err
+		}
+		// A raised quota releases a read-only database right away.
+		usage, err := b.databaseUsage(ctx, db, dbName)
+		if err != nil {
+			return fmt.Errorf("failed to check database size: %w", err)
+		}
+		for _, u := range usage {
+			if err := b.enforceQuota(ctx, db, u, limits.MaxSizeMB); err != nil {
+				return err
+			}
+		}
+	}
+
+	roles, err := b.bindingRoles(ctx, db, instance)
+	if err != nil {
+		return fmt.Errorf("failed to list binding roles: %w", err)
+	}
+	for _, role := range roles {
+		if err := validateIdentifier(role); err != nil {
+			return err
+		}
+		if err := b.applyRoleLimits(ctx, db, role, limits); err != nil {
+			return err
+		}
+	}
+
+	logging.FromContext(ctx).Info("applied plan limits", slog.Int("roles", len(roles)))
+	return nil
+}
@@ -0,0 +1,201 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+)
+
+var _ broker.Migrator = (*Backend)(nil)
+
+// progressInterval is how often a running copy reports the bytes streamed.
+const progressInterval = 10 * time.Second
+
+// MigrateTo streams a logical dump of the instance from this server into
+// the same database or schema on target, using pg_dump and psql. Ownership
+// is kept, so binding roles must already exist on target.
+func (b *Backend) MigrateTo(
+	ctx context.Context,
+	instance *broker.Instance,
+	target broker.Backend,
+	targetInstance *broker.Instance,
+	progress func(string),
+) error {
+	t, ok := target.(*Backend)
+	if !ok {
+		return fmt.Errorf("cannot migrate PostgreSQL instance to %T", target)
+	}
+
+	dbName, dumpArgs, err := b.dumpSource(instance)
+	if err != nil {
+		return err
+	}
+	dumpArgs = append(dumpArgs, "--no-password", "--format=plain")
+	targetDB := t.dbName(instance.ID)
+	if instance.PlanID == SchemaPlanID {
+		schema := b.schemaName(instance.ID)
+		targetDB = t.sharedDB
+
+		// The dump creates the schema itself.
+		db, err := t.connect(t.sharedDB)
+		if err != nil {
+			return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+		}
+		err = t.exec(ctx, db, "DROP SCHEMA", fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", quoteIdentifier(schema)))
+		db.Close()
+		if err != nil {
+			return fmt.Errorf("failed to prepare schema %s on target: %w", schema, err)
+		}
+	} else if err := b.copyOwnerRole(ctx, t, targetInstance); err != nil {
+		return err
+	}
+
+	ctx, span := tracing.StartClient(ctx, "postgresql pg_dump | psql", b.spanAttrs("COPY")...)
+	err = b.copyDump(ctx, dbName, dumpArgs, t, targetDB, progress)
+	tracing.End(span, err)
+	return err
+}
+
+// copyOwnerRole creates the owner role of a restored shared plan instance
+// on target, where the dump expects it, and makes the target's binding roles
+// members of it.
+func (b *Backend) copyOwnerRole(ctx context.Context, t *Backend, targetInstance *broker.Instance) error {
+	owner := b.ownerRoleName(targetInstance.ID)
+	admin, err := b.connectAdmin()
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	exists, err := b.roleExists(ctx, admin, owner)
+	admin.Close()
+	if err != nil {
+		return fmt.Errorf("failed to check role existence: %w", err)
+	}
+	if !exists {
+		return nil
+	}
+
+	targetAdmin, err := t.connectAdmin()
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer targetAdmin.Close()
+	if err := t.ensureOwnerRole(ctx, targetAdmin, owner); err != nil {
+		return err
+	}
+	roles, err := t.bindingRoles(ctx, targetAdmin, targetInstance)
+	if err != nil {
+		return fmt.Errorf("failed to list binding roles: %w", err)
+	}
+	return t.grantOwnerRole(ctx, targetAdmin, t.dbName(targetInstance.ID), owner, roles)
+}
+
+// copyDump pipes pg_dump of dbName on this server into psql on target,
+// counting the bytes that pass through the broker.
+func (b *Backend) copyDump(
+	ctx context.Context,
+	dbName string,
+	dumpArgs []string,
+	t *Backend,
+	targetDB string,
+	progress func(string),
+) error {
+	for _, tool := range []string{"pg_dump", "psql"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("%s is required for migration: %w", tool, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	dump := exec.CommandContext(ctx, "pg_dump", append(dumpArgs,
+		"--host="+b.host, "--port="+b.port, "--username="+b.adminUser, "--dbname="+dbName)...)
+	dump.Env = append(os.Environ(), "PGPASSWORD="+b.adminPass)
+	restore := exec.CommandContext(ctx, "psql",
+		"--no-password", "--quiet", "--single-transaction", "--set=ON_ERROR_STOP=1",
+		"--host="+t.host, "--port="+t.port, "--username="+t.adminUser, "--dbname="+targetDB)
+	restore.Env = append(os.Environ(), "PGPASSWORD="+t.adminPass)
+
+	var dumpErr, restoreErr strings.Builder
+	dump.Stderr = &dumpErr
+	restore.Stderr = &restoreErr
+
+	out, err := dump.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	in, err := restore.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := restore.Start(); err != nil {
+		return fmt.Errorf("failed to start psql: %w", err)
+	}
+	if err := dump.Start(); err != nil {
+		cancel()
+		_ = restore.Wait()
+		return fmt.Errorf("failed to start pg_dump: %w", err)
+	}
+
+	var copied atomic.Int64
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				progress(fmt.Sprintf("copied %d MiB", copied.Load()>>20))
+			}
+		}
+	}()
+
+	_, copyErr := io.Copy(in, io.TeeReader(out, countWriter{&copied}))
+	close(done)
+	in.Close()
+	if copyErr != nil {
+		cancel()
+	}
+	waitDump := dump.Wait()
+	waitRestore := restore.Wait()
+
+	// A failing psql stops reading and makes pg_dump fail too, so its
+	// error is the more useful one.
+	switch {
+	case waitRestore != nil:
+		return fmt.Errorf("psql failed: %w: %s", waitRestore, strings.TrimSpace(restoreErr.String()))
+	case waitDump != nil:
+		return fmt.Errorf("pg_dump failed: %w: %s", waitDump, strings.TrimSpace(dumpErr.String()))
+	case copyErr != nil:
+		return fmt.Errorf("failed to stream dump: %w", copyErr)
+	}
+
+	logging.FromContext(ctx).Info("copied database", "database", dbName, "bytes", copied.Load())
+	return nil
+}
+
+// countWriter adds the length of every write to n.
+type countWriter struct{ n *atomic.Int64 }
+
+func (w countWriter) Write(p []byte) (int, error) {
+	w.n.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// RemoveMigrated drops the instance's database or schema. Deprovision
+// already removes data unconditionally.
+func (b *Backend) RemoveMigrated(ctx context.Context, instance *broker.Instance) error {
+	return b.Deprovision(ctx, instance)
+}
@@ -0,0 +1,214 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+)
+
+// quotaInterval is how often Run measures the instance databases.
+const quotaInterval = time.Minute
+
+// quotaWarnPercents are the quota usage levels, in percent, that are logged
+// as warnings when a database first reaches them.
+var quotaWarnPercents = []int64{80, 90}
+
+var (
+	databaseSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "postgres_database_size_bytes",
+		Help: "Size of shared plan databases.",
+	}, []string{"server", "database"})
+
+	databaseQuota = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "postgres_database_quota_bytes",
+		Help: "Size quota of shared plan databases; absent when unlimited.",
+	}, []string{"server", "database"})
+
+	databaseQuotaExceeded = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "postgres_database_quota_exceeded",
+		Help: "1 while a database is read-only for exceeding its size quota.",
+	}, []string{"server", "database"})
+)
+
+// databaseUsage is the measured state of one shared plan database.
+type databaseUsage struct {
+	name string
+	// planID is the plan recorded by applyDatabaseLimits, or "" for
+	// databases provisioned before plans were recorded.
+	planID   string
+	size     int64
+	readOnly bool
+}
+
+// databaseUsage measures the named shared plan database, or all of them if
+// name is empty, and reports the plan of each and whether it has been made
+// read-only.
+func (b *Backend) databaseUsage(ctx context.Context, db *sql.DB, name string) ([]databaseUsage, error) {
+	ctx, span := tracing.StartClient(ctx, "postgresql SELECT pg_database_size", b.spanAttrs("SELECT")...)
+	usage, err := func() ([]databaseUsage, error) {
+		rows, err := db.QueryContext(ctx, `
+			SELECT d.datname, COALESCE(shobj_description(d.oid, 'pg_database'), ''), pg_database_size(d.oid),
+				COALESCE('default_transaction_read_only=on' = ANY(s.setconfig), false)
+			FROM pg_database d
+			LEFT JOIN pg_db_role_setting s ON s.setdatabase = d.oid AND s.setrole = 0
+			WHERE d.datname LIKE 'cf\_%' AND d.datname <> $1 AND d.datallowconn
+				AND ($2 = '' OR d.datname = $2)`, b.sharedDB, name)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var usage []databaseUsage
+		for rows.Next() {
+			var u databaseUsage
+			if err := rows.Scan(&u.name, &u.planID, &u.size, &u.readOnly); err != nil {
+				return nil, err
+			}
+			usage = append(usage, u)
+		}
+		return usage, rows.Err()
+	}()
+	tracing.End(span, err)
+	return usage, err
+}
+
+// enforceQuota makes a database read-only once it exceeds maxSizeMB and
+// writable again once it is back under it. Existing sessions are
+// terminated when the database becomes read-only, so that reconnecting
+// clients pick up the setting. Databases without a quota are left alone,
+// so a read-only setting made by an operator is kept.
+func (b *Backend) enforceQuota(ctx context.Context, db *sql.DB, u databaseUsage, maxSizeMB int64) error {
+	if maxSizeMB <= 0 {
+		return nil
+	}
+	logger := logging.FromContext(ctx)
+	exceeded := u.size > maxSizeMB<<20
+
+	switch {
+	case exceeded && !u.readOnly:
+		err := b.exec(ctx, db, "ALTER DATABASE", fmt.Sprintf(
+			"ALTER DATABASE %s SET default_transaction_read_only = on", quoteIdentifier(u.name),
+		))
+		if err != nil {
+			return fmt.Errorf("failed to make database %s read-only: %w", u.name, err)
+		}
+		err = b.exec(ctx, db, "SELECT pg_terminate_backend",
+			"SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1 AND usename <> current_user",
+			u.name,
+		)
+		if err != nil {
+			logger.Warn("failed to terminate connections",
+				slog.String("database", u.name), slog.String(logging.KeyError, err.Error()))
+		}
+		logger.Warn("database exceeded its size quota and was made read-only",
+			slog.String("database", u.name), slog.Int64("size_bytes", u.size), slog.Int64("max_size_mb", maxSizeMB))
+
+	case !exceeded && u.readOnly:
+		err := b.exec(ctx, db, "ALTER DATABASE", fmt.Sprintf(
+			"ALTER DATABASE %s RESET default_transaction_read_only", quoteIdentifier(u.name),
+		))
+		if err != nil {
+			return fmt.Errorf("failed to make database %s writable: %w", u.name, err)
+		}
+		logger.Info("database is within its size quota and writable again",
+			slog.String("database", u.name), slog.Int64("size_bytes", u.size), slog.Int64("max_size_mb", maxSizeMB))
+	}
+	return nil
+}
+
+// Run measures the shared plan databases every quotaInterval, exports their
+// sizes as metrics, warns as they approach the max_size_mb of their plan
+// and makes them read-only while they exceed it.
+func (b *Backend) Run(ctx context.Context) {
+	logger := logging.FromContext(ctx)
+	// levels holds the last warning level of each database, so that each
+	// level is only logged once per crossing.
+	levels := make(map[string]int64)
+
+	ticker := time.NewTicker(quotaInterval)
+	defer ticker.Stop()
+	for {
+		if err := b.checkQuotas(ctx, levels); err != nil && ctx.Err() == nil {
+			logger.Warn("failed to check database quotas", slog.String(logging.KeyError, err.Error()))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (b *Backend) checkQuotas(ctx context.Context, levels map[string]int64) error {
+	logger := logging.FromContext(ctx)
+	server := b.host + ":" + b.port
+
+	db, err := b.connectAdmin()
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer db.Close()
+
+	usage, err := b.databaseUsage(ctx, db, "")
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, len(usage))
+	for _, u := range usage {
+		seen[u.name] = true
+		planID := u.planID
+		if planID == "" {
+			planID = SharedPlanID
+		}
+		maxSizeMB := b.plans[planID].MaxSizeMB
+		if err := b.enforceQuota(ctx, db, u, maxSizeMB); err != nil {
+			logger.Warn("failed to enforce database quota",
+				slog.String("database", u.name), slog.String(logging.KeyError, err.Error()))
+		}
+
+		databaseSize.WithLabelValues(server, u.name).Set(float64(u.size))
+		exceeded := 0.0
+		if maxSizeMB > 0 {
+			databaseQuota.WithLabelValues(server, u.name).Set(float64(maxSizeMB << 20))
+			if u.size > maxSizeMB<<20 {
+				exceeded = 1
+			}
+		} else {
+			databaseQuota.DeleteLabelValues(server, u.name)
+		}
+		databaseQuotaExceeded.WithLabelValues(server, u.name).Set(exceeded)
+
+		var level int64
+		if maxSizeMB > 0 {
+			percent := u.size * 100 / (maxSizeMB << 20)
+			for _, p := range quotaWarnPercents {
+				if percent >= p {
+					level = p
+				}
+			}
+			if level > levels[u.name] && percent < 100 {
+				logger.Warn("database is approaching its size quota",
+					slog.String("database", u.name), slog.Int64("percent", percent), slog.Int64("max_size_mb", maxSizeMB))
+			}
+		}
+		levels[u.name] = level
+	}
+
+	// Forget databases that have been deprovisioned.
+	for name := range levels {
+		if !seen[name] {
+			delete(levels, name)
+			databaseSize.DeleteLabelValues(server, name)
+			databaseQuota.DeleteLabelValues(server, name)
+			databaseQuotaExceeded.DeleteLabelValues(server, name)
+		}
+	}
+	return nil
+}
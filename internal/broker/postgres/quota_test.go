@@ -0,0 +1,128 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// newMockBackend returns a backend with the given plan limits whose admin
+// connections go to mock.
+func newMockBackend(t *testing.T, limits map[string]Limits) (*Backend, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+	b, err := New("postgres.local", "5432", "admin", "secret", "cf_shared", limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.connect = func(string) (*sql.DB, error) { return db, nil }
+	return b, mock
+}
+
+func exact(query string) string {
+	return "^" + regexp.QuoteMeta(query) + "$"
+}
+
+// expectUsage expects databaseUsage to list one database.
+func expectUsage(mock sqlmock.Sqlmock, name, planID string, sizeMB int64, readOnly bool) {
+	mock.ExpectQuery(`SELECT d\.datname`).
+		WithArgs("cf_shared", "").
+		WillReturnRows(sqlmock.NewRows([]string{"datname", "plan", "size", "read_only"}).
+			AddRow(name, planID, sizeMB<<20, readOnly))
+}
+
+func TestCheckQuotas(t *testing.T) {
+	quota := map[string]Limits{"shared": {MaxSizeMB: 100}}
+
+	tests := []struct {
+		name     string
+		limits   map[string]Limits
+		planID   string
+		sizeMB   int64
+		readOnly bool
+		expect   func(mock sqlmock.Sqlmock)
+	}{
+		{
+			name:   "over quota",
+			limits: quota, planID: SharedPlanID, sizeMB: 150,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(exact(`ALTER DATABASE "cf_inst_1" SET default_transaction_read_only = on`)).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(`^SELECT pg_terminate_backend`).WithArgs("cf_inst_1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+		},
+		{
+			name:   "over quota and already read-only",
+			limits: quota, planID: SharedPlanID, sizeMB: 150, readOnly: true,
+		},
+		{
+			name:   "back under quota",
+			limits: quota, planID: SharedPlanID, sizeMB: 50, readOnly: true,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(exact(`ALTER DATABASE "cf_inst_1" RESET default_transaction_read_only`)).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+		},
+		{
+			name:   "under quota",
+			limits: quota, planID: SharedPlanID, sizeMB: 50,
+		},
+		{
+			name:   "plan not recorded",
+			limits: quota, sizeMB: 150,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`^ALTER DATABASE "cf_inst_1" SET default_transaction_read_only`).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(`^SELECT pg_terminate_backend`).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+		},
+		{
+			name:   "no quota",
+			limits: map[string]Limits{"shared": {ConnectionLimit: 10}}, planID: SharedPlanID, sizeMB: 150, readOnly: true,
+		},
+		{
+			name:   "no quota for the recorded plan",
+			limits: quota, planID: "retired-plan-id", sizeMB: 150, readOnly: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, mock := newMockBackend(t, tt.limits)
+			expectUsage(mock, "cf_inst_1", tt.planID, tt.sizeMB, tt.readOnly)
+			if tt.expect != nil {
+				tt.expect(mock)
+			}
+			if err := b.checkQuotas(context.Background(), make(map[string]int64)); err != nil {
+				t.Fatalf("checkQuotas: %v", err)
+			}
+		})
+	}
+}
+
+func TestApplyDatabaseLimitsRecordsPlan(t *testing.T) {
+	b, mock := newMockBackend(t, map[string]Limits{"shared": {ConnectionLimit: 10}})
+	mock.ExpectExec(exact(`ALTER DATABASE "cf_inst_1" CONNECTION LIMIT 10`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(exact(`COMMENT ON DATABASE "cf_inst_1" IS '` + SharedPlanID + `'`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	db, err := b.connectAdmin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.applyDatabaseLimits(context.Background(), db, "cf_inst_1", SharedPlanID); err != nil {
+		t.Fatalf("applyDatabaseLimits: %v", err)
+	}
+}
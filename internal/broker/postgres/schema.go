@@ -0,0 +1,381 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+)
+
+// The schema plan places every instance in its own schema inside sharedDB.
+// The schema is owned by a NOLOGIN owner role per instance. Binding roles
+// are members of the owner role and have their session role and search_path
+// pinned to it, so objects they create belong to the instance rather than
+// to the binding and survive unbinding.
+
+func (b *Backend) schemaName(instanceID string) string {
+	return "cf_" + sanitizeIdentifier(instanceID)
+}
+
+func (b *Backend) ownerRoleName(instanceID string) string {
+	return "cf_" + sanitizeIdentifier(instanceID) + "_owner"
+}
+
+// roleExists looks up name in pg_roles inside a client span.
+func (b *Backend) roleExists(ctx context.Context, db *sql.DB, name string) (bool, error) {
+	ctx, span := tracing.StartClient(ctx, "postgresql SELECT pg_roles", b.spanAttrs("SELECT")...)
+	var exists bool
+	err := db.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM pg_roles WHERE rolname = $1)", name,
+	).Scan(&exists)
+	tracing.End(span, err)
+	return exists, err
+}
+
+// roleMembers lists the roles that are members of role.
+func (b *Backend) roleMembers(ctx context.Context, db *sql.DB, role string) ([]string, error) {
+	ctx, span := tracing.StartClient(ctx, "postgresql SELECT pg_auth_members", b.spanAttrs("SELECT")...)
+	members, err := func() ([]string, error) {
+		rows, err := db.QueryContext(ctx, `
+			SELECT m.rolname FROM pg_auth_members a
+			JOIN pg_roles m ON m.oid = a.member
+			JOIN pg_roles r ON r.oid = a.roleid
+			WHERE r.rolname = $1`, role)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var members []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return nil, err
+			}
+			members = append(members, name)
+		}
+		return members, rows.Err()
+	}()
+	tracing.End(span, err)
+	return members, err
+}
+
+// ensureSharedDatabase creates the shared database on first use and locks
+// it down so that roles only reach the schemas they are granted.
+func (b *Backend) ensureSharedDatabase(ctx context.Context, admin *sql.DB) error {
+	if err := validateIdentifier(b.sharedDB); err != nil {
+		return err
+	}
+
+	exists, err := b.databaseExists(ctx, admin, b.sharedDB)
+	if err != nil {
+		return fmt.Errorf("failed to check database existence: %w", err)
+	}
+	if !exists {
+		err = b.exec(ctx, admin, "CREATE DATABASE", fmt.Sprintf("CREATE DATABASE %s", quoteIdentifier(b.sharedDB)))
+		if err != nil {
+			// Another provision may have created it concurrently.
+			if exists, checkErr := b.databaseExists(ctx, admin, b.sharedDB); checkErr != nil || !exists {
+				return fmt.Errorf("failed to create database %s: %w", b.sharedDB, err)
+			}
+		}
+	}
+
+	err = b.exec(ctx, admin, "REVOKE", fmt.Sprintf(
+		"REVOKE ALL ON DATABASE %s FROM PUBLIC", quoteIdentifier(b.sharedDB),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to revoke public access to database %s: %w", b.sharedDB, err)
+	}
+
+	db, err := b.connect(b.sharedDB)
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer db.Close()
+
+	if err := b.exec(ctx, db, "REVOKE", "REVOKE ALL ON SCHEMA public FROM PUBLIC"); err != nil {
+		return fmt.Errorf("failed to revoke public access to schema public: %w", err)
+	}
+	return nil
+}
+
+// provisionSchema creates the owner role and schema for a schema plan
+// instance.
+func (b *Backend) provisionSchema(ctx context.Context, instance *broker.Instance) error {
+	logger := logging.FromContext(ctx)
+
+	schema := b.schemaName(instance.ID)
+	owner := b.ownerRoleName(instance.ID)
+	if err := validateIdentifier(schema); err != nil {
+		return err
+	}
+
+	admin, err := b.connectAdmin()
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer admin.Close()
+
+	if err := b.ensureSharedDatabase(ctx, admin); err != nil {
+		return err
+	}
+
+	exists, err := b.roleExists(ctx, admin, owner)
+	if err != nil {
+		return fmt.Errorf("failed to check role existence: %w", err)
+	}
+	if !exists {
+		err = b.exec(ctx, admin, "CREATE ROLE", fmt.Sprintf("CREATE ROLE %s NOLOGIN", quoteIdentifier(owner)))
+		if err != nil {
+			return fmt.Errorf("failed to create role %s: %w", owner, err)
+		}
+	}
+
+	err = b.exec(ctx, admin, "GRANT", fmt.Sprintf(
+		"GRANT CONNECT ON DATABASE %s TO %s", quoteIdentifier(b.sharedDB), quoteIdentifier(owner),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to grant privileges: %w", err)
+	}
+
+	db, err := b.connect(b.sharedDB)
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer db.Close()
+
+	err = b.exec(ctx, db, "CREATE SCHEMA", fmt.Sprintf(
+		"CREATE SCHEMA IF NOT EXISTS %s AUTHORIZATION %s", quoteIdentifier(schema), quoteIdentifier(owner),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to create schema %s: %w", schema, err)
+	}
+
+	logger.Info("provisioned schema", slog.String("database", b.sharedDB), slog.String("schema", schema))
+	return nil
+}
+
+// deprovisionSchema drops the schema with everything in it, then the owner
+// role and any binding roles that were not unbound.
+func (b *Backend) deprovisionSchema(ctx context.Context, instance *broker.Instance) error {
+	logger := logging.FromContext(ctx)
+
+	schema := b.schemaName(instance.ID)
+	owner := b.ownerRoleName(instance.ID)
+	if err := validateIdentifier(schema); err != nil {
+		return err
+	}
+
+	admin, err := b.connectAdmin()
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer admin.Close()
+
+	exists, err := b.databaseExists(ctx, admin, b.sharedDB)
+	if err != nil {
+		return fmt.Errorf("failed to check database existence: %w", err)
+	}
+	if !exists {
+		logger.Info("shared database does not exist; nothing to deprovision")
+		return nil
+	}
+
+	ownerExists, err := b.roleExists(ctx, admin, owner)
+	if err != nil {
+		return fmt.Errorf("failed to check role existence: %w", err)
+	}
+	var members []string
+	if ownerExists {
+		if members, err = b.roleMembers(ctx, admin, owner); err != nil {
+			return fmt.Errorf("failed to list members of role %s: %w", owner, err)
+		}
+	}
+
+	db, err := b.connect(b.sharedDB)
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer db.Close()
+
+	// Terminate the sessions of the instance's binding roles
+	err = b.exec(ctx, db, "SELECT pg_terminate_backend", `
+		SELECT pg_terminate_backend(a.pid) FROM pg_stat_activity a
+		JOIN pg_auth_members m ON m.member = a.usesysid
+		JOIN pg_roles r ON r.oid = m.roleid
+		WHERE r.rolname = $1 AND a.pid <> pg_backend_pid()`, owner,
+	)
+	if err != nil {
+		logger.Warn("failed to terminate connections",
+			slog.String("schema", schema), slog.String(logging.KeyError, err.Error()))
+	}
+
+	err = b.exec(ctx, db, "DROP SCHEMA", fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", quoteIdentifier(schema)))
+	if err != nil {
+		return fmt.Errorf("failed to drop schema %s: %w", schema, err)
+	}
+
+	var roles []string
+	if ownerExists {
+		for _, member := range members {
+			// The admin user can be a member of roles it created.
+			if member != b.adminUser && strings.HasPrefix(member, "cf_") {
+				roles = append(roles, member)
+			}
+		}
+		roles = append(roles, owner)
+	}
+	for _, role := range roles {
+		if err := validateIdentifier(role); err != nil {
+			return err
+		}
+		// DROP OWNED also revokes the role's privileges in this database.
+		if err := b.exec(ctx, db, "DROP OWNED", fmt.Sprintf("DROP OWNED BY %s", quoteIdentifier(role))); err != nil {
+			return fmt.Errorf("failed to drop objects owned by %s: %w", role, err)
+		}
+		err = b.exec(ctx, admin, "REVOKE", fmt.Sprintf(
+			"REVOKE ALL PRIVILEGES ON DATABASE %s FROM %s", quoteIdentifier(b.sharedDB), quoteIdentifier(role),
+		))
+		if err != nil {
+			return fmt.Errorf("failed to revoke privileges: %w", err)
+		}
+		if err := b.exec(ctx, admin, "DROP ROLE", fmt.Sprintf("DROP ROLE IF EXISTS %s", quoteIdentifier(role))); err != nil {
+			return fmt.Errorf("failed to drop role %s: %w", role, err)
+		}
+	}
+
+	logger.Info("deprovisioned schema", slog.String("database", b.sharedDB), slog.String("schema", schema))
+	return nil
+}
+
+// bindSchema creates a login role confined to the instance's schema and
+// returns credentials.
+func (b *Backend) bindSchema(ctx context.Context, instance *broker.Instance, binding *broker.Binding) (map[string]any, error) {
+	logger := logging.FromContext(ctx)
+
+	schema := b.schemaName(instance.ID)
+	owner := b.ownerRoleName(instance.ID)
+	roleName := b.roleName(binding.ID)
+
+	if err := validateIdentifier(schema); err != nil {
+		return nil, err
+	}
+	if err := validateIdentifier(roleName); err != nil {
+		return nil, err
+	}
+
+	password, err := generatePassword(16)
+	if err != nil {
+		return nil, err
+	}
+
+	admin, err := b.connectAdmin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer admin.Close()
+
+	statements := []struct{ operation, query string }{
+		{"CREATE ROLE", fmt.Sprintf("CREATE ROLE %s WITH LOGIN PASSWORD %s",
+			quoteIdentifier(roleName), quoteLiteral(password))},
+		{"GRANT", fmt.Sprintf("GRANT CONNECT ON DATABASE %s TO %s",
+			quoteIdentifier(b.sharedDB), quoteIdentifier(roleName))},
+		{"GRANT", fmt.Sprintf("GRANT %s TO %s", quoteIdentifier(owner), quoteIdentifier(roleName))},
+		// Pin the session to the instance so that unqualified names
+		// resolve to its schema and new objects belong to the owner role.
+		{"ALTER ROLE", fmt.Sprintf("ALTER ROLE %s IN DATABASE %s SET search_path = %s",
+			quoteIdentifier(roleName), quoteIdentifier(b.sharedDB), quoteIdentifier(schema))},
+		{"ALTER ROLE", fmt.Sprintf("ALTER ROLE %s IN DATABASE %s SET role = %s",
+			quoteIdentifier(roleName), quoteIdentifier(b.sharedDB), quoteIdentifier(owner))},
+	}
+	for _, stmt := range statements {
+		if err := b.exec(ctx, admin, stmt.operation, stmt.query); err != nil {
+			return nil, fmt.Errorf("failed to set up role %s (%s): %w", roleName, stmt.operation, err)
+		}
+	}
+	if err := b.applyRoleLimits(ctx, admin, roleName, b.limits(instance)); err != nil {
+		return nil, err
+	}
+
+	uri := fmt.Sprintf("postgres://%s:%s@%s:%s/%s",
+		roleName, password, b.host, b.port, b.sharedDB,
+	)
+
+	logger.Info("created binding", slog.String("role", roleName), slog.String("schema", schema))
+
+	return map[string]any{
+		"host":     b.host,
+		"port":     b.port,
+		"database": b.sharedDB,
+		"schema":   schema,
+		"username": roleName,
+		"password": password,
+		"uri":      uri,
+	}, nil
+}
+
+// unbindSchema drops the binding role. Objects it created belong to the
+// owner role, so they are kept.
+func (b *Backend) unbindSchema(ctx context.Context, instance *broker.Instance, binding *broker.Binding) error {
+	logger := logging.FromContext(ctx)
+
+	owner := b.ownerRoleName(instance.ID)
+	roleName := b.roleName(binding.ID)
+	if err := validateIdentifier(roleName); err != nil {
+		return err
+	}
+
+	admin, err := b.connectAdmin()
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer admin.Close()
+
+	exists, err := b.roleExists(ctx, admin, roleName)
+	if err != nil {
+		return fmt.Errorf("failed to check role existence: %w", err)
+	}
+	if !exists {
+		logger.Info("role already removed", slog.String("role", roleName))
+		return nil
+	}
+
+	db, err := b.connect(b.sharedDB)
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer db.Close()
+
+	// Anything created with the role setting overridden still goes to
+	// the instance.
+	err = b.exec(ctx, db, "REASSIGN OWNED", fmt.Sprintf(
+		"REASSIGN OWNED BY %s TO %s", quoteIdentifier(roleName), quoteIdentifier(owner),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to reassign objects owned by %s: %w", roleName, err)
+	}
+	if err := b.exec(ctx, db, "DROP OWNED", fmt.Sprintf("DROP OWNED BY %s", quoteIdentifier(roleName))); err != nil {
+		return fmt.Errorf("failed to drop privileges of %s: %w", roleName, err)
+	}
+
+	err = b.exec(ctx, admin, "REVOKE", fmt.Sprintf(
+		"REVOKE ALL PRIVILEGES ON DATABASE %s FROM %s", quoteIdentifier(b.sharedDB), quoteIdentifier(roleName),
+	))
+	if err != nil {
+		logger.Warn("failed to revoke privileges",
+			slog.String("role", roleName), slog.String(logging.KeyError, err.Error()))
+	}
+
+	err = b.exec(ctx, admin, "DROP ROLE", fmt.Sprintf("DROP ROLE IF EXISTS %s", quoteIdentifier(roleName)))
+	if err != nil {
+		return fmt.Errorf("failed to drop role %s: %w", roleName, err)
+	}
+
+	logger.Info("removed binding", slog.String("role", roleName), slog.String("schema", b.schemaName(instance.ID)))
+	return nil
+}
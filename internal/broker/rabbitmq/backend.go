@@ -0,0 +1,245 @@
+package rabbitmq
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi/v11/domain"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+)
+
+// Service and plan IDs offered in the catalog.
+const (
+	ServiceID    = "rabbitmq-local-service-id"
+	SharedPlanID = "rabbitmq-local-shared-plan-id"
+)
+
+var (
+	_ broker.Backend   = (*Backend)(nil)
+	_ broker.Validator = (*Backend)(nil)
+)
+
+// Backend implements broker.Backend for RabbitMQ.
+// It creates a vhost per instance and a user per binding through the
+// management HTTP API of a shared RabbitMQ server.
+type Backend struct {
+	host          string
+	amqpPort      string
+	managementURL string
+	client        *managementClient
+}
+
+// New creates a new RabbitMQ backend. host and amqpPort are handed to apps;
+// managementURL is the base URL of the management API, e.g.
+// http://rabbitmq:15672.
+func New(host, amqpPort, managementURL, adminUser, adminPass string) *Backend {
+	return &Backend{
+		host:          host,
+		amqpPort:      amqpPort,
+		managementURL: strings.TrimSuffix(managementURL, "/"),
+		client:        newManagementClient(managementURL, adminUser, adminPass),
+	}
+}
+
+func (b *Backend) vhostName(instanceID string) string {
+	return "cf-" + instanceID
+}
+
+func (b *Backend) userName(bindingID string) string {
+	return "cf-" + bindingID
+}
+
+func generatePassword(length int) (string, error) {
+	bytes := make([]byte, length)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate random password: %w", err)
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// Service returns the catalog entry for the RabbitMQ service.
+func (b *Backend) Service() domain.Service {
+	return domain.Service{
+		ID:          ServiceID,
+		Name:        "rabbitmq-local",
+		Description: "RabbitMQ vhost on a shared local instance",
+		Bindable:    true,
+		Tags:        []string{"rabbitmq", "amqp", "messaging"},
+		Plans: []domain.ServicePlan{
+			{
+				ID:          SharedPlanID,
+				Name:        "shared",
+				Description: "Creates a vhost on the shared RabbitMQ instance",
+				Free:        domain.FreeValue(true),
+			},
+		},
+		Metadata: &domain.ServiceMetadata{
+			DisplayName: "RabbitMQ (Local)",
+			LongDescription: "Provisions a dedicated vhost and credentials on a shared " +
+				"RabbitMQ instance running in the local cluster.",
+		},
+	}
+}
+
+// Validate rejects parameters, as the service has none.
+func (b *Backend) Validate(instance *broker.Instance) error {
+	var params struct{}
+	return instance.DecodeParameters(&params)
+}
+
+// Provision creates a new vhost for the service instance.
+func (b *Backend) Provision(ctx context.Context, instance *broker.Instance) error {
+	logger := logging.FromContext(ctx)
+
+	vhost := b.vhostName(instance.ID)
+	if err := b.client.putVhost(ctx, vhost, "Cloud Foundry service instance "+instance.ID); err != nil {
+		return fmt.Errorf("failed to create vhost %s: %w", vhost, err)
+	}
+
+	logger.Info("provisioned vhost", slog.String("vhost", vhost))
+	return nil
+}
+
+// Deprovision deletes the vhost and any broker-created users that still
+// have access to it.
+func (b *Backend) Deprovision(ctx context.Context, instance *broker.Instance) error {
+	logger := logging.FromContext(ctx)
+
+	vhost := b.vhostName(instance.ID)
+
+	perms, err := b.client.vhostPermissions(ctx, vhost)
+	if err != nil {
+		return fmt.Errorf("failed to list permissions on vhost %s: %w", vhost, err)
+	}
+	for _, p := range perms {
+		if !strings.HasPrefix(p.User, "cf-") {
+			continue
+		}
+		if err := b.client.deleteUser(ctx, p.User); err != nil {
+			return fmt.Errorf("failed to delete user %s: %w", p.User, err)
+		}
+	}
+
+	// Deleting the vhost also closes its connections and deletes its
+	// queues and exchanges.
+	if err := b.client.deleteVhost(ctx, vhost); err != nil {
+		return fmt.Errorf("failed to delete vhost %s: %w", vhost, err)
+	}
+
+	logger.Info("deprovisioned vhost", slog.String("vhost", vhost))
+	return nil
+}
+
+// Bind creates a user with full permissions on the instance's vhost and
+// returns credentials.
+func (b *Backend) Bind(ctx context.Context, instance *broker.Instance, binding *broker.Binding) (map[string]any, error) {
+	logger := logging.FromContext(ctx)
+
+	vhost := b.vhostName(instance.ID)
+	user := b.userName(binding.ID)
+
+	password, err := generatePassword(16)
+	if err != nil {
+		return nil, err
+	}
+
+	// PUT replaces a user left over from an interrupted bind.
+	if err := b.client.putUser(ctx, user, password); err != nil {
+		return nil, fmt.Errorf("failed to create user %s: %w", user, err)
+	}
+
+	err = b.client.putPermissions(ctx, vhost, user, permission{Configure: ".*", Write: ".*", Read: ".*"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to grant permissions on vhost %s: %w", vhost, err)
+	}
+
+	logger.Info("created binding", slog.String("user", user), slog.String("vhost", vhost))
+	return b.credentials(vhost, user, password), nil
+}
+
+// credentials builds the binding credentials in the layout used by the
+// Cloud Foundry RabbitMQ tile, so existing client libraries find them.
+func (b *Backend) credentials(vhost, user, password string) map[string]any {
+	userinfo := url.UserPassword(user, password)
+
+	amqp := url.URL{
+		Scheme: "amqp",
+		User:   userinfo,
+		Host:   net.JoinHostPort(b.host, b.amqpPort),
+		Path:   "/" + vhost,
+	}
+	management, err := url.Parse(b.managementURL + "/api/")
+	if err != nil {
+		management = &url.URL{}
+	}
+	management.User = userinfo
+	dashboard := b.managementURL + "/#/vhosts/" + url.PathEscape(vhost)
+
+	return map[string]any{
+		"hostname":      b.host,
+		"hostnames":     []string{b.host},
+		"vhost":         vhost,
+		"username":      user,
+		"password":      password,
+		"uri":           amqp.String(),
+		"uris":          []string{amqp.String()},
+		"http_api_uri":  management.String(),
+		"http_api_uris": []string{management.String()},
+		"dashboard_url": dashboard,
+		"protocols": map[string]any{
+			"amqp": map[string]any{
+				"host":     b.host,
+				"hosts":    []string{b.host},
+				"port":     b.amqpPort,
+				"vhost":    vhost,
+				"username": user,
+				"password": password,
+				"uri":      amqp.String(),
+				"uris":     []string{amqp.String()},
+			},
+			"management": map[string]any{
+				"path":     "/api/",
+				"username": user,
+				"password": password,
+				"uri":      management.String(),
+				"uris":     []string{management.String()},
+			},
+		},
+	}
+}
+
+// Unbind deletes the user created during binding.
+func (b *Backend) Unbind(ctx context.Context, instance *broker.Instance, binding *broker.Binding) error {
+	logger := logging.FromContext(ctx)
+
+	user := b.userName(binding.ID)
+	if err := b.client.deleteUser(ctx, user); err != nil {
+		return fmt.Errorf("failed to delete user %s: %w", user, err)
+	}
+
+	logger.Info("removed binding", slog.String("user", user), slog.String("vhost", b.vhostName(instance.ID)))
+	return nil
+}
+
+// Update has nothing to change: there is a single plan and no parameters.
+func (b *Backend) Update(_ context.Context, _ *broker.Instance, _ *broker.Instance) error {
+	return nil
+}
+
+// Describe reports where the instance's vhost lives.
+func (b *Backend) Describe(_ context.Context, instance *broker.Instance) (map[string]any, error) {
+	vhost := b.vhostName(instance.ID)
+	return map[string]any{
+		"host":          b.host,
+		"port":          b.amqpPort,
+		"vhost":         vhost,
+		"dashboard_url": b.managementURL + "/#/vhosts/" + url.PathEscape(vhost),
+	}, nil
+}
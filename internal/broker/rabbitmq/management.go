@@ -0,0 +1,148 @@
+package rabbitmq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// managementClient is a minimal client for the RabbitMQ management HTTP API.
+type managementClient struct {
+	baseURL  string
+	user     string
+	password string
+	http     *http.Client
+}
+
+func newManagementClient(baseURL, user, password string) *managementClient {
+	return &managementClient{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		user:     user,
+		password: password,
+		http: &http.Client{
+			Transport: otelhttp.NewTransport(http.DefaultTransport),
+			Timeout:   30 * time.Second,
+		},
+	}
+}
+
+// apiError is a non-2xx response from the management API.
+type apiError struct {
+	Method string
+	Path   string
+	Status int
+	Reason string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.Status, e.Reason)
+}
+
+// isNotFound reports whether err is a 404 from the management API.
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && apiErr.Status == http.StatusNotFound
+}
+
+// do sends a request to the management API. path segments must already be
+// escaped. A non-nil in is sent as JSON and a non-nil out is decoded from
+// the response.
+func (c *managementClient) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.user, c.password)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var payload struct {
+			Error  string `json:"error"`
+			Reason string `json:"reason"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		reason := strings.TrimSpace(string(data))
+		if json.Unmarshal(data, &payload) == nil && payload.Reason != "" {
+			reason = payload.Reason
+		}
+		return &apiError{Method: method, Path: path, Status: resp.StatusCode, Reason: reason}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *managementClient) putVhost(ctx context.Context, vhost, description string) error {
+	return c.do(ctx, http.MethodPut, "/api/vhosts/"+url.PathEscape(vhost),
+		map[string]any{"description": description}, nil)
+}
+
+func (c *managementClient) deleteVhost(ctx context.Context, vhost string) error {
+	err := c.do(ctx, http.MethodDelete, "/api/vhosts/"+url.PathEscape(vhost), nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (c *managementClient) putUser(ctx context.Context, user, password string) error {
+	return c.do(ctx, http.MethodPut, "/api/users/"+url.PathEscape(user),
+		map[string]any{"password": password, "tags": "management"}, nil)
+}
+
+func (c *managementClient) deleteUser(ctx context.Context, user string) error {
+	err := c.do(ctx, http.MethodDelete, "/api/users/"+url.PathEscape(user), nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// permission is the configure/write/read regular expressions granted to a
+// user on a vhost.
+type permission struct {
+	User      string `json:"user,omitempty"`
+	Configure string `json:"configure"`
+	Write     string `json:"write"`
+	Read      string `json:"read"`
+}
+
+func (c *managementClient) putPermissions(ctx context.Context, vhost, user string, p permission) error {
+	return c.do(ctx, http.MethodPut,
+		"/api/permissions/"+url.PathEscape(vhost)+"/"+url.PathEscape(user), p, nil)
+}
+
+func (c *managementClient) vhostPermissions(ctx context.Context, vhost string) ([]permission, error) {
+	var perms []permission
+	err := c.do(ctx, http.MethodGet, "/api/vhosts/"+url.PathEscape(vhost)+"/permissions", nil, &perms)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return perms, err
+}
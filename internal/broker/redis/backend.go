@@ -0,0 +1,535 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi/v11/domain"
+	"github.com/pivotal-cf/brokerapi/v11/domain/apiresponses"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Service and plan IDs offered in the catalog.
+const (
+	ServiceID    = "redis-local-service-id"
+	SharedPlanID = "redis-local-shared-plan-id"
+)
+
+// Isolation modes. With IsolationACL every instance owns a key prefix and
+// bindings are ACL users restricted to it. With IsolationDB every instance
+// owns a logical database number and bindings are ACL users that can only
+// select it. IsolationAuto picks IsolationACL. Servers without ACL support
+// are refused, as bindings could only share the server password.
+const (
+	IsolationAuto = "auto"
+	IsolationACL  = "acl"
+	IsolationDB   = "db"
+)
+
+// brokerKeyPrefix prefixes the keys the broker keeps for itself.
+const brokerKeyPrefix = "cf-broker:"
+
+// databasesKey is the hash in database 0 that maps allocated database numbers
+// to instance IDs. Database 0 is never handed out.
+const databasesKey = brokerKeyPrefix + "databases"
+
+// Instance and binding attributes.
+const (
+	attrIsolation = "isolation"
+	attrKeyPrefix = "key_prefix"
+	attrDatabase  = "database"
+	attrACLUsers  = "acl_users"
+	attrUsername  = "username"
+)
+
+var (
+	_ broker.Backend   = (*Backend)(nil)
+	_ broker.Validator = (*Backend)(nil)
+)
+
+// Backend implements broker.Backend for Redis.
+// It isolates instances on a shared Redis server by key prefix or database
+// number and creates an ACL user per binding.
+type Backend struct {
+	host      string
+	port      string
+	adminUser string
+	adminPass string
+	isolation string
+}
+
+// New creates a new Redis backend. isolation is one of IsolationAuto,
+// IsolationACL or IsolationDB.
+func New(host, port, adminUser, adminPass, isolation string) *Backend {
+	return &Backend{
+		host:      host,
+		port:      port,
+		adminUser: adminUser,
+		adminPass: adminPass,
+		isolation: isolation,
+	}
+}
+
+func (b *Backend) connectAdmin(db int) *goredis.Client {
+	return goredis.NewClient(&goredis.Options{
+		Addr:     net.JoinHostPort(b.host, b.port),
+		Username: b.adminUser,
+		Password: b.adminPass,
+		DB:       db,
+	})
+}
+
+// do runs a command on the admin connection inside a client span. The
+// arguments are not recorded because they may contain passwords.
+func (b *Backend) do(ctx context.Context, client *goredis.Client, args ...any) *goredis.Cmd {
+	operation := strings.ToUpper(fmt.Sprint(args[0]))
+	if len(args) > 1 && (operation == "ACL" || operation == "CONFIG") {
+		operation += " " + strings.ToUpper(fmt.Sprint(args[1]))
+	}
+	ctx, span := tracing.StartClient(ctx, "redis "+operation, b.spanAttrs(operation)...)
+	cmd := client.Do(ctx, args...)
+	err := cmd.Err()
+	if errors.Is(err, goredis.Nil) {
+		err = nil
+	}
+	tracing.End(span, err)
+	return cmd
+}
+
+func (b *Backend) spanAttrs(operation string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("db.system.name", "redis"),
+		attribute.String("db.operation.name", operation),
+		attribute.String("server.address", b.host),
+		attribute.String("server.port", b.port),
+	}
+}
+
+// keyPrefix is the key and channel prefix owned by an instance.
+func keyPrefix(instanceID string) string {
+	return "cf:" + instanceID + ":"
+}
+
+// userPrefix is the prefix of the ACL users created for an instance's
+// bindings, so that leftover users can be found on deprovision.
+func userPrefix(instanceID string) string {
+	return "cf-" + instanceID + "-"
+}
+
+func userName(instanceID, bindingID string) string {
+	return userPrefix(instanceID) + bindingID
+}
+
+// escapePattern escapes the glob characters Redis interprets in key
+// patterns.
+func escapePattern(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// patternsExcept returns key patterns that together match every non-empty
+// key except s and the keys starting with it, as ACL rules cannot exclude
+// keys directly.
+func patternsExcept(s string) []string {
+	var patterns []string
+	for i := range len(s) {
+		// Keys that share the first i bytes of s and then differ, and
+		// keys that are a shorter prefix of s. The byte in the class is
+		// escaped so that '-' or '^' are taken literally.
+		patterns = append(patterns, escapePattern(s[:i])+`[^\`+s[i:i+1]+"]*")
+		if i > 0 {
+			patterns = append(patterns, escapePattern(s[:i]))
+		}
+	}
+	return patterns
+}
+
+// validateName rejects characters that would change the meaning of an ACL
+// rule or user name.
+func validateName(s string) error {
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"'<>~&%*?[]\\") {
+		return fmt.Errorf("invalid identifier: %s", s)
+	}
+	return nil
+}
+
+func generatePassword(length int) (string, error) {
+	bytes := make([]byte, length)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate random password: %w", err)
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// aclSupported reports whether the server understands ACL commands, which
+// were added in Redis 6.
+func (b *Backend) aclSupported(ctx context.Context, client *goredis.Client) (bool, error) {
+	err := b.do(ctx, client, "ACL", "WHOAMI").Err()
+	if err == nil {
+		return true, nil
+	}
+	if strings.Contains(strings.ToLower(err.Error()), "unknown command") {
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to check ACL support: %w", err)
+}
+
+// Service returns the catalog entry for the Redis service.
+func (b *Backend) Service() domain.Service {
+	return domain.Service{
+		ID:          ServiceID,
+		Name:        "redis-local",
+		Description: "Redis keyspace on a shared local instance",
+		Bindable:    true,
+		Tags:        []string{"redis", "key-value", "cache"},
+		Plans: []domain.ServicePlan{
+			{
+				ID:          SharedPlanID,
+				Name:        "shared",
+				Description: "Isolates a key prefix or database on the shared Redis instance",
+				Free:        domain.FreeValue(true),
+			},
+		},
+		Metadata: &domain.ServiceMetadata{
+			DisplayName: "Redis (Local)",
+			LongDescription: "Provisions an isolated keyspace and per-binding ACL users on a " +
+				"shared Redis instance running in the local cluster.",
+		},
+	}
+}
+
+// Validate rejects parameters, as the service has none.
+func (b *Backend) Validate(instance *broker.Instance) error {
+	var params struct{}
+	if err := instance.DecodeParameters(&params); err != nil {
+		return err
+	}
+	return validateName(instance.ID)
+}
+
+// Provision reserves a key prefix or database for the service instance.
+func (b *Backend) Provision(ctx context.Context, instance *broker.Instance) error {
+	logger := logging.FromContext(ctx)
+
+	client := b.connectAdmin(0)
+	defer client.Close()
+
+	acl, err := b.aclSupported(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	if !acl {
+		return errNoACL
+	}
+	isolation := b.isolation
+	if isolation == IsolationAuto {
+		isolation = IsolationACL
+	}
+
+	instance.SetAttribute(attrIsolation, isolation)
+	instance.SetAttribute(attrACLUsers, strconv.FormatBool(acl))
+
+	switch isolation {
+	case IsolationACL:
+		prefix := keyPrefix(instance.ID)
+		instance.SetAttribute(attrKeyPrefix, prefix)
+		logger.Info("provisioned key prefix", slog.String("key_prefix", prefix))
+	case IsolationDB:
+		db, err := b.allocateDatabase(ctx, client, instance.ID)
+		if err != nil {
+			return err
+		}
+		instance.SetAttribute(attrDatabase, strconv.Itoa(db))
+		logger.Info("provisioned database", slog.Int("database", db))
+	default:
+		return fmt.Errorf("unknown isolation mode %q", isolation)
+	}
+	return nil
+}
+
+// allocateDatabase claims the lowest free database number for instanceID.
+// Claims are made with HSETNX so that concurrent brokers cannot hand out the
+// same database twice.
+func (b *Backend) allocateDatabase(ctx context.Context, client *goredis.Client, instanceID string) (int, error) {
+	// The typed commands decode both RESP2 arrays and RESP3 maps.
+	spanCtx, span := tracing.StartClient(ctx, "redis CONFIG GET", b.spanAttrs("CONFIG GET")...)
+	config, err := client.ConfigGet(spanCtx, "databases").Result()
+	tracing.End(span, err)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read database count: %w", err)
+	}
+	value, ok := config["databases"]
+	if !ok {
+		return 0, errors.New("failed to read database count: unexpected reply")
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read database count: %w", err)
+	}
+
+	spanCtx, span = tracing.StartClient(ctx, "redis HGETALL", b.spanAttrs("HGETALL")...)
+	owners, err := client.HGetAll(spanCtx, databasesKey).Result()
+	tracing.End(span, err)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read database allocations: %w", err)
+	}
+	for db, owner := range owners {
+		if owner == instanceID {
+			// Left over from an earlier, interrupted attempt.
+			return strconv.Atoi(db)
+		}
+	}
+
+	for db := 1; db < count; db++ {
+		claimed, err := b.do(ctx, client, "HSETNX", databasesKey, strconv.Itoa(db), instanceID).Bool()
+		if err != nil {
+			return 0, fmt.Errorf("failed to allocate database: %w", err)
+		}
+		if !claimed {
+			continue
+		}
+		// Start from an empty keyspace even if an earlier owner left data.
+		dbClient := b.connectAdmin(db)
+		err = b.do(ctx, dbClient, "FLUSHDB").Err()
+		dbClient.Close()
+		if err != nil {
+			return 0, fmt.Errorf("failed to clear database %d: %w", db, err)
+		}
+		return db, nil
+	}
+	return 0, apiresponses.NewFailureResponse(
+		fmt.Errorf("all %d redis databases are in use", count-1),
+		http.StatusUnprocessableEntity, "no-capacity",
+	)
+}
+
+// Deprovision removes the instance's keys and any ACL users left behind.
+func (b *Backend) Deprovision(ctx context.Context, instance *broker.Instance) error {
+	logger := logging.FromContext(ctx)
+
+	client := b.connectAdmin(0)
+	defer client.Close()
+
+	if instance.Attribute(attrACLUsers) == "true" {
+		if err := b.deleteUsers(ctx, client, userPrefix(instance.ID)); err != nil {
+			return err
+		}
+	}
+
+	switch instance.Attribute(attrIsolation) {
+	case IsolationACL:
+		prefix := instance.Attribute(attrKeyPrefix)
+		n, err := b.deleteKeys(ctx, client, escapePattern(prefix)+"*")
+		if err != nil {
+			return fmt.Errorf("failed to delete keys under %s: %w", prefix, err)
+		}
+		logger.Info("deprovisioned key prefix", slog.String("key_prefix", prefix), slog.Int("keys", n))
+	case IsolationDB:
+		db, err := strconv.Atoi(instance.Attribute(attrDatabase))
+		if err != nil {
+			return fmt.Errorf("invalid database number for instance: %w", err)
+		}
+		dbClient := b.connectAdmin(db)
+		err = b.do(ctx, dbClient, "FLUSHDB").Err()
+		dbClient.Close()
+		if err != nil {
+			return fmt.Errorf("failed to clear database %d: %w", db, err)
+		}
+		owner, err := b.do(ctx, client, "HGET", databasesKey, strconv.Itoa(db)).Text()
+		if err != nil && !errors.Is(err, goredis.Nil) {
+			return fmt.Errorf("failed to read database allocation: %w", err)
+		}
+		if owner == instance.ID {
+			if err := b.do(ctx, client, "HDEL", databasesKey, strconv.Itoa(db)).Err(); err != nil {
+				return fmt.Errorf("failed to release database %d: %w", db, err)
+			}
+		}
+		logger.Info("deprovisioned database", slog.Int("database", db))
+	}
+	return nil
+}
+
+// deleteKeys unlinks every key matching pattern and returns how many were
+// removed.
+func (b *Backend) deleteKeys(ctx context.Context, client *goredis.Client, pattern string) (int, error) {
+	deleted := 0
+	var cursor uint64
+	for {
+		ctx, span := tracing.StartClient(ctx, "redis SCAN", b.spanAttrs("SCAN")...)
+		keys, next, err := client.Scan(ctx, cursor, pattern, 500).Result()
+		tracing.End(span, err)
+		if err != nil {
+			return deleted, err
+		}
+		if len(keys) > 0 {
+			args := make([]any, 0, len(keys)+1)
+			args = append(args, "UNLINK")
+			for _, k := range keys {
+				args = append(args, k)
+			}
+			if err := b.do(ctx, client, args...).Err(); err != nil {
+				return deleted, err
+			}
+			deleted += len(keys)
+		}
+		if next == 0 {
+			return deleted, nil
+		}
+		cursor = next
+	}
+}
+
+// deleteUsers removes every ACL user whose name starts with prefix.
+func (b *Backend) deleteUsers(ctx context.Context, client *goredis.Client, prefix string) error {
+	users, err := b.do(ctx, client, "ACL", "USERS").StringSlice()
+	if err != nil {
+		return fmt.Errorf("failed to list ACL users: %w", err)
+	}
+	for _, user := range users {
+		if !strings.HasPrefix(user, prefix) {
+			continue
+		}
+		if err := b.do(ctx, client, "ACL", "DELUSER", user).Err(); err != nil {
+			return fmt.Errorf("failed to delete ACL user %s: %w", user, err)
+		}
+	}
+	return nil
+}
+
+// errNoACL refuses instances on servers without ACL support, where a
+// binding could only be given the server password.
+var errNoACL = apiresponses.NewFailureResponse(
+	errors.New("redis server does not support ACLs; bindings need Redis 6 or later"),
+	http.StatusUnprocessableEntity, "acl-unsupported",
+)
+
+// Bind creates an ACL user limited to the instance's keyspace and returns
+// credentials. Instances provisioned on servers without ACL support cannot
+// be bound.
+func (b *Backend) Bind(ctx context.Context, instance *broker.Instance, binding *broker.Binding) (map[string]any, error) {
+	logger := logging.FromContext(ctx)
+
+	if err := validateName(binding.ID); err != nil {
+		return nil, err
+	}
+
+	creds := map[string]any{
+		"host": b.host,
+		"port": b.port,
+	}
+	path := ""
+	if db := instance.Attribute(attrDatabase); db != "" {
+		creds["database"] = db
+		path = "/" + db
+	}
+	if prefix := instance.Attribute(attrKeyPrefix); prefix != "" {
+		creds["key_prefix"] = prefix
+	}
+
+	if instance.Attribute(attrACLUsers) != "true" {
+		return nil, errNoACL
+	}
+
+	password, err := generatePassword(16)
+	if err != nil {
+		return nil, err
+	}
+	user := userName(instance.ID, binding.ID)
+
+	rules := []any{"ACL", "SETUSER", user, "reset", "on", ">" + password}
+	if prefix := instance.Attribute(attrKeyPrefix); prefix != "" {
+		pattern := escapePattern(prefix) + "*"
+		rules = append(rules, "~"+pattern, "&"+pattern)
+	} else {
+		// Connections start in database 0, so the broker's allocation
+		// table is kept out of reach by key pattern.
+		for _, pattern := range patternsExcept(brokerKeyPrefix) {
+			rules = append(rules, "~"+pattern)
+		}
+		rules = append(rules, "&*")
+	}
+	rules = append(rules, "+@all", "-@admin", "-@dangerous")
+	if db := instance.Attribute(attrDatabase); db != "" {
+		// SELECT is limited to the instance's database, and commands that
+		// reach into other databases are denied: MOVE and COPY take a
+		// database argument, RESET switches back to database 0.
+		rules = append(rules, "-select", "+select|"+db, "-move", "-copy", "-reset")
+	}
+
+	client := b.connectAdmin(0)
+	defer client.Close()
+
+	if err := b.do(ctx, client, rules...).Err(); err != nil {
+		return nil, fmt.Errorf("failed to create ACL user %s: %w", user, err)
+	}
+	binding.SetAttribute(attrUsername, user)
+
+	creds["username"] = user
+	creds["password"] = password
+	creds["uri"] = fmt.Sprintf("redis://%s:%s@%s%s", user, password, net.JoinHostPort(b.host, b.port), path)
+
+	logger.Info("created binding", slog.String("user", user))
+	return creds, nil
+}
+
+// Unbind deletes the binding's ACL user.
+func (b *Backend) Unbind(ctx context.Context, instance *broker.Instance, binding *broker.Binding) error {
+	logger := logging.FromContext(ctx)
+
+	user := binding.Attribute(attrUsername)
+	if user == "" {
+		logger.Info("binding has no ACL user to remove")
+		return nil
+	}
+
+	client := b.connectAdmin(0)
+	defer client.Close()
+
+	if err := b.do(ctx, client, "ACL", "DELUSER", user).Err(); err != nil {
+		return fmt.Errorf("failed to delete ACL user %s: %w", user, err)
+	}
+
+	logger.Info("removed binding", slog.String("user", user))
+	return nil
+}
+
+// Update has nothing to change: there is a single plan and no parameters.
+func (b *Backend) Update(_ context.Context, _ *broker.Instance, _ *broker.Instance) error {
+	return nil
+}
+
+// Describe reports how the instance is isolated.
+func (b *Backend) Describe(_ context.Context, instance *broker.Instance) (map[string]any, error) {
+	desc := map[string]any{
+		"host":      b.host,
+		"port":      b.port,
+		"isolation": instance.Attribute(attrIsolation),
+	}
+	if prefix := instance.Attribute(attrKeyPrefix); prefix != "" {
+		desc["key_prefix"] = prefix
+	}
+	if db := instance.Attribute(attrDatabase); db != "" {
+		desc["database"] = db
+	}
+	return desc, nil
+}
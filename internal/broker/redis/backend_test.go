@@ -0,0 +1,422 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/pivotal-cf/brokerapi/v11/domain/apiresponses"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+)
+
+// fakeServer is a miniredis server that also answers the ACL and CONFIG
+// commands the backend sends, which miniredis does not implement.
+type fakeServer struct {
+	*miniredis.Miniredis
+
+	mu        sync.Mutex
+	acl       bool
+	databases string
+	users     map[string][]string
+	deleted   []string
+}
+
+func newFakeServer(t *testing.T, acl bool) *fakeServer {
+	t.Helper()
+	s := &fakeServer{
+		Miniredis: miniredis.RunT(t),
+		acl:       acl,
+		databases: "4",
+		users:     map[string][]string{},
+	}
+	s.Server().SetPreHook(s.hook)
+	return s
+}
+
+func (s *fakeServer) hook(c *server.Peer, cmd string, args ...string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch cmd {
+	case "CONFIG":
+		if len(args) == 2 && strings.EqualFold(args[0], "GET") && args[1] == "databases" {
+			c.WriteStrings([]string{"databases", s.databases})
+		} else {
+			c.WriteError("ERR unsupported CONFIG subcommand")
+		}
+		return true
+	case "ACL":
+	default:
+		return false
+	}
+
+	if !s.acl {
+		c.WriteError("ERR unknown command 'ACL'")
+		return true
+	}
+	switch strings.ToUpper(args[0]) {
+	case "WHOAMI":
+		c.WriteBulk("default")
+	case "SETUSER":
+		s.users[args[1]] = args[2:]
+		c.WriteOK()
+	case "USERS":
+		users := []string{"default"}
+		for user := range s.users {
+			users = append(users, user)
+		}
+		slices.Sort(users)
+		c.WriteStrings(users)
+	case "DELUSER":
+		n := 0
+		for _, user := range args[1:] {
+			if _, ok := s.users[user]; ok {
+				delete(s.users, user)
+				n++
+			}
+			s.deleted = append(s.deleted, user)
+		}
+		c.WriteInt(n)
+	default:
+		c.WriteError("ERR unsupported ACL subcommand")
+	}
+	return true
+}
+
+func (s *fakeServer) rules(user string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.users[user]
+}
+
+func (s *fakeServer) deletedUsers() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.deleted)
+}
+
+// failureStatus returns the HTTP status of a failure response, or 0.
+func failureStatus(err error) int {
+	var failure *apiresponses.FailureResponse
+	if errors.As(err, &failure) {
+		return failure.ValidatedStatusCode(nil)
+	}
+	return 0
+}
+
+func newTestBackend(t *testing.T, s *fakeServer, isolation string) *Backend {
+	t.Helper()
+	host, port, err := net.SplitHostPort(s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(host, port, "", "", isolation)
+}
+
+func TestProvisionIsolation(t *testing.T) {
+	tests := []struct {
+		name      string
+		isolation string
+		acl       bool
+		want      string
+		wantErr   bool
+	}{
+		{name: "auto with ACL", isolation: IsolationAuto, acl: true, want: IsolationACL},
+		{name: "auto without ACL", isolation: IsolationAuto, acl: false, wantErr: true},
+		{name: "db with ACL", isolation: IsolationDB, acl: true, want: IsolationDB},
+		{name: "db without ACL", isolation: IsolationDB, acl: false, wantErr: true},
+		{name: "acl without ACL", isolation: IsolationACL, acl: false, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeServer(t, tt.acl)
+			b := newTestBackend(t, s, tt.isolation)
+			instance := &broker.Instance{ID: "inst-1"}
+
+			err := b.Provision(context.Background(), instance)
+			if tt.wantErr {
+				if status := failureStatus(err); status != http.StatusUnprocessableEntity {
+					t.Fatalf("Provision error = %v, want 422", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Provision: %v", err)
+			}
+
+			if got := instance.Attribute(attrIsolation); got != tt.want {
+				t.Errorf("isolation = %q, want %q", got, tt.want)
+			}
+			prefix, db := instance.Attribute(attrKeyPrefix), instance.Attribute(attrDatabase)
+			switch tt.want {
+			case IsolationACL:
+				if prefix != "cf:inst-1:" || db != "" {
+					t.Errorf("key prefix = %q, database = %q, want prefix cf:inst-1:", prefix, db)
+				}
+			case IsolationDB:
+				if prefix != "" || db != "1" {
+					t.Errorf("key prefix = %q, database = %q, want database 1", prefix, db)
+				}
+			}
+			if got, want := instance.Attribute(attrACLUsers), map[bool]string{true: "true", false: "false"}[tt.acl]; got != want {
+				t.Errorf("acl_users = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestDatabaseAllocation(t *testing.T) {
+	ctx := context.Background()
+	s := newFakeServer(t, true)
+	b := newTestBackend(t, s, IsolationDB)
+
+	// Data left in a database by an earlier owner is cleared on allocation.
+	s.DB(2).Set("stale", "value")
+
+	first := &broker.Instance{ID: "inst-1"}
+	second := &broker.Instance{ID: "inst-2"}
+	third := &broker.Instance{ID: "inst-3"}
+	for _, instance := range []*broker.Instance{first, second, third} {
+		if err := b.Provision(ctx, instance); err != nil {
+			t.Fatalf("Provision %s: %v", instance.ID, err)
+		}
+	}
+	for instance, want := range map[*broker.Instance]string{first: "1", second: "2", third: "3"} {
+		if got := instance.Attribute(attrDatabase); got != want {
+			t.Errorf("%s: database = %s, want %s", instance.ID, got, want)
+		}
+		if got := s.HGet(databasesKey, want); got != instance.ID {
+			t.Errorf("owner of database %s = %q, want %q", want, got, instance.ID)
+		}
+	}
+	if s.DB(2).Exists("stale") {
+		t.Error("database 2 was not cleared on allocation")
+	}
+
+	// Provisioning the same instance again reuses its claim.
+	retry := &broker.Instance{ID: "inst-2"}
+	if err := b.Provision(ctx, retry); err != nil {
+		t.Fatalf("Provision retry: %v", err)
+	}
+	if got := retry.Attribute(attrDatabase); got != "2" {
+		t.Errorf("retried database = %s, want 2", got)
+	}
+
+	// Databases 1 to 3 are taken; 0 is never handed out.
+	if err := b.Provision(ctx, &broker.Instance{ID: "inst-4"}); err == nil {
+		t.Fatal("Provision with all databases in use succeeded, want error")
+	}
+
+	s.DB(2).Set("key", "value")
+	if err := b.Deprovision(ctx, second); err != nil {
+		t.Fatalf("Deprovision: %v", err)
+	}
+	if s.DB(2).Exists("key") {
+		t.Error("database 2 was not cleared on deprovision")
+	}
+	if got := s.HGet(databasesKey, "2"); got != "" {
+		t.Errorf("database 2 still owned by %q after deprovision", got)
+	}
+
+	fourth := &broker.Instance{ID: "inst-4"}
+	if err := b.Provision(ctx, fourth); err != nil {
+		t.Fatalf("Provision after release: %v", err)
+	}
+	if got := fourth.Attribute(attrDatabase); got != "2" {
+		t.Errorf("database after release = %s, want 2", got)
+	}
+}
+
+func TestDeprovisionKeepsForeignDatabaseClaim(t *testing.T) {
+	ctx := context.Background()
+	s := newFakeServer(t, false)
+	b := newTestBackend(t, s, IsolationDB)
+
+	s.HSet(databasesKey, "1", "other")
+	instance := &broker.Instance{ID: "inst-1", Attributes: map[string]string{
+		attrIsolation: IsolationDB,
+		attrDatabase:  "1",
+	}}
+	if err := b.Deprovision(ctx, instance); err != nil {
+		t.Fatalf("Deprovision: %v", err)
+	}
+	if got := s.HGet(databasesKey, "1"); got != "other" {
+		t.Errorf("owner of database 1 = %q, want other", got)
+	}
+}
+
+func TestBindACLRules(t *testing.T) {
+	tests := []struct {
+		name      string
+		isolation string
+		rules     []string
+	}{
+		{name: "prefix", isolation: IsolationACL, rules: []string{"~cf:inst-1:*", "&cf:inst-1:*", "+@all", "-@admin", "-@dangerous"}},
+		{
+			name:      "database",
+			isolation: IsolationDB,
+			rules: slices.Concat(
+				keyRules(patternsExcept(brokerKeyPrefix)),
+				[]string{"&*", "+@all", "-@admin", "-@dangerous", "-select", "+select|1", "-move", "-copy", "-reset"},
+			),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newFakeServer(t, true)
+			b := newTestBackend(t, s, tt.isolation)
+			instance := &broker.Instance{ID: "inst-1"}
+			if err := b.Provision(ctx, instance); err != nil {
+				t.Fatalf("Provision: %v", err)
+			}
+
+			binding := &broker.Binding{ID: "bind-1", InstanceID: instance.ID}
+			creds, err := b.Bind(ctx, instance, binding)
+			if err != nil {
+				t.Fatalf("Bind: %v", err)
+			}
+
+			user := "cf-inst-1-bind-1"
+			if got := binding.Attribute(attrUsername); got != user {
+				t.Errorf("username attribute = %q, want %q", got, user)
+			}
+			if creds["username"] != user {
+				t.Errorf("credentials username = %v, want %q", creds["username"], user)
+			}
+			password, _ := creds["password"].(string)
+			if password == "" {
+				t.Fatal("credentials have no password")
+			}
+
+			want := append([]string{"reset", "on", ">" + password}, tt.rules...)
+			if got := s.rules(user); !slices.Equal(got, want) {
+				t.Errorf("ACL SETUSER rules = %q, want %q", got, want)
+			}
+
+			if err := b.Unbind(ctx, instance, binding); err != nil {
+				t.Fatalf("Unbind: %v", err)
+			}
+			if got := s.deletedUsers(); !slices.Equal(got, []string{user}) {
+				t.Errorf("ACL DELUSER calls = %q, want %q", got, []string{user})
+			}
+			if s.rules(user) != nil {
+				t.Error("ACL user still exists after Unbind")
+			}
+		})
+	}
+}
+
+func TestBindEscapesPrefix(t *testing.T) {
+	ctx := context.Background()
+	s := newFakeServer(t, true)
+	b := newTestBackend(t, s, IsolationACL)
+
+	instance := &broker.Instance{ID: "inst-1", Attributes: map[string]string{
+		attrIsolation: IsolationACL,
+		attrKeyPrefix: "cf:a*b:",
+		attrACLUsers:  "true",
+	}}
+	binding := &broker.Binding{ID: "bind-1", InstanceID: instance.ID}
+	if _, err := b.Bind(ctx, instance, binding); err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+	rules := s.rules("cf-inst-1-bind-1")
+	if !slices.Contains(rules, `~cf:a\*b:*`) || !slices.Contains(rules, `&cf:a\*b:*`) {
+		t.Errorf("ACL SETUSER rules = %q, want escaped key and channel patterns", rules)
+	}
+}
+
+func TestBindWithoutACL(t *testing.T) {
+	s := newFakeServer(t, false)
+	b := newTestBackend(t, s, IsolationAuto)
+
+	// Provisioned before servers without ACLs were refused.
+	instance := &broker.Instance{ID: "inst-1", Attributes: map[string]string{
+		attrIsolation: IsolationDB,
+		attrDatabase:  "1",
+		attrACLUsers:  "false",
+	}}
+	creds, err := b.Bind(context.Background(), instance, &broker.Binding{ID: "bind-1", InstanceID: instance.ID})
+	if status := failureStatus(err); status != http.StatusUnprocessableEntity {
+		t.Fatalf("Bind error = %v, want 422", err)
+	}
+	if creds != nil {
+		t.Errorf("Bind returned credentials %v", creds)
+	}
+}
+
+func TestPatternsExcept(t *testing.T) {
+	patterns := patternsExcept(brokerKeyPrefix)
+	matches := func(key string) bool {
+		return slices.ContainsFunc(patterns, func(pattern string) bool {
+			ok, err := path.Match(pattern, key)
+			if err != nil {
+				t.Fatalf("invalid pattern %q: %v", pattern, err)
+			}
+			return ok
+		})
+	}
+	for _, key := range []string{"a", "c", "cf", "cf-", "cf-b", "cf-broker", "cf-brokers", "cf:inst-1:x", "session:42", "databases"} {
+		if !matches(key) {
+			t.Errorf("key %q is not matched", key)
+		}
+	}
+	for _, key := range []string{databasesKey, databasesKey + ":x", "cf-broker:other"} {
+		if matches(key) {
+			t.Errorf("key %q is matched", key)
+		}
+	}
+}
+
+// keyRules turns key patterns into ACL rules.
+func keyRules(patterns []string) []string {
+	var rules []string
+	for _, pattern := range patterns {
+		rules = append(rules, "~"+pattern)
+	}
+	return rules
+}
+
+func TestDeprovisionACL(t *testing.T) {
+	ctx := context.Background()
+	s := newFakeServer(t, true)
+	b := newTestBackend(t, s, IsolationACL)
+
+	instance := &broker.Instance{ID: "inst-1"}
+	if err := b.Provision(ctx, instance); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	if _, err := b.Bind(ctx, instance, &broker.Binding{ID: "bind-1", InstanceID: instance.ID}); err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+	other := &broker.Instance{ID: "inst-2"}
+	if err := b.Provision(ctx, other); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	if _, err := b.Bind(ctx, other, &broker.Binding{ID: "bind-2", InstanceID: other.ID}); err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+
+	s.Set("cf:inst-1:a", "1")
+	s.Set("cf:inst-1:b", "2")
+	s.Set("cf:inst-2:a", "3")
+
+	if err := b.Deprovision(ctx, instance); err != nil {
+		t.Fatalf("Deprovision: %v", err)
+	}
+	if got := s.deletedUsers(); !slices.Equal(got, []string{"cf-inst-1-bind-1"}) {
+		t.Errorf("ACL DELUSER calls = %q, want only the instance's user", got)
+	}
+	if got := s.Keys(); !slices.Equal(got, []string{"cf:inst-2:a"}) {
+		t.Errorf("keys after deprovision = %q, want only the other instance's", got)
+	}
+}
@@ -0,0 +1,255 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi/v11/domain/apiresponses"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+)
+
+// operationSnapshot names snapshots in logs and metrics. Like backups,
+// snapshots are not recorded as the instance's LastOperation.
+const operationSnapshot = "snapshot"
+
+// SnapshotInfo describes a snapshot kept on a backing server. Snapshot IDs
+// use BackupIDFormat.
+type SnapshotInfo struct {
+	ID         string    `json:"id"`
+	InstanceID string    `json:"instance_id"`
+	ServiceID  string    `json:"service_id"`
+	PlanID     string    `json:"plan_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	Objects    int64     `json:"objects"`
+	Size       int64     `json:"size"`
+}
+
+// Snapshotter is implemented by server backends that keep point-in-time
+// copies of their instances on the server itself, where they can be taken
+// and restored without streaming data through the broker.
+type Snapshotter interface {
+	// Snapshot copies the current data of instance into a snapshot, which
+	// is listed once it is complete.
+	Snapshot(ctx context.Context, instance *Instance, info SnapshotInfo, progress func(string)) error
+
+	// Snapshots returns the complete snapshots of an instance, oldest
+	// first. The instance need not exist anymore.
+	Snapshots(ctx context.Context, instanceID string) ([]SnapshotInfo, error)
+
+	// RestoreSnapshot replaces the data of instance with snapshot, which
+	// may have been taken of another instance of the same plan.
+	RestoreSnapshot(ctx context.Context, instance *Instance, snapshot SnapshotInfo, progress func(string)) error
+
+	// DeleteSnapshot removes a snapshot. It must succeed if it is already
+	// gone.
+	DeleteSnapshot(ctx context.Context, instanceID, id string) error
+}
+
+func snapshotError(format string, args ...any) error {
+	return apiresponses.NewFailureResponse(
+		fmt.Errorf(format, args...), http.StatusBadRequest, "invalid-snapshot",
+	)
+}
+
+// snapshotter returns the Snapshotter serving instance.
+func (b *Broker) snapshotter(instance *Instance) (Snapshotter, error) {
+	backend, err := b.serverBackend(instance)
+	if err != nil {
+		return nil, err
+	}
+	snapshotter, ok := backend.(Snapshotter)
+	if !ok {
+		return nil, snapshotError("service %s does not support snapshots", instance.ServiceID)
+	}
+	return snapshotter, nil
+}
+
+// snapshotters returns the Snapshotters that may hold snapshots of an
+// instance: the one serving it, or every one if it has been deprovisioned.
+func (b *Broker) snapshotters(ctx context.Context, instanceID string) ([]Snapshotter, error) {
+	instance, err := b.store.GetInstance(ctx, instanceID)
+	switch {
+	case err == nil:
+		snapshotter, err := b.snapshotter(instance)
+		if err != nil {
+			return nil, err
+		}
+		return []Snapshotter{snapshotter}, nil
+	case !errors.Is(err, ErrNotFound):
+		return nil, err
+	}
+
+	var snapshotters []Snapshotter
+	for _, backend := range b.backends {
+		backends := []Backend{backend}
+		if pool, ok := backend.(*Pool); ok {
+			backends = backends[:0]
+			for _, s := range pool.servers {
+				backends = append(backends, s.Backend)
+			}
+		}
+		for _, backend := range backends {
+			if snapshotter, ok := backend.(Snapshotter); ok {
+				snapshotters = append(snapshotters, snapshotter)
+			}
+		}
+	}
+	return snapshotters, nil
+}
+
+// Snapshot starts a snapshot of an instance in the background and returns
+// the info it will be kept under. The outcome is logged; the snapshot is
+// listed by Snapshots once it is complete.
+func (b *Broker) Snapshot(ctx context.Context, instanceID string) (SnapshotInfo, error) {
+	unlock := b.locks.lock(instanceID)
+	defer unlock()
+
+	instance, err := b.readyInstance(ctx, instanceID)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	snapshotter, err := b.snapshotter(instance)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	release, err := b.markCopying(operationSnapshot, instanceID)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	now := time.Now().UTC()
+	info := SnapshotInfo{
+		ID:         now.Format(BackupIDFormat),
+		InstanceID: instance.ID,
+		ServiceID:  instance.ServiceID,
+		PlanID:     instance.PlanID,
+		CreatedAt:  now,
+	}
+
+	// The snapshot outlives the request but keeps its trace and
+	// correlation values.
+	ctx = context.WithoutCancel(ctx)
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer release()
+		_ = b.run(ctx, operationSnapshot, instance, nil, func(ctx context.Context) error {
+			logger := logging.FromContext(ctx).With(slog.String("snapshot_id", info.ID))
+			err := snapshotter.Snapshot(ctx, instance, info, func(msg string) {
+				logger.Info(msg)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to snapshot instance: %w", err)
+			}
+			logger.Info("took snapshot")
+			return nil
+		})
+	}()
+	return info, nil
+}
+
+// Snapshots lists the snapshots of an instance, oldest first. Snapshots of
+// deprovisioned instances are looked up on every server.
+func (b *Broker) Snapshots(ctx context.Context, instanceID string) ([]SnapshotInfo, error) {
+	snapshotters, err := b.snapshotters(ctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []SnapshotInfo{}
+	for _, snapshotter := range snapshotters {
+		found, err := snapshotter.Snapshots(ctx, instanceID)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, found...)
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool { return snapshots[i].ID < snapshots[j].ID })
+	return snapshots, nil
+}
+
+// DeleteSnapshot removes a snapshot of an instance.
+func (b *Broker) DeleteSnapshot(ctx context.Context, instanceID, snapshotID string) error {
+	snapshotters, err := b.snapshotters(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+	deleted := false
+	for _, snapshotter := range snapshotters {
+		snapshots, err := snapshotter.Snapshots(ctx, instanceID)
+		if err != nil {
+			return err
+		}
+		for _, s := range snapshots {
+			if s.ID != snapshotID {
+				continue
+			}
+			if err := snapshotter.DeleteSnapshot(ctx, instanceID, snapshotID); err != nil {
+				return fmt.Errorf("failed to delete snapshot %s: %w", snapshotID, err)
+			}
+			deleted = true
+		}
+	}
+	if !deleted {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RestoreSnapshot replaces the data of an instance with a snapshot in the
+// background. The snapshot may have been taken of sourceInstanceID, another
+// instance of the same plan, and must be kept on the instance's server; an
+// empty sourceInstanceID means the instance itself. Progress and the outcome
+// are reported through LastOperation.
+func (b *Broker) RestoreSnapshot(ctx context.Context, instanceID, sourceInstanceID, snapshotID string) error {
+	if sourceInstanceID == "" {
+		sourceInstanceID = instanceID
+	}
+
+	unlock := b.locks.lock(instanceID)
+	defer unlock()
+
+	instance, err := b.readyInstance(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+	snapshotter, err := b.snapshotter(instance)
+	if err != nil {
+		return err
+	}
+	snapshots, err := snapshotter.Snapshots(ctx, sourceInstanceID)
+	if err != nil {
+		return err
+	}
+	var info *SnapshotInfo
+	for i := range snapshots {
+		if snapshots[i].ID == snapshotID {
+			info = &snapshots[i]
+		}
+	}
+	if info == nil {
+		return fmt.Errorf("snapshot %s of instance %s on the instance's server: %w",
+			snapshotID, sourceInstanceID, ErrNotFound)
+	}
+	if info.ServiceID != instance.ServiceID || info.PlanID != instance.PlanID {
+		return snapshotError("snapshot %s is of plan %s and cannot be restored into plan %s",
+			snapshotID, info.PlanID, instance.PlanID)
+	}
+
+	restore := func(ctx context.Context) error {
+		return snapshotter.RestoreSnapshot(ctx, instance, *info, func(msg string) {
+			b.reportProgress(ctx, instanceID, msg)
+		})
+	}
+	return b.startAsync(ctx, OperationRestore, instance, restore, func(ctx context.Context, err error) error {
+		instance.LastOperation.finish(err)
+		if err == nil {
+			instance.LastOperation.Description = "restored snapshot " + info.ID
+		}
+		return b.store.PutInstance(ctx, instance)
+	})
+}
@@ -0,0 +1,285 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ErrNotFound is returned by a Store when an instance or binding is not
+// recorded.
+var ErrNotFound = errors.New("not found")
+
+// Store persists instance and binding state. Implementations must be safe
+// for concurrent use and must return copies, so callers can modify the
+// returned values freely.
+type Store interface {
+	GetInstance(ctx context.Context, id string) (*Instance, error)
+	ListInstances(ctx context.Context) ([]*Instance, error)
+	PutInstance(ctx context.Context, instance *Instance) error
+	// DeleteInstance removes an instance and all of its bindings.
+	DeleteInstance(ctx context.Context, id string) error
+
+	GetBinding(ctx context.Context, instanceID, bindingID string) (*Binding, error)
+	ListBindings(ctx context.Context, instanceID string) ([]*Binding, error)
+	PutBinding(ctx context.Context, binding *Binding) error
+	DeleteBinding(ctx context.Context, instanceID, bindingID string) error
+}
+
+// state is the document held by MemoryStore and persisted by FileStore.
+type state struct {
+	Instances map[string]*Instance           `json:"instances"`
+	Bindings  map[string]map[string]*Binding `json:"bindings"`
+}
+
+// MemoryStore keeps state in memory. It is lost when the broker restarts.
+type MemoryStore struct {
+	mu    sync.RWMutex
+	state state
+	// persist, if set, is called with the lock held after every change.
+	persist func(*state) error
+}
+
+// NewMemoryStore creates an empty in-memory Store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{state: state{
+		Instances: make(map[string]*Instance),
+		Bindings:  make(map[string]map[string]*Binding),
+	}}
+}
+
+// GetInstance implements Store.
+func (s *MemoryStore) GetInstance(_ context.Context, id string) (*Instance, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	instance, ok := s.state.Instances[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return clone(instance)
+}
+
+// ListInstances implements Store. Instances are ordered by ID.
+func (s *MemoryStore) ListInstances(_ context.Context) ([]*Instance, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	instances := make([]*Instance, 0, len(s.state.Instances))
+	for _, instance := range s.state.Instances {
+		c, err := clone(instance)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, c)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+	return instances, nil
+}
+
+// PutInstance implements Store.
+func (s *MemoryStore) PutInstance(_ context.Context, instance *Instance) error {
+	c, err := clone(instance)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, existed := s.state.Instances[instance.ID]
+	s.state.Instances[instance.ID] = c
+	if err := s.save(); err != nil {
+		if existed {
+			s.state.Instances[instance.ID] = prev
+		} else {
+			delete(s.state.Instances, instance.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// DeleteInstance implements Store.
+func (s *MemoryStore) DeleteInstance(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, existed := s.state.Instances[id]
+	prevBindings := s.state.Bindings[id]
+	delete(s.state.Instances, id)
+	delete(s.state.Bindings, id)
+	if err := s.save(); err != nil {
+		if existed {
+			s.state.Instances[id] = prev
+		}
+		if prevBindings != nil {
+			s.state.Bindings[id] = prevBindings
+		}
+		return err
+	}
+	return nil
+}
+
+// GetBinding implements Store.
+func (s *MemoryStore) GetBinding(_ context.Context, instanceID, bindingID string) (*Binding, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	binding, ok := s.state.Bindings[instanceID][bindingID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return clone(binding)
+}
+
+// ListBindings implements Store. Bindings are ordered by ID.
+func (s *MemoryStore) ListBindings(_ context.Context, instanceID string) ([]*Binding, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bindings := make([]*Binding, 0, len(s.state.Bindings[instanceID]))
+	for _, binding := range s.state.Bindings[instanceID] {
+		c, err := clone(binding)
+		if err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, c)
+	}
+	sort.Slice(bindings, func(i, j int) bool { return bindings[i].ID < bindings[j].ID })
+	return bindings, nil
+}
+
+// PutBinding implements Store.
+func (s *MemoryStore) PutBinding(_ context.Context, binding *Binding) error {
+	c, err := clone(binding)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bindings := s.state.Bindings[binding.InstanceID]
+	if bindings == nil {
+		bindings = make(map[string]*Binding)
+		s.state.Bindings[binding.InstanceID] = bindings
+	}
+	prev, existed := bindings[binding.ID]
+	bindings[binding.ID] = c
+	if err := s.save(); err != nil {
+		if existed {
+			bindings[binding.ID] = prev
+		} else {
+			delete(bindings, binding.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// DeleteBinding implements Store.
+func (s *MemoryStore) DeleteBinding(_ context.Context, instanceID, bindingID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bindings := s.state.Bindings[instanceID]
+	prev, existed := bindings[bindingID]
+	if !existed {
+		return nil
+	}
+	delete(bindings, bindingID)
+	if err := s.save(); err != nil {
+		bindings[bindingID] = prev
+		return err
+	}
+	return nil
+}
+
+func (s *MemoryStore) save() error {
+	if s.persist == nil {
+		return nil
+	}
+	return s.persist(&s.state)
+}
+
+// FileStore is a MemoryStore that writes its state to a JSON file after
+// every change. The file contains binding credentials and is created with
+// mode 0600.
+type FileStore struct {
+	*MemoryStore
+	path string
+}
+
+// NewFileStore loads the state file at path, creating it on first write.
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{MemoryStore: NewMemoryStore(), path: path}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read state file %s: %w", path, err)
+	default:
+		if err := json.Unmarshal(data, &s.state); err != nil {
+			return nil, fmt.Errorf("failed to decode state file %s: %w", path, err)
+		}
+		if s.state.Instances == nil {
+			s.state.Instances = make(map[string]*Instance)
+		}
+		if s.state.Bindings == nil {
+			s.state.Bindings = make(map[string]map[string]*Binding)
+		}
+	}
+
+	s.persist = s.write
+	return s, nil
+}
+
+// write replaces the state file atomically.
+func (s *FileStore) write(st *state) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+	return nil
+}
+
+// clone deep-copies a stored value through its JSON form.
+func clone[T any](v *T) (*T, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy state: %w", err)
+	}
+	var c T
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("failed to copy state: %w", err)
+	}
+	return &c, nil
+}
@@ -0,0 +1,579 @@
+// Package config reads broker and backend settings from the environment.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server holds the settings shared by every broker binary.
+type Server struct {
+	Port         string
+	Username     string
+	Password     string
+	AuditLogFile string
+	// StateFile is where instance and binding state is kept. When empty,
+	// state is held in memory only.
+	StateFile string
+	// StateRequired refuses to start without a StateFile.
+	StateRequired bool
+	// Async runs long operations in the background when the platform
+	// accepts incomplete operations.
+	Async bool
+}
+
+// ServerFromEnv reads PORT, BROKER_USERNAME, BROKER_PASSWORD,
+// AUDIT_LOG_FILE, STATE_FILE, STATE_REQUIRED and BROKER_ASYNC.
+func ServerFromEnv() (Server, error) {
+	cfg := Server{
+		Port:         getenv("PORT", "8080"),
+		Username:     os.Getenv("BROKER_USERNAME"),
+		Password:     os.Getenv("BROKER_PASSWORD"),
+		AuditLogFile: os.Getenv("AUDIT_LOG_FILE"),
+		StateFile:    os.Getenv("STATE_FILE"),
+		Async:        strings.EqualFold(os.Getenv("BROKER_ASYNC"), "true"),
+
+		StateRequired: strings.EqualFold(os.Getenv("STATE_REQUIRED"), "true"),
+	}
+	if cfg.Username == "" || cfg.Password == "" {
+		return Server{}, errors.New("BROKER_USERNAME and BROKER_PASSWORD must be set")
+	}
+	if cfg.StateRequired && cfg.StateFile == "" {
+		return Server{}, errors.New("STATE_FILE must be set when STATE_REQUIRED is true")
+	}
+	return cfg, nil
+}
+
+// Postgres holds the connection settings for the shared PostgreSQL server.
+type Postgres struct {
+	Host          string
+	Port          string
+	AdminUser     string
+	AdminPassword string
+	// SharedDatabase holds the schemas of schema plan instances.
+	SharedDatabase string
+}
+
+// PostgresFromEnv reads PG_HOST, PG_PORT, PG_ADMIN_USER, PG_ADMIN_PASSWORD
+// and PG_SHARED_DATABASE.
+func PostgresFromEnv() (Postgres, error) {
+	cfg := postgresDefaults()
+	if cfg.AdminPassword == "" {
+		return Postgres{}, errors.New("PG_ADMIN_PASSWORD must be set")
+	}
+	return cfg, nil
+}
+
+func postgresDefaults() Postgres {
+	return Postgres{
+		Host:           getenv("PG_HOST", "postgresql.default.svc.cluster.local"),
+		Port:           getenv("PG_PORT", "5432"),
+		AdminUser:      getenv("PG_ADMIN_USER", "postgres"),
+		AdminPassword:  os.Getenv("PG_ADMIN_PASSWORD"),
+		SharedDatabase: getenv("PG_SHARED_DATABASE", "cf_shared"),
+	}
+}
+
+// PostgresServer is one PostgreSQL server of a pool.
+type PostgresServer struct {
+	PoolServer
+	Postgres
+}
+
+// PostgresServersFromEnv reads the PostgreSQL servers from PG_SERVERS, a
+// JSON array of objects with the keys name, host, port, admin_user,
+// admin_password, labels, capacity and draining. Missing connection
+// settings default to the PG_* variables. Without PG_SERVERS the single
+// server from PostgresFromEnv is returned, named "default".
+func PostgresServersFromEnv() ([]PostgresServer, error) {
+	raw := os.Getenv("PG_SERVERS")
+	if raw == "" {
+		cfg, err := PostgresFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return []PostgresServer{{PoolServer: PoolServer{Name: "default"}, Postgres: cfg}}, nil
+	}
+
+	var entries []struct {
+		PoolServer
+		Host          string `json:"host"`
+		Port          string `json:"port"`
+		AdminUser     string `json:"admin_user"`
+		AdminPassword string `json:"admin_password"`
+	}
+	if err := json.Unmarshal([]byte(raw), &entries); err != nil {
+		return nil, fmt.Errorf("invalid PG_SERVERS: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("PG_SERVERS must list at least one server")
+	}
+
+	servers := make([]PostgresServer, 0, len(entries))
+	for _, e := range entries {
+		cfg := postgresDefaults()
+		if e.Host != "" {
+			cfg.Host = e.Host
+		}
+		if e.Port != "" {
+			cfg.Port = e.Port
+		}
+		if e.AdminUser != "" {
+			cfg.AdminUser = e.AdminUser
+		}
+		if e.AdminPassword != "" {
+			cfg.AdminPassword = e.AdminPassword
+		}
+		if cfg.AdminPassword == "" {
+			return nil, fmt.Errorf("PG_SERVERS: server %q has no admin_password and PG_ADMIN_PASSWORD is not set", e.Name)
+		}
+		servers = append(servers, PostgresServer{PoolServer: e.PoolServer, Postgres: cfg})
+	}
+	return servers, nil
+}
+
+// PostgresLimits holds the resource limits of one PostgreSQL plan.
+type PostgresLimits struct {
+	ConnectionLimit                 int    `json:"connection_limit,omitempty"`
+	RoleConnectionLimit             int    `json:"role_connection_limit,omitempty"`
+	StatementTimeout                string `json:"statement_timeout,omitempty"`
+	IdleInTransactionSessionTimeout string `json:"idle_in_transaction_session_timeout,omitempty"`
+	WorkMem                         string `json:"work_mem,omitempty"`
+	MaxSizeMB                       int64  `json:"max_size_mb,omitempty"`
+}
+
+// PostgresPlanLimitsFromEnv reads PG_PLAN_LIMITS, a JSON object mapping
+// plan names to their limits.
+func PostgresPlanLimitsFromEnv() (map[string]PostgresLimits, error) {
+	var plans map[string]PostgresLimits
+	if raw := os.Getenv("PG_PLAN_LIMITS"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &plans); err != nil {
+			return nil, fmt.Errorf("invalid PG_PLAN_LIMITS: %w", err)
+		}
+	}
+	return plans, nil
+}
+
+// MinIO holds the connection settings for the shared MinIO server.
+type MinIO struct {
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+	// PublicEndpoint is how the server is reached from outside the
+	// cluster, as host[:port] or an http(s) URL; empty uses Endpoint.
+	PublicEndpoint string
+	// SnapshotBucket is the bucket, optionally followed by a /prefix, that
+	// instance snapshots are kept in on the server.
+	SnapshotBucket string
+	// NotificationTarget is the ARN of the webhook target configured on the
+	// server for bucket notifications.
+	NotificationTarget string
+	// CAFile is a PEM bundle of extra certificate authorities to trust.
+	CAFile string
+	// InsecureSkipVerify disables TLS certificate verification; for
+	// development only.
+	InsecureSkipVerify bool
+	// Region is sent in request signatures; empty looks it up.
+	Region string
+	// ConnectTimeout and ResponseTimeout limit connecting and waiting for
+	// response headers; zero leaves them unlimited.
+	ConnectTimeout  time.Duration
+	ResponseTimeout time.Duration
+}
+
+// MinIOFromEnv reads MINIO_ENDPOINT, MINIO_ACCESS_KEY, MINIO_SECRET_KEY,
+// MINIO_USE_SSL, MINIO_PUBLIC_ENDPOINT, MINIO_SNAPSHOT_BUCKET, MINIO_NOTIFICATION_TARGET,
+// MINIO_CA_FILE, MINIO_INSECURE_SKIP_VERIFY, MINIO_REGION,
+// MINIO_CONNECT_TIMEOUT and MINIO_RESPONSE_TIMEOUT.
+func MinIOFromEnv() (MinIO, error) {
+	cfg := minioDefaults()
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return MinIO{}, errors.New("MINIO_ACCESS_KEY and MINIO_SECRET_KEY must be set")
+	}
+	if err := minioTimeouts(&cfg); err != nil {
+		return MinIO{}, err
+	}
+	return cfg, nil
+}
+
+// minioTimeouts reads MINIO_CONNECT_TIMEOUT and MINIO_RESPONSE_TIMEOUT,
+// which apply to every server.
+func minioTimeouts(cfg *MinIO) error {
+	var err error
+	if cfg.ConnectTimeout, err = durationEnv("MINIO_CONNECT_TIMEOUT"); err != nil {
+		return err
+	}
+	cfg.ResponseTimeout, err = durationEnv("MINIO_RESPONSE_TIMEOUT")
+	return err
+}
+
+func minioDefaults() MinIO {
+	return MinIO{
+		Endpoint:  getenv("MINIO_ENDPOINT", "minio.default.svc.cluster.local:9000"),
+		AccessKey: os.Getenv("MINIO_ACCESS_KEY"),
+		SecretKey: os.Getenv("MINIO_SECRET_KEY"),
+		UseSSL:    strings.EqualFold(os.Getenv("MINIO_USE_SSL"), "true"),
+
+		PublicEndpoint:     os.Getenv("MINIO_PUBLIC_ENDPOINT"),
+		SnapshotBucket:     getenv("MINIO_SNAPSHOT_BUCKET", "broker-snapshots"),
+		NotificationTarget: os.Getenv("MINIO_NOTIFICATION_TARGET"),
+		CAFile:             os.Getenv("MINIO_CA_FILE"),
+		InsecureSkipVerify: strings.EqualFold(os.Getenv("MINIO_INSECURE_SKIP_VERIFY"), "true"),
+		Region:             os.Getenv("MINIO_REGION"),
+	}
+}
+
+// MinIOServer is one MinIO server of a pool.
+type MinIOServer struct {
+	PoolServer
+	MinIO
+}
+
+// MinIOServersFromEnv reads the MinIO servers from MINIO_SERVERS, a JSON
+// array of objects with the keys name, endpoint, access_key, secret_key,
+// use_ssl, public_endpoint, snapshot_bucket, notification_target, ca_file,
+// insecure_skip_verify, region, labels, capacity and draining. Missing connection settings
+// default to the MINIO_* variables. Without MINIO_SERVERS the single server
+// from MinIOFromEnv is returned, named "default".
+func MinIOServersFromEnv() ([]MinIOServer, error) {
+	raw := os.Getenv("MINIO_SERVERS")
+	if raw == "" {
+		cfg, err := MinIOFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return []MinIOServer{{PoolServer: PoolServer{Name: "default"}, MinIO: cfg}}, nil
+	}
+
+	var entries []struct {
+		PoolServer
+		Endpoint  string `json:"endpoint"`
+		AccessKey string `json:"access_key"`
+		SecretKey string `json:"secret_key"`
+		UseSSL    *bool  `json:"use_ssl"`
+
+		PublicEndpoint     string `json:"public_endpoint"`
+		SnapshotBucket     string `json:"snapshot_bucket"`
+		NotificationTarget string `json:"notification_target"`
+		CAFile             string `json:"ca_file"`
+		InsecureSkipVerify *bool  `json:"insecure_skip_verify"`
+		Region             string `json:"region"`
+	}
+	if err := json.Unmarshal([]byte(raw), &entries); err != nil {
+		return nil, fmt.Errorf("invalid MINIO_SERVERS: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("MINIO_SERVERS must list at least one server")
+	}
+
+	servers := make([]MinIOServer, 0, len(entries))
+	for _, e := range entries {
+		cfg := minioDefaults()
+		if e.Endpoint != "" {
+			cfg.Endpoint = e.Endpoint
+		}
+		if e.AccessKey != "" {
+			cfg.AccessKey = e.AccessKey
+		}
+		if e.SecretKey != "" {
+			cfg.SecretKey = e.SecretKey
+		}
+		if e.UseSSL != nil {
+			cfg.UseSSL = *e.UseSSL
+		}
+		if e.PublicEndpoint != "" {
+			cfg.PublicEndpoint = e.PublicEndpoint
+		}
+		if e.SnapshotBucket != "" {
+			cfg.SnapshotBucket = e.SnapshotBucket
+		}
+		if e.NotificationTarget != "" {
+			cfg.NotificationTarget = e.NotificationTarget
+		}
+		if e.CAFile != "" {
+			cfg.CAFile = e.CAFile
+		}
+		if e.InsecureSkipVerify != nil {
+			cfg.InsecureSkipVerify = *e.InsecureSkipVerify
+		}
+		if e.Region != "" {
+			cfg.Region = e.Region
+		}
+		if err := minioTimeouts(&cfg); err != nil {
+			return nil, err
+		}
+		if cfg.AccessKey == "" || cfg.SecretKey == "" {
+			return nil, fmt.Errorf("MINIO_SERVERS: server %q has no access_key/secret_key and MINIO_ACCESS_KEY/MINIO_SECRET_KEY are not set", e.Name)
+		}
+		servers = append(servers, MinIOServer{PoolServer: e.PoolServer, MinIO: cfg})
+	}
+	return servers, nil
+}
+
+// MinIOEncryptionFromEnv reads MINIO_ENCRYPTION_PLANS, a comma-separated
+// list of the default bucket encryption modes to offer a plan for: sse-s3
+// and sse-kms. The modes are returned as SSE-S3 and SSE-KMS.
+func MinIOEncryptionFromEnv() ([]string, error) {
+	var modes []string
+	for _, mode := range strings.Split(os.Getenv("MINIO_ENCRYPTION_PLANS"), ",") {
+		switch mode = strings.ToUpper(strings.TrimSpace(mode)); mode {
+		case "":
+		case "SSE-S3", "SSE-KMS":
+			modes = append(modes, mode)
+		default:
+			return nil, fmt.Errorf("invalid MINIO_ENCRYPTION_PLANS: unknown mode %q", mode)
+		}
+	}
+	return modes, nil
+}
+
+// MinIOPlanFeatures holds the parameters one MinIO plan allows.
+type MinIOPlanFeatures struct {
+	CORS       bool `json:"cors"`
+	PublicRead bool `json:"public_read"`
+}
+
+// MinIOPlanFeaturesFromEnv reads MINIO_PLAN_FEATURES, a JSON object mapping
+// plan names to the parameters they allow. Features left out of an entry
+// are allowed.
+func MinIOPlanFeaturesFromEnv() (map[string]MinIOPlanFeatures, error) {
+	var entries map[string]json.RawMessage
+	if raw := os.Getenv("MINIO_PLAN_FEATURES"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &entries); err != nil {
+			return nil, fmt.Errorf("invalid MINIO_PLAN_FEATURES: %w", err)
+		}
+	}
+	plans := make(map[string]MinIOPlanFeatures, len(entries))
+	for name, raw := range entries {
+		features := MinIOPlanFeatures{CORS: true, PublicRead: true}
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&features); err != nil {
+			return nil, fmt.Errorf("invalid MINIO_PLAN_FEATURES for plan %q: %w", name, err)
+		}
+		plans[name] = features
+	}
+	return plans, nil
+}
+
+// MySQL holds the connection settings for the shared MySQL or MariaDB
+// server.
+type MySQL struct {
+	Host          string
+	Port          string
+	AdminUser     string
+	AdminPassword string
+}
+
+// MySQLFromEnv reads MYSQL_HOST, MYSQL_PORT, MYSQL_ADMIN_USER and
+// MYSQL_ADMIN_PASSWORD.
+func MySQLFromEnv() (MySQL, error) {
+	cfg := MySQL{
+		Host:          getenv("MYSQL_HOST", "mysql.default.svc.cluster.local"),
+		Port:          getenv("MYSQL_PORT", "3306"),
+		AdminUser:     getenv("MYSQL_ADMIN_USER", "root"),
+		AdminPassword: os.Getenv("MYSQL_ADMIN_PASSWORD"),
+	}
+	if cfg.AdminPassword == "" {
+		return MySQL{}, errors.New("MYSQL_ADMIN_PASSWORD must be set")
+	}
+	return cfg, nil
+}
+
+// RabbitMQ holds the connection settings for the shared RabbitMQ server.
+type RabbitMQ struct {
+	Host          string
+	AMQPPort      string
+	ManagementURL string
+	AdminUser     string
+	AdminPassword string
+}
+
+// RabbitMQFromEnv reads RABBITMQ_HOST, RABBITMQ_AMQP_PORT,
+// RABBITMQ_MANAGEMENT_URL, RABBITMQ_ADMIN_USER and RABBITMQ_ADMIN_PASSWORD.
+func RabbitMQFromEnv() (RabbitMQ, error) {
+	cfg := RabbitMQ{
+		Host:          getenv("RABBITMQ_HOST", "rabbitmq.default.svc.cluster.local"),
+		AMQPPort:      getenv("RABBITMQ_AMQP_PORT", "5672"),
+		AdminUser:     getenv("RABBITMQ_ADMIN_USER", "guest"),
+		AdminPassword: os.Getenv("RABBITMQ_ADMIN_PASSWORD"),
+	}
+	cfg.ManagementURL = getenv("RABBITMQ_MANAGEMENT_URL", "http://"+cfg.Host+":15672")
+	if cfg.AdminPassword == "" {
+		return RabbitMQ{}, errors.New("RABBITMQ_ADMIN_PASSWORD must be set")
+	}
+	return cfg, nil
+}
+
+// Redis holds the connection settings for the shared Redis server.
+type Redis struct {
+	Host          string
+	Port          string
+	AdminUser     string
+	AdminPassword string
+	// Isolation is "auto", "acl" or "db".
+	Isolation string
+}
+
+// RedisFromEnv reads REDIS_HOST, REDIS_PORT, REDIS_ADMIN_USER,
+// REDIS_ADMIN_PASSWORD and REDIS_ISOLATION.
+func RedisFromEnv() (Redis, error) {
+	cfg := Redis{
+		Host:          getenv("REDIS_HOST", "redis.default.svc.cluster.local"),
+		Port:          getenv("REDIS_PORT", "6379"),
+		AdminUser:     os.Getenv("REDIS_ADMIN_USER"),
+		AdminPassword: os.Getenv("REDIS_ADMIN_PASSWORD"),
+		Isolation:     strings.ToLower(getenv("REDIS_ISOLATION", "auto")),
+	}
+	switch cfg.Isolation {
+	case "auto", "acl", "db":
+	default:
+		return Redis{}, fmt.Errorf("REDIS_ISOLATION must be auto, acl or db, got %q", cfg.Isolation)
+	}
+	return cfg, nil
+}
+
+// Backups holds where instance backups are stored and how often they are
+// taken.
+type Backups struct {
+	// Bucket is empty when backups are disabled.
+	Bucket    string
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+	// CAFile is a PEM bundle of extra certificate authorities to trust.
+	CAFile string
+	// InsecureSkipVerify disables TLS certificate verification; for
+	// development only.
+	InsecureSkipVerify bool
+	// Region is sent in request signatures; empty looks it up.
+	Region string
+	// Interval between scheduled backups of each instance; zero disables
+	// scheduled backups.
+	Interval time.Duration
+	// Keep is the number of backups kept per instance; zero keeps all.
+	Keep int
+	// MaxAge is how long backups are kept; zero keeps them forever.
+	MaxAge time.Duration
+}
+
+// BackupsFromEnv reads BACKUP_BUCKET, BACKUP_ENDPOINT, BACKUP_ACCESS_KEY,
+// BACKUP_SECRET_KEY, BACKUP_USE_SSL, BACKUP_CA_FILE,
+// BACKUP_INSECURE_SKIP_VERIFY, BACKUP_REGION, BACKUP_INTERVAL, BACKUP_KEEP
+// and BACKUP_MAX_AGE. Backups are disabled unless BACKUP_BUCKET is set; the
+// connection settings default to the MINIO_* variables.
+func BackupsFromEnv() (Backups, error) {
+	minio := minioDefaults()
+	cfg := Backups{
+		Bucket:    os.Getenv("BACKUP_BUCKET"),
+		Endpoint:  getenv("BACKUP_ENDPOINT", minio.Endpoint),
+		AccessKey: getenv("BACKUP_ACCESS_KEY", minio.AccessKey),
+		SecretKey: getenv("BACKUP_SECRET_KEY", minio.SecretKey),
+		UseSSL:    strings.EqualFold(getenv("BACKUP_USE_SSL", strconv.FormatBool(minio.UseSSL)), "true"),
+
+		CAFile:             getenv("BACKUP_CA_FILE", minio.CAFile),
+		InsecureSkipVerify: strings.EqualFold(getenv("BACKUP_INSECURE_SKIP_VERIFY", strconv.FormatBool(minio.InsecureSkipVerify)), "true"),
+		Region:             getenv("BACKUP_REGION", minio.Region),
+	}
+	if cfg.Bucket == "" {
+		return cfg, nil
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return Backups{}, errors.New("BACKUP_ACCESS_KEY and BACKUP_SECRET_KEY (or MINIO_ACCESS_KEY and MINIO_SECRET_KEY) must be set when BACKUP_BUCKET is")
+	}
+
+	var err error
+	if cfg.Interval, err = durationEnv("BACKUP_INTERVAL"); err != nil {
+		return Backups{}, err
+	}
+	if cfg.MaxAge, err = durationEnv("BACKUP_MAX_AGE"); err != nil {
+		return Backups{}, err
+	}
+	if cfg.Keep, err = strconv.Atoi(getenv("BACKUP_KEEP", "7")); err != nil || cfg.Keep < 0 {
+		return Backups{}, fmt.Errorf("BACKUP_KEEP must be a non-negative number, got %q", os.Getenv("BACKUP_KEEP"))
+	}
+	return cfg, nil
+}
+
+// durationEnv parses a duration such as "24h", treating an unset variable
+// as zero.
+func durationEnv(key string) (time.Duration, error) {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s must be a duration such as 24h, got %q", key, raw)
+	}
+	return d, nil
+}
+
+// PoolServer holds the placement settings of one server in a pool.
+type PoolServer struct {
+	Name     string            `json:"name"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Capacity int               `json:"capacity,omitempty"`
+	Draining bool              `json:"draining,omitempty"`
+}
+
+// Placement holds how a backend spreads instances over its servers.
+type Placement struct {
+	Strategy string
+	// Plans maps plan names to plan-specific placement rules.
+	Plans map[string]PlanPlacement
+}
+
+// PlanPlacement holds the labels a plan requires of its servers and an
+// optional strategy override.
+type PlanPlacement struct {
+	Labels   map[string]string `json:"labels,omitempty"`
+	Strategy string            `json:"strategy,omitempty"`
+}
+
+// PlacementFromEnv reads <prefix>_PLACEMENT, the strategy, which defaults to
+// "least-loaded", and <prefix>_PLAN_PLACEMENT, a JSON object mapping plan
+// names to {"labels": {...}, "strategy": "..."}.
+func PlacementFromEnv(prefix string) (Placement, error) {
+	cfg := Placement{Strategy: getenv(prefix+"_PLACEMENT", "least-loaded")}
+	if raw := os.Getenv(prefix + "_PLAN_PLACEMENT"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &cfg.Plans); err != nil {
+			return Placement{}, fmt.Errorf("invalid %s_PLAN_PLACEMENT: %w", prefix, err)
+		}
+	}
+	return cfg, nil
+}
+
+// Backends returns the backends enabled by BACKENDS, a comma-separated list
+// that defaults to "postgres,minio".
+func Backends() ([]string, error) {
+	var backends []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(getenv("BACKENDS", "postgres,minio"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		backends = append(backends, name)
+	}
+	if len(backends) == 0 {
+		return nil, errors.New("BACKENDS must list at least one backend")
+	}
+	return backends, nil
+}
+
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,241 @@
+// Package logging builds the structured loggers used by the brokers and
+// provides helpers for logging broker operations with a consistent set of
+// attributes.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/williamzujkowski/cf-local-service-broker/internal/osbapi"
+)
+
+// Attribute keys shared by every broker operation log line.
+const (
+	KeyOperation           = "operation"
+	KeyInstanceID          = "instance_id"
+	KeyBindingID           = "binding_id"
+	KeyServiceID           = "service_id"
+	KeyPlanID              = "plan_id"
+	KeyOrganizationGUID    = "organization_guid"
+	KeySpaceGUID           = "space_guid"
+	KeyOriginatingIdentity = "originating_identity"
+	KeyCorrelationID       = "correlation_id"
+	KeyRequestIdentity     = "request_identity"
+	KeyParameters          = "parameters"
+	KeyDuration            = "duration"
+	KeyError               = "error"
+)
+
+// Redacted replaces the value of any sensitive attribute or parameter.
+const Redacted = "[REDACTED]"
+
+// sensitiveSuffixes are matched case-insensitively against the end of
+// attribute and parameter keys, so "admin_password" and "jdbcUrl" are
+// redacted but "security" is not.
+var sensitiveSuffixes = []string{
+	"password",
+	"secret",
+	"secret_key",
+	"token",
+	"credentials",
+	"private_key",
+	"uri",
+	"url",
+}
+
+// New creates a logger writing to w. format is "json" or "text" (the
+// default); level is "debug", "info" (the default), "warn" or "error".
+// Sensitive attributes are redacted regardless of format.
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("invalid log level %q: %w", level, err)
+		}
+	}
+
+	opts := &slog.HandlerOptions{
+		Level:       lvl,
+		ReplaceAttr: redactAttr,
+	}
+
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q: must be json or text", format)
+	}
+}
+
+// FromEnv creates a logger configured by LOG_FORMAT and LOG_LEVEL.
+func FromEnv(w io.Writer) (*slog.Logger, error) {
+	return New(w, os.Getenv("LOG_FORMAT"), os.Getenv("LOG_LEVEL"))
+}
+
+// IsSensitive reports whether values stored under key should be redacted.
+func IsSensitive(key string) bool {
+	k := strings.ToLower(key)
+	for _, s := range sensitiveSuffixes {
+		if strings.HasSuffix(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	if IsSensitive(a.Key) {
+		return slog.String(a.Key, Redacted)
+	}
+	return a
+}
+
+// RedactMap returns a copy of m with the values of sensitive keys replaced,
+// descending into nested maps and slices.
+func RedactMap(m map[string]any) map[string]any {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]any, len(m))
+	for k, v := range m {
+		if IsSensitive(k) {
+			out[k] = Redacted
+			continue
+		}
+		out[k] = redactValue(v)
+	}
+	return out
+}
+
+func redactValue(v any) any {
+	switch val := v.(type) {
+	case map[string]any:
+		return RedactMap(val)
+	case []any:
+		out := make([]any, len(val))
+		for i, item := range val {
+			out[i] = redactValue(item)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// RedactParameters decodes raw OSBAPI parameters and redacts sensitive
+// values. Parameters that are not a JSON object are returned as nil.
+func RedactParameters(raw json.RawMessage) map[string]any {
+	if len(raw) == 0 {
+		return nil
+	}
+	var params map[string]any
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil
+	}
+	return RedactMap(params)
+}
+
+// InstanceID returns the instance_id attribute.
+func InstanceID(id string) slog.Attr { return slog.String(KeyInstanceID, id) }
+
+// BindingID returns the binding_id attribute.
+func BindingID(id string) slog.Attr { return slog.String(KeyBindingID, id) }
+
+// ServiceID returns the service_id attribute.
+func ServiceID(id string) slog.Attr { return slog.String(KeyServiceID, id) }
+
+// PlanID returns the plan_id attribute.
+func PlanID(id string) slog.Attr { return slog.String(KeyPlanID, id) }
+
+// Parameters returns the parameters attribute with secrets redacted.
+func Parameters(raw json.RawMessage) slog.Attr {
+	return slog.Any(KeyParameters, RedactParameters(raw))
+}
+
+// Platform returns the org/space attributes for a CF organization and space.
+// Empty values are omitted.
+func Platform(orgGUID, spaceGUID string) slog.Attr {
+	var attrs []any
+	if orgGUID != "" {
+		attrs = append(attrs, slog.String(KeyOrganizationGUID, orgGUID))
+	}
+	if spaceGUID != "" {
+		attrs = append(attrs, slog.String(KeySpaceGUID, spaceGUID))
+	}
+	// An empty group is dropped by the handlers.
+	return slog.Group("", attrs...)
+}
+
+// Request returns the per-request correlation attributes found on ctx.
+func Request(ctx context.Context) []any {
+	var attrs []any
+	if id := osbapi.CorrelationID(ctx); id != "" {
+		attrs = append(attrs, slog.String(KeyCorrelationID, id))
+	}
+	if id := osbapi.RequestIdentity(ctx); id != "" {
+		attrs = append(attrs, slog.String(KeyRequestIdentity, id))
+	}
+	if id := osbapi.OriginatingIdentity(ctx).String(); id != "" {
+		attrs = append(attrs, slog.String(KeyOriginatingIdentity, id))
+	}
+	return attrs
+}
+
+// Operation logs the outcome and duration of a single broker operation.
+type Operation struct {
+	logger *slog.Logger
+	start  time.Time
+}
+
+// Start begins logging the named operation. The returned Operation's logger
+// carries the operation name, the request correlation attributes from ctx
+// and attrs on every line.
+func Start(ctx context.Context, logger *slog.Logger, name string, attrs ...any) *Operation {
+	args := append([]any{slog.String(KeyOperation, name)}, Request(ctx)...)
+	args = append(args, attrs...)
+
+	l := logger.With(args...)
+	l.DebugContext(ctx, "operation started")
+	return &Operation{logger: l, start: time.Now()}
+}
+
+// Logger returns the operation-scoped logger.
+func (o *Operation) Logger() *slog.Logger {
+	return o.logger
+}
+
+// End logs the operation's outcome and duration. Callers defer it in a
+// closure over their named error result.
+func (o *Operation) End(err error) {
+	d := slog.Duration(KeyDuration, time.Since(o.start))
+	if err != nil {
+		o.logger.Error("operation failed", d, slog.String(KeyError, err.Error()))
+		return
+	}
+	o.logger.Info("operation succeeded", d)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying logger.
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger stored on ctx by NewContext, or
+// slog.Default() if there is none.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,108 @@
+// Package osbapi extracts the Open Service Broker API request metadata that
+// brokerapi's middleware stores on the request context.
+package osbapi
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi/v11/middlewares"
+)
+
+// Identity is the decoded X-Broker-API-Originating-Identity header.
+type Identity struct {
+	// Platform is the identity platform, e.g. "cloudfoundry" or "kubernetes".
+	Platform string `json:"platform,omitempty"`
+	// User is the user_id (Cloud Foundry) or username (Kubernetes) of the
+	// end user that triggered the request.
+	User string `json:"user,omitempty"`
+}
+
+// String renders the identity as "platform:user", or "" when unknown.
+func (i Identity) String() string {
+	if i.Platform == "" && i.User == "" {
+		return ""
+	}
+	return i.Platform + ":" + i.User
+}
+
+// CorrelationID returns the request correlation ID set by brokerapi, which
+// is taken from X-Request-ID, X-Vcap-Request-Id and friends or generated.
+func CorrelationID(ctx context.Context) string {
+	return stringValue(ctx, middlewares.CorrelationIDKey)
+}
+
+// RequestIdentity returns the X-Broker-API-Request-Identity header value.
+func RequestIdentity(ctx context.Context) string {
+	return stringValue(ctx, middlewares.RequestIdentityKey)
+}
+
+// OriginatingIdentity decodes the X-Broker-API-Originating-Identity header.
+// The header has the form "<platform> <base64 JSON>"; malformed values are
+// returned with only the platform set.
+func OriginatingIdentity(ctx context.Context) Identity {
+	return ParseOriginatingIdentity(stringValue(ctx, middlewares.OriginatingIdentityKey))
+}
+
+// ParseOriginatingIdentity decodes a raw X-Broker-API-Originating-Identity
+// header value.
+func ParseOriginatingIdentity(header string) Identity {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return Identity{}
+	}
+
+	platform, encoded, _ := strings.Cut(header, " ")
+	identity := Identity{Platform: platform}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return identity
+	}
+
+	var value struct {
+		UserID   string `json:"user_id"`
+		Username string `json:"username"`
+	}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return identity
+	}
+
+	identity.User = value.UserID
+	if identity.User == "" {
+		identity.User = value.Username
+	}
+	return identity
+}
+
+// PlatformContext holds the fields of the OSBAPI "context" object that the
+// brokers care about.
+type PlatformContext struct {
+	Platform         string `json:"platform"`
+	OrganizationGUID string `json:"organization_guid"`
+	SpaceGUID        string `json:"space_guid"`
+	InstanceName     string `json:"instance_name"`
+}
+
+// ParseContext decodes a raw OSBAPI context object. Invalid or empty input
+// yields a zero PlatformContext.
+func ParseContext(raw json.RawMessage) PlatformContext {
+	var pc PlatformContext
+	if len(raw) == 0 {
+		return pc
+	}
+	_ = json.Unmarshal(raw, &pc)
+	return pc
+}
+
+func stringValue(ctx context.Context, key middlewares.ContextKey) string {
+	if ctx == nil {
+		return ""
+	}
+	if v, ok := ctx.Value(key).(string); ok {
+		return v
+	}
+	return ""
+}
@@ -0,0 +1,165 @@
+// Package server contains the bootstrapping shared by the broker binaries:
+// logging and tracing setup, state, audit, backup and metrics wiring,
+// authentication and graceful shutdown.
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pivotal-cf/brokerapi/v11"
+	"github.com/pivotal-cf/brokerapi/v11/auth"
+	"github.com/pivotal-cf/brokerapi/v11/domain"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/audit"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/backup"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/broker"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/config"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/logging"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tlsutil"
+	"github.com/williamzujkowski/cf-local-service-broker/internal/tracing"
+)
+
+// BuildFunc creates the backends to serve. It is called after logging and
+// tracing have been configured.
+type BuildFunc func(ctx context.Context, logger *slog.Logger) ([]broker.Backend, error)
+
+// Main configures logging and tracing from the environment, builds the
+// backends and serves them until SIGINT or SIGTERM. name identifies the
+// binary in logs and traces. Main exits the process on startup failure.
+func Main(name string, build BuildFunc) {
+	logger, err := logging.FromEnv(os.Stderr)
+	if err != nil {
+		slog.Error("invalid logging configuration", "error", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
+	if err := run(name, build, logger); err != nil {
+		logger.Error("broker failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(name string, build BuildFunc, logger *slog.Logger) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	cfg, err := config.ServerFromEnv()
+	if err != nil {
+		return err
+	}
+
+	shutdownTracing, err := tracing.Setup(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.Error("failed to flush traces", "error", err)
+		}
+	}()
+
+	backends, err := build(ctx, logger)
+	if err != nil {
+		return err
+	}
+
+	var store broker.Store = broker.NewMemoryStore()
+	if cfg.StateFile != "" {
+		if store, err = broker.NewFileStore(cfg.StateFile); err != nil {
+			return err
+		}
+	} else {
+		logger.Warn("STATE_FILE is not set; instance state will be lost on restart")
+	}
+
+	brokerCfg := broker.Config{
+		Store:  store,
+		Logger: logger,
+		Async:  cfg.Async,
+	}
+	// The audit store is closed after background operations have recorded
+	// their outcome.
+	var auditStore *audit.FileStore
+	if cfg.AuditLogFile != "" {
+		if auditStore, err = audit.NewFileStore(cfg.AuditLogFile); err != nil {
+			return err
+		}
+		defer auditStore.Close()
+		brokerCfg.OperationDone = audit.OperationDone(auditStore, logger)
+	}
+	backupCfg, err := config.BackupsFromEnv()
+	if err != nil {
+		return err
+	}
+	if backupCfg.Bucket != "" {
+		if backupCfg.InsecureSkipVerify {
+			logger.Warn("TLS certificate verification is disabled for the backup store; use this for development only")
+		}
+		brokerCfg.Backups, err = backup.NewMinIOStore(
+			backupCfg.Endpoint, backupCfg.AccessKey, backupCfg.SecretKey, backupCfg.UseSSL,
+			backupCfg.Region, backupCfg.Bucket,
+			tlsutil.Config{
+				CAFile:             backupCfg.CAFile,
+				InsecureSkipVerify: backupCfg.InsecureSkipVerify,
+			})
+		if err != nil {
+			return err
+		}
+		brokerCfg.BackupPolicy = broker.BackupPolicy{
+			Interval: backupCfg.Interval,
+			Keep:     backupCfg.Keep,
+			MaxAge:   backupCfg.MaxAge,
+		}
+	}
+
+	framework, err := broker.New(ctx, brokerCfg, backends...)
+	if err != nil {
+		return err
+	}
+	// Let background operations record their outcome before exiting.
+	defer framework.Wait()
+	// Stop background work on any return, not only on a signal.
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	framework.Start(runCtx)
+
+	var serviceBroker domain.ServiceBroker = framework
+
+	credentials := brokerapi.BrokerCredentials{
+		Username: cfg.Username,
+		Password: cfg.Password,
+	}
+	adminAuth := auth.NewWrapper(cfg.Username, cfg.Password)
+
+	mux := http.NewServeMux()
+	if auditStore != nil {
+		serviceBroker = audit.Wrap(serviceBroker, auditStore, logger)
+		mux.Handle("/admin/audit", adminAuth.Wrap(audit.Handler(auditStore)))
+	}
+	mux.Handle("/admin/servers", adminAuth.Wrap(framework.ServersHandler()))
+	mux.Handle("/admin/instances/", adminAuth.Wrap(framework.InstancesHandler()))
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/", brokerapi.New(serviceBroker, logger, credentials))
+
+	server := &http.Server{Addr: ":" + cfg.Port, Handler: tracing.Handler(mux)}
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Shutdown(context.Background()); err != nil {
+			logger.Error("failed to shut down server", "error", err)
+		}
+	}()
+
+	logger.Info("broker starting", "name", name, "port", cfg.Port)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
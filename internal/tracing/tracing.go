@@ -0,0 +1,159 @@
+// Package tracing configures OpenTelemetry tracing for the brokers and
+// provides helpers for instrumenting the OSBAPI handler and backend calls.
+//
+// Exporters are selected with OTEL_TRACES_EXPORTER:
+//
+//   - "otlp" exports over OTLP/HTTP; the standard OTEL_EXPORTER_OTLP_*
+//     variables configure the endpoint, headers and TLS.
+//   - "console" (or "stdout") writes spans to stdout for local debugging.
+//   - "none" disables tracing.
+//
+// When OTEL_TRACES_EXPORTER is unset, "otlp" is used if an OTLP endpoint is
+// configured and tracing is disabled otherwise.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies the spans created by this module.
+const instrumentationName = "github.com/williamzujkowski/cf-local-service-broker"
+
+// Setup installs the global tracer provider and propagator configured from
+// the environment. serviceName is used unless OTEL_SERVICE_NAME overrides
+// it. The returned function flushes and stops the exporter.
+func Setup(ctx context.Context, serviceName string) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+
+	exporter, err := newExporter(ctx)
+	if err != nil {
+		return noop, err
+	}
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if exporter == nil {
+		return noop, nil
+	}
+
+	// Later detectors win, so OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES
+	// override the default service name.
+	res, err := resource.New(ctx,
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return noop, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+func newExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	name := strings.ToLower(strings.TrimSpace(os.Getenv("OTEL_TRACES_EXPORTER")))
+	if name == "" {
+		if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" ||
+			os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+			name = "otlp"
+		} else {
+			name = "none"
+		}
+	}
+
+	switch name {
+	case "none":
+		return nil, nil
+	case "otlp":
+		exporter, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+		}
+		return exporter, nil
+	case "console", "stdout":
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stdout trace exporter: %w", err)
+		}
+		return exporter, nil
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_EXPORTER %q: must be otlp, console or none", name)
+	}
+}
+
+// Tracer returns the tracer used for broker spans.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Start starts a span named name as a child of any span on ctx.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartClient starts a client span for a call to a backing service.
+func StartClient(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// End records err on span, if any, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Handler wraps an OSBAPI handler so that every request gets a server span.
+// Span names use the route template rather than the raw path so instance
+// and binding IDs do not blow up span cardinality.
+func Handler(h http.Handler) http.Handler {
+	return otelhttp.NewHandler(h, "osbapi",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + Route(r.URL.Path)
+		}),
+	)
+}
+
+// Route replaces the instance and binding IDs in an OSBAPI path with their
+// route parameter names.
+func Route(path string) string {
+	segments := strings.Split(path, "/")
+	for i := 1; i < len(segments); i++ {
+		switch segments[i-1] {
+		case "service_instances":
+			segments[i] = "{instance_id}"
+		case "service_bindings":
+			segments[i] = "{binding_id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}